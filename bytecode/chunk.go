@@ -0,0 +1,359 @@
+// Package bytecode parses lua 5.4 binary chunks, as produced by State.Dump or luac, and lists
+// them like luac -l -l. Nothing is loaded in a lua state nor executed.
+package bytecode
+
+import (
+    "encoding/binary"
+    "fmt"
+    "math"
+)
+
+// Header of lua 5.4 binary chunks
+const (
+    LUA_SIGNATURE = "\x1bLua"
+    LUAC_VERSION  = 0x54
+    LUAC_FORMAT   = 0
+    LUAC_DATA     = "\x19\x93\r\n\x1a\n"
+    LUAC_INT      = 0x5678
+    LUAC_NUM      = 370.5
+)
+
+// Types of the constants, the variant tags of lobject.h as written in the chunks
+const (
+    LUA_VNIL    = 0x00
+    LUA_VFALSE  = 0x01
+    LUA_VTRUE   = 0x11
+    LUA_VNUMINT = 0x03
+    LUA_VNUMFLT = 0x13
+    LUA_VSHRSTR = 0x04
+    LUA_VLNGSTR = 0x14
+)
+
+// Parsed binary chunk
+type Chunk struct {
+    // Byte order of the numbers and instructions
+    ByteOrder binary.ByteOrder
+    // Sizes in bytes of lua_Integer and lua_Number
+    IntegerSize, NumberSize int
+    // Number of upvalues of the main function
+    NumUpvalues int
+    // Main function
+    Main *Proto
+}
+
+// Function prototype
+type Proto struct {
+    // Chunk name, inherited from the parent when it is not in the chunk; "" when stripped
+    Source          string
+    LineDefined     int
+    LastLineDefined int
+    NumParams       int
+    IsVararg        bool
+    MaxStackSize    int
+    Code            []Instruction
+    // nil, bool, int64, float64 or string values
+    Constants []interface{}
+    Upvalues  []Upvalue
+    Protos    []*Proto
+
+    // Debug information, empty when stripped
+    LineInfo    []int8
+    AbsLineInfo []AbsLineInfo
+    LocVars     []LocVar
+}
+
+// Description of an upvalue of a function
+type Upvalue struct {
+    // Name, "" when stripped
+    Name string
+    // Whether the upvalue is a register of the enclosing function or one of its upvalues
+    InStack bool
+    // Index of the register or upvalue
+    Index int
+    // Kind of the variable: 0 regular, 1 constant (<const>), 2 to be closed, 3 compile time constant
+    Kind int
+}
+
+// Absolute line of an instruction, see ldebug.c
+type AbsLineInfo struct {
+    PC   int
+    Line int
+}
+
+// Local variable, active from StartPC to EndPC (excluded)
+type LocVar struct {
+    Name    string
+    StartPC int
+    EndPC   int
+}
+
+// Error returned for malformed chunks
+type FormatError struct {
+    Msg string
+    // Offset in the chunk where the problem was found
+    Offset int
+}
+
+func (e *FormatError) Error() string {
+    return fmt.Sprintf("bad binary format (%s) at offset %d", e.Msg, e.Offset)
+}
+
+// Reports whether data starts like a binary chunk
+func IsChunk(data []byte) bool {
+    return len(data) > 0 && data[0] == LUA_SIGNATURE[0]
+}
+
+type loadState struct {
+    data  []byte
+    pos   int
+    order binary.ByteOrder
+    isize int
+    nsize int
+}
+
+// Aborts the parsing, recovered by Parse
+type loadError struct{ err *FormatError }
+
+func (S *loadState) error(msg string) {
+    panic(loadError{&FormatError{msg, S.pos}})
+}
+
+func (S *loadState) block(n int) []byte {
+    if n < 0 || n > len(S.data)-S.pos {
+        S.error("truncated chunk")
+    }
+    b := S.data[S.pos : S.pos+n]
+    S.pos += n
+    return b
+}
+
+func (S *loadState) byte() byte {
+    return S.block(1)[0]
+}
+
+func (S *loadState) unsigned(limit uint64) uint64 {
+    var x uint64
+    limit >>= 7
+    for {
+        b := S.byte()
+        if x >= limit {
+            S.error("integer overflow")
+        }
+        x = x<<7 | uint64(b&0x7f)
+        if b&0x80 != 0 {
+            return x
+        }
+    }
+}
+
+func (S *loadState) size() int {
+    return int(S.unsigned(math.MaxInt64))
+}
+
+func (S *loadState) int() int {
+    return int(S.unsigned(math.MaxInt32))
+}
+
+// Reads a vector length, checking that n elements of elemsize bytes can be in the chunk
+func (S *loadState) vector(elemsize int) int {
+    n := S.int()
+    if n > (len(S.data)-S.pos)/elemsize {
+        S.error("truncated chunk")
+    }
+    return n
+}
+
+func (S *loadState) integer() int64 {
+    b := S.block(S.isize)
+    if S.isize == 4 {
+        return int64(int32(S.order.Uint32(b)))
+    }
+    return int64(S.order.Uint64(b))
+}
+
+func (S *loadState) number() float64 {
+    b := S.block(S.nsize)
+    if S.nsize == 4 {
+        return float64(math.Float32frombits(S.order.Uint32(b)))
+    }
+    return math.Float64frombits(S.order.Uint64(b))
+}
+
+// Reads a nullable string, ok is false for a null one
+func (S *loadState) stringN() (s string, ok bool) {
+    n := S.size()
+    if n == 0 {
+        return "", false
+    }
+    return string(S.block(n - 1)), true
+}
+
+func (S *loadState) checkLiteral(s, msg string) {
+    if n := len(s); n > len(S.data)-S.pos || string(S.data[S.pos:S.pos+n]) != s {
+        S.error(msg)
+    }
+    S.pos += len(s)
+}
+
+func (S *loadState) checkHeader(c *Chunk) {
+    S.checkLiteral(LUA_SIGNATURE, "not a binary chunk")
+    if S.byte() != LUAC_VERSION {
+        S.error("version mismatch")
+    }
+    if S.byte() != LUAC_FORMAT {
+        S.error("format mismatch")
+    }
+    S.checkLiteral(LUAC_DATA, "corrupted chunk")
+    if S.byte() != 4 {
+        S.error("Instruction size mismatch")
+    }
+    S.isize = int(S.byte())
+    if S.isize != 4 && S.isize != 8 {
+        S.error("lua_Integer size mismatch")
+    }
+    S.nsize = int(S.byte())
+    if S.nsize != 4 && S.nsize != 8 {
+        S.error("lua_Number size mismatch")
+    }
+    // the byte order is the one giving LUAC_INT
+    start := S.pos
+    for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+        S.pos, S.order = start, order
+        if S.integer() == LUAC_INT {
+            break
+        }
+        if order == binary.BigEndian {
+            S.error("integer format mismatch")
+        }
+    }
+    if S.number() != LUAC_NUM {
+        S.error("float format mismatch")
+    }
+    c.ByteOrder, c.IntegerSize, c.NumberSize = S.order, S.isize, S.nsize
+}
+
+func (S *loadState) function(f *Proto, psource string) {
+    source, ok := S.stringN()
+    if !ok {
+        source = psource
+    }
+    f.Source = source
+    f.LineDefined = S.int()
+    f.LastLineDefined = S.int()
+    f.NumParams = int(S.byte())
+    f.IsVararg = S.byte() != 0
+    f.MaxStackSize = int(S.byte())
+
+    n := S.vector(4)
+    f.Code = make([]Instruction, n)
+    for i := range f.Code {
+        f.Code[i] = Instruction(S.order.Uint32(S.block(4)))
+    }
+
+    n = S.vector(1)
+    f.Constants = make([]interface{}, n)
+    for i := range f.Constants {
+        switch t := S.byte(); t {
+        case LUA_VNIL:
+        case LUA_VFALSE:
+            f.Constants[i] = false
+        case LUA_VTRUE:
+            f.Constants[i] = true
+        case LUA_VNUMFLT:
+            f.Constants[i] = S.number()
+        case LUA_VNUMINT:
+            f.Constants[i] = S.integer()
+        case LUA_VSHRSTR, LUA_VLNGSTR:
+            s, ok := S.stringN()
+            if !ok {
+                S.error("bad format for constant string")
+            }
+            f.Constants[i] = s
+        default:
+            S.error(fmt.Sprintf("bad constant type %d", t))
+        }
+    }
+
+    n = S.vector(3)
+    f.Upvalues = make([]Upvalue, n)
+    for i := range f.Upvalues {
+        f.Upvalues[i].InStack = S.byte() != 0
+        f.Upvalues[i].Index = int(S.byte())
+        f.Upvalues[i].Kind = int(S.byte())
+    }
+
+    n = S.vector(1)
+    f.Protos = make([]*Proto, n)
+    for i := range f.Protos {
+        f.Protos[i] = &Proto{}
+        S.function(f.Protos[i], f.Source)
+    }
+
+    n = S.vector(1)
+    f.LineInfo = make([]int8, n)
+    for i, b := range S.block(n) {
+        f.LineInfo[i] = int8(b)
+    }
+    n = S.vector(2)
+    f.AbsLineInfo = make([]AbsLineInfo, n)
+    for i := range f.AbsLineInfo {
+        f.AbsLineInfo[i].PC = S.int()
+        f.AbsLineInfo[i].Line = S.int()
+    }
+    n = S.vector(3)
+    f.LocVars = make([]LocVar, n)
+    for i := range f.LocVars {
+        f.LocVars[i].Name, _ = S.stringN()
+        f.LocVars[i].StartPC = S.int()
+        f.LocVars[i].EndPC = S.int()
+    }
+    n = S.vector(1)
+    if n > len(f.Upvalues) {
+        S.error("too many upvalue names")
+    }
+    for i := 0; i < n; i++ {
+        f.Upvalues[i].Name, _ = S.stringN()
+    }
+}
+
+// Parses a lua 5.4 binary chunk. Malformed chunks are reported with a *FormatError.
+func Parse(data []byte) (c *Chunk, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            le, ok := r.(loadError)
+            if !ok {
+                panic(r)
+            }
+            c, err = nil, le.err
+        }
+    }()
+    S := &loadState{data: data}
+    c = &Chunk{}
+    S.checkHeader(c)
+    c.NumUpvalues = int(S.byte())
+    c.Main = &Proto{}
+    S.function(c.Main, "")
+    if c.NumUpvalues != len(c.Main.Upvalues) {
+        S.error("wrong number of upvalues")
+    }
+    return c, nil
+}
+
+// Returns the line of the instruction at pc (0 based), or -1 without debug information.
+// See luaG_getfuncline.
+func (f *Proto) Line(pc int) int {
+    if pc < 0 || pc >= len(f.LineInfo) {
+        return -1
+    }
+    basepc, line := -1, f.LineDefined
+    for _, abs := range f.AbsLineInfo {
+        if abs.PC > pc {
+            break
+        }
+        basepc, line = abs.PC, abs.Line
+    }
+    for basepc++; basepc <= pc; basepc++ {
+        line += int(f.LineInfo[basepc])
+    }
+    return line
+}
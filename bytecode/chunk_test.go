@@ -0,0 +1,234 @@
+package bytecode_test
+
+import (
+    "encoding/binary"
+    "errors"
+    "reflect"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+const chunkScript = `local N <const> = 10
+local greeting = "hello"
+local pi, big = 3.5, 1 << 40
+local function counter(start)
+    local n = start
+    return function(step)
+        n = n + (step or 1)
+        return n, greeting
+    end
+end
+local long = "a long string constant, longer than the 40 bytes of short strings"
+return counter(N), pi, big, long
+`
+
+func dumpChunk(t *testing.T, src, name string, strip bool) []byte {
+    t.Helper()
+    L := lua.NewState()
+    defer L.Close()
+    if r := L.LoadBuffer([]byte(src), name, "t"); r != 0 {
+        t.Fatal(L.ToString(-1))
+    }
+    if strip {
+        L.DumpStrip()
+    } else {
+        L.Dump()
+    }
+    return append([]byte(nil), L.ToBytes(-1)...)
+}
+
+func TestParse(t *testing.T) {
+    data := dumpChunk(t, chunkScript, "@chunk.lua", false)
+    if !bytecode.IsChunk(data) || bytecode.IsChunk([]byte(chunkScript)) || bytecode.IsChunk(nil) {
+        t.Error("IsChunk")
+    }
+    c, err := bytecode.Parse(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.ByteOrder != binary.LittleEndian || c.IntegerSize != 8 || c.NumberSize != 8 || c.NumUpvalues != 1 {
+        t.Errorf("chunk %+v", c)
+    }
+
+    main := c.Main
+    if main.Source != "@chunk.lua" || main.LineDefined != 0 || main.LastLineDefined != 0 || !main.IsVararg || main.NumParams != 0 {
+        t.Errorf("main %+v", main)
+    }
+    if main.Upvalues[0] != (bytecode.Upvalue{Name: "_ENV", InStack: true, Index: 0}) {
+        t.Errorf("upvalues of main %+v", main.Upvalues)
+    }
+    // N is a compile time constant
+    want := []interface{}{"hello", 3.5, int64(1 << 40), "a long string constant, longer than the 40 bytes of short strings"}
+    if !reflect.DeepEqual(main.Constants, want) {
+        t.Errorf("constants of main %#v", main.Constants)
+    }
+    var locals []string
+    for _, v := range main.LocVars {
+        locals = append(locals, v.Name)
+        if v.StartPC > v.EndPC || v.EndPC > len(main.Code) {
+            t.Errorf("local %+v", v)
+        }
+    }
+    if strings.Join(locals, " ") != "greeting pi big counter long" {
+        t.Errorf("locals of main %v", locals)
+    }
+    if len(main.LineInfo) != len(main.Code) || main.Line(0) != 1 || main.Line(len(main.Code)-1) != 12 {
+        t.Errorf("lines of main: %d, %d", main.Line(0), main.Line(len(main.Code)-1))
+    }
+
+    if len(main.Protos) != 1 {
+        t.Fatalf("%d functions in main", len(main.Protos))
+    }
+    counter := main.Protos[0]
+    if counter.Source != "@chunk.lua" || counter.LineDefined != 4 || counter.LastLineDefined != 10 ||
+        counter.NumParams != 1 || counter.IsVararg {
+        t.Errorf("counter %+v", counter)
+    }
+    if !reflect.DeepEqual(counter.Upvalues, []bytecode.Upvalue{{Name: "greeting", InStack: true, Index: 0}}) {
+        t.Errorf("upvalues of counter %+v", counter.Upvalues)
+    }
+    if len(counter.LocVars) != 2 || counter.LocVars[0].Name != "start" || counter.LocVars[1].Name != "n" {
+        t.Errorf("locals of counter %+v", counter.LocVars)
+    }
+
+    inner := counter.Protos[0]
+    if inner.LineDefined != 6 || inner.LastLineDefined != 9 || len(inner.Protos) != 0 {
+        t.Errorf("inner %+v", inner)
+    }
+    // n is the register 1 of counter, greeting its upvalue 0
+    want2 := []bytecode.Upvalue{{Name: "n", InStack: true, Index: 1}, {Name: "greeting", InStack: false, Index: 0}}
+    if !reflect.DeepEqual(inner.Upvalues, want2) {
+        t.Errorf("upvalues of inner %+v", inner.Upvalues)
+    }
+    for pc := range inner.Code {
+        if line := inner.Line(pc); line < 7 || line > 9 {
+            t.Errorf("line %d at pc %d of inner", line, pc)
+        }
+    }
+    if inner.Line(-1) != -1 || inner.Line(len(inner.Code)) != -1 {
+        t.Error("line out of the code")
+    }
+}
+
+func TestParseStripped(t *testing.T) {
+    c, err := bytecode.Parse(dumpChunk(t, chunkScript, "@chunk.lua", true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    main := c.Main
+    if main.Source != "" || len(main.LineInfo) != 0 || len(main.AbsLineInfo) != 0 || len(main.LocVars) != 0 {
+        t.Errorf("debug information of main %+v", main)
+    }
+    if main.Line(0) != -1 || main.Upvalues[0].Name != "" || !main.Upvalues[0].InStack {
+        t.Errorf("upvalues of main %+v", main.Upvalues)
+    }
+    if inner := main.Protos[0].Protos[0]; inner.Source != "" || inner.Upvalues[0].Name != "" || inner.Upvalues[0].Index != 1 {
+        t.Errorf("inner %+v", inner)
+    }
+}
+
+// Functions with more than 128 instructions on a line, or far from the previous line, have
+// absolute line information
+func TestParseAbsLineInfo(t *testing.T) {
+    src := "local x = 0\n" + strings.Repeat("x = x + 1 ", 200) + "\n" + strings.Repeat("\n", 300) + "return x\n"
+    c, err := bytecode.Parse(dumpChunk(t, src, "=abs", false))
+    if err != nil {
+        t.Fatal(err)
+    }
+    main := c.Main
+    if len(main.AbsLineInfo) == 0 {
+        t.Fatal("no absolute line information")
+    }
+    n := len(main.Code)
+    if main.Line(1) != 1 && main.Line(1) != 2 || main.Line(n-2) != 303 || main.Line(n-1) != 303 {
+        t.Errorf("lines %d, %d, %d", main.Line(1), main.Line(n-2), main.Line(n-1))
+    }
+    for pc := 2; pc < n-3; pc++ {
+        if main.Line(pc) != 2 {
+            t.Fatalf("line %d at pc %d", main.Line(pc), pc)
+        }
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    data := dumpChunk(t, chunkScript, "@chunk.lua", false)
+    // every truncation fails with an error
+    for n := 0; n < len(data); n++ {
+        _, err := bytecode.Parse(data[:n])
+        var ferr *bytecode.FormatError
+        if !errors.As(err, &ferr) || ferr.Offset > n {
+            t.Fatalf("truncated at %d: %v", n, err)
+        }
+    }
+
+    tests := []struct {
+        offset int
+        value  byte
+        msg    string
+    }{
+        {0, 'X', "not a binary chunk"},
+        {4, 0x53, "version mismatch"},
+        {5, 1, "format mismatch"},
+        {8, 0, "corrupted chunk"},
+        {12, 8, "Instruction size mismatch"},
+        {13, 2, "lua_Integer size mismatch"},
+        {14, 16, "lua_Number size mismatch"},
+        {15, 0, "integer format mismatch"},
+        {30, 0, "float format mismatch"},
+        {31, 2, "wrong number of upvalues"},
+    }
+    for _, tt := range tests {
+        bad := append([]byte(nil), data...)
+        bad[tt.offset] = tt.value
+        _, err := bytecode.Parse(bad)
+        if err == nil || !strings.Contains(err.Error(), tt.msg) {
+            t.Errorf("byte %d set to %d: error %v, want %q", tt.offset, tt.value, err, tt.msg)
+        }
+    }
+
+    // a vector longer than the chunk, in place of the size of the code of main
+    bad := append([]byte(nil), data[:32]...)
+    bad = append(bad, 0x80|12, 'x')
+    if _, err := bytecode.Parse(append(bad, 0xff, 0xff, 0xff, 0x8f)); err == nil {
+        t.Error("vector longer than the chunk")
+    }
+    if _, err := bytecode.Parse(append(data[:len(data):len(data)], 0x7f, 0x7f, 0x7f)); err != nil {
+        t.Errorf("trailing bytes: %v", err)
+    }
+}
+
+func TestInstruction(t *testing.T) {
+    tests := []struct {
+        i    bytecode.Instruction
+        want string
+    }{
+        // A=1, B=2, C=3, k
+        {bytecode.Instruction(bytecode.OP_ADD) | 1<<bytecode.POS_A | 2<<bytecode.POS_B | 3<<bytecode.POS_C | 1<<bytecode.POS_k, "ADD 1 2 3 1"},
+        {bytecode.Instruction(bytecode.OP_LOADK) | 4<<bytecode.POS_A | 1000<<bytecode.POS_Bx, "LOADK 4 1000"},
+        {bytecode.Instruction(bytecode.OP_LOADI) | (bytecode.OFFSET_sBx-5)<<bytecode.POS_Bx, "LOADI 0 -5"},
+        {bytecode.Instruction(bytecode.OP_EXTRAARG) | 12345<<bytecode.POS_Ax, "EXTRAARG 12345"},
+        {bytecode.Instruction(bytecode.OP_JMP) | (bytecode.OFFSET_sJ+7)<<bytecode.POS_sJ, "JMP 7"},
+        {bytecode.Instruction(bytecode.NUM_OPCODES), "OP_83 0 0 0 0"},
+    }
+    for _, tt := range tests {
+        if got := tt.i.String(); got != tt.want {
+            t.Errorf("%08x: %s, want %s", uint32(tt.i), got, tt.want)
+        }
+    }
+    i := bytecode.Instruction(bytecode.OP_ADDI) | (bytecode.OFFSET_sC-3)<<bytecode.POS_C | (bytecode.OFFSET_sC+2)<<bytecode.POS_B
+    if i.SC() != -3 || i.SB() != 2 || i.K() {
+        t.Errorf("%v: sC %d, sB %d", i, i.SC(), i.SB())
+    }
+
+    if !bytecode.OP_EQ.IsTest() || bytecode.OP_ADD.IsTest() || !bytecode.OP_CALL.SetsTop() || !bytecode.OP_RETURN.UsesTop() ||
+        !bytecode.OP_MMBIN.IsMetamethod() || !bytecode.OP_MOVE.SetsA() || bytecode.OP_JMP.Mode() != bytecode.IsJ {
+        t.Error("opcode modes")
+    }
+    bad := bytecode.OpCode(bytecode.NUM_OPCODES + 1)
+    if bad.IsTest() || bad.SetsA() || bad.Mode() != bytecode.IABC {
+        t.Error("modes of an invalid opcode")
+    }
+}
@@ -0,0 +1,355 @@
+package bytecode
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Writes the listing of the chunk in the format of luac -l, or luac -l -l with full (constants,
+// locals and upvalues of each function). Functions are identified by the address of their Proto.
+func (c *Chunk) Fprint(w io.Writer, full bool) error {
+    return c.Main.Fprint(w, full)
+}
+
+// Returns the listing of the chunk, see Fprint
+func (c *Chunk) Listing(full bool) string {
+    var b strings.Builder
+    c.Fprint(&b, full)
+    return b.String()
+}
+
+// Writes the listing of the function and of its nested functions, see Chunk.Fprint
+func (f *Proto) Fprint(w io.Writer, full bool) error {
+    bw := bufio.NewWriter(w)
+    f.print(bw, full)
+    return bw.Flush()
+}
+
+func (f *Proto) print(w *bufio.Writer, full bool) {
+    f.printHeader(w)
+    for pc := range f.Code {
+        fmt.Fprintf(w, "\t%d\t", pc+1)
+        if line := f.Line(pc); line > 0 {
+            fmt.Fprintf(w, "[%d]\t", line)
+        } else {
+            w.WriteString("[-]\t")
+        }
+        fmt.Fprintf(w, "%-9s\t%s\n", f.Code[pc].OpCode(), f.Operands(pc))
+    }
+    if full {
+        f.printDebug(w)
+    }
+    for _, p := range f.Protos {
+        p.print(w, full)
+    }
+}
+
+func plural(n int) string {
+    if n == 1 {
+        return ""
+    }
+    return "s"
+}
+
+func (f *Proto) printHeader(w *bufio.Writer) {
+    s := f.Source
+    if s == "" {
+        s = "=?"
+    }
+    switch {
+    case s[0] == '@' || s[0] == '=':
+        s = s[1:]
+    case s[0] == LUA_SIGNATURE[0]:
+        s = "(bstring)"
+    default:
+        s = "(string)"
+    }
+    kind := "function"
+    if f.LineDefined == 0 {
+        kind = "main"
+    }
+    vararg := ""
+    if f.IsVararg {
+        vararg = "+"
+    }
+    fmt.Fprintf(w, "\n%s <%s:%d,%d> (%d instruction%s at %p)\n", kind, s, f.LineDefined, f.LastLineDefined,
+        len(f.Code), plural(len(f.Code)), f)
+    fmt.Fprintf(w, "%d%s param%s, %d slot%s, %d upvalue%s, ", f.NumParams, vararg, plural(f.NumParams),
+        f.MaxStackSize, plural(f.MaxStackSize), len(f.Upvalues), plural(len(f.Upvalues)))
+    fmt.Fprintf(w, "%d local%s, %d constant%s, %d function%s\n", len(f.LocVars), plural(len(f.LocVars)),
+        len(f.Constants), plural(len(f.Constants)), len(f.Protos), plural(len(f.Protos)))
+}
+
+func (f *Proto) printDebug(w *bufio.Writer) {
+    fmt.Fprintf(w, "constants (%d) for %p:\n", len(f.Constants), f)
+    for i, k := range f.Constants {
+        fmt.Fprintf(w, "\t%d\t%s\t%s\n", i, ConstantType(k), FormatConstant(k))
+    }
+    fmt.Fprintf(w, "locals (%d) for %p:\n", len(f.LocVars), f)
+    for i, v := range f.LocVars {
+        fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, v.Name, v.StartPC+1, v.EndPC+1)
+    }
+    fmt.Fprintf(w, "upvalues (%d) for %p:\n", len(f.Upvalues), f)
+    for i, u := range f.Upvalues {
+        instack := 0
+        if u.InStack {
+            instack = 1
+        }
+        fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, f.upvalueName(i), instack, u.Index)
+    }
+}
+
+// Returns the letter luac uses for the type of a constant: N, B, F, I or S
+func ConstantType(k interface{}) string {
+    switch k.(type) {
+    case nil:
+        return "N"
+    case bool:
+        return "B"
+    case float64:
+        return "F"
+    case int64:
+        return "I"
+    case string:
+        return "S"
+    }
+    return "?"
+}
+
+// Formats a constant like luac: floats always have a decimal point or an exponent and strings
+// are quoted with C escapes
+func FormatConstant(k interface{}) string {
+    switch v := k.(type) {
+    case nil:
+        return "nil"
+    case bool:
+        return strconv.FormatBool(v)
+    case int64:
+        return strconv.FormatInt(v, 10)
+    case float64:
+        var s string
+        switch {
+        case math.IsInf(v, 1):
+            s = "inf"
+        case math.IsInf(v, -1):
+            s = "-inf"
+        case math.IsNaN(v):
+            s = "nan"
+        default:
+            s = fmt.Sprintf("%.14g", v)
+        }
+        if strings.Trim(s, "-0123456789") == "" {
+            s += ".0"
+        }
+        return s
+    case string:
+        return quote(v)
+    }
+    return "?"
+}
+
+func quote(s string) string {
+    var b strings.Builder
+    b.WriteByte('"')
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch c {
+        case '"':
+            b.WriteString("\\\"")
+        case '\\':
+            b.WriteString("\\\\")
+        case '\a':
+            b.WriteString("\\a")
+        case '\b':
+            b.WriteString("\\b")
+        case '\f':
+            b.WriteString("\\f")
+        case '\n':
+            b.WriteString("\\n")
+        case '\r':
+            b.WriteString("\\r")
+        case '\t':
+            b.WriteString("\\t")
+        case '\v':
+            b.WriteString("\\v")
+        default:
+            if c >= ' ' && c <= '~' {
+                b.WriteByte(c)
+            } else {
+                fmt.Fprintf(&b, "\\%03d", c)
+            }
+        }
+    }
+    b.WriteByte('"')
+    return b.String()
+}
+
+func (f *Proto) upvalueName(i int) string {
+    if i < 0 || i >= len(f.Upvalues) || f.Upvalues[i].Name == "" {
+        return "-"
+    }
+    return f.Upvalues[i].Name
+}
+
+func (f *Proto) constant(i int) string {
+    if i < 0 || i >= len(f.Constants) {
+        return "?"
+    }
+    return FormatConstant(f.Constants[i])
+}
+
+func eventName(i int) string {
+    if i < 0 || i >= len(eventNames) {
+        return "?"
+    }
+    return eventNames[i]
+}
+
+// Returns the operands of the instruction at pc followed by the luac comment, if any: the
+// constants, upvalue names, jump targets (1 based) and argument counts it refers to
+func (f *Proto) Operands(pc int) string {
+    i := f.Code[pc]
+    a, b, c, k := i.A(), i.B(), i.C(), 0
+    if i.K() {
+        k = 1
+    }
+    isk := ""
+    if i.K() {
+        isk = "k"
+    }
+    extraarg := 0
+    if pc+1 < len(f.Code) {
+        extraarg = f.Code[pc+1].Ax()
+    }
+    var s strings.Builder
+    p := func(format string, args ...interface{}) { fmt.Fprintf(&s, format, args...) }
+    const comment = "\t; "
+
+    switch i.OpCode() {
+    case OP_MOVE:
+        p("%d %d", a, b)
+    case OP_LOADI, OP_LOADF:
+        p("%d %d", a, i.SBx())
+    case OP_LOADK:
+        p("%d %d"+comment+"%s", a, i.Bx(), f.constant(i.Bx()))
+    case OP_LOADKX:
+        p("%d"+comment+"%s", a, f.constant(extraarg))
+    case OP_LOADFALSE, OP_LFALSESKIP, OP_LOADTRUE:
+        p("%d", a)
+    case OP_LOADNIL:
+        p("%d %d"+comment+"%d out", a, b, b+1)
+    case OP_GETUPVAL, OP_SETUPVAL:
+        p("%d %d"+comment+"%s", a, b, f.upvalueName(b))
+    case OP_GETTABUP:
+        p("%d %d %d"+comment+"%s %s", a, b, c, f.upvalueName(b), f.constant(c))
+    case OP_GETTABLE, OP_GETI:
+        p("%d %d %d", a, b, c)
+    case OP_GETFIELD:
+        p("%d %d %d"+comment+"%s", a, b, c, f.constant(c))
+    case OP_SETTABUP:
+        p("%d %d %d%s"+comment+"%s %s", a, b, c, isk, f.upvalueName(a), f.constant(b))
+        if i.K() {
+            p(" %s", f.constant(c))
+        }
+    case OP_SETTABLE, OP_SETI, OP_SELF:
+        p("%d %d %d%s", a, b, c, isk)
+        if i.K() {
+            p(comment+"%s", f.constant(c))
+        }
+    case OP_SETFIELD:
+        p("%d %d %d%s"+comment+"%s", a, b, c, isk, f.constant(b))
+        if i.K() {
+            p(" %s", f.constant(c))
+        }
+    case OP_NEWTABLE:
+        p("%d %d %d"+comment+"%d", a, b, c, c+extraarg*(MAXARG_C+1))
+    case OP_ADDI, OP_SHRI, OP_SHLI:
+        p("%d %d %d", a, b, i.SC())
+    case OP_ADDK, OP_SUBK, OP_MULK, OP_MODK, OP_POWK, OP_DIVK, OP_IDIVK, OP_BANDK, OP_BORK, OP_BXORK:
+        p("%d %d %d"+comment+"%s", a, b, c, f.constant(c))
+    case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+        p("%d %d %d", a, b, c)
+    case OP_MMBIN:
+        p("%d %d %d"+comment+"%s", a, b, c, eventName(c))
+    case OP_MMBINI:
+        p("%d %d %d %d"+comment+"%s", a, i.SB(), c, k, eventName(c))
+        if i.K() {
+            p(" flip")
+        }
+    case OP_MMBINK:
+        p("%d %d %d %d"+comment+"%s %s", a, b, c, k, eventName(c), f.constant(b))
+        if i.K() {
+            p(" flip")
+        }
+    case OP_UNM, OP_BNOT, OP_NOT, OP_LEN, OP_CONCAT:
+        p("%d %d", a, b)
+    case OP_CLOSE, OP_TBC, OP_RETURN1, OP_VARARGPREP:
+        p("%d", a)
+    case OP_JMP:
+        p("%d"+comment+"to %d", i.SJ(), i.SJ()+pc+2)
+    case OP_EQ, OP_LT, OP_LE:
+        p("%d %d %d", a, b, k)
+    case OP_EQK:
+        p("%d %d %d"+comment+"%s", a, b, k, f.constant(b))
+    case OP_EQI, OP_LTI, OP_LEI, OP_GTI, OP_GEI:
+        p("%d %d %d", a, i.SB(), k)
+    case OP_TEST:
+        p("%d %d", a, k)
+    case OP_TESTSET:
+        p("%d %d %d", a, b, k)
+    case OP_CALL:
+        p("%d %d %d"+comment, a, b, c)
+        if b == 0 {
+            p("all in ")
+        } else {
+            p("%d in ", b-1)
+        }
+        if c == 0 {
+            p("all out")
+        } else {
+            p("%d out", c-1)
+        }
+    case OP_TAILCALL:
+        p("%d %d %d"+comment+"%d in", a, b, c, b-1)
+    case OP_RETURN:
+        p("%d %d %d"+comment, a, b, c)
+        if b == 0 {
+            p("all out")
+        } else {
+            p("%d out", b-1)
+        }
+    case OP_RETURN0:
+    case OP_FORLOOP, OP_TFORLOOP:
+        p("%d %d"+comment+"to %d", a, i.Bx(), pc-i.Bx()+2)
+    case OP_FORPREP, OP_TFORPREP:
+        p("%d %d"+comment+"to %d", a, i.Bx(), pc+i.Bx()+2)
+    case OP_TFORCALL:
+        p("%d %d", a, c)
+    case OP_SETLIST:
+        p("%d %d %d", a, b, c)
+        if i.K() {
+            p(comment+"%d", c+extraarg*(MAXARG_C+1))
+        }
+    case OP_CLOSURE:
+        p("%d %d", a, i.Bx())
+        if i.Bx() < len(f.Protos) {
+            p(comment+"%p", f.Protos[i.Bx()])
+        }
+    case OP_VARARG:
+        p("%d %d"+comment, a, c)
+        if c == 0 {
+            p("all out")
+        } else {
+            p("%d out", c-1)
+        }
+    case OP_EXTRAARG:
+        p("%d", i.Ax())
+    default:
+        p("%d %d %d"+comment+"not handled", a, b, c)
+    }
+    return s.String()
+}
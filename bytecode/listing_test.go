@@ -0,0 +1,92 @@
+package bytecode_test
+
+import (
+    "flag"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Addresses of the functions, which change from run to run
+var addresses = regexp.MustCompile(`0x[0-9a-f]+`)
+
+func TestListing(t *testing.T) {
+    src, err := os.ReadFile(filepath.Join("testdata", "listing.lua"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    c, err := bytecode.Parse(dumpChunk(t, string(src), "@listing.lua", false))
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := addresses.ReplaceAllString(c.Listing(true), "0x?")
+    path := filepath.Join("testdata", "listing.golden")
+    if *updateGolden {
+        if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    want, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != string(want) {
+        t.Errorf("listing differs from %s, run go test -run Listing -update and check the diff:\n%s", path, got)
+    }
+
+    // without the debug information of luac -l -l
+    short := addresses.ReplaceAllString(c.Listing(false), "0x?")
+    for _, line := range strings.Split(short, "\n") {
+        if !strings.Contains(got, line) {
+            t.Errorf("line %q of the short listing not in the full one", line)
+        }
+    }
+    if strings.Contains(short, "constants (") || strings.Count(short, "\nfunction <listing.lua:") != 1 {
+        t.Errorf("short listing:\n%s", short)
+    }
+}
+
+func TestListingStripped(t *testing.T) {
+    c, err := bytecode.Parse(dumpChunk(t, "local x = 1 return function() return x end", "=s", true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := addresses.ReplaceAllString(c.Listing(true), "0x?")
+    for _, want := range []string{
+        "\nmain <?:0,0> (5 instructions at 0x?)\n",
+        "\t1\t[-]\tVARARGPREP\t0\n",
+        "\nfunction <?:1,1> (3 instructions at 0x?)\n",
+        "\t1\t[-]\tGETUPVAL \t0 0\t; -\n",
+        "upvalues (1) for 0x?:\n\t0\t-\t1\t0\n",
+    } {
+        if !strings.Contains(got, want) {
+            t.Errorf("no %q in the listing:\n%s", want, got)
+        }
+    }
+}
+
+func TestFormatConstant(t *testing.T) {
+    tests := []struct {
+        k         interface{}
+        typ, want string
+    }{
+        {nil, "N", "nil"},
+        {true, "B", "true"},
+        {int64(-7), "I", "-7"},
+        {2.0, "F", "2.0"},
+        {-0.5, "F", "-0.5"},
+        {1e100, "F", "1e+100"},
+        {"a\"b\\\n\x01é", "S", `"a\"b\\\n\001\195\169"`},
+    }
+    for _, tt := range tests {
+        if typ, got := bytecode.ConstantType(tt.k), bytecode.FormatConstant(tt.k); typ != tt.typ || got != tt.want {
+            t.Errorf("%#v: %s %s, want %s %s", tt.k, typ, got, tt.typ, tt.want)
+        }
+    }
+}
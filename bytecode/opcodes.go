@@ -0,0 +1,359 @@
+package bytecode
+
+import "fmt"
+
+// A lua 5.4 virtual machine instruction
+type Instruction uint32
+
+// Opcodes, in the order of lopcodes.h
+type OpCode uint8
+
+const (
+    OP_MOVE OpCode = iota
+    OP_LOADI
+    OP_LOADF
+    OP_LOADK
+    OP_LOADKX
+    OP_LOADFALSE
+    OP_LFALSESKIP
+    OP_LOADTRUE
+    OP_LOADNIL
+    OP_GETUPVAL
+    OP_SETUPVAL
+
+    OP_GETTABUP
+    OP_GETTABLE
+    OP_GETI
+    OP_GETFIELD
+
+    OP_SETTABUP
+    OP_SETTABLE
+    OP_SETI
+    OP_SETFIELD
+
+    OP_NEWTABLE
+
+    OP_SELF
+
+    OP_ADDI
+
+    OP_ADDK
+    OP_SUBK
+    OP_MULK
+    OP_MODK
+    OP_POWK
+    OP_DIVK
+    OP_IDIVK
+
+    OP_BANDK
+    OP_BORK
+    OP_BXORK
+
+    OP_SHRI
+    OP_SHLI
+
+    OP_ADD
+    OP_SUB
+    OP_MUL
+    OP_MOD
+    OP_POW
+    OP_DIV
+    OP_IDIV
+
+    OP_BAND
+    OP_BOR
+    OP_BXOR
+    OP_SHL
+    OP_SHR
+
+    OP_MMBIN
+    OP_MMBINI
+    OP_MMBINK
+
+    OP_UNM
+    OP_BNOT
+    OP_NOT
+    OP_LEN
+
+    OP_CONCAT
+
+    OP_CLOSE
+    OP_TBC
+    OP_JMP
+    OP_EQ
+    OP_LT
+    OP_LE
+
+    OP_EQK
+    OP_EQI
+    OP_LTI
+    OP_LEI
+    OP_GTI
+    OP_GEI
+
+    OP_TEST
+    OP_TESTSET
+
+    OP_CALL
+    OP_TAILCALL
+
+    OP_RETURN
+    OP_RETURN0
+    OP_RETURN1
+
+    OP_FORLOOP
+    OP_FORPREP
+
+    OP_TFORPREP
+    OP_TFORCALL
+    OP_TFORLOOP
+
+    OP_SETLIST
+
+    OP_CLOSURE
+
+    OP_VARARG
+
+    OP_VARARGPREP
+
+    OP_EXTRAARG
+
+    // Number of opcodes
+    NUM_OPCODES
+)
+
+// Instruction formats
+type OpMode uint8
+
+const (
+    IABC OpMode = iota
+    IABx
+    IAsBx
+    IAx
+    IsJ
+)
+
+// Sizes and limits of the instruction arguments
+const (
+    SIZE_C  = 8
+    SIZE_B  = 8
+    SIZE_Bx = SIZE_C + SIZE_B + 1
+    SIZE_A  = 8
+    SIZE_Ax = SIZE_Bx + SIZE_A
+    SIZE_sJ = SIZE_Bx + SIZE_A
+    SIZE_OP = 7
+
+    POS_OP = 0
+    POS_A  = POS_OP + SIZE_OP
+    POS_k  = POS_A + SIZE_A
+    POS_B  = POS_k + 1
+    POS_C  = POS_B + SIZE_B
+    POS_Bx = POS_k
+    POS_Ax = POS_A
+    POS_sJ = POS_A
+
+    MAXARG_Bx  = 1<<SIZE_Bx - 1
+    OFFSET_sBx = MAXARG_Bx >> 1
+    MAXARG_Ax  = 1<<SIZE_Ax - 1
+    MAXARG_sJ  = 1<<SIZE_sJ - 1
+    OFFSET_sJ  = MAXARG_sJ >> 1
+    MAXARG_A   = 1<<SIZE_A - 1
+    MAXARG_B   = 1<<SIZE_B - 1
+    MAXARG_C   = 1<<SIZE_C - 1
+    OFFSET_sC  = MAXARG_C >> 1
+)
+
+var opNames = [NUM_OPCODES]string{
+    "MOVE", "LOADI", "LOADF", "LOADK", "LOADKX", "LOADFALSE", "LFALSESKIP", "LOADTRUE", "LOADNIL",
+    "GETUPVAL", "SETUPVAL", "GETTABUP", "GETTABLE", "GETI", "GETFIELD", "SETTABUP", "SETTABLE",
+    "SETI", "SETFIELD", "NEWTABLE", "SELF", "ADDI", "ADDK", "SUBK", "MULK", "MODK", "POWK", "DIVK",
+    "IDIVK", "BANDK", "BORK", "BXORK", "SHRI", "SHLI", "ADD", "SUB", "MUL", "MOD", "POW", "DIV",
+    "IDIV", "BAND", "BOR", "BXOR", "SHL", "SHR", "MMBIN", "MMBINI", "MMBINK", "UNM", "BNOT", "NOT",
+    "LEN", "CONCAT", "CLOSE", "TBC", "JMP", "EQ", "LT", "LE", "EQK", "EQI", "LTI", "LEI", "GTI",
+    "GEI", "TEST", "TESTSET", "CALL", "TAILCALL", "RETURN", "RETURN0", "RETURN1", "FORLOOP",
+    "FORPREP", "TFORPREP", "TFORCALL", "TFORLOOP", "SETLIST", "CLOSURE", "VARARG", "VARARGPREP",
+    "EXTRAARG",
+}
+
+// Properties of an opcode, see luaP_opmodes
+type opProps struct {
+    mm, ot, it, t, a bool
+    mode             OpMode
+}
+
+var opModes = [NUM_OPCODES]opProps{
+    OP_MOVE:       {a: true, mode: IABC},
+    OP_LOADI:      {a: true, mode: IAsBx},
+    OP_LOADF:      {a: true, mode: IAsBx},
+    OP_LOADK:      {a: true, mode: IABx},
+    OP_LOADKX:     {a: true, mode: IABx},
+    OP_LOADFALSE:  {a: true, mode: IABC},
+    OP_LFALSESKIP: {a: true, mode: IABC},
+    OP_LOADTRUE:   {a: true, mode: IABC},
+    OP_LOADNIL:    {a: true, mode: IABC},
+    OP_GETUPVAL:   {a: true, mode: IABC},
+    OP_SETUPVAL:   {mode: IABC},
+    OP_GETTABUP:   {a: true, mode: IABC},
+    OP_GETTABLE:   {a: true, mode: IABC},
+    OP_GETI:       {a: true, mode: IABC},
+    OP_GETFIELD:   {a: true, mode: IABC},
+    OP_SETTABUP:   {mode: IABC},
+    OP_SETTABLE:   {mode: IABC},
+    OP_SETI:       {mode: IABC},
+    OP_SETFIELD:   {mode: IABC},
+    OP_NEWTABLE:   {a: true, mode: IABC},
+    OP_SELF:       {a: true, mode: IABC},
+    OP_ADDI:       {a: true, mode: IABC},
+    OP_ADDK:       {a: true, mode: IABC},
+    OP_SUBK:       {a: true, mode: IABC},
+    OP_MULK:       {a: true, mode: IABC},
+    OP_MODK:       {a: true, mode: IABC},
+    OP_POWK:       {a: true, mode: IABC},
+    OP_DIVK:       {a: true, mode: IABC},
+    OP_IDIVK:      {a: true, mode: IABC},
+    OP_BANDK:      {a: true, mode: IABC},
+    OP_BORK:       {a: true, mode: IABC},
+    OP_BXORK:      {a: true, mode: IABC},
+    OP_SHRI:       {a: true, mode: IABC},
+    OP_SHLI:       {a: true, mode: IABC},
+    OP_ADD:        {a: true, mode: IABC},
+    OP_SUB:        {a: true, mode: IABC},
+    OP_MUL:        {a: true, mode: IABC},
+    OP_MOD:        {a: true, mode: IABC},
+    OP_POW:        {a: true, mode: IABC},
+    OP_DIV:        {a: true, mode: IABC},
+    OP_IDIV:       {a: true, mode: IABC},
+    OP_BAND:       {a: true, mode: IABC},
+    OP_BOR:        {a: true, mode: IABC},
+    OP_BXOR:       {a: true, mode: IABC},
+    OP_SHL:        {a: true, mode: IABC},
+    OP_SHR:        {a: true, mode: IABC},
+    OP_MMBIN:      {mm: true, mode: IABC},
+    OP_MMBINI:     {mm: true, mode: IABC},
+    OP_MMBINK:     {mm: true, mode: IABC},
+    OP_UNM:        {a: true, mode: IABC},
+    OP_BNOT:       {a: true, mode: IABC},
+    OP_NOT:        {a: true, mode: IABC},
+    OP_LEN:        {a: true, mode: IABC},
+    OP_CONCAT:     {a: true, mode: IABC},
+    OP_CLOSE:      {mode: IABC},
+    OP_TBC:        {mode: IABC},
+    OP_JMP:        {mode: IsJ},
+    OP_EQ:         {t: true, mode: IABC},
+    OP_LT:         {t: true, mode: IABC},
+    OP_LE:         {t: true, mode: IABC},
+    OP_EQK:        {t: true, mode: IABC},
+    OP_EQI:        {t: true, mode: IABC},
+    OP_LTI:        {t: true, mode: IABC},
+    OP_LEI:        {t: true, mode: IABC},
+    OP_GTI:        {t: true, mode: IABC},
+    OP_GEI:        {t: true, mode: IABC},
+    OP_TEST:       {t: true, mode: IABC},
+    OP_TESTSET:    {t: true, a: true, mode: IABC},
+    OP_CALL:       {ot: true, it: true, a: true, mode: IABC},
+    OP_TAILCALL:   {ot: true, it: true, a: true, mode: IABC},
+    OP_RETURN:     {it: true, mode: IABC},
+    OP_RETURN0:    {mode: IABC},
+    OP_RETURN1:    {mode: IABC},
+    OP_FORLOOP:    {a: true, mode: IABx},
+    OP_FORPREP:    {a: true, mode: IABx},
+    OP_TFORPREP:   {mode: IABx},
+    OP_TFORCALL:   {mode: IABC},
+    OP_TFORLOOP:   {a: true, mode: IABx},
+    OP_SETLIST:    {it: true, mode: IABC},
+    OP_CLOSURE:    {a: true, mode: IABx},
+    OP_VARARG:     {ot: true, a: true, mode: IABC},
+    OP_VARARGPREP: {it: true, a: true, mode: IABC},
+    OP_EXTRAARG:   {mode: IAx},
+}
+
+// Returns the name of the opcode as printed by luac, like "MOVE"
+func (op OpCode) String() string {
+    if op < NUM_OPCODES {
+        return opNames[op]
+    }
+    return fmt.Sprintf("OP_%d", int(op))
+}
+
+// Format of the instructions with this opcode, IABC for an invalid opcode
+func (op OpCode) Mode() OpMode {
+    if op >= NUM_OPCODES {
+        return IABC
+    }
+    return opModes[op].mode
+}
+
+// Reports whether the instruction is a test, the next one being a jump
+func (op OpCode) IsTest() bool { return op < NUM_OPCODES && opModes[op].t }
+
+// Reports whether the instruction sets register A
+func (op OpCode) SetsA() bool { return op < NUM_OPCODES && opModes[op].a }
+
+// Reports whether the instruction uses the top of the stack set by the previous one (B == 0)
+func (op OpCode) UsesTop() bool { return op < NUM_OPCODES && opModes[op].it }
+
+// Reports whether the instruction sets the top of the stack for the next one (C == 0)
+func (op OpCode) SetsTop() bool { return op < NUM_OPCODES && opModes[op].ot }
+
+// Reports whether the instruction is a metamethod call following an arithmetic one
+func (op OpCode) IsMetamethod() bool { return op < NUM_OPCODES && opModes[op].mm }
+
+// Opcode of the instruction
+func (i Instruction) OpCode() OpCode { return OpCode(i >> POS_OP & (1<<SIZE_OP - 1)) }
+
+// Argument A
+func (i Instruction) A() int { return int(i >> POS_A & MAXARG_A) }
+
+// Argument B
+func (i Instruction) B() int { return int(i >> POS_B & MAXARG_B) }
+
+// Argument B as a signed integer
+func (i Instruction) SB() int { return i.B() - OFFSET_sC }
+
+// Argument C
+func (i Instruction) C() int { return int(i >> POS_C & MAXARG_C) }
+
+// Argument C as a signed integer
+func (i Instruction) SC() int { return i.C() - OFFSET_sC }
+
+// The k bit
+func (i Instruction) K() bool { return i>>POS_k&1 != 0 }
+
+// Argument Bx
+func (i Instruction) Bx() int { return int(i >> POS_Bx & MAXARG_Bx) }
+
+// Argument Bx as a signed integer
+func (i Instruction) SBx() int { return i.Bx() - OFFSET_sBx }
+
+// Argument Ax
+func (i Instruction) Ax() int { return int(i >> POS_Ax & MAXARG_Ax) }
+
+// Jump offset of OP_JMP
+func (i Instruction) SJ() int { return int(i>>POS_sJ&MAXARG_sJ) - OFFSET_sJ }
+
+// Returns the opcode and the raw arguments of the instruction, according to its format
+func (i Instruction) String() string {
+    op := i.OpCode()
+    switch op.Mode() {
+    case IABx:
+        return fmt.Sprintf("%s %d %d", op, i.A(), i.Bx())
+    case IAsBx:
+        return fmt.Sprintf("%s %d %d", op, i.A(), i.SBx())
+    case IAx:
+        return fmt.Sprintf("%s %d", op, i.Ax())
+    case IsJ:
+        return fmt.Sprintf("%s %d", op, i.SJ())
+    }
+    k := 0
+    if i.K() {
+        k = 1
+    }
+    return fmt.Sprintf("%s %d %d %d %d", op, i.A(), i.B(), i.C(), k)
+}
+
+// Names of the metamethods, indexed by the C argument of OP_MMBIN, OP_MMBINI and OP_MMBINK
+var eventNames = []string{
+    "__index", "__newindex", "__gc", "__mode", "__len", "__eq", "__add", "__sub", "__mul", "__mod",
+    "__pow", "__div", "__idiv", "__band", "__bor", "__bxor", "__shl", "__shr", "__unm", "__bnot",
+    "__lt", "__le", "__concat", "__call", "__close",
+}
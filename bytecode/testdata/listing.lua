@@ -0,0 +1,25 @@
+-- instructions of most opcodes, for the golden listing
+local N <const> = 10
+local t = {1, 2, 3, x = "y\t\"q\"", [4.5] = true, n = -0.25, big = 1 << 40}
+local s = "a" .. "b" .. N
+local a, b = 1, 2.5
+a = a + 1; a = a - b; a = a * 3; a = a / 2; a = a // 1; a = a % 7; a = a ^ 2
+a = 1 - a; a = a & 3; a = a | b; a = ~a; a = a << 1; a = a >> 2; a = -a
+local up = 0
+local function f(x, ...)
+    up = up + x
+    if x == 1 or x < 2 or x >= 3.5 or x ~= "s" then return ... end
+    return select("#", ...), t.x, t[1], t[x]
+end
+for i = 1, N, 2 do up = up + i end
+for k, v in pairs(t) do t[k] = v end
+while a < 100 do a = a * 2 if a > 50 then break end end
+repeat a = a - 1 until a <= 0
+do
+    local c <close> = nil
+    goto done
+end
+::done::
+t.y, t[2], up = not s, #s, nil
+print(f(1, 2, 3))
+return f(table.unpack({a, b}))
@@ -0,0 +1,521 @@
+package bytecode
+
+import "fmt"
+
+// Limits checked by Verify
+const (
+    // Maximum nesting of functions, LUAI_MAXCCALLS
+    MaxNesting = 200
+    // Maximum length of the short strings used as field names, LUAI_MAXSHORTLEN
+    MaxShortLen = 40
+    // Interval of the absolute line information, MAXIWTHABS
+    maxIWthAbs = 128
+)
+
+// Arithmetic metamethod events accepted by OP_MMBIN, OP_MMBINI and OP_MMBINK (TM_ADD to TM_SHR)
+const (
+    tmAdd = 6
+    tmShr = 17
+)
+
+// Error returned by Verify
+type VerifyError struct {
+    // Chunk name and first line of the function
+    Source      string
+    LineDefined int
+    // Instruction (0 based), -1 for a problem with the function itself
+    PC  int
+    Msg string
+}
+
+func (e *VerifyError) Error() string {
+    s := e.Source
+    if s == "" {
+        s = "=?"
+    }
+    if s[0] == '@' || s[0] == '=' {
+        s = s[1:]
+    }
+    if e.PC < 0 {
+        return fmt.Sprintf("invalid bytecode in function <%s:%d>: %s", s, e.LineDefined, e.Msg)
+    }
+    return fmt.Sprintf("invalid bytecode in function <%s:%d> at instruction %d: %s", s, e.LineDefined, e.PC+1, e.Msg)
+}
+
+// Statically checks that the chunk cannot make the virtual machine access memory out of its
+// bounds: registers within the stack size of each function, constant, upvalue and function
+// indices, jump targets, the instructions that must follow others (jumps after tests,
+// metamethod calls after arithmetic, extra arguments), vararg handling and debug information.
+//
+// A verified chunk can still raise lua errors, loop forever or use unlimited memory.
+func Verify(c *Chunk) error {
+    if c.Main == nil {
+        return &VerifyError{PC: -1, Msg: "no main function"}
+    }
+    if c.NumUpvalues != len(c.Main.Upvalues) {
+        return &VerifyError{c.Main.Source, c.Main.LineDefined, -1, "wrong number of upvalues"}
+    }
+    return verifyProto(c.Main, nil, 0)
+}
+
+type verifier struct {
+    f  *Proto
+    pc int
+}
+
+type verifyFailure struct{ err *VerifyError }
+
+func (v *verifier) fail(format string, args ...interface{}) {
+    panic(verifyFailure{&VerifyError{v.f.Source, v.f.LineDefined, v.pc, fmt.Sprintf(format, args...)}})
+}
+
+func verifyProto(f, parent *Proto, depth int) (err error) {
+    v := &verifier{f: f, pc: -1}
+    defer func() {
+        if r := recover(); r != nil {
+            vf, ok := r.(verifyFailure)
+            if !ok {
+                panic(r)
+            }
+            err = vf.err
+        }
+    }()
+    v.function(parent, depth)
+    for pc := range f.Code {
+        v.pc = pc
+        v.instruction()
+    }
+    v.pc = -1
+    for _, p := range f.Protos {
+        if err := verifyProto(p, f, depth+1); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Checks the function header, upvalues and debug information
+func (v *verifier) function(parent *Proto, depth int) {
+    f := v.f
+    if depth >= MaxNesting {
+        v.fail("functions nested too deeply")
+    }
+    if f.NumParams > f.MaxStackSize {
+        v.fail("%d parameters for a stack of %d", f.NumParams, f.MaxStackSize)
+    }
+    if len(f.Code) == 0 {
+        v.fail("no instructions")
+    }
+    switch f.Code[len(f.Code)-1].OpCode() {
+    case OP_RETURN, OP_RETURN0, OP_RETURN1:
+    default:
+        v.fail("last instruction is not a return")
+    }
+    if f.IsVararg != (f.Code[0].OpCode() == OP_VARARGPREP) {
+        v.fail("vararg functions must start with VARARGPREP, and only them")
+    }
+    for i, u := range f.Upvalues {
+        if parent == nil {
+            continue
+        }
+        if u.InStack && u.Index >= parent.MaxStackSize {
+            v.fail("upvalue %d refers to register %d of the enclosing function", i, u.Index)
+        }
+        if !u.InStack && u.Index >= len(parent.Upvalues) {
+            v.fail("upvalue %d refers to upvalue %d of the enclosing function", i, u.Index)
+        }
+    }
+    if len(f.LineInfo) != 0 && len(f.LineInfo) != len(f.Code) {
+        v.fail("%d line entries for %d instructions", len(f.LineInfo), len(f.Code))
+    }
+    for i, abs := range f.AbsLineInfo {
+        if abs.PC < 0 || abs.PC >= len(f.Code) || (i > 0 && abs.PC <= f.AbsLineInfo[i-1].PC) {
+            v.fail("bad absolute line information")
+        }
+    }
+    // getbaseline starts from an estimate that must be a valid lower bound
+    if len(f.AbsLineInfo) > 0 {
+        for pc := f.AbsLineInfo[0].PC; pc < len(f.Code); pc++ {
+            if i := pc/maxIWthAbs - 1; i >= 0 && (i >= len(f.AbsLineInfo) || f.AbsLineInfo[i].PC > pc) {
+                v.fail("bad absolute line information")
+            }
+        }
+    }
+    for i, l := range f.LocVars {
+        if l.StartPC < 0 || l.StartPC > l.EndPC || l.EndPC > len(f.Code) {
+            v.fail("bad range for local variable %d", i)
+        }
+    }
+}
+
+// Checks that registers a to a+n-1 are in the stack frame
+func (v *verifier) regs(a, n int) {
+    if a < 0 || n < 0 || a+n > v.f.MaxStackSize {
+        if n == 1 {
+            v.fail("register %d out of the stack of %d", a, v.f.MaxStackSize)
+        }
+        v.fail("registers %d to %d out of the stack of %d", a, a+n-1, v.f.MaxStackSize)
+    }
+}
+
+func (v *verifier) reg(r int) {
+    v.regs(r, 1)
+}
+
+func (v *verifier) constant(k int) interface{} {
+    if k < 0 || k >= len(v.f.Constants) {
+        v.fail("constant %d out of %d", k, len(v.f.Constants))
+    }
+    return v.f.Constants[k]
+}
+
+// Checks a constant used as a field name: the virtual machine expects a short string
+func (v *verifier) shortString(k int) {
+    if s, ok := v.constant(k).(string); !ok || len(s) > MaxShortLen {
+        v.fail("constant %d is not a short string", k)
+    }
+}
+
+func (v *verifier) number(k int) {
+    switch v.constant(k).(type) {
+    case int64, float64:
+    default:
+        v.fail("constant %d is not a number", k)
+    }
+}
+
+func (v *verifier) integer(k int) {
+    if _, ok := v.constant(k).(int64); !ok {
+        v.fail("constant %d is not an integer", k)
+    }
+}
+
+func (v *verifier) upvalue(u int) {
+    if u < 0 || u >= len(v.f.Upvalues) {
+        v.fail("upvalue %d out of %d", u, len(v.f.Upvalues))
+    }
+}
+
+// Checks that the instruction at target exists
+func (v *verifier) target(target int) {
+    if target < 0 || target >= len(v.f.Code) {
+        v.fail("jump to %d out of the code", target+1)
+    }
+}
+
+// Checks a jump target, which cannot rely on the top of the stack set by the instruction before it
+func (v *verifier) jump(target int) {
+    v.target(target)
+    i := v.f.Code[target]
+    switch i.OpCode() {
+    case OP_CALL, OP_TAILCALL, OP_RETURN, OP_SETLIST:
+        if i.B() == 0 {
+            v.fail("jump to %d, which uses the top of the stack", target+1)
+        }
+    }
+}
+
+// Returns the next instruction, which must exist
+func (v *verifier) next() Instruction {
+    v.target(v.pc + 1)
+    return v.f.Code[v.pc+1]
+}
+
+// Checks that the previous instruction left the top of the stack set, for operands of 0 meaning
+// "up to the top"
+func (v *verifier) top() {
+    if v.pc == 0 {
+        v.fail("no instruction setting the top of the stack")
+    }
+    prev := v.f.Code[v.pc-1]
+    switch prev.OpCode() {
+    case OP_CALL, OP_VARARG:
+        if prev.C() == 0 {
+            return
+        }
+    case OP_TAILCALL:
+        // a C function called in tail position returns all its results like CALL
+        return
+    }
+    v.fail("previous instruction does not set the top of the stack")
+}
+
+func (v *verifier) instruction() {
+    f := v.f
+    i := f.Code[v.pc]
+    op := i.OpCode()
+    a, b, c := i.A(), i.B(), i.C()
+    if op >= NUM_OPCODES {
+        v.fail("invalid opcode %d", int(op))
+    }
+    if op.IsTest() {
+        if v.next().OpCode() != OP_JMP {
+            v.fail("%s not followed by a jump", op)
+        }
+        v.jump(v.pc + 2)
+    }
+
+    switch op {
+    case OP_MOVE:
+        v.reg(a)
+        v.reg(b)
+    case OP_LOADI, OP_LOADF, OP_LOADFALSE, OP_LOADTRUE:
+        v.reg(a)
+    case OP_LOADK:
+        v.reg(a)
+        v.constant(i.Bx())
+    case OP_LOADKX:
+        v.reg(a)
+        next := v.next()
+        if next.OpCode() != OP_EXTRAARG {
+            v.fail("LOADKX not followed by EXTRAARG")
+        }
+        v.constant(next.Ax())
+    case OP_LFALSESKIP:
+        v.reg(a)
+        v.jump(v.pc + 2)
+    case OP_LOADNIL:
+        v.regs(a, b+1)
+    case OP_GETUPVAL:
+        v.reg(a)
+        v.upvalue(b)
+    case OP_SETUPVAL:
+        v.reg(a)
+        v.upvalue(b)
+    case OP_GETTABUP:
+        v.reg(a)
+        v.upvalue(b)
+        v.shortString(c)
+    case OP_GETTABLE:
+        v.reg(a)
+        v.reg(b)
+        v.reg(c)
+    case OP_GETI:
+        v.reg(a)
+        v.reg(b)
+    case OP_GETFIELD:
+        v.reg(a)
+        v.reg(b)
+        v.shortString(c)
+    case OP_SETTABUP:
+        v.upvalue(a)
+        v.shortString(b)
+        v.rk(i)
+    case OP_SETTABLE:
+        v.reg(a)
+        v.reg(b)
+        v.rk(i)
+    case OP_SETI:
+        v.reg(a)
+        v.rk(i)
+    case OP_SETFIELD:
+        v.reg(a)
+        v.shortString(b)
+        v.rk(i)
+    case OP_NEWTABLE:
+        v.reg(a)
+        if v.next().OpCode() != OP_EXTRAARG {
+            v.fail("NEWTABLE not followed by EXTRAARG")
+        }
+    case OP_SELF:
+        v.regs(a, 2)
+        v.reg(b)
+        if i.K() {
+            if _, ok := v.constant(c).(string); !ok {
+                v.fail("constant %d is not a string", c)
+            }
+        } else {
+            v.reg(c)
+        }
+    case OP_ADDI, OP_SHRI, OP_SHLI:
+        v.reg(a)
+        v.reg(b)
+        v.arith()
+    case OP_ADDK, OP_SUBK, OP_MULK, OP_MODK, OP_POWK, OP_DIVK, OP_IDIVK:
+        v.reg(a)
+        v.reg(b)
+        v.number(c)
+        v.arith()
+    case OP_BANDK, OP_BORK, OP_BXORK:
+        v.reg(a)
+        v.reg(b)
+        v.integer(c)
+        v.arith()
+    case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+        v.reg(a)
+        v.reg(b)
+        v.reg(c)
+        v.arith()
+    case OP_MMBIN, OP_MMBINI, OP_MMBINK:
+        v.reg(a)
+        if op == OP_MMBIN {
+            v.reg(b)
+        } else if op == OP_MMBINK {
+            v.constant(b)
+        }
+        if c < tmAdd || c > tmShr {
+            v.fail("invalid metamethod event %d", c)
+        }
+        // the result goes to the register A of the arithmetic instruction before
+        if v.pc == 0 || !isArith(f.Code[v.pc-1].OpCode()) {
+            v.fail("%s not preceded by an arithmetic instruction", op)
+        }
+    case OP_UNM, OP_BNOT, OP_NOT, OP_LEN:
+        v.reg(a)
+        v.reg(b)
+    case OP_CONCAT:
+        if b < 2 {
+            v.fail("CONCAT of %d values", b)
+        }
+        v.regs(a, b)
+    case OP_CLOSE, OP_TBC:
+        v.reg(a)
+    case OP_JMP:
+        v.jump(v.pc + 1 + i.SJ())
+    case OP_EQ, OP_LT, OP_LE:
+        v.reg(a)
+        v.reg(b)
+    case OP_EQK:
+        v.reg(a)
+        v.constant(b)
+    case OP_EQI, OP_LTI, OP_LEI, OP_GTI, OP_GEI, OP_TEST:
+        v.reg(a)
+    case OP_TESTSET:
+        v.reg(a)
+        v.reg(b)
+    case OP_CALL:
+        v.reg(a)
+        if b == 0 {
+            v.top()
+        } else {
+            v.regs(a, b)
+        }
+        if c > 0 {
+            v.regs(a, c-1)
+        }
+    case OP_TAILCALL:
+        v.reg(a)
+        if b == 0 {
+            v.top()
+        } else {
+            v.regs(a, b)
+        }
+        v.varargReturn(c)
+    case OP_RETURN:
+        if b == 0 {
+            v.reg(a)
+            v.top()
+        } else {
+            v.regs(a, b-1)
+        }
+        v.varargReturn(c)
+    case OP_RETURN0, OP_RETURN1:
+        // vararg functions must restore their frame with RETURN
+        if f.IsVararg {
+            v.fail("%s in a vararg function", op)
+        }
+        if op == OP_RETURN1 {
+            v.reg(a)
+        }
+    case OP_FORPREP:
+        v.regs(a, 4)
+        // jumps to the FORLOOP, skips the loop past it
+        loop := v.pc + 1 + i.Bx()
+        v.target(loop)
+        if l := f.Code[loop]; l.OpCode() != OP_FORLOOP || l.A() != a {
+            v.fail("FORPREP does not match a FORLOOP")
+        }
+        v.jump(loop + 1)
+    case OP_FORLOOP:
+        v.regs(a, 4)
+        v.jump(v.pc + 1 - i.Bx())
+    case OP_TFORPREP:
+        v.regs(a, 4)
+        call := v.pc + 1 + i.Bx()
+        v.target(call)
+        if l := f.Code[call]; l.OpCode() != OP_TFORCALL || l.A() != a {
+            v.fail("TFORPREP does not jump to a matching TFORCALL")
+        }
+    case OP_TFORCALL:
+        // the iterator and its two arguments are copied to A+4..A+6, and its C results
+        // replace them
+        v.regs(a, 4)
+        v.regs(a+4, max(3, c))
+        if l := v.next(); l.OpCode() != OP_TFORLOOP || l.A() != a {
+            v.fail("TFORCALL not followed by a matching TFORLOOP")
+        }
+    case OP_TFORLOOP:
+        v.regs(a, 4)
+        v.jump(v.pc + 1 - i.Bx())
+    case OP_SETLIST:
+        if b == 0 {
+            v.reg(a)
+            v.top()
+        } else {
+            v.regs(a, b+1)
+        }
+        if i.K() && v.next().OpCode() != OP_EXTRAARG {
+            v.fail("SETLIST not followed by EXTRAARG")
+        }
+    case OP_CLOSURE:
+        v.reg(a)
+        if i.Bx() >= len(f.Protos) {
+            v.fail("function %d out of %d", i.Bx(), len(f.Protos))
+        }
+    case OP_VARARG:
+        if !f.IsVararg {
+            v.fail("VARARG in a function without varargs")
+        }
+        v.reg(a)
+        if c > 0 {
+            v.regs(a, c-1)
+        }
+    case OP_VARARGPREP:
+        if v.pc != 0 {
+            v.fail("VARARGPREP is not the first instruction")
+        }
+        if a != f.NumParams {
+            v.fail("VARARGPREP does not match the number of parameters")
+        }
+    case OP_EXTRAARG:
+        if v.pc == 0 {
+            v.fail("EXTRAARG without a previous instruction")
+        }
+        switch f.Code[v.pc-1].OpCode() {
+        case OP_LOADKX, OP_NEWTABLE, OP_SETLIST:
+        default:
+            v.fail("EXTRAARG does not follow LOADKX, NEWTABLE or SETLIST")
+        }
+    }
+}
+
+// Checks the RK(C) operand of the table stores: a constant with the k bit, a register otherwise
+func (v *verifier) rk(i Instruction) {
+    if i.K() {
+        v.constant(i.C())
+    } else {
+        v.reg(i.C())
+    }
+}
+
+// Arithmetic instructions skip the metamethod call following them when they succeed
+func (v *verifier) arith() {
+    if !v.next().OpCode().IsMetamethod() {
+        v.fail("%s not followed by a metamethod call", v.f.Code[v.pc].OpCode())
+    }
+}
+
+func isArith(op OpCode) bool {
+    return op >= OP_ADDI && op <= OP_SHR
+}
+
+// Returns of vararg functions restore the frame using C, the number of parameters plus one
+func (v *verifier) varargReturn(c int) {
+    want := 0
+    if v.f.IsVararg {
+        want = v.f.NumParams + 1
+    }
+    if c != want {
+        v.fail("C of %s is %d instead of %d", v.f.Code[v.pc].OpCode(), c, want)
+    }
+}
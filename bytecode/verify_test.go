@@ -0,0 +1,213 @@
+package bytecode_test
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+// Scripts covering the instructions with register, constant, upvalue and jump operands
+var verifyScripts = []string{
+    `local a, b = 1, 2 a = b return a + b`,
+    `local x = 0 while x < 10 do x = x + 1 end return x`,
+    `local s = 0 for i = 1, 10, 2 do s = s + i end return s`,
+    `local t = {} for k, v in next, {1, 2, 3} do t[#t + 1] = k .. v end return t`,
+    `local a = 1 return function(...) a = a + select("#", ...) return a, ... end`,
+    `local t = {1, 2, 3, x = "y", [4.5] = true} t.x = t[1] return t:unpack()`,
+    `local function f(n) if n <= 1 then return 1 end return n * f(n - 1) end return f(5)`,
+    `local x <close> = nil local s = "a" .. "b" .. 1 goto done ::done:: return s, -#s, ~1, not s`,
+    `return 1 // 2, 3.0 % 2, 2^10, 1 << 3, 8 >> 1, 5 & 3, 5 | 3, 5 ~ 3, "long " .. ("x"):rep(50)`,
+    `for k, v in next, {} do end`,
+}
+
+func dump(t testing.TB, src string) []byte {
+    t.Helper()
+    L := lua.NewState()
+    defer L.Close()
+    if r := L.LoadBuffer([]byte(src), "=t", "t"); r != 0 {
+        t.Fatal(L.ToString(-1))
+    }
+    L.Dump()
+    return append([]byte(nil), L.ToBytes(-1)...)
+}
+
+// Returns a copy of data with the instruction pc of f replaced by i
+func patchCode(t *testing.T, data []byte, c *bytecode.Chunk, f *bytecode.Proto, pc int, i bytecode.Instruction) []byte {
+    t.Helper()
+    code := make([]byte, 4*len(f.Code))
+    for n, i := range f.Code {
+        c.ByteOrder.PutUint32(code[4*n:], uint32(i))
+    }
+    at := bytes.Index(data, code)
+    if at < 0 {
+        t.Fatal("code not found in the dump")
+    }
+    data = append([]byte(nil), data...)
+    c.ByteOrder.PutUint32(data[at+4*pc:], uint32(i))
+    return data
+}
+
+// Returns the first instruction with the opcode in f or its nested functions
+func find(f *bytecode.Proto, op bytecode.OpCode) (*bytecode.Proto, int) {
+    for pc, i := range f.Code {
+        if i.OpCode() == op {
+            return f, pc
+        }
+    }
+    for _, p := range f.Protos {
+        if p, pc := find(p, op); p != nil {
+            return p, pc
+        }
+    }
+    return nil, -1
+}
+
+func mustFind(t *testing.T, f *bytecode.Proto, op bytecode.OpCode) (*bytecode.Proto, int) {
+    t.Helper()
+    f, pc := find(f, op)
+    if f == nil {
+        t.Fatalf("no %s instruction", op)
+    }
+    return f, pc
+}
+
+func setArg(i bytecode.Instruction, pos, size uint, v int) bytecode.Instruction {
+    mask := bytecode.Instruction(1<<size-1) << pos
+    return i&^mask | bytecode.Instruction(v)<<pos&mask
+}
+
+func TestVerify(t *testing.T) {
+    for _, src := range verifyScripts {
+        c, err := bytecode.Parse(dump(t, src))
+        if err != nil {
+            t.Fatalf("%s: %v", src, err)
+        }
+        if err := bytecode.Verify(c); err != nil {
+            t.Errorf("%s: %v", src, err)
+        }
+    }
+}
+
+func TestLoadVerified(t *testing.T) {
+    // offset of the stack size of the main function, after the header, the number of upvalues,
+    // the source "=t", the lines and the parameters
+    const maxStackSize = 31 + 1 + 3 + 2 + 2
+    tests := []struct {
+        name  string
+        src   string
+        patch func(c *bytecode.Chunk, data []byte) []byte
+        err   string
+    }{
+        {"jump target", verifyScripts[1], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_JMP)
+            i := setArg(f.Code[pc], bytecode.POS_sJ, bytecode.SIZE_sJ, bytecode.OFFSET_sJ+1000)
+            return patchCode(t, data, c, f, pc, i)
+        }, "jump to"},
+        {"backward jump target", verifyScripts[2], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_FORLOOP)
+            i := setArg(f.Code[pc], bytecode.POS_Bx, bytecode.SIZE_Bx, pc+10)
+            return patchCode(t, data, c, f, pc, i)
+        }, "jump to"},
+        {"register", verifyScripts[0], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_MOVE)
+            i := setArg(f.Code[pc], bytecode.POS_B, bytecode.SIZE_B, f.MaxStackSize)
+            return patchCode(t, data, c, f, pc, i)
+        }, "out of the stack"},
+        {"constant", verifyScripts[5], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_LOADK)
+            i := setArg(f.Code[pc], bytecode.POS_Bx, bytecode.SIZE_Bx, len(f.Constants))
+            return patchCode(t, data, c, f, pc, i)
+        }, "constant"},
+        {"field name", verifyScripts[5], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_SETFIELD)
+            i := setArg(f.Code[pc], bytecode.POS_B, bytecode.SIZE_B, 200)
+            return patchCode(t, data, c, f, pc, i)
+        }, "constant 200"},
+        {"upvalue", verifyScripts[4], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_GETUPVAL)
+            i := setArg(f.Code[pc], bytecode.POS_B, bytecode.SIZE_B, len(f.Upvalues))
+            return patchCode(t, data, c, f, pc, i)
+        }, "upvalue 2 out of 2"},
+        {"global table", verifyScripts[3], func(c *bytecode.Chunk, data []byte) []byte {
+            f, pc := mustFind(t, c.Main, bytecode.OP_GETTABUP)
+            i := setArg(f.Code[pc], bytecode.POS_B, bytecode.SIZE_B, 3)
+            return patchCode(t, data, c, f, pc, i)
+        }, "upvalue 3"},
+        {"stack size", verifyScripts[8], func(c *bytecode.Chunk, data []byte) []byte {
+            data = append([]byte(nil), data...)
+            data[maxStackSize] = 2
+            return data
+        }, "out of the stack of 2"},
+        {"generic for call", verifyScripts[9], func(c *bytecode.Chunk, data []byte) []byte {
+            // enough for the loop variables, not for the call of the iterator
+            f, pc := mustFind(t, c.Main, bytecode.OP_TFORCALL)
+            if f != c.Main || f.Code[pc].A() != 0 || f.Code[pc].C() != 2 {
+                t.Fatal("unexpected TFORCALL")
+            }
+            data = append([]byte(nil), data...)
+            data[maxStackSize] = 6
+            return data
+        }, "registers 4 to 6 out of the stack of 6"},
+        {"truncated", verifyScripts[0], func(c *bytecode.Chunk, data []byte) []byte {
+            return data[:len(data)-10]
+        }, "truncated"},
+    }
+
+    L := lua.NewState()
+    defer L.Close()
+    for _, tt := range tests {
+        data := dump(t, tt.src)
+        if r := L.LoadVerified(data, "=t"); r != lua.LUA_OK {
+            t.Fatalf("%s: %s", tt.name, L.ToString(-1))
+        }
+        L.Pop(1)
+        c, err := bytecode.Parse(data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        data = tt.patch(c, data)
+        if r := L.LoadVerified(data, "=t"); r != lua.LUA_ERRSYNTAX {
+            t.Errorf("%s: loaded", tt.name)
+            L.Pop(1)
+            continue
+        }
+        if msg := L.ToString(-1); !strings.Contains(msg, tt.err) {
+            t.Errorf("%s: error %q, want %q", tt.name, msg, tt.err)
+        }
+        L.Pop(1)
+    }
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+// Parses and verifies arbitrary data. Verified chunks are listed and run, without libraries and
+// with an execution limit, where an unchecked operand would corrupt memory.
+func FuzzVerify(f *testing.F) {
+    for _, src := range verifyScripts {
+        f.Add(dump(f, src))
+    }
+    L := lua.NewState()
+    defer L.Close()
+    L.SetExecutionLimit(10000)
+    f.Fuzz(func(t *testing.T, data []byte) {
+        c, err := bytecode.Parse(data)
+        if err != nil {
+            return
+        }
+        c.Listing(true)
+        if bytecode.Verify(c) != nil {
+            return
+        }
+        if L.LoadVerified(data, "=fuzz") != lua.LUA_OK {
+            t.Fatalf("verified chunk refused: %s", L.ToString(-1))
+        }
+        if err := L.Call(0, 0); err != nil {
+            L.Pop(1)
+        }
+        L.SetTop(0)
+    })
+}
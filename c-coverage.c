@@ -0,0 +1,299 @@
+#include <stdlib.h>
+#include <string.h>
+
+#include "lua.h"
+#include "lauxlib.h"
+#include "lstate.h"
+#include "lobject.h"
+#include "lopcodes.h"
+#include "ldebug.h"
+#include "lstring.h"
+#include "clua.h"
+
+#define MT_COVERAGE "Lua.Coverage"
+
+/* =============================================================================
+ * Line and branch coverage, see State.StartCoverage.
+ *
+ * A C hook is called for every new line (LUA_MASKLINE) and every instruction
+ * (LUA_MASKCOUNT with a count of 1). The first time a function runs its
+ * prototype and all the nested ones are registered, with the line of each
+ * instruction so that lines never executed are reported too, and the closure
+ * is anchored so that the prototypes are not collected.
+ *
+ * Line events are counted at the instruction starting the line. Branches are
+ * the test instructions (the ones followed by a jump): when the instruction
+ * run after a test in the same function is the one after the jump the jump
+ * was skipped, otherwise it was taken.
+ *
+ * The hook installed before (SetHook, SetExecutionLimit, the profiler or the
+ * debugger) keeps receiving the events of its mask, its instruction count is
+ * counted down here, and it is restored when coverage stops.
+ * ========================================================================== */
+
+typedef struct coverage {
+    clua_covproto *protos;
+    int n;
+    int cap;
+    /* Proto* -> index in protos + 1, open addressing */
+    const Proto **keys;
+    int *values;
+    int nkeys;
+    int keycap;
+    const Proto *last;
+    clua_covproto *lastcp;
+    /* hook installed before, chained and restored by clua_coverage_stop */
+    lua_Hook prevhook;
+    int prevmask;
+    int prevcount;
+    int countdown;
+} coverage;
+
+static const char CoverageKey = 'k';
+
+static unsigned proto_hash(const Proto *p, int cap)
+{
+    size_t h = (size_t)p;
+    h ^= h >> 17;
+    h *= 0x9E3779B1u;
+    return (unsigned)(h ^ (h >> 15)) & (unsigned)(cap - 1);
+}
+
+static int coverage_find(coverage *cov, const Proto *p)
+{
+    unsigned i;
+    if (cov->keycap == 0)
+        return -1;
+    for (i = proto_hash(p, cov->keycap); cov->keys[i] != NULL; i = (i + 1) & (unsigned)(cov->keycap - 1)) {
+        if (cov->keys[i] == p)
+            return cov->values[i] - 1;
+    }
+    return -1;
+}
+
+static void coverage_setkey(coverage *cov, const Proto *p, int index)
+{
+    unsigned i;
+    if ((cov->nkeys + 1) * 2 > cov->keycap) {
+        const Proto **keys = cov->keys;
+        int *values = cov->values, cap = cov->keycap, j;
+        cov->keycap = cap == 0 ? 64 : cap * 2;
+        cov->keys = (const Proto **)calloc((size_t)cov->keycap, sizeof(Proto *));
+        cov->values = (int *)calloc((size_t)cov->keycap, sizeof(int));
+        cov->nkeys = 0;
+        for (j = 0; j < cap; j++) {
+            if (keys[j] != NULL)
+                coverage_setkey(cov, keys[j], values[j] - 1);
+        }
+        free(keys);
+        free(values);
+    }
+    for (i = proto_hash(p, cov->keycap); cov->keys[i] != NULL; i = (i + 1) & (unsigned)(cov->keycap - 1))
+        ;
+    cov->keys[i] = p;
+    cov->values[i] = index + 1;
+    cov->nkeys++;
+}
+
+/* Registers p and its nested prototypes */
+static void coverage_addproto(coverage *cov, const Proto *p)
+{
+    clua_covproto *cp;
+    int pc, line, i;
+    if (coverage_find(cov, p) >= 0)
+        return;
+    if (cov->n == cov->cap) {
+        cov->cap = cov->cap == 0 ? 16 : cov->cap * 2;
+        cov->protos = (clua_covproto *)realloc(cov->protos, (size_t)cov->cap * sizeof(clua_covproto));
+    }
+    cp = &cov->protos[cov->n];
+    memset(cp, 0, sizeof(*cp));
+    cp->source = p->source != NULL ? getstr(p->source) : NULL;
+    cp->linedefined = p->linedefined;
+    cp->n = p->sizecode;
+    cp->lines = (int *)calloc((size_t)p->sizecode, sizeof(int));
+    cp->hits = (unsigned *)calloc((size_t)p->sizecode, sizeof(unsigned));
+    cp->branches = (unsigned *)calloc((size_t)p->sizecode * 2, sizeof(unsigned));
+    cp->tests = (unsigned char *)calloc((size_t)p->sizecode, 1);
+    cp->pending = -1;
+    if (p->lineinfo != NULL) {
+        line = p->linedefined;
+        for (pc = 0; pc < p->sizecode; pc++) {
+            if (p->lineinfo[pc] != ABSLINEINFO)
+                line += p->lineinfo[pc];
+            else
+                line = luaG_getfuncline(p, pc);
+            /* like activelines, the OP_VARARGPREP of vararg functions is not a line */
+            if (!(pc == 0 && p->is_vararg))
+                cp->lines[pc] = line;
+        }
+    }
+    for (pc = 0; pc + 1 < p->sizecode; pc++) {
+        OpCode op = GET_OPCODE(p->code[pc]);
+        if (testTMode(op) && GET_OPCODE(p->code[pc + 1]) == OP_JMP)
+            cp->tests[pc] = 1;
+    }
+    coverage_setkey(cov, p, cov->n);
+    cov->n++;
+    cov->last = NULL;
+    for (i = 0; i < p->sizep; i++)
+        coverage_addproto(cov, p->p[i]);
+}
+
+static coverage *coverage_get(lua_State *L)
+{
+    coverage *cov;
+    lua_rawgetp(L, LUA_REGISTRYINDEX, &CoverageKey);
+    cov = (coverage *)lua_touserdata(L, -1);
+    lua_pop(L, 1);
+    return cov;
+}
+
+static void coverage_record(lua_State *L, coverage *cov, lua_Debug *ar)
+{
+    clua_covproto *cp;
+    const Proto *p;
+    CallInfo *ci = ar->i_ci;
+    int pc, index;
+
+    if (!isLua(ci))
+        return;
+    p = ci_func(ci)->p;
+    if (p == cov->last) {
+        cp = cov->lastcp;
+    } else {
+        index = coverage_find(cov, p);
+        if (index < 0) {
+            /* anchor the closure in the uservalue of the coverage userdata */
+            lua_rawgetp(L, LUA_REGISTRYINDEX, &CoverageKey);
+            lua_getiuservalue(L, -1, 1);
+            lua_getinfo(L, "f", ar);
+            lua_pushboolean(L, 1);
+            lua_rawset(L, -3);
+            lua_pop(L, 2);
+            coverage_addproto(cov, p);
+            index = coverage_find(cov, p);
+        }
+        cov->last = p;
+        cov->lastcp = cp = &cov->protos[index];
+    }
+
+    pc = pcRel(ci->u.l.savedpc, p);
+    if (pc < 0 || pc >= cp->n)
+        return;
+    if (ar->event == LUA_HOOKLINE) {
+        cp->hits[pc]++;
+        return;
+    }
+    if (cp->pending >= 0) {
+        cp->branches[cp->pending * 2 + (pc == cp->pending + 2 ? 0 : 1)]++;
+        cp->pending = -1;
+    }
+    if (cp->tests[pc])
+        cp->pending = pc;
+}
+
+static void coverage_hook(lua_State *L, lua_Debug *ar)
+{
+    coverage *cov = coverage_get(L);
+    int forward = 0;
+
+    if (cov == NULL)
+        return;
+    switch (ar->event) {
+    case LUA_HOOKLINE:
+        coverage_record(L, cov, ar);
+        forward = cov->prevmask & LUA_MASKLINE;
+        break;
+    case LUA_HOOKCOUNT:
+        coverage_record(L, cov, ar);
+        if ((cov->prevmask & LUA_MASKCOUNT) && cov->prevcount > 0 && --cov->countdown == 0) {
+            cov->countdown = cov->prevcount;
+            forward = 1;
+        }
+        break;
+    default:
+        /* call and return events are only asked for the previous hook */
+        forward = 1;
+        break;
+    }
+    /* may not return, the previous hook can raise an error */
+    if (forward && cov->prevhook != NULL)
+        cov->prevhook(L, ar);
+}
+
+static int coverage_gc(lua_State *L)
+{
+    coverage *cov = (coverage *)luaL_checkudata(L, 1, MT_COVERAGE);
+    int i;
+    for (i = 0; i < cov->n; i++) {
+        free(cov->protos[i].lines);
+        free(cov->protos[i].hits);
+        free(cov->protos[i].branches);
+        free(cov->protos[i].tests);
+    }
+    free(cov->protos);
+    free(cov->keys);
+    free(cov->values);
+    memset(cov, 0, sizeof(*cov));
+    return 0;
+}
+
+/* Starts collecting coverage, returns 0 if already collecting */
+int clua_coverage_start(lua_State *L)
+{
+    coverage *cov;
+    if (lua_rawgetp(L, LUA_REGISTRYINDEX, &CoverageKey) != LUA_TNIL) {
+        lua_pop(L, 1);
+        return 0;
+    }
+    lua_pop(L, 1);
+    cov = (coverage *)lua_newuserdatauv(L, sizeof(coverage), 1);
+    memset(cov, 0, sizeof(*cov));
+    if (luaL_newmetatable(L, MT_COVERAGE)) {
+        lua_pushcfunction(L, coverage_gc);
+        lua_setfield(L, -2, "__gc");
+    }
+    lua_setmetatable(L, -2);
+    lua_newtable(L);
+    lua_setiuservalue(L, -2, 1);
+    lua_rawsetp(L, LUA_REGISTRYINDEX, &CoverageKey);
+    L = G(L)->mainthread;
+    cov->prevhook = lua_gethook(L);
+    cov->prevmask = cov->prevhook != NULL ? lua_gethookmask(L) : 0;
+    cov->prevcount = cov->countdown = lua_gethookcount(L);
+    lua_sethook(L, coverage_hook, LUA_MASKLINE | LUA_MASKCOUNT | (cov->prevmask & (LUA_MASKCALL | LUA_MASKRET)), 1);
+    return 1;
+}
+
+/* Stops collecting coverage and restores the previous hook, unless the hook was replaced since
+ * then. The data stays available until clua_coverage_release */
+void clua_coverage_stop(lua_State *L)
+{
+    coverage *cov = coverage_get(L);
+    L = G(L)->mainthread;
+    if (cov == NULL || lua_gethook(L) != coverage_hook)
+        return;
+    lua_sethook(L, cov->prevhook, cov->prevmask, cov->prevcount);
+}
+
+void clua_coverage_release(lua_State *L)
+{
+    lua_pushnil(L);
+    lua_rawsetp(L, LUA_REGISTRYINDEX, &CoverageKey);
+}
+
+/* Number of prototypes registered, -1 if coverage was not started */
+int clua_coverage_count(lua_State *L)
+{
+    coverage *cov = coverage_get(L);
+    return cov != NULL ? cov->n : -1;
+}
+
+clua_covproto *clua_coverage_proto(lua_State *L, int i)
+{
+    coverage *cov = coverage_get(L);
+    if (cov == NULL || i < 0 || i >= cov->n)
+        return NULL;
+    return &cov->protos[i];
+}
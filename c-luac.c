@@ -0,0 +1,62 @@
+/*
+** Combining of compiled chunks, adapted from luac.c (see luac.c.txt) so
+** that it can be used on the functions of a lua_State. The listing is done
+** in Go by the bytecode package, see State.Listing.
+** See Copyright Notice in lua.h
+*/
+
+#include "lua.h"
+
+#include "lgc.h"
+#include "lobject.h"
+#include "lstate.h"
+
+#define PROGNAME	"luac"
+#define FUNCTION "(function()end)();"
+
+static const char* reader(lua_State* L, void* ud, size_t* size)
+{
+ UNUSED(L);
+ if ((*(int*)ud)--)
+ {
+  *size=sizeof(FUNCTION)-1;
+  return FUNCTION;
+ }
+ else
+ {
+  *size=0;
+  return NULL;
+ }
+}
+
+#define toproto(L,i) getproto(s2v(L->top+(i)))
+
+/*
+** Replaces the n functions on top of the stack with a main function running
+** them in order, returns 0 on success or the status of lua_load with the
+** error message on the stack.
+*/
+int clua_luac_combine(lua_State* L, int n)
+{
+ Proto* f;
+ int i=n, status;
+ if (n==1)
+  return LUA_OK;
+ status=lua_load(L,reader,&i,"=(" PROGNAME ")",NULL);
+ if (status!=LUA_OK)
+ {
+  lua_replace(L,-n-1);
+  lua_pop(L,n-1);
+  return status;
+ }
+ f=toproto(L,-1);
+ for (i=0; i<n; i++)
+ {
+  f->p[i]=toproto(L,i-n-1);
+  luaC_objbarrier(L,f,f->p[i]);
+  if (f->p[i]->sizeupvalues>0) f->p[i]->upvalues[0].instack=0;
+ }
+ lua_replace(L,-n-1);
+ lua_pop(L,n-1);
+ return LUA_OK;
+}
@@ -0,0 +1,240 @@
+#include <stdlib.h>
+#include <stdint.h>
+#include <string.h>
+#include <math.h>
+
+#include "lua.h"
+#include "lauxlib.h"
+#include "lualib.h"
+#include "lstate.h"
+#include "lobject.h"
+#include "_cgo_export.h"
+
+/* =============================================================================
+ * Sampling allocation profiler, see State.StartMemProfile.
+ *
+ * The allocator of the state is wrapped: allocations are counted and every
+ * `rate` bytes on average (exponentially distributed intervals, like the go
+ * runtime) the allocation being made is sampled. The stack of the running
+ * coroutine is walked by golua_memprof_record before the real allocator is
+ * called, so that a stack being reallocated is still valid, and the returned
+ * call site id is kept along with the block in an open addressing table.
+ * Frees and reallocations of sampled blocks are reported to go so that the
+ * live heap can be attributed to call sites.
+ *
+ * The allocator has no lua_State argument: the running coroutine is found by
+ * descending from the main thread through the coroutine.resume and
+ * coroutine.wrap calls at the top of the stacks. Coroutines resumed from go
+ * are attributed to the resuming call.
+ * ========================================================================== */
+
+typedef struct memprof_block {
+    void *ptr;  /* NULL for an empty slot, &memprof_tombstone for a removed one */
+    int site;
+} memprof_block;
+
+typedef struct memprof {
+    lua_Alloc f;
+    void *ud;
+    lua_State *L;
+    size_t gostateindex;
+    double rate;
+    double next;
+    uint64_t rng;
+    int busy;
+    lua_CFunction resume;
+    lua_CFunction auxwrap;
+
+    memprof_block *blocks;
+    size_t cap;
+    size_t used;
+} memprof;
+
+static char memprof_tombstone;
+
+static size_t block_hash(void *ptr, size_t cap)
+{
+    uint64_t h = (uint64_t)(uintptr_t)ptr;
+    h ^= h >> 33;
+    h *= 0xff51afd7ed558ccdULL;
+    h ^= h >> 33;
+    return (size_t)h & (cap - 1);
+}
+
+static memprof_block *block_find(memprof *mp, void *ptr)
+{
+    size_t i;
+    if (mp->cap == 0)
+        return NULL;
+    for (i = block_hash(ptr, mp->cap); mp->blocks[i].ptr != NULL; i = (i + 1) & (mp->cap - 1)) {
+        if (mp->blocks[i].ptr == ptr)
+            return &mp->blocks[i];
+    }
+    return NULL;
+}
+
+static void block_insert(memprof *mp, void *ptr, int site);
+
+static int block_grow(memprof *mp)
+{
+    memprof_block *old = mp->blocks;
+    size_t oldcap = mp->cap, i;
+    size_t cap = oldcap == 0 ? 64 : oldcap * 2;
+    memprof_block *blocks = (memprof_block *)calloc(cap, sizeof(memprof_block));
+    if (blocks == NULL)
+        return 0;
+    mp->blocks = blocks;
+    mp->cap = cap;
+    mp->used = 0;
+    for (i = 0; i < oldcap; i++) {
+        if (old[i].ptr != NULL && old[i].ptr != &memprof_tombstone)
+            block_insert(mp, old[i].ptr, old[i].site);
+    }
+    free(old);
+    return 1;
+}
+
+static void block_insert(memprof *mp, void *ptr, int site)
+{
+    size_t i;
+    if ((mp->used + 1) * 4 > mp->cap * 3 && !block_grow(mp))
+        return;
+    for (i = block_hash(ptr, mp->cap); mp->blocks[i].ptr != NULL && mp->blocks[i].ptr != &memprof_tombstone; i = (i + 1) & (mp->cap - 1))
+        ;
+    if (mp->blocks[i].ptr == NULL)
+        mp->used++;
+    mp->blocks[i].ptr = ptr;
+    mp->blocks[i].site = site;
+}
+
+/* xorshift64*, uniform in (0, 1] */
+static double memprof_random(memprof *mp)
+{
+    mp->rng ^= mp->rng >> 12;
+    mp->rng ^= mp->rng << 25;
+    mp->rng ^= mp->rng >> 27;
+    return ((mp->rng * 0x2545F4914F6CDD1DULL) >> 11) * (1.0 / 9007199254740992.0) + (1.0 / 9007199254740992.0);
+}
+
+static double memprof_interval(memprof *mp)
+{
+    if (mp->rate <= 1)
+        return 0;
+    return -log(memprof_random(mp)) * mp->rate;
+}
+
+/* Returns the coroutine resumed by the function running in L, if any */
+static lua_State *resumed_thread(memprof *mp, lua_State *L)
+{
+    TValue *f = s2v(L->ci->func);
+    lua_State *co = NULL;
+    if (mp->resume != NULL && ttislcf(f) && fvalue(f) == mp->resume) {
+        if (L->ci->func + 1 < L->top && ttisthread(s2v(L->ci->func + 1)))
+            co = thvalue(s2v(L->ci->func + 1));
+    } else if (mp->auxwrap != NULL && ttisCclosure(f) && clCvalue(f)->f == mp->auxwrap) {
+        if (clCvalue(f)->nupvalues > 0 && ttisthread(&clCvalue(f)->upvalue[0]))
+            co = thvalue(&clCvalue(f)->upvalue[0]);
+    }
+    /* only a coroutine actually running has frames and status LUA_OK */
+    if (co == NULL || co == L || co->status != LUA_OK || co->ci == &co->base_ci)
+        return NULL;
+    return co;
+}
+
+static lua_State *running_thread(memprof *mp)
+{
+    lua_State *L = mp->L, *co;
+    while (L->ci != &L->base_ci && (co = resumed_thread(mp, L)) != NULL)
+        L = co;
+    return L;
+}
+
+static void *memprof_alloc(void *ud, void *ptr, size_t osize, size_t nsize)
+{
+    memprof *mp = (memprof *)ud;
+    memprof_block *b = ptr != NULL ? block_find(mp, ptr) : NULL;
+    int site = -1;
+    void *r;
+
+    if (nsize == 0) {
+        if (b != NULL) {
+            golua_memprof_free(mp->gostateindex, b->site, osize);
+            b->ptr = &memprof_tombstone;
+        }
+        return mp->f(mp->ud, ptr, osize, 0);
+    }
+
+    if (b == NULL && !mp->busy) {
+        size_t grown = ptr == NULL ? nsize : (nsize > osize ? nsize - osize : 0);
+        mp->next -= (double)grown;
+        if (grown > 0 && mp->next < 0) {
+            mp->next = memprof_interval(mp);
+            mp->busy = 1;
+            site = golua_memprof_record(mp->gostateindex, running_thread(mp), nsize);
+            mp->busy = 0;
+        }
+    }
+
+    r = mp->f(mp->ud, ptr, osize, nsize);
+    if (r == NULL) {
+        if (site >= 0)
+            golua_memprof_free(mp->gostateindex, site, nsize);
+        return NULL;
+    }
+    if (b != NULL) {
+        golua_memprof_resize(mp->gostateindex, b->site, osize, nsize);
+        if (r != ptr) {
+            site = b->site;
+            b->ptr = &memprof_tombstone;
+            block_insert(mp, r, site);
+        }
+    } else if (site >= 0) {
+        block_insert(mp, r, site);
+    }
+    return r;
+}
+
+void *clua_memprof_start(lua_State *L, size_t gostateindex, size_t rate)
+{
+    memprof *mp = (memprof *)calloc(1, sizeof(memprof));
+    int top;
+    if (mp == NULL)
+        return NULL;
+    mp->f = lua_getallocf(L, &mp->ud);
+    mp->L = G(L)->mainthread;
+    mp->gostateindex = gostateindex;
+    mp->rate = (double)rate;
+    mp->rng = (uint64_t)(uintptr_t)mp ^ 0x9E3779B97F4A7C15ULL;
+    mp->next = memprof_interval(mp);
+
+    /* coroutine functions, to find the running coroutine */
+    top = lua_gettop(L);
+    if (lua_getfield(L, LUA_REGISTRYINDEX, LUA_LOADED_TABLE) == LUA_TTABLE
+            && lua_getfield(L, -1, LUA_COLIBNAME) == LUA_TTABLE) {
+        if (lua_getfield(L, -1, "resume") == LUA_TFUNCTION)
+            mp->resume = lua_tocfunction(L, -1);
+        lua_pop(L, 1);
+        /* coroutine.wrap(coroutine.resume) returns a closure of auxwrap */
+        if (lua_getfield(L, -1, "wrap") == LUA_TFUNCTION && lua_getfield(L, -2, "resume") == LUA_TFUNCTION
+                && lua_pcall(L, 1, 1, 0) == LUA_OK)
+            mp->auxwrap = lua_tocfunction(L, -1);
+    }
+    lua_settop(L, top);
+
+    lua_setallocf(L, memprof_alloc, mp);
+    return mp;
+}
+
+void clua_memprof_stop(lua_State *L, void *p)
+{
+    memprof *mp = (memprof *)p;
+    lua_setallocf(L, mp->f, mp->ud);
+    free(mp->blocks);
+    free(mp);
+}
+
+/* Reports whether the allocator of the profiler is installed */
+int clua_memprof_active(lua_State *L)
+{
+    return lua_getallocf(L, NULL) == memprof_alloc;
+}
@@ -0,0 +1,638 @@
+#include <stdlib.h>
+#include <stdint.h>
+#include <string.h>
+
+#include "lua.h"
+#include "lauxlib.h"
+#include "clua.h"
+
+#define LUASERIALIZE_NAME     "serialize"
+#define LUASERIALIZE_VERSION  "lua-serialize 1.0.0"
+
+/* Max nesting of tables/functions/userdata payloads while packing. */
+#ifndef LUASERIALIZE_MAX_NESTING
+    #define LUASERIALIZE_MAX_NESTING  128
+#endif
+
+#define MT_SERIALIZE_BUFFER "Lua.SerializeBuffer"
+
+/* =============================================================================
+ * Binary serializer for arbitrary Lua values.
+ *
+ * serialize.pack(...)      -> string
+ * serialize.unpack(string) -> ...
+ *
+ * Every table, Lua function and userdata gets a reference number the first
+ * time it is written, later occurrences are written as TAG_REF so cycles and
+ * shared references survive a round trip. Lua functions are written as
+ * lua_dump bytecode followed by their upvalues; upvalues shared between
+ * closures are joined again with lua_upvaluejoin. Userdata are written as the
+ * value returned by the __serialize metamethod together with the metatable
+ * __name, unpack calls __deserialize from the metatable registered under that
+ * name (luaL_newmetatable) to rebuild them. Metatables of tables are
+ * written along with the table.
+ *
+ * luaserialize_packx/luaserialize_unpackx take an extra table of permanent
+ * values as first argument: values found in it are written by name and looked
+ * up by name when unpacking, which is how State.Snapshot refers to library
+ * functions instead of trying to persist them.
+ *
+ * Unpacking loads binary chunks, which can corrupt memory when they are
+ * malformed: the bytecode of every function payload is first checked with
+ * luaserialize_verify, and function payloads are refused when it is not set.
+ * The Go host sets it to bytecode.Verify.
+ * ========================================================================== */
+
+luaserialize_verifier luaserialize_verify = NULL;
+
+enum {
+    TAG_NIL = 0,
+    TAG_FALSE,
+    TAG_TRUE,
+    TAG_INT,
+    TAG_FLOAT,
+    TAG_STRING,
+    TAG_TABLE,
+    TAG_FUNCTION,
+    TAG_USERDATA,
+    TAG_REF,
+    TAG_GLOBALS,
+    TAG_UPVALREF,
+    TAG_END,
+    TAG_TABLE_MT,
+    TAG_PERM
+};
+
+/* ------------------------------ Write buffer ------------------------------ */
+
+typedef struct {
+    char *b;
+    size_t n;
+    size_t cap;
+} sbuf;
+
+static int sbuf_gc(lua_State *L) {
+    sbuf *buf = (sbuf *)luaL_checkudata(L, 1, MT_SERIALIZE_BUFFER);
+    free(buf->b);
+    buf->b = NULL;
+    buf->n = buf->cap = 0;
+    return 0;
+}
+
+static sbuf *sbuf_new(lua_State *L) {
+    sbuf *buf = (sbuf *)lua_newuserdatauv(L, sizeof(sbuf), 0);
+    buf->b = NULL;
+    buf->n = buf->cap = 0;
+    if (luaL_newmetatable(L, MT_SERIALIZE_BUFFER)) {
+        lua_pushcfunction(L, sbuf_gc);
+        lua_setfield(L, -2, "__gc");
+    }
+    lua_setmetatable(L, -2);
+    return buf;
+}
+
+static void sbuf_add(lua_State *L, sbuf *buf, const void *p, size_t len) {
+    if (buf->n + len > buf->cap) {
+        size_t cap = buf->cap ? buf->cap * 2 : 256;
+        char *nb;
+        while (cap < buf->n + len) cap *= 2;
+        nb = (char *)realloc(buf->b, cap);
+        if (nb == NULL) luaL_error(L, "serialize.pack: out of memory");
+        buf->b = nb;
+        buf->cap = cap;
+    }
+    memcpy(buf->b + buf->n, p, len);
+    buf->n += len;
+}
+
+static void sbuf_addbyte(lua_State *L, sbuf *buf, unsigned char c) {
+    sbuf_add(L, buf, &c, 1);
+}
+
+static void sbuf_addvarint(lua_State *L, sbuf *buf, uint64_t v) {
+    unsigned char tmp[10];
+    int n = 0;
+    while (v >= 0x80) {
+        tmp[n++] = (unsigned char)(v | 0x80);
+        v >>= 7;
+    }
+    tmp[n++] = (unsigned char)v;
+    sbuf_add(L, buf, tmp, n);
+}
+
+static void sbuf_addstring(lua_State *L, sbuf *buf, const char *s, size_t len) {
+    sbuf_addvarint(L, buf, len);
+    sbuf_add(L, buf, s, len);
+}
+
+/* ---------------------------------- Pack ---------------------------------- */
+
+typedef struct {
+    lua_State *L;
+    sbuf *buf;
+    int seen;     /* stack index of object -> reference number table */
+    int upvals;   /* stack index of upvalue id -> {ref, n} table */
+    int globals;  /* stack index of the globals table */
+    int perms;    /* stack index of the value -> name table, 0 if none */
+    lua_Integer nextref;
+} packer;
+
+static void pack_value(packer *p, int idx, int depth);
+
+static int pack_writer(lua_State *L, const void *b, size_t size, void *ud) {
+    sbuf_add(L, (sbuf *)ud, b, size);
+    return 0;
+}
+
+/* Writes TAG_REF if the object at idx was already written, otherwise records
+ * a new reference number for it and returns 0. */
+static int pack_ref(packer *p, int idx) {
+    lua_State *L = p->L;
+    lua_pushvalue(L, idx);
+    if (lua_rawget(L, p->seen) == LUA_TNUMBER) {
+        lua_Integer ref = lua_tointeger(L, -1);
+        lua_pop(L, 1);
+        sbuf_addbyte(L, p->buf, TAG_REF);
+        sbuf_addvarint(L, p->buf, (uint64_t)ref);
+        return 1;
+    }
+    lua_pop(L, 1);
+    lua_pushvalue(L, idx);
+    lua_pushinteger(L, p->nextref++);
+    lua_rawset(L, p->seen);
+    return 0;
+}
+
+static void pack_table(packer *p, int idx, int depth) {
+    lua_State *L = p->L;
+    int hasmt;
+    if (pack_ref(p, idx)) return;
+    hasmt = lua_getmetatable(L, idx);
+    sbuf_addbyte(L, p->buf, hasmt ? TAG_TABLE_MT : TAG_TABLE);
+    lua_pushnil(L);
+    while (lua_next(L, idx) != 0) {
+        int top = lua_gettop(L);
+        pack_value(p, top - 1, depth);
+        pack_value(p, top, depth);
+        lua_pop(L, 1);
+    }
+    sbuf_addbyte(L, p->buf, TAG_END);
+    if (hasmt) {
+        pack_value(p, lua_gettop(L), depth);
+        lua_pop(L, 1);
+    }
+}
+
+static void pack_function(packer *p, int idx, int depth) {
+    lua_State *L = p->L;
+    lua_Integer ref;
+    int n, nups = 0;
+    if (lua_iscfunction(L, idx))
+        luaL_error(L, "serialize.pack: cannot serialize a C function");
+    if (pack_ref(p, idx)) return;
+    ref = p->nextref - 1;
+    sbuf_addbyte(L, p->buf, TAG_FUNCTION);
+
+    /* bytecode goes through a scratch buffer to get its length prefix */
+    {
+        sbuf *code = sbuf_new(L);
+        int status;
+        lua_pushvalue(L, idx);
+        status = lua_dump(L, pack_writer, code, 0);
+        lua_pop(L, 1);
+        if (status != 0)
+            luaL_error(L, "serialize.pack: unable to dump function");
+        sbuf_addstring(L, p->buf, code->b, code->n);
+        lua_pop(L, 1);
+    }
+
+    while (lua_getupvalue(L, idx, nups + 1) != NULL) {
+        lua_pop(L, 1);
+        nups++;
+    }
+    sbuf_addvarint(L, p->buf, (uint64_t)nups);
+    for (n = 1; n <= nups; n++) {
+        void *id = lua_upvalueid(L, idx, n);
+        lua_pushlightuserdata(L, id);
+        if (lua_rawget(L, p->upvals) == LUA_TTABLE) {
+            /* upvalue shared with a closure already written */
+            lua_rawgeti(L, -1, 1);
+            lua_rawgeti(L, -2, 2);
+            sbuf_addbyte(L, p->buf, TAG_UPVALREF);
+            sbuf_addvarint(L, p->buf, (uint64_t)lua_tointeger(L, -2));
+            sbuf_addvarint(L, p->buf, (uint64_t)lua_tointeger(L, -1));
+            lua_pop(L, 3);
+            continue;
+        }
+        lua_pop(L, 1);
+        lua_pushlightuserdata(L, id);
+        lua_createtable(L, 2, 0);
+        lua_pushinteger(L, ref);
+        lua_rawseti(L, -2, 1);
+        lua_pushinteger(L, n);
+        lua_rawseti(L, -2, 2);
+        lua_rawset(L, p->upvals);
+
+        lua_getupvalue(L, idx, n);
+        pack_value(p, lua_gettop(L), depth);
+        lua_pop(L, 1);
+    }
+}
+
+static void pack_userdata(packer *p, int idx, int depth) {
+    lua_State *L = p->L;
+    lua_pushvalue(L, idx);
+    switch (lua_rawget(L, p->seen)) {
+    case LUA_TNUMBER:
+        sbuf_addbyte(L, p->buf, TAG_REF);
+        sbuf_addvarint(L, p->buf, (uint64_t)lua_tointeger(L, -1));
+        lua_pop(L, 1);
+        return;
+    case LUA_TBOOLEAN:
+        luaL_error(L, "serialize.pack: userdata refers to itself in __serialize");
+        return;
+    }
+    lua_pop(L, 1);
+
+    if (luaL_getmetafield(L, idx, "__serialize") == LUA_TNIL) {
+        if (luaL_getmetafield(L, idx, "__name") == LUA_TSTRING)
+            luaL_error(L, "serialize.pack: cannot serialize userdata of type %s (no __serialize metamethod)",
+                lua_tostring(L, -1));
+        luaL_error(L, "serialize.pack: cannot serialize userdata without __serialize metamethod");
+    }
+    if (luaL_getmetafield(L, idx, "__name") != LUA_TSTRING)
+        luaL_error(L, "serialize.pack: userdata metatable has no __name");
+
+    /* mark as in progress, the reference number is assigned after the
+     * payload so that unpack can number it in the same order */
+    lua_pushvalue(L, idx);
+    lua_pushboolean(L, 0);
+    lua_rawset(L, p->seen);
+
+    sbuf_addbyte(L, p->buf, TAG_USERDATA);
+    {
+        size_t len;
+        const char *name = lua_tolstring(L, -1, &len);
+        sbuf_addstring(L, p->buf, name, len);
+    }
+    lua_pop(L, 1);
+
+    lua_pushvalue(L, idx);
+    lua_call(L, 1, 1);
+    pack_value(p, lua_gettop(L), depth);
+    lua_pop(L, 1);
+
+    lua_pushvalue(L, idx);
+    lua_pushinteger(L, p->nextref++);
+    lua_rawset(L, p->seen);
+}
+
+static void pack_value(packer *p, int idx, int depth) {
+    lua_State *L = p->L;
+    if (depth > LUASERIALIZE_MAX_NESTING)
+        luaL_error(L, "serialize.pack: nesting too deep");
+    luaL_checkstack(L, 8, "serialize.pack: nesting too deep");
+
+    if (p->perms != 0 && lua_type(L, idx) >= LUA_TTABLE) {
+        lua_pushvalue(L, idx);
+        if (lua_rawget(L, p->perms) == LUA_TSTRING) {
+            size_t len;
+            const char *name = lua_tolstring(L, -1, &len);
+            sbuf_addbyte(L, p->buf, TAG_PERM);
+            sbuf_addstring(L, p->buf, name, len);
+            lua_pop(L, 1);
+            return;
+        }
+        lua_pop(L, 1);
+    }
+
+    switch (lua_type(L, idx)) {
+    case LUA_TNIL:
+        sbuf_addbyte(L, p->buf, TAG_NIL);
+        break;
+    case LUA_TBOOLEAN:
+        sbuf_addbyte(L, p->buf, lua_toboolean(L, idx) ? TAG_TRUE : TAG_FALSE);
+        break;
+    case LUA_TNUMBER:
+        if (lua_isinteger(L, idx)) {
+            lua_Integer i = lua_tointeger(L, idx);
+            /* zigzag so small negative numbers stay short */
+            uint64_t z = ((uint64_t)i << 1) ^ (uint64_t)(i >> 63);
+            sbuf_addbyte(L, p->buf, TAG_INT);
+            sbuf_addvarint(L, p->buf, z);
+        } else {
+            double d = (double)lua_tonumber(L, idx);
+            sbuf_addbyte(L, p->buf, TAG_FLOAT);
+            sbuf_add(L, p->buf, &d, sizeof(d));
+        }
+        break;
+    case LUA_TSTRING: {
+        size_t len;
+        const char *s = lua_tolstring(L, idx, &len);
+        sbuf_addbyte(L, p->buf, TAG_STRING);
+        sbuf_addstring(L, p->buf, s, len);
+        break;
+    }
+    case LUA_TTABLE:
+        if (lua_rawequal(L, idx, p->globals)) {
+            sbuf_addbyte(L, p->buf, TAG_GLOBALS);
+            break;
+        }
+        pack_table(p, idx, depth + 1);
+        break;
+    case LUA_TFUNCTION:
+        pack_function(p, idx, depth + 1);
+        break;
+    case LUA_TUSERDATA:
+        pack_userdata(p, idx, depth + 1);
+        break;
+    default:
+        luaL_error(L, "serialize.pack: cannot serialize a %s", luaL_typename(L, idx));
+    }
+}
+
+static int pack_values(lua_State *L, int perms, int first) {
+    packer p;
+    int i, n = lua_gettop(L);
+
+    p.L = L;
+    p.perms = perms;
+    p.buf = sbuf_new(L);
+    lua_newtable(L);
+    p.seen = lua_gettop(L);
+    lua_newtable(L);
+    p.upvals = lua_gettop(L);
+    lua_rawgeti(L, LUA_REGISTRYINDEX, LUA_RIDX_GLOBALS);
+    p.globals = lua_gettop(L);
+    p.nextref = 1;
+
+    for (i = first; i <= n; i++)
+        pack_value(&p, i, 0);
+
+    lua_pushlstring(L, p.buf->b ? p.buf->b : "", p.buf->n);
+    return 1;
+}
+
+static int serialize_pack(lua_State *L) {
+    return pack_values(L, 0, 1);
+}
+
+int luaserialize_packx(lua_State *L) {
+    luaL_checktype(L, 1, LUA_TTABLE);
+    return pack_values(L, 1, 2);
+}
+
+/* --------------------------------- Unpack --------------------------------- */
+
+typedef struct {
+    lua_State *L;
+    const char *s;
+    size_t len;
+    size_t pos;
+    int refs;     /* stack index of reference number -> object table */
+    int perms;    /* stack index of the name -> value table, 0 if none */
+    lua_Integer nextref;
+} unpacker;
+
+static void unpack_value(unpacker *u, int depth);
+
+static void unpack_need(unpacker *u, size_t n) {
+    if (u->len - u->pos < n)
+        luaL_error(u->L, "serialize.unpack: truncated data");
+}
+
+static int unpack_byte(unpacker *u) {
+    unpack_need(u, 1);
+    return (unsigned char)u->s[u->pos++];
+}
+
+static uint64_t unpack_varint(unpacker *u) {
+    uint64_t v = 0;
+    int shift;
+    for (shift = 0; shift < 64; shift += 7) {
+        int c = unpack_byte(u);
+        v |= (uint64_t)(c & 0x7f) << shift;
+        if ((c & 0x80) == 0) return v;
+    }
+    luaL_error(u->L, "serialize.unpack: malformed varint");
+    return 0;
+}
+
+static const char *unpack_string(unpacker *u, size_t *len) {
+    uint64_t n = unpack_varint(u);
+    const char *s;
+    unpack_need(u, (size_t)n);
+    s = u->s + u->pos;
+    u->pos += (size_t)n;
+    *len = (size_t)n;
+    return s;
+}
+
+static lua_Integer unpack_newref(unpacker *u) {
+    lua_State *L = u->L;
+    lua_pushvalue(L, -1);
+    lua_rawseti(L, u->refs, u->nextref);
+    return u->nextref++;
+}
+
+static void unpack_table(unpacker *u, int hasmt, int depth) {
+    lua_State *L = u->L;
+    int t;
+    lua_newtable(L);
+    t = lua_gettop(L);
+    unpack_newref(u);
+    for (;;) {
+        unpack_need(u, 1);
+        if ((unsigned char)u->s[u->pos] == TAG_END) {
+            u->pos++;
+            break;
+        }
+        unpack_value(u, depth);
+        if (lua_isnil(L, -1))
+            luaL_error(L, "serialize.unpack: table key is nil");
+        unpack_value(u, depth);
+        lua_rawset(L, t);
+    }
+    if (hasmt) {
+        unpack_value(u, depth);
+        if (!lua_istable(L, -1))
+            luaL_error(L, "serialize.unpack: metatable is not a table");
+        lua_setmetatable(L, t);
+    }
+}
+
+static void unpack_function(unpacker *u, int depth) {
+    lua_State *L = u->L;
+    size_t len;
+    const char *code = unpack_string(u, &len);
+    int f, n, nups;
+
+    if (luaserialize_verify == NULL)
+        luaL_error(L, "serialize.unpack: cannot load functions without bytecode verifier");
+    if (luaserialize_verify(L, code, len) != 0)
+        lua_error(L);
+    if (luaL_loadbufferx(L, code, len, "=serialize", "b") != LUA_OK)
+        lua_error(L);
+    f = lua_gettop(L);
+    unpack_newref(u);
+
+    nups = (int)unpack_varint(u);
+    for (n = 1; n <= nups; n++) {
+        unpack_need(u, 1);
+        if ((unsigned char)u->s[u->pos] == TAG_UPVALREF) {
+            lua_Integer other;
+            int on;
+            u->pos++;
+            other = (lua_Integer)unpack_varint(u);
+            on = (int)unpack_varint(u);
+            if (lua_rawgeti(L, u->refs, other) != LUA_TFUNCTION || lua_iscfunction(L, -1))
+                luaL_error(L, "serialize.unpack: bad upvalue reference");
+            if (lua_getupvalue(L, -1, on) == NULL || lua_getupvalue(L, f, n) == NULL)
+                luaL_error(L, "serialize.unpack: bad upvalue reference");
+            lua_pop(L, 2);
+            lua_upvaluejoin(L, f, n, lua_gettop(L), on);
+            lua_pop(L, 1);
+            continue;
+        }
+        unpack_value(u, depth);
+        if (lua_setupvalue(L, f, n) == NULL) {
+            lua_pop(L, 1);
+            luaL_error(L, "serialize.unpack: too many upvalues");
+        }
+    }
+}
+
+static void unpack_userdata(unpacker *u, int depth) {
+    lua_State *L = u->L;
+    size_t len;
+    const char *name = unpack_string(u, &len);
+
+    lua_pushlstring(L, name, len);
+    lua_pushvalue(L, -1);
+    if (lua_rawget(L, LUA_REGISTRYINDEX) != LUA_TTABLE)
+        luaL_error(L, "serialize.unpack: unknown userdata type '%s'", lua_tostring(L, -2));
+    if (lua_getfield(L, -1, "__deserialize") == LUA_TNIL)
+        luaL_error(L, "serialize.unpack: userdata type has no __deserialize metamethod");
+    lua_replace(L, -3);
+    lua_pop(L, 1);
+
+    unpack_value(u, depth);
+    lua_call(L, 1, 1);
+    unpack_newref(u);
+}
+
+static void unpack_value(unpacker *u, int depth) {
+    lua_State *L = u->L;
+    int tag;
+    if (depth > LUASERIALIZE_MAX_NESTING)
+        luaL_error(L, "serialize.unpack: nesting too deep");
+    luaL_checkstack(L, 8, "serialize.unpack: nesting too deep");
+
+    tag = unpack_byte(u);
+    switch (tag) {
+    case TAG_NIL:
+        lua_pushnil(L);
+        break;
+    case TAG_FALSE:
+        lua_pushboolean(L, 0);
+        break;
+    case TAG_TRUE:
+        lua_pushboolean(L, 1);
+        break;
+    case TAG_INT: {
+        uint64_t z = unpack_varint(u);
+        lua_pushinteger(L, (lua_Integer)((z >> 1) ^ (~(z & 1) + 1)));
+        break;
+    }
+    case TAG_FLOAT: {
+        double d;
+        unpack_need(u, sizeof(d));
+        memcpy(&d, u->s + u->pos, sizeof(d));
+        u->pos += sizeof(d);
+        lua_pushnumber(L, (lua_Number)d);
+        break;
+    }
+    case TAG_STRING: {
+        size_t len;
+        const char *s = unpack_string(u, &len);
+        lua_pushlstring(L, s, len);
+        break;
+    }
+    case TAG_TABLE:
+    case TAG_TABLE_MT:
+        unpack_table(u, tag == TAG_TABLE_MT, depth + 1);
+        break;
+    case TAG_FUNCTION:
+        unpack_function(u, depth + 1);
+        break;
+    case TAG_USERDATA:
+        unpack_userdata(u, depth + 1);
+        break;
+    case TAG_REF: {
+        lua_Integer ref = (lua_Integer)unpack_varint(u);
+        if (ref <= 0 || ref >= u->nextref)
+            luaL_error(L, "serialize.unpack: bad reference %I", (LUAI_UACINT)ref);
+        lua_rawgeti(L, u->refs, ref);
+        break;
+    }
+    case TAG_GLOBALS:
+        lua_rawgeti(L, LUA_REGISTRYINDEX, LUA_RIDX_GLOBALS);
+        break;
+    case TAG_PERM: {
+        size_t len;
+        const char *name = unpack_string(u, &len);
+        if (u->perms == 0)
+            luaL_error(L, "serialize.unpack: data needs permanent values, use unpackx");
+        lua_pushlstring(L, name, len);
+        if (lua_rawget(L, u->perms) == LUA_TNIL)
+            luaL_error(L, "serialize.unpack: missing permanent value '%s'", lua_pushlstring(L, name, len));
+        break;
+    }
+    default:
+        luaL_error(L, "serialize.unpack: unknown tag %d", tag);
+    }
+}
+
+static int unpack_values(lua_State *L, int perms, int arg) {
+    unpacker u;
+    int base;
+
+    u.L = L;
+    u.s = luaL_checklstring(L, arg, &u.len);
+    u.pos = 0;
+    u.perms = perms;
+    u.nextref = 1;
+    lua_settop(L, arg);
+    lua_newtable(L);
+    u.refs = lua_gettop(L);
+    base = u.refs;
+
+    while (u.pos < u.len)
+        unpack_value(&u, 0);
+
+    return lua_gettop(L) - base;
+}
+
+static int serialize_unpack(lua_State *L) {
+    return unpack_values(L, 0, 1);
+}
+
+int luaserialize_unpackx(lua_State *L) {
+    luaL_checktype(L, 1, LUA_TTABLE);
+    return unpack_values(L, 1, 2);
+}
+
+static const struct luaL_Reg serialize_funcs[] = {
+    {"pack", serialize_pack},
+    {"unpack", serialize_unpack},
+    {NULL, NULL}
+};
+
+LUALIB_API int luaopen_serialize(lua_State *L) {
+    luaL_newlib(L, serialize_funcs);
+    lua_pushliteral(L, LUASERIALIZE_NAME);
+    lua_setfield(L, -2, "_NAME");
+    lua_pushliteral(L, LUASERIALIZE_VERSION);
+    lua_setfield(L, -2, "_VERSION");
+    return 1;
+}
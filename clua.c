@@ -8,6 +8,8 @@
 
 #define MT_GOFUNCTION "Lua.GoFunction"
 #define MT_GOINTERFACE "Lua.GoInterface"
+#define MT_GOMAP "Lua.GoMap"
+#define MT_GOSLICE "Lua.GoSlice"
 
 #define GOLUA_DEFAULT_MSGHANDLER "lua_default_msghandler"
 
@@ -48,6 +50,16 @@ int clua_isgostruct(lua_State *L, int n)
 	return testudata(L, n, MT_GOINTERFACE) != NULL;
 }
 
+int clua_isgomap(lua_State *L, int n)
+{
+	return testudata(L, n, MT_GOMAP) != NULL;
+}
+
+int clua_isgoslice(lua_State *L, int n)
+{
+	return testudata(L, n, MT_GOSLICE) != NULL;
+}
+
 unsigned int* clua_checkgosomething(lua_State* L, int index, const char *desired_metatable)
 {
 	if (desired_metatable != NULL)
@@ -58,7 +70,11 @@ unsigned int* clua_checkgosomething(lua_State* L, int index, const char *desired
 	{
 		unsigned int *sid = testudata(L, index, MT_GOFUNCTION);
 		if (sid != NULL) return sid;
-		return testudata(L, index, MT_GOINTERFACE);
+		sid = testudata(L, index, MT_GOINTERFACE);
+		if (sid != NULL) return sid;
+		sid = testudata(L, index, MT_GOMAP);
+		if (sid != NULL) return sid;
+		return testudata(L, index, MT_GOSLICE);
 	}
 }
 
@@ -82,7 +98,11 @@ int callback_function(lua_State* L)
 	size_t gostateindex = clua_getgostate(L);
 	//remove the go function from the stack (to present same behavior as lua_CFunctions)
 	lua_remove(L,1);
-	return golua_callgofunction(gostateindex, fid!=NULL ? *fid : -1);
+	r = golua_callgofunction(gostateindex, fid!=NULL ? *fid : -1);
+	//a negative result raises the error message pushed by the go function
+	if (r < 0)
+		return lua_error(L);
+	return r;
 }
 
 //wrapper for gchook
@@ -108,6 +128,18 @@ unsigned int clua_togostruct(lua_State *L, int index)
 	return (r != NULL) ? *r : -1;
 }
 
+unsigned int clua_togomap(lua_State *L, int index)
+{
+	unsigned int *r = clua_checkgosomething(L, index, MT_GOMAP);
+	return (r != NULL) ? *r : -1;
+}
+
+unsigned int clua_togoslice(lua_State *L, int index)
+{
+	unsigned int *r = clua_checkgosomething(L, index, MT_GOSLICE);
+	return (r != NULL) ? *r : -1;
+}
+
 void clua_pushgofunction(lua_State* L, unsigned int fid)
 {
 	unsigned int* fidptr = (unsigned int *)lua_newuserdatauv(L, sizeof(unsigned int),0);
@@ -120,7 +152,10 @@ static int callback_c (lua_State* L)
 {
 	int fid = clua_togofunction(L,lua_upvalueindex(1));
 	size_t gostateindex = clua_getgostate(L);
-	return golua_callgofunction(gostateindex,fid);
+	int r = golua_callgofunction(gostateindex,fid);
+	if (r < 0)
+		return lua_error(L);
+	return r;
 }
 
 void clua_pushcallback(lua_State* L)
@@ -136,6 +171,22 @@ void clua_pushgostruct(lua_State* L, unsigned int iid)
 	lua_setmetatable(L,-2);
 }
 
+void clua_pushgomap(lua_State* L, unsigned int iid)
+{
+	unsigned int* iidptr = (unsigned int *)lua_newuserdatauv(L, sizeof(unsigned int),0);
+	*iidptr = iid;
+	luaL_getmetatable(L, MT_GOMAP);
+	lua_setmetatable(L,-2);
+}
+
+void clua_pushgoslice(lua_State* L, unsigned int iid)
+{
+	unsigned int* iidptr = (unsigned int *)lua_newuserdatauv(L, sizeof(unsigned int),0);
+	*iidptr = iid;
+	luaL_getmetatable(L, MT_GOSLICE);
+	lua_setmetatable(L,-2);
+}
+
 int default_panicf(lua_State *L)
 {
 	const char *s = lua_tostring(L, -1);
@@ -152,25 +203,33 @@ void clua_setgostate(lua_State* L, size_t gostateindex)
 	lua_settable(L, LUA_REGISTRYINDEX);
 }
 
-static int writer (lua_State *L, const void* b, size_t size, void* B) {
-	static int count=0;
-	(void)L;
-	luaL_addlstring((luaL_Buffer*) B, (const char *)b, size);
+typedef struct dump_writer {
+	int init;
+	luaL_Buffer B;
+} dump_writer;
+
+/* the buffer is initialized by the first write: lua_dump needs the function on top of the stack */
+static int writer (lua_State *L, const void* b, size_t size, void* ud) {
+	dump_writer *w = (dump_writer *)ud;
+	if (!w->init) {
+		w->init = 1;
+		luaL_buffinit(L, &w->B);
+	}
+	luaL_addlstring(&w->B, (const char *)b, size);
 	return 0;
 }
 
 // dump function chunk from luaL_loadstring
-int dump_chunk (lua_State *L) {
-	luaL_Buffer b;
+int dump_chunk (lua_State *L, int strip) {
+	dump_writer w;
 	luaL_checktype(L, -1, LUA_TFUNCTION);
-	lua_settop(L, -1);
-	luaL_buffinit(L,&b);
+	w.init = 0;
 	int _errno;
-	_errno = lua_dump(L, writer, &b, 0);
-	if (_errno != 0){
+	_errno = lua_dump(L, writer, &w, strip);
+	if (_errno != 0 || !w.init){
 	return luaL_error(L, "unable to dump given function, errno:%d", _errno);
 	}
-	luaL_pushresult(&b);
+	luaL_pushresult(&w.B);
 	return 0;
 }
 
@@ -215,7 +274,8 @@ int interface_index_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
+	size_t field_len;
+	char *field_name = (char *)lua_tolstring(L, 2, &field_len);
 	if (field_name == NULL)
 	{
 		lua_pushnil(L);
@@ -224,7 +284,7 @@ int interface_index_callback(lua_State *L)
 
 	size_t gostateindex = clua_getgostate(L);
 
-	int r = golua_interface_index_callback(gostateindex, *iid, field_name);
+	int r = golua_interface_index_callback(gostateindex, *iid, field_name, field_len);
 
 	if (r < 0)
 	{
@@ -247,7 +307,8 @@ int interface_newindex_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
+	size_t field_len;
+	char *field_name = (char *)lua_tolstring(L, 2, &field_len);
 	if (field_name == NULL)
 	{
 		lua_pushnil(L);
@@ -256,7 +317,32 @@ int interface_newindex_callback(lua_State *L)
 
 	size_t gostateindex = clua_getgostate(L);
 
-	int r = golua_interface_newindex_callback(gostateindex, *iid, field_name);
+	int r = golua_interface_newindex_callback(gostateindex, *iid, field_name, field_len);
+
+	if (r < 0)
+	{
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+/* called by serialize.pack (and Snapshot) to persist a published go object */
+int interface_serialize_callback(lua_State *L)
+{
+	unsigned int *iid = clua_checkgosomething(L, 1, MT_GOINTERFACE);
+	if (iid == NULL)
+	{
+		lua_pushnil(L);
+		return 1;
+	}
+
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = golua_interface_serialize_callback(gostateindex, *iid);
 
 	if (r < 0)
 	{
@@ -269,11 +355,148 @@ int interface_newindex_callback(lua_State *L)
 	}
 }
 
+/* called by serialize.unpack (and Restore) to rebuild a published go object */
+int interface_deserialize_callback(lua_State *L)
+{
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = golua_interface_deserialize_callback(gostateindex);
+
+	if (r < 0)
+	{
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+/* calls the go callback of a metamethod of a published go map or slice, with the object at index 1 and the
+ * metatable mt, raising the error it leaves on the stack */
+static int proxy_callback(lua_State *L, const char *mt, GoInt (*callback)(GoUintptr, GoUint))
+{
+	unsigned int *iid = clua_checkgosomething(L, 1, mt);
+	if (iid == NULL)
+	{
+		lua_pushnil(L);
+		return 1;
+	}
+
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = callback(gostateindex, *iid);
+
+	if (r < 0)
+	{
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+/* called when lua code reads m[k] of a published go map */
+int map_index_callback(lua_State *L)
+{
+	return proxy_callback(L, MT_GOMAP, golua_map_index_callback);
+}
+
+/* called when lua code sets m[k] = v of a published go map, nil deleting the key */
+int map_newindex_callback(lua_State *L)
+{
+	return proxy_callback(L, MT_GOMAP, golua_map_newindex_callback);
+}
+
+/* called for #m */
+int map_len_callback(lua_State *L)
+{
+	return proxy_callback(L, MT_GOMAP, golua_map_len_callback);
+}
+
+/* next function of pairs(m), its upvalue is the go iterator over the keys of the map */
+static int map_next_callback(lua_State *L)
+{
+	unsigned int *iid = clua_checkgosomething(L, lua_upvalueindex(1), MT_GOINTERFACE);
+	if (iid == NULL)
+	{
+		lua_pushnil(L);
+		return 1;
+	}
+
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = golua_map_next_callback(gostateindex, *iid);
+
+	if (r < 0)
+	{
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+/* called by pairs(m), returns the next function, m and nil */
+int map_pairs_callback(lua_State *L)
+{
+	proxy_callback(L, MT_GOMAP, golua_map_pairs_callback);
+	lua_pushcclosure(L, &map_next_callback, 1);
+	lua_pushvalue(L, 1);
+	lua_pushnil(L);
+	return 3;
+}
+
+/* called when lua code reads s[i] of a published go slice; s.append and s.slice are the methods of the
+ * upvalue table */
+int slice_index_callback(lua_State *L)
+{
+	if (lua_type(L, 2) == LUA_TSTRING)
+	{
+		lua_pushvalue(L, 2);
+		lua_rawget(L, lua_upvalueindex(1));
+		return 1;
+	}
+	return proxy_callback(L, MT_GOSLICE, golua_slice_index_callback);
+}
+
+/* called when lua code sets s[i] = v of a published go slice */
+int slice_newindex_callback(lua_State *L)
+{
+	return proxy_callback(L, MT_GOSLICE, golua_slice_newindex_callback);
+}
+
+/* called for #s */
+int slice_len_callback(lua_State *L)
+{
+	return proxy_callback(L, MT_GOSLICE, golua_slice_len_callback);
+}
+
+/* s:append(v...), returns s */
+int slice_append_callback(lua_State *L)
+{
+	luaL_checkudata(L, 1, MT_GOSLICE);
+	return proxy_callback(L, MT_GOSLICE, golua_slice_append_callback);
+}
+
+/* s:slice([i [, j]]), returns a slice of the elements i to j sharing their storage */
+int slice_slice_callback(lua_State *L)
+{
+	luaL_checkudata(L, 1, MT_GOSLICE);
+	return proxy_callback(L, MT_GOSLICE, golua_slice_slice_callback);
+}
+
 int panic_msghandler(lua_State *L)
 {
 	size_t gostateindex = clua_getgostate(L);
 	go_panic_msghandler(gostateindex, (char *)lua_tolstring(L, -1, NULL));
-	return 0;
+	//keep the message, the go error is recorded for callEx
+	return 1;
 }
 
 void clua_hide_pcall(lua_State *L)
@@ -322,6 +545,74 @@ void clua_initstate(lua_State* L)
 	lua_pushcfunction(L, &interface_newindex_callback);
 	lua_settable(L, -3);
 
+	// gointerface_metatable[__serialize] = &interface_serialize_callback
+	lua_pushliteral(L, "__serialize");
+	lua_pushcfunction(L, &interface_serialize_callback);
+	lua_settable(L, -3);
+
+	// gointerface_metatable[__deserialize] = &interface_deserialize_callback
+	lua_pushliteral(L, "__deserialize");
+	lua_pushcfunction(L, &interface_deserialize_callback);
+	lua_settable(L, -3);
+
+	lua_pop(L, 1);
+
+	luaL_newmetatable(L, MT_GOMAP);
+
+	// gomap_metatable[__gc] = &gchook_wrapper
+	lua_pushliteral(L, "__gc");
+	lua_pushcfunction(L, &gchook_wrapper);
+	lua_settable(L, -3);
+
+	// gomap_metatable[__index] = &map_index_callback
+	lua_pushliteral(L, "__index");
+	lua_pushcfunction(L, &map_index_callback);
+	lua_settable(L, -3);
+
+	// gomap_metatable[__newindex] = &map_newindex_callback
+	lua_pushliteral(L, "__newindex");
+	lua_pushcfunction(L, &map_newindex_callback);
+	lua_settable(L, -3);
+
+	// gomap_metatable[__len] = &map_len_callback
+	lua_pushliteral(L, "__len");
+	lua_pushcfunction(L, &map_len_callback);
+	lua_settable(L, -3);
+
+	// gomap_metatable[__pairs] = &map_pairs_callback
+	lua_pushliteral(L, "__pairs");
+	lua_pushcfunction(L, &map_pairs_callback);
+	lua_settable(L, -3);
+
+	lua_pop(L, 1);
+
+	luaL_newmetatable(L, MT_GOSLICE);
+
+	// goslice_metatable[__gc] = &gchook_wrapper
+	lua_pushliteral(L, "__gc");
+	lua_pushcfunction(L, &gchook_wrapper);
+	lua_settable(L, -3);
+
+	// goslice_metatable[__index] = &slice_index_callback, with the methods as upvalue
+	lua_pushliteral(L, "__index");
+	lua_createtable(L, 0, 2);
+	lua_pushcfunction(L, &slice_append_callback);
+	lua_setfield(L, -2, "append");
+	lua_pushcfunction(L, &slice_slice_callback);
+	lua_setfield(L, -2, "slice");
+	lua_pushcclosure(L, &slice_index_callback, 1);
+	lua_settable(L, -3);
+
+	// goslice_metatable[__newindex] = &slice_newindex_callback
+	lua_pushliteral(L, "__newindex");
+	lua_pushcfunction(L, &slice_newindex_callback);
+	lua_settable(L, -3);
+
+	// goslice_metatable[__len] = &slice_len_callback
+	lua_pushliteral(L, "__len");
+	lua_pushcfunction(L, &slice_len_callback);
+	lua_settable(L, -3);
+
 	lua_register(L, GOLUA_DEFAULT_MSGHANDLER, &panic_msghandler);
 	lua_pop(L, 1);
 }
@@ -375,6 +666,32 @@ int clua_callluacfunc(lua_State* L, lua_CFunction f)
 	return f(L);
 }
 
+static int clua_compareaux(lua_State* L)
+{
+	lua_pushboolean(L, lua_compare(L, 1, 2, (int)lua_tointeger(L, lua_upvalueindex(1))));
+	return 1;
+}
+
+/* lua_compare in a protected call: returns -1 with the error message on the stack when a
+ * metamethod raises an error */
+int clua_compare(lua_State* L, int index1, int index2, int op)
+{
+	int r;
+	if (lua_type(L, index1) == LUA_TNONE || lua_type(L, index2) == LUA_TNONE)
+		return 0;
+	index1 = lua_absindex(L, index1);
+	index2 = lua_absindex(L, index2);
+	lua_pushinteger(L, op);
+	lua_pushcclosure(L, clua_compareaux, 1);
+	lua_pushvalue(L, index1);
+	lua_pushvalue(L, index2);
+	if (lua_pcall(L, 2, 1, 0) != LUA_OK)
+		return -1;
+	r = lua_toboolean(L, -1);
+	lua_pop(L, 1);
+	return r;
+}
+
 void* allocwrapper(void* ud, void *ptr, size_t osize, size_t nsize)
 {
 	return (void*)golua_callallocf((GoUintptr)ud,(GoUintptr)ptr,osize,nsize);
@@ -446,6 +763,92 @@ void clua_register_lib(lua_State* L, lua_CFunction func, const char* name)
 	lua_pop(L, 1);
 }
 
+/* adds the value on top of the stack to the permanents table at index t */
+static void add_permanent(lua_State *L, int t, int reverse, const char *kind, const char *mod, const char *name)
+{
+	if (mod != NULL)
+		lua_pushfstring(L, "%s:%s.%s", kind, mod, name);
+	else
+		lua_pushfstring(L, "%s:%s", kind, name);
+	if (reverse)
+	{
+		// t[name] = value
+		lua_pushvalue(L, -2);
+		lua_rawset(L, t);
+		lua_pop(L, 1);
+		return;
+	}
+	// t[value] = name, keeping the first name found
+	lua_pushvalue(L, -2);
+	if (lua_rawget(L, t) != LUA_TNIL)
+	{
+		lua_pop(L, 3);
+		return;
+	}
+	lua_pop(L, 1);
+	lua_rawset(L, t);
+}
+
+static int is_permanent_global(lua_State *L, int idx)
+{
+	return lua_iscfunction(L, idx) || testudata(L, idx, MT_GOFUNCTION) != NULL;
+}
+
+static int is_permanent_field(lua_State *L, int idx)
+{
+	if (lua_iscfunction(L, idx))
+		return 1;
+	return lua_type(L, idx) == LUA_TUSERDATA && testudata(L, idx, MT_GOINTERFACE) == NULL;
+}
+
+/*
+ * Pushes the table of values Snapshot refers to by name instead of persisting
+ * them: C and Go functions stored in globals, the modules in package.loaded and
+ * the C functions and userdata they export. The table maps values to names,
+ * or names to values when reverse is set.
+ */
+void clua_pushpermanents(lua_State *L, int reverse)
+{
+	int t, g, loaded;
+	lua_newtable(L);
+	t = lua_gettop(L);
+
+	lua_rawgeti(L, LUA_REGISTRYINDEX, LUA_RIDX_GLOBALS);
+	g = lua_gettop(L);
+	lua_pushnil(L);
+	while (lua_next(L, g) != 0)
+	{
+		if (lua_type(L, -2) == LUA_TSTRING && is_permanent_global(L, -1))
+			add_permanent(L, t, reverse, "g", NULL, lua_tostring(L, -2));
+		else
+			lua_pop(L, 1);
+	}
+
+	luaL_getsubtable(L, LUA_REGISTRYINDEX, LUA_LOADED_TABLE);
+	loaded = lua_gettop(L);
+	lua_pushnil(L);
+	while (lua_next(L, loaded) != 0)
+	{
+		if (lua_type(L, -2) != LUA_TSTRING || !lua_istable(L, -1) || lua_rawequal(L, -1, g))
+		{
+			lua_pop(L, 1);
+			continue;
+		}
+		const char *mod = lua_tostring(L, -2);
+		int m = lua_gettop(L);
+		lua_pushnil(L);
+		while (lua_next(L, m) != 0)
+		{
+			if (lua_type(L, -2) == LUA_TSTRING && is_permanent_field(L, -1))
+				add_permanent(L, t, reverse, "f", mod, lua_tostring(L, -2));
+			else
+				lua_pop(L, 1);
+		}
+		add_permanent(L, t, reverse, "m", NULL, mod);
+	}
+	lua_pop(L, 2);
+}
+
 void clua_hook_function(lua_State *L, lua_Debug *ar)
 {
 	lua_checkstack(L, 2);
@@ -470,3 +873,50 @@ void clua_lua_replace(lua_State* L, int n) {
 	lua_replace(L, n);
 }
 
+
+static void warnf_wrapper(void *ud, const char *msg, int tocont)
+{
+	golua_callwarnf((size_t)ud, (char *)msg, tocont);
+}
+
+void clua_setwarnf(lua_State* L, int set)
+{
+	lua_setwarnf(L, set ? &warnf_wrapper : NULL, (void *)clua_getgostate(L));
+}
+
+void* clua_getextraspace(lua_State* L)
+{
+	return lua_getextraspace(L);
+}
+
+void clua_pushcallbackn(lua_State* L, int n)
+{
+	lua_pushcclosure(L, callback_c, n);
+}
+
+static void gohook_wrapper(lua_State *L, lua_Debug *ar)
+{
+	size_t gostateindex = clua_getgostate(L);
+	//a panic of the go hook is raised as a lua error
+	if (golua_callhook(gostateindex, L, ar) < 0)
+		lua_error(L);
+}
+
+void clua_sethook(lua_State* L, int mask, int count)
+{
+	lua_sethook(L, mask != 0 ? &gohook_wrapper : NULL, mask, count);
+}
+
+// defined in c-serialize.c, see clua.h
+typedef int (*luaserialize_verifier)(lua_State *L, const char *code, size_t len);
+extern luaserialize_verifier luaserialize_verify;
+
+static int verify_wrapper(lua_State *L, const char *code, size_t len)
+{
+	return golua_verifybytecode(L, (char *)code, len);
+}
+
+void clua_setserializeverifier(void)
+{
+	luaserialize_verify = &verify_wrapper;
+}
@@ -18,15 +18,21 @@ void clua_hide_pcall(lua_State *L);
 
 unsigned int clua_togofunction(lua_State* L, int index);
 unsigned int clua_togostruct(lua_State *L, int index);
+unsigned int clua_togomap(lua_State *L, int index);
+unsigned int clua_togoslice(lua_State *L, int index);
 void clua_pushcallback(lua_State* L);
+void clua_pushcallbackn(lua_State* L, int n);
 void clua_pushgofunction(lua_State* L, unsigned int fid);
 void clua_pushgostruct(lua_State *L, unsigned int fid);
+void clua_pushgomap(lua_State *L, unsigned int iid);
+void clua_pushgoslice(lua_State *L, unsigned int iid);
 void clua_setgostate(lua_State* L, size_t gostateindex);
-int dump_chunk (lua_State *L);
+int dump_chunk (lua_State *L, int strip);
 int load_chunk(lua_State *L, const char *b, int size, const char* chunk_name);
 size_t clua_getgostate(lua_State* L);
 GoInterface clua_atpanic(lua_State* L, unsigned int panicf_id);
 int clua_callluacfunc(lua_State* L, lua_CFunction f);
+int clua_compare(lua_State* L, int index1, int index2, int op);
 lua_State* clua_newstate(void* goallocf);
 void clua_setallocf(lua_State* L, void* goallocf);
 
@@ -38,18 +44,53 @@ void clua_openstring(lua_State* L);
 void clua_opentable(lua_State* L);
 void clua_openos(lua_State* L);
 void clua_setexecutionlimit(lua_State* L, int n);
+void clua_sethook(lua_State* L, int mask, int count);
+void* clua_memprof_start(lua_State* L, size_t gostateindex, size_t rate);
+void clua_memprof_stop(lua_State* L, void* mp);
+int clua_memprof_active(lua_State* L);
+
+// coverage of a function prototype, see c-coverage.c
+typedef struct clua_covproto {
+	const char* source;
+	int linedefined;
+	int n;                  // number of instructions
+	int* lines;             // line of each instruction, 0 if none
+	unsigned* hits;         // line events at each instruction
+	unsigned* branches;     // for each test instruction: jump skipped, jump taken
+	unsigned char* tests;   // 1 for the test instructions
+	int pending;            // test instruction run last, -1 if none
+} clua_covproto;
+
+int clua_coverage_start(lua_State* L);
+void clua_coverage_stop(lua_State* L);
+void clua_coverage_release(lua_State* L);
+int clua_coverage_count(lua_State* L);
+clua_covproto* clua_coverage_proto(lua_State* L, int i);
 void clua_lua_insert(lua_State* L, int n);
 void clua_lua_remove(lua_State* L, int n);
 void clua_lua_replace(lua_State* L, int n);
+void clua_setwarnf(lua_State* L, int set);
+void* clua_getextraspace(lua_State* L);
 
 
 int clua_isgofunction(lua_State *L, int n);
 int clua_isgostruct(lua_State *L, int n);
+int clua_isgomap(lua_State *L, int n);
+int clua_isgoslice(lua_State *L, int n);
 // ext libs
 void clua_register_lib(lua_State* L, void* func, const char* name);
+void clua_pushpermanents(lua_State* L, int reverse);
 
 int luaopen_cmsgpack(lua_State *L);
 int luaopen_pb(lua_State *L);
 int luaopen_cjson(lua_State *L);
+int luaopen_serialize(lua_State *L);
+int luaserialize_packx(lua_State *L);
+int luaserialize_unpackx(lua_State *L);
+// checks the bytecode of the functions unpacked by serialize, returns 0 or pushes an error message
+typedef int (*luaserialize_verifier)(lua_State *L, const char *code, size_t len);
+extern luaserialize_verifier luaserialize_verify;
+void clua_setserializeverifier(void);
+int clua_luac_combine(lua_State* L, int n);
 
 #endif
\ No newline at end of file
@@ -0,0 +1,443 @@
+// Command glua is a stand-alone lua interpreter built on this package, a port of lua.c.
+//
+//	usage: glua [options] [script [args]]
+//
+// It takes the options of the reference interpreter, plus -x to open the extension libraries
+// (serialize, cmsgpack, pb and cjson).
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+const (
+    prompt  = "> "
+    prompt2 = ">> "
+    eofMark = "<eof>"
+)
+
+var progname = "glua"
+
+type options struct {
+    e, i, v, E, x bool
+    // index of the script in the arguments, len(args) if there is none
+    script int
+}
+
+func printUsage(badoption string) {
+    fmt.Fprintf(os.Stderr, "%s: ", progname)
+    if strings.HasPrefix(badoption, "-e") || strings.HasPrefix(badoption, "-l") {
+        fmt.Fprintf(os.Stderr, "'%s' needs argument\n", badoption)
+    } else {
+        fmt.Fprintf(os.Stderr, "unrecognized option '%s'\n", badoption)
+    }
+    fmt.Fprintf(os.Stderr, `usage: %s [options] [script [args]]
+Available options are:
+  -e stat  execute string 'stat'
+  -i       enter interactive mode after executing 'script'
+  -l name  require library 'name' into global 'name'
+  -v       show version information
+  -E       ignore environment variables
+  -W       turn warnings on
+  -x       open the extension libraries (serialize, cmsgpack, pb, cjson)
+  --       stop handling options
+  -        stop handling options and execute stdin
+`, progname)
+}
+
+func message(pname, msg string) {
+    if pname != "" {
+        fmt.Fprintf(os.Stderr, "%s: ", pname)
+    }
+    fmt.Fprintln(os.Stderr, msg)
+}
+
+// Prints the error message on top of the stack if status is not LUA_OK
+func report(L *lua.State, status int) int {
+    if status != lua.LUA_OK {
+        message(progname, L.ToString(-1))
+        L.Pop(1)
+    }
+    return status
+}
+
+// Message handler used to run all chunks
+func msghandler(L *lua.State) int {
+    msg := ""
+    if L.Type(1) == lua.LUA_TSTRING || L.IsNumber(1) {
+        msg = L.ToString(1)
+    } else {
+        if L.CallMeta(1, "__tostring") != 0 && L.Type(-1) == lua.LUA_TSTRING {
+            return 1
+        }
+        msg = fmt.Sprintf("(error object is a %s value)", L.Typename(int(L.Type(1))))
+    }
+    L.Traceback(L, msg, 1)
+    return 1
+}
+
+// Calls the function under the narg arguments on top of the stack with the message handler
+func docall(L *lua.State, narg, nres int) int {
+    base := L.GetTop() - narg
+    L.PushGoFunction(msghandler)
+    L.Insert(base)
+    status := L.PCall(narg, nres, base)
+    L.Remove(base)
+    return status
+}
+
+func dochunk(L *lua.State, status int) int {
+    if status == lua.LUA_OK {
+        status = docall(L, 0, 0)
+    }
+    return report(L, status)
+}
+
+// Loads a file, or stdin when name is empty
+func loadfile(L *lua.State, name string) int {
+    if name != "" {
+        return L.LoadFile(name)
+    }
+    data, err := io.ReadAll(os.Stdin)
+    if err != nil {
+        L.PushString("cannot read stdin: " + err.Error())
+        return lua.LUA_ERRFILE
+    }
+    if len(data) > 0 && data[0] == '#' {
+        // skip the first line, keeping the newline so that line numbers are right
+        i := 0
+        for i < len(data) && data[i] != '\n' {
+            i++
+        }
+        data = data[i:]
+    }
+    return L.LoadBuffer(data, "=stdin", "")
+}
+
+func dofile(L *lua.State, name string) int {
+    return dochunk(L, loadfile(L, name))
+}
+
+func dostring(L *lua.State, s, name string) int {
+    return dochunk(L, L.LoadBuffer([]byte(s), name, ""))
+}
+
+// Calls require(name) and stores the result in the global name
+func dolibrary(L *lua.State, name string) int {
+    L.GetGlobal("require")
+    L.PushString(name)
+    status := docall(L, 1, 1)
+    if status == lua.LUA_OK {
+        L.SetGlobal(name)
+    }
+    return report(L, status)
+}
+
+// Creates the arg table: the script name at index 0, its arguments at positive indices and the
+// interpreter arguments at negative indices
+func createargtable(L *lua.State, args []string, script int) {
+    if script == len(args) {
+        script = 0
+    }
+    L.CreateTable(len(args)-(script+1), script+1)
+    for i, a := range args {
+        L.PushString(a)
+        L.RawSeti(-2, i-script)
+    }
+    L.SetGlobal("arg")
+}
+
+// Runs the script args[script] with the arguments that follow it
+func handleScript(L *lua.State, args []string, script int) int {
+    fname := args[script]
+    if fname == "-" && args[script-1] != "--" {
+        fname = ""
+    }
+    status := loadfile(L, fname)
+    if status == lua.LUA_OK {
+        for _, a := range args[script+1:] {
+            L.PushString(a)
+        }
+        status = docall(L, len(args)-script-1, lua.LUA_MULTRET)
+    }
+    return report(L, status)
+}
+
+// Checks the options that must be handled before running any lua code, returns false on an
+// invalid option with opts.script set to its index
+func collectargs(args []string, opts *options) bool {
+    for i := 1; i < len(args); i++ {
+        opts.script = i
+        a := args[i]
+        if len(a) == 0 || a[0] != '-' {
+            return true
+        }
+        if len(a) == 1 {
+            // '-': script "name" is stdin
+            return true
+        }
+        switch a[1] {
+        case '-':
+            if len(a) != 2 {
+                return false
+            }
+            opts.script = i + 1
+            return true
+        case 'E', 'W', 'x', 'i', 'v':
+            if len(a) != 2 {
+                return false
+            }
+            switch a[1] {
+            case 'E':
+                opts.E = true
+            case 'x':
+                opts.x = true
+            case 'i':
+                opts.i, opts.v = true, true
+            case 'v':
+                opts.v = true
+            }
+        case 'e', 'l':
+            if a[1] == 'e' {
+                opts.e = true
+            }
+            if len(a) == 2 {
+                i++
+                if i >= len(args) || strings.HasPrefix(args[i], "-") {
+                    return false
+                }
+            }
+        default:
+            return false
+        }
+    }
+    opts.script = len(args)
+    return true
+}
+
+// Runs the -e, -l and -W options in order, returns false if some code raised an error
+func runargs(L *lua.State, args []string, n int) bool {
+    for i := 1; i < n; i++ {
+        option := args[i][1]
+        switch option {
+        case 'e', 'l':
+            extra := args[i][2:]
+            if extra == "" {
+                i++
+                extra = args[i]
+            }
+            var status int
+            if option == 'e' {
+                status = dostring(L, extra, "=(command line)")
+            } else {
+                status = dolibrary(L, extra)
+            }
+            if status != lua.LUA_OK {
+                return false
+            }
+        case 'W':
+            L.Warning("@on", false)
+        }
+    }
+    return true
+}
+
+func handleLuainit(L *lua.State) int {
+    name := "LUA_INIT_5_4"
+    init, ok := os.LookupEnv(name)
+    if !ok {
+        name = "LUA_INIT"
+        init, ok = os.LookupEnv(name)
+    }
+    if !ok {
+        return lua.LUA_OK
+    }
+    if strings.HasPrefix(init, "@") {
+        return dofile(L, init[1:])
+    }
+    return dostring(L, init, "="+name)
+}
+
+func printVersion() {
+    fmt.Println(lua.LUA_COPYRIGHT)
+}
+
+func stdinIsTTY() bool {
+    fi, err := os.Stdin.Stat()
+    return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+type repl struct {
+    L  *lua.State
+    in *bufio.Reader
+}
+
+// Returns the prompt, _PROMPT or _PROMPT2 when they are set
+func (r *repl) prompt(firstline bool) string {
+    name, p := "_PROMPT", prompt
+    if !firstline {
+        name, p = "_PROMPT2", prompt2
+    }
+    r.L.GetGlobal(name)
+    if !r.L.IsNil(-1) {
+        p = r.L.LToString(-1)
+        r.L.Pop(1)
+    }
+    r.L.Pop(1)
+    return p
+}
+
+// Shows the prompt and reads a line, returns false at the end of the input
+func (r *repl) readline(firstline bool) (string, bool) {
+    fmt.Print(r.prompt(firstline))
+    line, err := r.in.ReadString('\n')
+    if err != nil && line == "" {
+        return "", false
+    }
+    line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+    if firstline && strings.HasPrefix(line, "=") {
+        line = "return " + line[1:]
+    }
+    return line, true
+}
+
+// Reports whether status is a syntax error for an incomplete statement, popping the message
+func (r *repl) incomplete(status int) bool {
+    if status == lua.LUA_ERRSYNTAX && strings.HasSuffix(r.L.ToString(-1), eofMark) {
+        r.L.Pop(1)
+        return true
+    }
+    return false
+}
+
+// Reads and compiles a line, first as an expression then as a statement, reading more lines
+// while the statement is incomplete. Returns -1 at the end of the input, otherwise the load
+// status with the function or the error message on the stack.
+func (r *repl) loadline() int {
+    L := r.L
+    L.SetTop(0)
+    line, ok := r.readline(true)
+    if !ok {
+        return -1
+    }
+    if status := L.LoadBuffer([]byte("return "+line+";"), "=stdin", ""); status == lua.LUA_OK {
+        return status
+    }
+    L.Pop(1)
+    for {
+        status := L.LoadBuffer([]byte(line), "=stdin", "")
+        if !r.incomplete(status) {
+            return status
+        }
+        more, ok := r.readline(false)
+        if !ok {
+            // reload to get the error message back
+            return L.LoadBuffer([]byte(line), "=stdin", "")
+        }
+        line += "\n" + more
+    }
+}
+
+// Prints the values on the stack with the global print
+func (r *repl) print() {
+    L := r.L
+    n := L.GetTop()
+    if n == 0 {
+        return
+    }
+    if !L.CheckStack(lua.LUA_MINSTACK) {
+        message(progname, "too many results to print")
+        L.SetTop(0)
+        return
+    }
+    L.GetGlobal("print")
+    L.Insert(1)
+    if L.PCall(n, 0, 0) != lua.LUA_OK {
+        message(progname, fmt.Sprintf("error calling 'print' (%s)", L.ToString(-1)))
+    }
+}
+
+func (r *repl) run() {
+    oldprogname := progname
+    progname = ""
+    for {
+        status := r.loadline()
+        if status == -1 {
+            break
+        }
+        if status == lua.LUA_OK {
+            status = docall(r.L, 0, lua.LUA_MULTRET)
+        }
+        if status == lua.LUA_OK {
+            r.print()
+        } else {
+            report(r.L, status)
+        }
+    }
+    r.L.SetTop(0)
+    fmt.Println()
+    progname = oldprogname
+}
+
+func run(L *lua.State, args []string) bool {
+    var opts options
+    if !collectargs(args, &opts) {
+        printUsage(args[opts.script])
+        return false
+    }
+    if opts.v {
+        printVersion()
+    }
+    if opts.E {
+        L.PushBoolean(true)
+        L.SetField(lua.LUA_REGISTRYINDEX, "LUA_NOENV")
+    }
+    L.OpenLibs()
+    if opts.x {
+        L.OpenLibsExt()
+    }
+    createargtable(L, args, opts.script)
+    L.GC(lua.LUA_GCGEN, 0)
+    if !opts.E && handleLuainit(L) != lua.LUA_OK {
+        return false
+    }
+    if !runargs(L, args, opts.script) {
+        return false
+    }
+    if opts.script < len(args) && handleScript(L, args, opts.script) != lua.LUA_OK {
+        return false
+    }
+    if opts.i {
+        (&repl{L, bufio.NewReader(os.Stdin)}).run()
+    } else if opts.script == len(args) && !opts.e && !opts.v {
+        if stdinIsTTY() {
+            printVersion()
+            (&repl{L, bufio.NewReader(os.Stdin)}).run()
+        } else {
+            dofile(L, "")
+        }
+    }
+    return true
+}
+
+func main() {
+    if len(os.Args) > 0 && os.Args[0] != "" {
+        progname = os.Args[0]
+    }
+    L := lua.NewState()
+    if L == nil {
+        message(progname, "cannot create state: not enough memory")
+        os.Exit(1)
+    }
+    ok := run(L, os.Args)
+    L.Close()
+    if !ok {
+        os.Exit(1)
+    }
+}
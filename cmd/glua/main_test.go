@@ -0,0 +1,201 @@
+package main
+
+import (
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+// Set in the environment of the test binary to run it as glua
+const runMain = "GLUA_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+    if os.Getenv(runMain) != "" {
+        main()
+        os.Exit(0)
+    }
+    os.Exit(m.Run())
+}
+
+// Runs glua in dir with the variables of env and stdin, returns its output, its error output and
+// whether it succeeded. The LUA_ variables of the environment of the tests are removed.
+func glua(t *testing.T, dir string, env []string, stdin string, args ...string) (string, string, bool) {
+    t.Helper()
+    cmd := exec.Command(os.Args[0], args...)
+    cmd.Dir = dir
+    for _, e := range os.Environ() {
+        if !strings.HasPrefix(e, "LUA_") {
+            cmd.Env = append(cmd.Env, e)
+        }
+    }
+    cmd.Env = append(append(cmd.Env, runMain+"=1"), env...)
+    cmd.Stdin = strings.NewReader(stdin)
+    var stdout, stderr strings.Builder
+    cmd.Stdout, cmd.Stderr = &stdout, &stderr
+    err := cmd.Run()
+    if _, ok := err.(*exec.ExitError); err != nil && !ok {
+        t.Fatal(err)
+    }
+    return stdout.String(), stderr.String(), err == nil
+}
+
+// Writes the files of name=content in a new directory
+func writeFiles(t *testing.T, files map[string]string) string {
+    t.Helper()
+    dir := t.TempDir()
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+func TestOptions(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "script.lua": `print("script", ...)`,
+        "-dash.lua":  `print("dash")`,
+        "fail.lua":   "local x = nil\nreturn x.y\n",
+    })
+    // out of the ./?.lua of the default path
+    lib := writeFiles(t, map[string]string{"mod.lua": `return {name = "mod"}`})
+    path := []string{"LUA_PATH=" + filepath.Join(lib, "?.lua")}
+    tests := []struct {
+        name   string
+        env    []string
+        stdin  string
+        args   []string
+        stdout string
+        // in the error output, "" for none
+        stderr string
+        ok     bool
+    }{
+        {"e", nil, "", []string{"-e", "print(1 + 1)"}, "2\n", "", true},
+        {"e attached", nil, "", []string{"-eprint(3)", "-e", "print(4)"}, "3\n4\n", "", true},
+        {"e error", nil, "", []string{"-e", "error('boom')"}, "", "boom", false},
+        {"e syntax error", nil, "", []string{"-e", "print("}, "", "(command line):1:", false},
+        {"e without argument", nil, "", []string{"-e"}, "", "'-e' needs argument", false},
+        {"l", path, "", []string{"-l", "mod", "-e", "print(mod.name)"}, "mod\n", "", true},
+        {"l attached", path, "", []string{"-lmod", "-e", "print(mod.name)"}, "mod\n", "", true},
+        {"l missing", path, "", []string{"-l", "missing"}, "", "module 'missing' not found", false},
+        {"l without argument", nil, "", []string{"-l", "-e", "x = 1"}, "", "'-l' needs argument", false},
+        {"v", nil, "print('stdin')", []string{"-v"}, lua.LUA_COPYRIGHT + "\n", "", true},
+        {"v and script", nil, "", []string{"-v", "script.lua"}, lua.LUA_COPYRIGHT + "\nscript\n", "", true},
+        {"E ignores LUA_PATH", path, "", []string{"-E", "-l", "mod"}, "", "module 'mod' not found", false},
+        {"W", nil, "", []string{"-W", "-e", "warn('hello')"}, "", "Lua warning: hello", true},
+        {"warnings off", nil, "", []string{"-e", "warn('hello')"}, "", "", true},
+        {"unknown option", nil, "", []string{"-z"}, "", "unrecognized option '-z'", false},
+        {"script", nil, "", []string{"script.lua", "a", "-e"}, "script\ta\t-e\n", "", true},
+        {"script error", nil, "", []string{"fail.lua"}, "", "fail.lua:2: attempt to index a nil value (local 'x')", false},
+        {"missing script", nil, "", []string{"missing.lua"}, "", "cannot open missing.lua", false},
+        {"dash dash", nil, "", []string{"--", "-dash.lua"}, "dash\n", "", true},
+        {"dash dash ends options", nil, "", []string{"-e", "print(1)", "--", "script.lua", "-e"}, "1\nscript\t-e\n", "", true},
+        {"stdin", nil, "#!/usr/bin/glua\nprint('stdin', ...)", []string{"-", "a"}, "stdin\ta\n", "", true},
+        {"stdin without script", nil, "print('stdin')", nil, "stdin\n", "", true},
+        // like lua, the status of stdin run as a script is ignored
+        {"stdin error line", nil, "#!/usr/bin/glua\n\nerror('boom')", nil, "", "stdin:3: boom", true},
+    }
+    for _, tt := range tests {
+        stdout, stderr, ok := glua(t, dir, tt.env, tt.stdin, tt.args...)
+        if stdout != tt.stdout || ok != tt.ok || tt.stderr == "" && stderr != "" || !strings.Contains(stderr, tt.stderr) {
+            t.Errorf("%s: glua %q: output %q, error output %q, success %v", tt.name, tt.args, stdout, stderr, ok)
+        }
+    }
+}
+
+func TestArgTable(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "args.lua": `for i = -3, #arg do io.write(i, "=", arg[i], " ") end print(select("#", ...), ...)`,
+    })
+    stdout, stderr, ok := glua(t, dir, nil, "", "-e", "x = 1", "args.lua", "a", "b")
+    // arg[-3] is the interpreter
+    want := "-2=-e -1=x = 1 0=args.lua 1=a 2=b 2\ta\tb\n"
+    if !ok || !strings.HasPrefix(stdout, "-3=") || !strings.HasSuffix(stdout, " "+want) || stderr != "" {
+        t.Errorf("output %q, error output %q", stdout, stderr)
+    }
+
+    // without a script, the interpreter at index 0
+    stdout, _, _ = glua(t, dir, nil, "", "-e", "print(#arg, arg[1], arg[2], arg[-1])")
+    if stdout != "2\t-e\tprint(#arg, arg[1], arg[2], arg[-1])\tnil\n" {
+        t.Errorf("output %q", stdout)
+    }
+}
+
+func TestLuaInit(t *testing.T) {
+    dir := writeFiles(t, map[string]string{
+        "init.lua": `print("init file")`,
+    })
+    tests := []struct {
+        name   string
+        env    []string
+        args   []string
+        stdout string
+        stderr string
+        ok     bool
+    }{
+        {"LUA_INIT", []string{"LUA_INIT=print('init')"}, []string{"-e", "print(2)"}, "init\n2\n", "", true},
+        {"LUA_INIT_5_4 first", []string{"LUA_INIT=print('init')", "LUA_INIT_5_4=print('init 5.4')"}, []string{"-e", ""}, "init 5.4\n", "", true},
+        {"file", []string{"LUA_INIT=@init.lua"}, []string{"-e", ""}, "init file\n", "", true},
+        {"missing file", []string{"LUA_INIT=@missing.lua"}, []string{"-e", "print(2)"}, "", "cannot open missing.lua", false},
+        {"error", []string{"LUA_INIT_5_4=error('init failed')"}, []string{"-e", "print(2)"}, "", "LUA_INIT_5_4:1: init failed", false},
+        {"E", []string{"LUA_INIT=print('init')"}, []string{"-E", "-e", "print(2)"}, "2\n", "", true},
+    }
+    for _, tt := range tests {
+        stdout, stderr, ok := glua(t, dir, tt.env, "", tt.args...)
+        if stdout != tt.stdout || ok != tt.ok || tt.stderr == "" && stderr != "" || !strings.Contains(stderr, tt.stderr) {
+            t.Errorf("%s: output %q, error output %q, success %v", tt.name, stdout, stderr, ok)
+        }
+    }
+}
+
+func TestREPL(t *testing.T) {
+    input := `=1 + 2
+2 * 3
+x = 10
+= x, x * 2
+for i = 1, 2 do
+print(i)
+end
+local t = {
+    1,
+    2}
+error("boom")
+_PROMPT, _PROMPT2 = "$ ", "$$ "
+if x then
+print("x")
+end
+if
+`
+    stdout, stderr, ok := glua(t, "", nil, input, "-i")
+    // a prompt for each line read, followed by the results of the statement
+    want := lua.LUA_COPYRIGHT + "\n" +
+        "> 3\n" +
+        "> 6\n" +
+        "> " +
+        "> 10\t20\n" +
+        "> >> >> 1\n2\n" +
+        "> >> >> " +
+        "> " +
+        "> " +
+        "$ $$ $$ x\n" +
+        "$ $$ $ \n"
+    if !ok || stdout != want {
+        t.Errorf("output %q, want %q", stdout, want)
+    }
+    // without the name of the interpreter, incomplete at the end of the input
+    if stderr != "stdin:1: boom\nstack traceback:\n\t[C]: in function 'error'\n\tstdin:1: in main chunk\n"+
+        "stdin:1: unexpected symbol near <eof>\n" {
+        t.Errorf("error output %q", stderr)
+    }
+
+    // after the script, with its globals
+    dir := writeFiles(t, map[string]string{"script.lua": `y = 42`})
+    stdout, _, _ = glua(t, dir, nil, "=y\n", "-i", "script.lua")
+    if stdout != lua.LUA_COPYRIGHT+"\n> 42\n> \n" {
+        t.Errorf("output %q", stdout)
+    }
+}
@@ -0,0 +1,173 @@
+// Command gluac is a lua compiler built on this package, a port of luac.c.
+//
+//	usage: gluac [options] [filenames]
+//
+// The files are compiled into a single precompiled chunk, which can be listed with -l.
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+const output = "luac.out"
+
+var progname = "gluac"
+
+type options struct {
+    listing   int
+    dumping   bool
+    stripping bool
+    // output file, "" for stdout
+    output string
+}
+
+func fatal(message string) {
+    fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+    os.Exit(1)
+}
+
+func usage(message string) {
+    if len(message) > 0 && message[0] == '-' {
+        fmt.Fprintf(os.Stderr, "%s: unrecognized option '%s'\n", progname, message)
+    } else {
+        fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+    }
+    fmt.Fprintf(os.Stderr, `usage: %s [options] [filenames]
+Available options are:
+  -l       list (use -l -l for full listing)
+  -o name  output to file 'name' (default is "%s")
+  -p       parse only
+  -s       strip debug information
+  -v       show version information
+  --       stop handling options
+  -        stop handling options and process stdin
+`, progname, output)
+    os.Exit(1)
+}
+
+// Parses the options, returns the files to compile
+func doargs(args []string, opts *options) []string {
+    version := 0
+    i := 1
+    for ; i < len(args); i++ {
+        a := args[i]
+        if len(a) == 0 || a[0] != '-' {
+            break
+        } else if a == "--" {
+            i++
+            if version > 0 {
+                version++
+            }
+            break
+        } else if a == "-" {
+            break
+        }
+        switch a {
+        case "-l":
+            opts.listing++
+        case "-o":
+            i++
+            if i >= len(args) || args[i] == "" || (args[i][0] == '-' && args[i] != "-") {
+                usage("'-o' needs argument")
+            }
+            opts.output = args[i]
+            if opts.output == "-" {
+                opts.output = ""
+            }
+        case "-p":
+            opts.dumping = false
+        case "-s":
+            opts.stripping = true
+        case "-v":
+            version++
+        default:
+            usage(a)
+        }
+    }
+    files := args[i:]
+    if len(files) == 0 && (opts.listing > 0 || !opts.dumping) {
+        opts.dumping = false
+        files = []string{output}
+    }
+    if version > 0 {
+        fmt.Println(lua.LUA_COPYRIGHT)
+        if version == len(args)-1 {
+            os.Exit(0)
+        }
+    }
+    return files
+}
+
+func load(L *lua.State, filename string) int {
+    if filename != "-" {
+        return L.LoadFile(filename)
+    }
+    data, err := io.ReadAll(os.Stdin)
+    if err != nil {
+        fatal("cannot read stdin: " + err.Error())
+    }
+    if len(data) > 0 && data[0] == '#' {
+        i := 0
+        for i < len(data) && data[i] != '\n' {
+            i++
+        }
+        data = data[i:]
+    }
+    return L.LoadBuffer(data, "=stdin", "")
+}
+
+func main() {
+    if len(os.Args) > 0 && os.Args[0] != "" {
+        progname = os.Args[0]
+    }
+    opts := options{dumping: true, output: output}
+    files := doargs(os.Args, &opts)
+    if len(files) == 0 {
+        usage("no input files given")
+    }
+
+    L := lua.NewState()
+    if L == nil {
+        fatal("cannot create state: not enough memory")
+    }
+    defer L.Close()
+    if !L.CheckStack(len(files)) {
+        fatal("too many input files")
+    }
+    for _, filename := range files {
+        if load(L, filename) != lua.LUA_OK {
+            fatal(L.ToString(-1))
+        }
+    }
+    if err := L.Combine(len(files)); err != nil {
+        fatal(err.Error())
+    }
+    if opts.listing > 0 {
+        listing, err := L.Listing(opts.listing > 1)
+        if err != nil {
+            fatal(err.Error())
+        }
+        fmt.Print(listing)
+    }
+    if opts.dumping {
+        if opts.stripping {
+            L.DumpStrip()
+        } else {
+            L.Dump()
+        }
+        chunk := L.ToBytes(-1)
+        var err error
+        if opts.output == "" {
+            _, err = os.Stdout.Write(chunk)
+        } else {
+            err = os.WriteFile(opts.output, chunk, 0666)
+        }
+        if err != nil {
+            fatal(fmt.Sprintf("cannot write %s: %v", opts.output, err))
+        }
+    }
+}
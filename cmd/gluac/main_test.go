@@ -0,0 +1,206 @@
+package main
+
+import (
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+// Set in the environment of the test binary to run it as gluac
+const runMain = "GLUAC_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+    if os.Getenv(runMain) != "" {
+        main()
+        os.Exit(0)
+    }
+    os.Exit(m.Run())
+}
+
+// Runs gluac in dir with stdin, returns its output, its error output and whether it succeeded
+func gluac(t *testing.T, dir, stdin string, args ...string) (string, string, bool) {
+    t.Helper()
+    cmd := exec.Command(os.Args[0], args...)
+    cmd.Dir = dir
+    cmd.Env = append(os.Environ(), runMain+"=1")
+    cmd.Stdin = strings.NewReader(stdin)
+    var stdout, stderr strings.Builder
+    cmd.Stdout, cmd.Stderr = &stdout, &stderr
+    err := cmd.Run()
+    if _, ok := err.(*exec.ExitError); err != nil && !ok {
+        t.Fatal(err)
+    }
+    return stdout.String(), stderr.String(), err == nil
+}
+
+// A directory with the scripts a.lua and b.lua, appending their name to the global order
+func sources(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    files := map[string]string{
+        "a.lua":   "local name = \"a\"\norder = (order or \"\") .. name\n",
+        "b.lua":   "order = (order or \"\") .. \"b\"\n",
+        "bad.lua": "order = \n",
+    }
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+// Runs the chunk and returns the global order
+func runChunk(t *testing.T, chunk []byte) string {
+    t.Helper()
+    L := lua.NewState()
+    defer L.Close()
+    L.OpenLibs()
+    if L.LoadBuffer(chunk, "chunk", "b") != 0 {
+        t.Fatal(L.ToString(-1))
+    }
+    if err := L.Call(0, 0); err != nil {
+        t.Fatal(err)
+    }
+    L.GetGlobal("order")
+    defer L.Pop(1)
+    return L.ToString(-1)
+}
+
+func readFile(t *testing.T, name string) []byte {
+    t.Helper()
+    data, err := os.ReadFile(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestCompile(t *testing.T) {
+    dir := sources(t)
+    out := filepath.Join(dir, output)
+    if stdout, stderr, ok := gluac(t, dir, "", "a.lua", "b.lua"); !ok || stdout != "" || stderr != "" {
+        t.Fatalf("output %q, error output %q", stdout, stderr)
+    }
+    // the files in order, in a main chunk of their own
+    chunk := readFile(t, out)
+    if got := runChunk(t, chunk); got != "ab" {
+        t.Errorf("order %q", got)
+    }
+    c, err := bytecode.Parse(chunk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Main.Source != "=(luac)" || len(c.Main.Protos) != 2 || c.Main.Protos[0].Source != "@a.lua" {
+        t.Errorf("main %+v", c.Main)
+    }
+
+    // a single file is not wrapped
+    os.Remove(out)
+    gluac(t, dir, "", "--", "b.lua")
+    if c, err := bytecode.Parse(readFile(t, out)); err != nil || c.Main.Source != "@b.lua" {
+        t.Errorf("single file: %v", err)
+    }
+
+    // -o, and - for stdout
+    if _, stderr, ok := gluac(t, dir, "", "-o", "ba.luac", "b.lua", "a.lua"); !ok {
+        t.Fatal(stderr)
+    }
+    if got := runChunk(t, readFile(t, filepath.Join(dir, "ba.luac"))); got != "ba" {
+        t.Errorf("order %q", got)
+    }
+    stdout, _, ok := gluac(t, dir, "order = 'stdin'", "-o", "-", "-")
+    if !ok || runChunk(t, []byte(stdout)) != "stdin" {
+        t.Errorf("output to stdout %q", stdout)
+    }
+}
+
+func TestStrip(t *testing.T) {
+    dir := sources(t)
+    gluac(t, dir, "", "-o", "full.luac", "a.lua")
+    if _, stderr, ok := gluac(t, dir, "", "-s", "-o", "stripped.luac", "a.lua"); !ok {
+        t.Fatal(stderr)
+    }
+    full := readFile(t, filepath.Join(dir, "full.luac"))
+    stripped := readFile(t, filepath.Join(dir, "stripped.luac"))
+    if len(stripped) >= len(full) || runChunk(t, stripped) != "a" {
+        t.Errorf("stripped chunk of %d bytes, %d unstripped", len(stripped), len(full))
+    }
+    c, err := bytecode.Parse(stripped)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Main.Source != "" || len(c.Main.LineInfo) != 0 || len(c.Main.LocVars) != 0 {
+        t.Errorf("debug information %+v", c.Main)
+    }
+}
+
+func TestParseOnly(t *testing.T) {
+    dir := sources(t)
+    if stdout, stderr, ok := gluac(t, dir, "", "-p", "a.lua", "b.lua"); !ok || stdout != "" || stderr != "" {
+        t.Errorf("output %q, error output %q", stdout, stderr)
+    }
+    if _, err := os.Stat(filepath.Join(dir, output)); !os.IsNotExist(err) {
+        t.Errorf("%s written by -p: %v", output, err)
+    }
+    _, stderr, ok := gluac(t, dir, "", "-p", "a.lua", "bad.lua")
+    if ok || !strings.Contains(stderr, "bad.lua:2: unexpected symbol near <eof>") {
+        t.Errorf("error output %q", stderr)
+    }
+}
+
+func TestListing(t *testing.T) {
+    dir := sources(t)
+    stdout, _, ok := gluac(t, dir, "", "-l", "a.lua", "b.lua")
+    if !ok || !strings.HasPrefix(stdout, "\nmain <(luac):0,0> (6 instructions at ") ||
+        !strings.Contains(stdout, "\nmain <a.lua:0,0> (10 instructions at ") || !strings.Contains(stdout, "\nmain <b.lua:0,0> ") ||
+        !strings.Contains(stdout, "\tLOADK    \t0 0\t; \"a\"\n") || strings.Contains(stdout, "constants (") {
+        t.Errorf("listing %q", stdout)
+    }
+    // and compiled
+    if runChunk(t, readFile(t, filepath.Join(dir, output))) != "ab" {
+        t.Error("not compiled with -l")
+    }
+
+    // -l -l, of luac.out when there are no files
+    stdout, _, ok = gluac(t, dir, "", "-l", "-l")
+    if !ok || !strings.Contains(stdout, "\nmain <(luac):0,0> ") || !strings.Contains(stdout, "constants (3) for ") ||
+        !strings.Contains(stdout, "locals (1) for ") || !strings.Contains(stdout, "\t0\tname\t") {
+        t.Errorf("full listing %q", stdout)
+    }
+
+    // listed, not compiled
+    stdout, _, ok = gluac(t, dir, "", "-l", "-p", "-o", "other.luac", "b.lua")
+    if _, err := os.Stat(filepath.Join(dir, "other.luac")); !ok || !os.IsNotExist(err) || !strings.HasPrefix(stdout, "\nmain <b.lua:0,0> ") {
+        t.Errorf("listing %q", stdout)
+    }
+}
+
+func TestUsage(t *testing.T) {
+    dir := sources(t)
+    tests := []struct {
+        args   []string
+        stdout string
+        stderr string
+        ok     bool
+    }{
+        {[]string{"-v"}, lua.LUA_COPYRIGHT + "\n", "", true},
+        {[]string{"-v", "-p", "a.lua"}, lua.LUA_COPYRIGHT + "\n", "", true},
+        {nil, "", "no input files given", false},
+        {[]string{"-o"}, "", "'-o' needs argument", false},
+        {[]string{"-o", "-p", "a.lua"}, "", "'-o' needs argument", false},
+        {[]string{"-z", "a.lua"}, "", "unrecognized option '-z'", false},
+        {[]string{"missing.lua"}, "", "cannot open missing.lua", false},
+    }
+    for _, tt := range tests {
+        stdout, stderr, ok := gluac(t, dir, "", tt.args...)
+        if stdout != tt.stdout || ok != tt.ok || tt.stderr == "" && stderr != "" || !strings.Contains(stderr, tt.stderr) {
+            t.Errorf("gluac %q: output %q, error output %q, success %v", tt.args, stdout, stderr, ok)
+        }
+    }
+}
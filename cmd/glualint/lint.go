@@ -0,0 +1,419 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+// Diagnostic codes
+const (
+    SyntaxError        = "syntax-error"
+    UndefinedGlobal    = "undefined-global"
+    ImplicitGlobal     = "implicit-global"
+    ReadonlyAssignment = "readonly-assignment"
+    UnusedLocal        = "unused-local"
+    Shadowing          = "shadowing"
+    UnknownFunction    = "unknown-function"
+)
+
+// Problem found in a script
+type Diagnostic struct {
+    File     string `json:"file"`
+    Line     int    `json:"line"`
+    Code     string `json:"code"`
+    Severity string `json:"severity"`
+    Name     string `json:"name,omitempty"`
+    Message  string `json:"message"`
+}
+
+// Globals known to the linter
+type config struct {
+    // read-only globals: the standard libraries, as "name" and "lib.name"
+    std map[string]bool
+    // Go-registered functions and tables, read-only; nil to accept calls to any defined global
+    allow map[string]bool
+    // globals provided by the host that scripts may also assign
+    globals map[string]bool
+}
+
+// Collects the globals and library functions of a state with the standard libraries opened
+func stdGlobals(ext bool) map[string]bool {
+    L := lua.NewState()
+    defer L.Close()
+    L.OpenLibs()
+    if ext {
+        L.OpenLibsExt()
+    }
+    std := map[string]bool{}
+    L.GetGlobal("_G")
+    L.PushNil()
+    for L.Next(-2) != 0 {
+        if L.Type(-2) == lua.LUA_TSTRING {
+            name := L.ToString(-2)
+            std[name] = true
+            if L.IsTable(-1) && name != "_G" {
+                L.PushNil()
+                for L.Next(-2) != 0 {
+                    if L.Type(-2) == lua.LUA_TSTRING {
+                        std[name+"."+L.ToString(-2)] = true
+                    }
+                    L.Pop(1)
+                }
+            }
+        }
+        L.Pop(1)
+    }
+    L.Pop(1)
+    return std
+}
+
+// Reports whether name, or the table it is a field of, is a read-only global
+func (c *config) readonly(name string) bool {
+    return c.std[name] || c.allow[name] || c.allow[root(name)]
+}
+
+// Reports whether a call to name is allowed by the allowlist. Fields of an allowed table are
+// accepted unless the allowlist enumerates some of them.
+func (c *config) allowed(name string) bool {
+    if c.std[name] || c.allow[name] {
+        return true
+    }
+    r := root(name)
+    if r == name || !c.allow[r] {
+        return false
+    }
+    for a := range c.allow {
+        if strings.HasPrefix(a, r+".") {
+            return false
+        }
+    }
+    return true
+}
+
+func root(name string) string {
+    if i := strings.IndexByte(name, '.'); i >= 0 {
+        return name[:i]
+    }
+    return name
+}
+
+type linter struct {
+    *config
+    file string
+    // globals assigned somewhere in the script
+    defined map[string]bool
+    diags   []Diagnostic
+}
+
+func (l *linter) report(line int, code, name, format string, args ...interface{}) {
+    severity := "warning"
+    if code == SyntaxError || code == ReadonlyAssignment {
+        severity = "error"
+    }
+    l.diags = append(l.diags, Diagnostic{l.file, line, code, severity, name, fmt.Sprintf(format, args...)})
+}
+
+// Lints the script src, named file in the diagnostics
+func lint(cfg *config, file string, src []byte) []Diagnostic {
+    l := &linter{config: cfg, file: file, defined: map[string]bool{}}
+    L := lua.NewState()
+    defer L.Close()
+    if L.LoadBuffer(src, "@"+file, "t") != lua.LUA_OK {
+        l.syntaxError(L.ToString(-1))
+        return l.diags
+    }
+    L.Dump()
+    c, err := bytecode.Parse(L.ToBytes(-1))
+    if err != nil {
+        l.report(0, SyntaxError, "", "%v", err)
+        return l.diags
+    }
+    l.collectGlobals(c.Main)
+    l.function(c.Main, map[string]int{})
+    sort.SliceStable(l.diags, func(i, j int) bool { return l.diags[i].Line < l.diags[j].Line })
+    return l.diags
+}
+
+// Reports a compilation error, of the form "file:line: message"
+func (l *linter) syntaxError(msg string) {
+    line := 0
+    rest := strings.TrimPrefix(msg, l.file+":")
+    if i := strings.IndexByte(rest, ':'); i > 0 {
+        if n, err := strconv.Atoi(rest[:i]); err == nil {
+            line, msg = n, strings.TrimSpace(rest[i+1:])
+        }
+    }
+    code := SyntaxError
+    if strings.HasPrefix(msg, "attempt to assign to const variable") {
+        code = ReadonlyAssignment
+    }
+    l.report(line, code, "", "%s", msg)
+}
+
+// Returns the name of the global accessed through upvalue u and constant k, "" if u is not _ENV
+func global(f *bytecode.Proto, u, k int) string {
+    if u >= len(f.Upvalues) || f.Upvalues[u].Name != "_ENV" || k >= len(f.Constants) {
+        return ""
+    }
+    s, _ := f.Constants[k].(string)
+    return s
+}
+
+func (l *linter) collectGlobals(f *bytecode.Proto) {
+    for _, i := range f.Code {
+        if i.OpCode() == bytecode.OP_SETTABUP {
+            if name := global(f, i.A(), i.B()); name != "" {
+                l.defined[name] = true
+            }
+        }
+    }
+    for _, p := range f.Protos {
+        l.collectGlobals(p)
+    }
+}
+
+// Line of a local variable declaration
+func declLine(f *bytecode.Proto, v bytecode.LocVar) int {
+    if v.StartPC == 0 {
+        return f.LineDefined
+    }
+    return f.Line(v.StartPC - 1)
+}
+
+// Lints a function, outer holding the lines of the locals of the enclosing functions visible in it
+func (l *linter) function(f *bytecode.Proto, outer map[string]int) {
+    l.checkGlobals(f)
+    l.checkLocals(f, outer)
+    for pc, i := range f.Code {
+        if i.OpCode() != bytecode.OP_CLOSURE || i.Bx() >= len(f.Protos) {
+            continue
+        }
+        visible := map[string]int{}
+        for name, line := range outer {
+            visible[name] = line
+        }
+        for _, v := range f.LocVars {
+            if v.StartPC <= pc && pc < v.EndPC && !internal(v.Name) {
+                visible[v.Name] = declLine(f, v)
+            }
+        }
+        l.function(f.Protos[i.Bx()], visible)
+    }
+}
+
+// Names of the locals generated by the compiler, like "(for state)", and of the ones that
+// should not be reported, starting with "_"
+func internal(name string) bool {
+    return name == "" || name[0] == '(' || name[0] == '_'
+}
+
+// Checks the accesses to global variables and the calls to global functions
+func (l *linter) checkGlobals(f *bytecode.Proto) {
+    // calls to global functions, by pc of the access to the global
+    callees := map[int]string{}
+    if l.allow != nil {
+        for pc, i := range f.Code {
+            if op := i.OpCode(); op == bytecode.OP_CALL || op == bytecode.OP_TAILCALL {
+                if name, gpc := callee(f, pc, i.A()); name != "" {
+                    callees[gpc] = name
+                }
+            }
+        }
+    }
+    for pc, i := range f.Code {
+        switch i.OpCode() {
+        case bytecode.OP_GETTABUP:
+            name := global(f, i.B(), i.C())
+            if name == "" {
+                continue
+            }
+            if call, ok := callees[pc]; ok && !l.defined[root(call)] && !l.globals[root(call)] {
+                if !l.allowed(call) {
+                    l.report(f.Line(pc), UnknownFunction, call, "call to function '%s' not in the allowlist", call)
+                }
+            } else if !l.readonly(name) && !l.defined[name] && !l.globals[name] {
+                l.report(f.Line(pc), UndefinedGlobal, name, "accessing undefined variable '%s'", name)
+            }
+        case bytecode.OP_SETTABUP:
+            name := global(f, i.A(), i.B())
+            switch {
+            case name == "":
+            case l.readonly(name):
+                l.report(f.Line(pc), ReadonlyAssignment, name, "setting read-only global variable '%s'", name)
+            case !l.globals[name]:
+                l.report(f.Line(pc), ImplicitGlobal, name, "setting non-standard global variable '%s'", name)
+            }
+        }
+    }
+}
+
+// Returns the name of the global function called by the instruction at pc, like "print" or
+// "string.format", and the pc where the global is read; "" if it is not a global function
+func callee(f *bytecode.Proto, pc, r int) (name string, gpc int) {
+    q := writer(f, pc, r)
+    if q < 0 {
+        return "", -1
+    }
+    i := f.Code[q]
+    switch i.OpCode() {
+    case bytecode.OP_GETTABUP:
+        return global(f, i.B(), i.C()), q
+    case bytecode.OP_GETFIELD:
+        if i.C() >= len(f.Constants) {
+            break
+        }
+        key, _ := f.Constants[i.C()].(string)
+        if base, gpc := callee(f, q, i.B()); base != "" && key != "" {
+            return base + "." + key, gpc
+        }
+    }
+    return "", -1
+}
+
+// Returns the pc of the last instruction before pc setting register r, -1 if none
+func writer(f *bytecode.Proto, pc, r int) int {
+    for q := pc - 1; q >= 0; q-- {
+        switch i := f.Code[q]; {
+        case i.OpCode() == bytecode.OP_JMP:
+            return -1
+        case i.OpCode().SetsA() && i.A() == r:
+            return q
+        }
+    }
+    return -1
+}
+
+// Checks the unused and shadowing local variables
+func (l *linter) checkLocals(f *bytecode.Proto, outer map[string]int) {
+    used := make([]bool, len(f.LocVars))
+    regs := make([]int, len(f.LocVars))
+    for n, v := range f.LocVars {
+        for _, w := range f.LocVars[:n] {
+            if w.StartPC <= v.StartPC && v.StartPC < w.EndPC {
+                regs[n]++
+                if w.Name == v.Name && !internal(v.Name) {
+                    l.report(declLine(f, v), Shadowing, v.Name, "shadowing definition of variable '%s' on line %d",
+                        v.Name, declLine(f, w))
+                }
+            }
+        }
+        if line, ok := outer[v.Name]; ok && !internal(v.Name) {
+            l.report(declLine(f, v), Shadowing, v.Name, "shadowing upvalue '%s' on line %d", v.Name, line)
+        }
+    }
+    for pc := range f.Code {
+        reads(f, pc, func(r int) {
+            for n, v := range f.LocVars {
+                if regs[n] == r && v.StartPC <= pc && pc < v.EndPC {
+                    used[n] = true
+                }
+            }
+        })
+    }
+    for n, v := range f.LocVars {
+        if used[n] || internal(v.Name) {
+            continue
+        }
+        if n < f.NumParams {
+            l.report(declLine(f, v), UnusedLocal, v.Name, "unused argument '%s'", v.Name)
+        } else {
+            l.report(declLine(f, v), UnusedLocal, v.Name, "unused variable '%s'", v.Name)
+        }
+    }
+}
+
+// Calls read for each register the instruction at pc reads, including the registers captured by
+// closures
+func reads(f *bytecode.Proto, pc int, read func(r int)) {
+    i := f.Code[pc]
+    a, b, c := i.A(), i.B(), i.C()
+    span := func(from, n int) {
+        for r := from; r < from+n; r++ {
+            read(r)
+        }
+    }
+    // operands up to the top of the stack
+    rest := func(from int) { span(from, f.MaxStackSize-from) }
+    switch op := i.OpCode(); op {
+    case bytecode.OP_MOVE, bytecode.OP_GETI, bytecode.OP_GETFIELD, bytecode.OP_UNM, bytecode.OP_BNOT,
+        bytecode.OP_NOT, bytecode.OP_LEN, bytecode.OP_TESTSET, bytecode.OP_ADDI, bytecode.OP_SHRI,
+        bytecode.OP_SHLI:
+        read(b)
+    case bytecode.OP_GETTABLE, bytecode.OP_ADD, bytecode.OP_SUB, bytecode.OP_MUL, bytecode.OP_MOD,
+        bytecode.OP_POW, bytecode.OP_DIV, bytecode.OP_IDIV, bytecode.OP_BAND, bytecode.OP_BOR,
+        bytecode.OP_BXOR, bytecode.OP_SHL, bytecode.OP_SHR:
+        read(b)
+        read(c)
+    case bytecode.OP_ADDK, bytecode.OP_SUBK, bytecode.OP_MULK, bytecode.OP_MODK, bytecode.OP_POWK,
+        bytecode.OP_DIVK, bytecode.OP_IDIVK, bytecode.OP_BANDK, bytecode.OP_BORK, bytecode.OP_BXORK:
+        read(b)
+    case bytecode.OP_SETUPVAL, bytecode.OP_TBC, bytecode.OP_TEST, bytecode.OP_EQK, bytecode.OP_EQI,
+        bytecode.OP_LTI, bytecode.OP_LEI, bytecode.OP_GTI, bytecode.OP_GEI, bytecode.OP_RETURN1,
+        bytecode.OP_MMBINI, bytecode.OP_MMBINK:
+        read(a)
+    case bytecode.OP_EQ, bytecode.OP_LT, bytecode.OP_LE, bytecode.OP_MMBIN:
+        read(a)
+        read(b)
+    case bytecode.OP_SETTABUP:
+        if !i.K() {
+            read(c)
+        }
+    case bytecode.OP_SETTABLE:
+        read(a)
+        read(b)
+        if !i.K() {
+            read(c)
+        }
+    case bytecode.OP_SETI, bytecode.OP_SETFIELD:
+        read(a)
+        if !i.K() {
+            read(c)
+        }
+    case bytecode.OP_SELF:
+        read(b)
+        if !i.K() {
+            read(c)
+        }
+    case bytecode.OP_CONCAT:
+        span(a, b)
+    case bytecode.OP_CALL, bytecode.OP_TAILCALL:
+        if b == 0 {
+            rest(a)
+        } else {
+            span(a, b)
+        }
+    case bytecode.OP_RETURN:
+        if b == 0 {
+            rest(a)
+        } else {
+            span(a, b-1)
+        }
+    case bytecode.OP_SETLIST:
+        if b == 0 {
+            rest(a)
+        } else {
+            span(a, b+1)
+        }
+    case bytecode.OP_FORPREP:
+        span(a, 3)
+    case bytecode.OP_TFORPREP:
+        span(a, 4)
+    case bytecode.OP_TFORCALL:
+        span(a, 3)
+    case bytecode.OP_TFORLOOP:
+        read(a + 4)
+    case bytecode.OP_CLOSURE:
+        if bx := i.Bx(); bx < len(f.Protos) {
+            for _, u := range f.Protos[bx].Upvalues {
+                if u.InStack {
+                    read(u.Index)
+                }
+            }
+        }
+    }
+}
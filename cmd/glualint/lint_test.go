@@ -0,0 +1,102 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+func TestLint(t *testing.T) {
+    cfg := &config{std: stdGlobals(false), globals: map[string]bool{"host": true}}
+    tests := []struct {
+        name string
+        src  string
+        // expected diagnostics, as code and line
+        want []Diagnostic
+    }{
+        {"clean", `local t = {} for i, v in ipairs(t) do print(i, v) end host = string.format("%d", #t)`, nil},
+        {"undefined global", "local x = 1\nprint(y, x)\n", []Diagnostic{
+            {Line: 2, Code: UndefinedGlobal, Name: "y"},
+        }},
+        {"implicit global", "counter = 1\nprint(counter)\n", []Diagnostic{
+            {Line: 1, Code: ImplicitGlobal, Name: "counter"},
+        }},
+        {"readonly global", "print = nil\n", []Diagnostic{
+            {Line: 1, Code: ReadonlyAssignment, Name: "print"},
+        }},
+        {"const assignment", "local x <const> = 1\nx = 2\n", []Diagnostic{
+            {Line: 2, Code: ReadonlyAssignment},
+        }},
+        {"syntax error", "local = 1\n", []Diagnostic{
+            {Line: 1, Code: SyntaxError},
+        }},
+        {"unused locals", "local a, b = 1, 2\nlocal function f(x, _y) return a end\nreturn f\n", []Diagnostic{
+            {Line: 1, Code: UnusedLocal, Name: "b"},
+            {Line: 2, Code: UnusedLocal, Name: "x"},
+        }},
+        {"used by a closure", "local a = 1\nreturn function() return a end\n", nil},
+        {"shadowing", "local a = 1\ndo\n    local a = 2\n    print(a)\nend\nprint(a)\n", []Diagnostic{
+            {Line: 3, Code: Shadowing, Name: "a"},
+        }},
+        {"shadowing upvalue", "local a = 1\nreturn function()\n    local a = 2\n    return a\nend, a\n", []Diagnostic{
+            {Line: 3, Code: Shadowing, Name: "a"},
+        }},
+    }
+    for _, tt := range tests {
+        diags := lint(cfg, "test.lua", []byte(tt.src))
+        if len(diags) != len(tt.want) {
+            t.Errorf("%s: %v, want %v", tt.name, diags, tt.want)
+            continue
+        }
+        for i, d := range diags {
+            w := tt.want[i]
+            if d.File != "test.lua" || d.Line != w.Line || d.Code != w.Code || w.Name != "" && d.Name != w.Name {
+                t.Errorf("%s: %v, want %v", tt.name, diags, tt.want)
+                break
+            }
+        }
+    }
+}
+
+func TestLintAllowlist(t *testing.T) {
+    cfg := &config{
+        std:     stdGlobals(false),
+        allow:   map[string]bool{"log": true, "json": true, "json.encode": true},
+        globals: map[string]bool{},
+    }
+    src := "log(1)\nlog.debug(2)\njson.encode({})\njson.decode('')\nstring.format('')\nos.exit()\n"
+    var calls []Diagnostic
+    for _, d := range lint(cfg, "test.lua", []byte(src)) {
+        if d.Code == UnknownFunction {
+            calls = append(calls, d)
+        }
+    }
+    if len(calls) != 1 || calls[0].Name != "json.decode" || calls[0].Line != 4 {
+        t.Errorf("unknown functions %v", calls)
+    }
+}
+
+func TestCalleeBounds(t *testing.T) {
+    abc := func(op bytecode.OpCode, a, b, c int) bytecode.Instruction {
+        return bytecode.Instruction(op)<<bytecode.POS_OP | bytecode.Instruction(a)<<bytecode.POS_A |
+            bytecode.Instruction(b)<<bytecode.POS_B | bytecode.Instruction(c)<<bytecode.POS_C
+    }
+    f := &bytecode.Proto{
+        MaxStackSize: 2,
+        Upvalues:     []bytecode.Upvalue{{Name: "_ENV"}},
+        Constants:    []interface{}{"string"},
+        Code: []bytecode.Instruction{
+            abc(bytecode.OP_GETTABUP, 0, 0, 0),
+            // field name out of the constants
+            abc(bytecode.OP_GETFIELD, 0, 0, 5),
+            abc(bytecode.OP_CALL, 0, 1, 1),
+        },
+    }
+    if name, pc := callee(f, 2, 0); name != "" || pc != -1 {
+        t.Errorf("callee %q at %d", name, pc)
+    }
+    f.Code[1] = abc(bytecode.OP_GETFIELD, 0, 0, 0)
+    if name, pc := callee(f, 2, 0); name != "string.string" || pc != 0 {
+        t.Errorf("callee %q at %d", name, pc)
+    }
+}
@@ -0,0 +1,141 @@
+// Command glualint reports likely mistakes in lua scripts without running them. The scripts are
+// compiled with the lua 5.4 compiler of this package and their bytecode is inspected.
+//
+//	usage: glualint [options] [filenames]
+//
+// The problems found, one diagnostic per problem, are:
+//
+//	syntax-error         the script does not compile
+//	undefined-global     read of a global that is not standard, registered nor assigned by the script
+//	implicit-global      assignment to a global not declared with -globals
+//	readonly-assignment  assignment to a standard or Go-registered global, or to a <const> local
+//	unused-local         local variable or argument never read; names starting with _ are ignored
+//	shadowing            local variable hiding another one of the same name
+//	unknown-function     call to a global function missing from the allowlist, with -allow
+//
+// They are written as a JSON array of objects with the fields file, line, code, severity (error
+// or warning), name and message, or as lines "file:line: severity: message (code)" with
+// -format text. The exit status is 1 when something was reported.
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+var progname = "glualint"
+
+func fatal(message string) {
+    fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+    os.Exit(1)
+}
+
+// Adds the comma separated names of list to set
+func addNames(set map[string]bool, list string) {
+    for _, name := range strings.Split(list, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            set[name] = true
+        }
+    }
+}
+
+// Adds the names of the file, one per line, to set; blank lines and lines starting with # are skipped
+func addNamesFile(set map[string]bool, filename string) error {
+    f, err := os.Open(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    s := bufio.NewScanner(f)
+    for s.Scan() {
+        if line := strings.TrimSpace(s.Text()); line != "" && line[0] != '#' {
+            set[line] = true
+        }
+    }
+    return s.Err()
+}
+
+func read(filename string) ([]byte, error) {
+    if filename == "-" {
+        return io.ReadAll(os.Stdin)
+    }
+    return os.ReadFile(filename)
+}
+
+func main() {
+    if len(os.Args) > 0 && os.Args[0] != "" {
+        progname = os.Args[0]
+    }
+    flags := flag.NewFlagSet(progname, flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(os.Stderr, "usage: %s [options] [filenames]\nAvailable options are:\n", progname)
+        flags.PrintDefaults()
+        os.Exit(1)
+    }
+    allowList := flags.String("allow", "", "comma separated Go-registered functions and tables, like log,json.encode; enables unknown-function")
+    allowFile := flags.String("allow-file", "", "file with the Go-registered names, one per line; enables unknown-function")
+    globalList := flags.String("globals", "", "comma separated globals provided by the host that scripts may assign")
+    ext := flags.Bool("ext", false, "accept the libraries of OpenLibsExt (cjson, cmsgpack, pb, serialize)")
+    format := flags.String("format", "json", "output format, json or text")
+    flags.Parse(os.Args[1:])
+    if *format != "json" && *format != "text" {
+        fatal("unknown format '" + *format + "'")
+    }
+    files := flags.Args()
+    if len(files) == 0 {
+        files = []string{"-"}
+    }
+
+    cfg := &config{std: stdGlobals(*ext), globals: map[string]bool{}}
+    addNames(cfg.globals, *globalList)
+    if *allowList != "" || *allowFile != "" {
+        cfg.allow = map[string]bool{}
+        addNames(cfg.allow, *allowList)
+        if *allowFile != "" {
+            if err := addNamesFile(cfg.allow, *allowFile); err != nil {
+                fatal("cannot read allowlist: " + err.Error())
+            }
+        }
+    }
+
+    diags := []Diagnostic{}
+    for _, filename := range files {
+        src, err := read(filename)
+        if err != nil {
+            fatal("cannot read " + err.Error())
+        }
+        name := filename
+        if name == "-" {
+            name = "stdin"
+        }
+        if len(src) > 0 && src[0] == '#' {
+            // skip the first line like luaL_loadfile, keeping the newline for the line numbers
+            i := 0
+            for i < len(src) && src[i] != '\n' {
+                i++
+            }
+            src = src[i:]
+        }
+        diags = append(diags, lint(cfg, name, src)...)
+    }
+
+    w := bufio.NewWriter(os.Stdout)
+    if *format == "json" {
+        e := json.NewEncoder(w)
+        e.SetIndent("", "  ")
+        e.Encode(diags)
+    } else {
+        for _, d := range diags {
+            fmt.Fprintf(w, "%s:%d: %s: %s (%s)\n", d.File, d.Line, d.Severity, d.Message, d.Code)
+        }
+    }
+    w.Flush()
+    if len(diags) > 0 {
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,514 @@
+// Command gluastubs writes EmmyLua/LuaLS definitions for the Go structs and functions of a package
+// exposed to lua, from their source. It is meant for go generate:
+//
+//	//go:generate go run github.com/DGHeroin/lua.go/cmd/gluastubs -o api.lua Player spawn=Spawn game.log=Log
+//
+// Each argument names a struct type, described with ---@class, or a global of lua bound to a
+// struct type or to a function, as "name=Ident" or just "Ident". Functions taking a *lua.State
+// (LuaGoFunction) cannot be described from their signature: their doc comments should hold
+// @param and @return annotations, which are copied like all the doc comment lines starting with @.
+// The parameter names of other functions come from their declaration. The fields and methods
+// are named like PushGoStruct does, by their lua or json tag and the -naming policy.
+//
+// See lua.GenerateStubs to describe the bindings by reflection from a Go program instead.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "io"
+    "os"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+var progname = "gluastubs"
+
+func fatal(message string) {
+    fmt.Fprintf(os.Stderr, "%s: %s\n", progname, message)
+    os.Exit(1)
+}
+
+type generator struct {
+    types map[string]*ast.TypeSpec
+    docs  map[string]*ast.CommentGroup
+    funcs map[string]*ast.FuncDecl
+    // exported methods by receiver type name
+    methods map[string][]*ast.FuncDecl
+    naming  lua.NamingPolicy
+    // name of the package when it is package lua itself, where State is not qualified
+    pkg   string
+    stubs lua.Stubs
+    seen  map[string]bool
+}
+
+// Parses the non test Go files of dir
+func (g *generator) parse(dir string) error {
+    fset := token.NewFileSet()
+    pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+        return !strings.HasSuffix(fi.Name(), "_test.go")
+    }, parser.ParseComments)
+    if err != nil {
+        return err
+    }
+    names := make([]string, 0, len(pkgs))
+    for name := range pkgs {
+        names = append(names, name)
+    }
+    if len(names) != 1 {
+        sort.Strings(names)
+        return fmt.Errorf("expected one package in %s, found %v", dir, names)
+    }
+    g.pkg = names[0]
+    for _, file := range pkgs[g.pkg].Files {
+        for _, decl := range file.Decls {
+            switch d := decl.(type) {
+            case *ast.GenDecl:
+                for _, spec := range d.Specs {
+                    if ts, ok := spec.(*ast.TypeSpec); ok {
+                        g.types[ts.Name.Name] = ts
+                        g.docs[ts.Name.Name] = ts.Doc
+                        if ts.Doc == nil && len(d.Specs) == 1 {
+                            g.docs[ts.Name.Name] = d.Doc
+                        }
+                    }
+                }
+            case *ast.FuncDecl:
+                if d.Recv == nil {
+                    g.funcs[d.Name.Name] = d
+                } else if recv := receiver(d); recv != "" && d.Name.IsExported() {
+                    g.methods[recv] = append(g.methods[recv], d)
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// Name of the type of the receiver of the method d
+func receiver(d *ast.FuncDecl) string {
+    typ := d.Recv.List[0].Type
+    if star, ok := typ.(*ast.StarExpr); ok {
+        typ = star.X
+    }
+    if id, ok := typ.(*ast.Ident); ok {
+        return id.Name
+    }
+    return ""
+}
+
+// Splits the @param name type [doc] and @return type [name] [# doc] lines out of doc
+func annotations(doc string) (rest string, params, returns []lua.StubParam) {
+    var lines []string
+    for _, line := range strings.Split(doc, "\n") {
+        fields := strings.Fields(line)
+        switch {
+        case len(fields) >= 2 && fields[0] == "@param":
+            p := lua.StubParam{Name: fields[1], Type: "any"}
+            if len(fields) > 2 {
+                p.Type, p.Doc = fields[2], strings.Join(fields[3:], " ")
+            }
+            params = append(params, p)
+        case len(fields) >= 2 && fields[0] == "@return":
+            r := lua.StubParam{Type: fields[1]}
+            fields = fields[2:]
+            if len(fields) > 0 && fields[0] != "#" {
+                r.Name, fields = fields[0], fields[1:]
+            }
+            if len(fields) > 0 && fields[0] == "#" {
+                fields = fields[1:]
+            }
+            r.Doc = strings.Join(fields, " ")
+            returns = append(returns, r)
+        default:
+            lines = append(lines, line)
+        }
+    }
+    return strings.Join(lines, "\n"), params, returns
+}
+
+// Text of a doc comment, "" without one
+func docText(cg *ast.CommentGroup) string {
+    if cg == nil {
+        return ""
+    }
+    return strings.TrimSpace(cg.Text())
+}
+
+func (g *generator) bind(arg string) error {
+    name, ident := "", arg
+    if i := strings.IndexByte(arg, '='); i >= 0 {
+        name, ident = arg[:i], arg[i+1:]
+    }
+    if f, ok := g.funcs[ident]; ok {
+        if name == "" {
+            name = ident
+        }
+        g.stubs.Functions = append(g.stubs.Functions, g.function(name, f))
+        return nil
+    }
+    ts, ok := g.types[ident]
+    if !ok {
+        return fmt.Errorf("%s is neither a function nor a type of package %s", ident, g.pkg)
+    }
+    if _, ok := ts.Type.(*ast.StructType); !ok {
+        return fmt.Errorf("type %s is not a struct", ident)
+    }
+    g.class(ident)
+    if name != "" {
+        g.stubs.Globals = append(g.stubs.Globals, lua.StubGlobal{Name: name, Type: ident})
+    }
+    return nil
+}
+
+// Reports whether the function is a LuaGoFunction, taking a *lua.State
+func (g *generator) isLuaGoFunction(ft *ast.FuncType) bool {
+    if ft.Params.NumFields() != 1 {
+        return false
+    }
+    star, ok := ft.Params.List[0].Type.(*ast.StarExpr)
+    if !ok {
+        return false
+    }
+    switch t := star.X.(type) {
+    case *ast.SelectorExpr:
+        return t.Sel.Name == "State"
+    case *ast.Ident:
+        return g.pkg == "lua" && t.Name == "State"
+    }
+    return false
+}
+
+func (g *generator) function(name string, d *ast.FuncDecl) lua.StubFunc {
+    f := lua.StubFunc{Name: name, Doc: docText(d.Doc)}
+    if g.isLuaGoFunction(d.Type) {
+        f.Doc, f.Params, f.Returns = annotations(f.Doc)
+        if len(f.Params) == 0 {
+            f.Params = []lua.StubParam{{Name: "...", Type: "any"}}
+        }
+        if len(f.Returns) == 0 {
+            f.Returns = []lua.StubParam{{Name: "...", Type: "any"}}
+        }
+        return f
+    }
+    n := 0
+    for _, field := range d.Type.Params.List {
+        typ := field.Type
+        variadic := false
+        if e, ok := typ.(*ast.Ellipsis); ok {
+            typ, variadic = e.Elt, true
+        }
+        names := field.Names
+        if len(names) == 0 {
+            names = []*ast.Ident{nil}
+        }
+        for _, id := range names {
+            n++
+            p := lua.StubParam{Name: fmt.Sprintf("p%d", n), Type: g.luaType(typ)}
+            if id != nil && id.Name != "_" {
+                p.Name = id.Name
+            }
+            if variadic {
+                p.Name = "..."
+            }
+            f.Params = append(f.Params, p)
+        }
+    }
+    if d.Type.Results != nil {
+        for _, field := range d.Type.Results.List {
+            names := field.Names
+            if len(names) == 0 {
+                names = []*ast.Ident{nil}
+            }
+            for _, id := range names {
+                r := lua.StubParam{Type: g.luaType(field.Type)}
+                if id != nil && id.Name != "_" {
+                    r.Name = id.Name
+                }
+                f.Returns = append(f.Returns, r)
+            }
+        }
+    }
+    return f
+}
+
+// Adds the class of the struct type name, once
+func (g *generator) class(name string) {
+    if g.seen[name] {
+        return
+    }
+    g.seen[name] = true
+    n := len(g.stubs.Classes)
+    g.stubs.Classes = append(g.stubs.Classes, lua.StubClass{Name: name, Doc: docText(g.docs[name])})
+    // computed first as they may add classes
+    fields := g.fields(name, map[string]bool{})
+    methods := g.classMethods(name, map[string]bool{})
+    g.stubs.Classes[n].Fields, g.stubs.Classes[n].Methods = fields, methods
+}
+
+// Returns the methods of the struct type name, with the ones promoted from embedded structs of
+// the package not hidden by others, sorted by name like reflection does
+func (g *generator) classMethods(name string, visited map[string]bool) []lua.StubFunc {
+    visited[name] = true
+    var methods []lua.StubFunc
+    has := map[string]bool{}
+    for _, d := range g.methods[name] {
+        m := g.function(g.naming.Apply(d.Name.Name), d)
+        // the error is raised, not returned
+        if n := len(m.Returns); n > 0 && isError(d) {
+            m.Returns = m.Returns[:n-1]
+        }
+        methods = append(methods, m)
+        has[m.Name] = true
+    }
+    for _, e := range g.embedded(name) {
+        if !visited[e] {
+            for _, m := range g.classMethods(e, visited) {
+                if !has[m.Name] {
+                    methods = append(methods, m)
+                    has[m.Name] = true
+                }
+            }
+        }
+    }
+    sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+    return methods
+}
+
+// Reports whether the last result of d is an error
+func isError(d *ast.FuncDecl) bool {
+    results := d.Type.Results
+    if results == nil || len(results.List) == 0 {
+        return false
+    }
+    id, ok := results.List[len(results.List)-1].Type.(*ast.Ident)
+    return ok && id.Name == "error"
+}
+
+// Returns the struct types of the package embedded in the struct type name, except the ones
+// excluded by their tag
+func (g *generator) embedded(name string) []string {
+    var names []string
+    for _, field := range g.types[name].Type.(*ast.StructType).Fields.List {
+        if len(field.Names) != 0 {
+            continue
+        }
+        if _, ok := g.naming.FieldName("", tag(field)); !ok {
+            continue
+        }
+        typ := field.Type
+        if star, ok := typ.(*ast.StarExpr); ok {
+            typ = star.X
+        }
+        if id, ok := typ.(*ast.Ident); ok {
+            if ts, ok := g.types[id.Name]; ok {
+                if _, ok := ts.Type.(*ast.StructType); ok {
+                    names = append(names, id.Name)
+                }
+            }
+        }
+    }
+    return names
+}
+
+// Tag of a struct field
+func tag(field *ast.Field) reflect.StructTag {
+    if field.Tag == nil {
+        return ""
+    }
+    s, _ := strconv.Unquote(field.Tag.Value)
+    return reflect.StructTag(s)
+}
+
+// Returns the fields of the struct type name accessible from lua, with the ones promoted from
+// embedded structs of the package not hidden by others
+func (g *generator) fields(name string, visited map[string]bool) []lua.StubParam {
+    visited[name] = true
+    var fields, promoted []lua.StubParam
+    for _, e := range g.embedded(name) {
+        if !visited[e] {
+            promoted = append(promoted, g.fields(e, visited)...)
+        }
+    }
+    for _, field := range g.types[name].Type.(*ast.StructType).Fields.List {
+        if len(field.Names) == 0 {
+            continue
+        }
+        typ := g.fieldType(field.Type)
+        if typ == "" {
+            continue
+        }
+        doc := field.Doc
+        if doc == nil {
+            doc = field.Comment
+        }
+        for _, id := range field.Names {
+            if name, ok := g.naming.FieldName(id.Name, tag(field)); ok && id.IsExported() {
+                fields = append(fields, lua.StubParam{Name: name, Type: typ, Doc: strings.Join(strings.Fields(docText(doc)), " ")})
+            }
+        }
+    }
+    for _, p := range promoted {
+        hidden := false
+        for _, f := range fields {
+            hidden = hidden || f.Name == p.Name
+        }
+        if !hidden {
+            fields = append(fields, p)
+        }
+    }
+    return fields
+}
+
+// Go types whose values are converted to basic lua types
+var basicTypes = map[string]string{
+    "bool": "boolean", "string": "string", "float32": "number", "float64": "number",
+    "int": "integer", "int8": "integer", "int16": "integer", "int32": "integer", "int64": "integer",
+    "uint": "integer", "uint8": "integer", "uint16": "integer", "uint32": "integer", "uint64": "integer",
+    "uintptr": "integer", "byte": "integer", "rune": "integer",
+}
+
+// Returns the definition of a named type of the package, following the type declarations
+// like "type ID int" but not structs
+func (g *generator) underlying(e ast.Expr) ast.Expr {
+    for i := 0; i < 10; i++ {
+        id, ok := e.(*ast.Ident)
+        if !ok {
+            return e
+        }
+        ts, ok := g.types[id.Name]
+        if !ok {
+            return e
+        }
+        if _, ok := ts.Type.(*ast.StructType); ok {
+            return e
+        }
+        e = ts.Type
+    }
+    return e
+}
+
+// Type of a struct field accessible from lua, "" for the ones PushGoStruct does not handle
+func (g *generator) fieldType(e ast.Expr) string {
+    e = g.underlying(e)
+    switch t := e.(type) {
+    case *ast.ChanType:
+        return ""
+    case *ast.StarExpr:
+        if typ := g.fieldType(t.X); typ != "" {
+            return typ + "?"
+        }
+        return ""
+    case *ast.Ident:
+        if t.Name == "uintptr" || t.Name == "complex64" || t.Name == "complex128" {
+            return ""
+        }
+    }
+    return g.luaType(e)
+}
+
+// LuaLS type of a Go type expression, adding the classes of the structs it refers to
+func (g *generator) luaType(e ast.Expr) string {
+    e = g.underlying(e)
+    switch t := e.(type) {
+    case *ast.Ident:
+        if s, ok := basicTypes[t.Name]; ok {
+            return s
+        }
+        if t.Name == "error" {
+            return "string?"
+        }
+        if ts, ok := g.types[t.Name]; ok {
+            if _, ok := ts.Type.(*ast.StructType); ok {
+                g.class(t.Name)
+                return t.Name
+            }
+        }
+    case *ast.StarExpr:
+        return g.luaType(t.X)
+    case *ast.ArrayType:
+        if id, ok := t.Elt.(*ast.Ident); ok && (id.Name == "byte" || id.Name == "uint8") && t.Len == nil {
+            return "string"
+        }
+        return g.luaType(t.Elt) + "[]"
+    case *ast.MapType:
+        return fmt.Sprintf("table<%s, %s>", g.luaType(t.Key), g.luaType(t.Value))
+    case *ast.FuncType:
+        return "function"
+    case *ast.SelectorExpr:
+        if t.Sel.Name == "LuaGoFunction" {
+            return "function"
+        }
+        if x, ok := t.X.(*ast.Ident); ok && x.Name == "time" && t.Sel.Name == "Time" {
+            return "integer"
+        }
+    case *ast.StructType:
+        return "table"
+    }
+    return "any"
+}
+
+func main() {
+    if len(os.Args) > 0 && os.Args[0] != "" {
+        progname = os.Args[0]
+    }
+    flags := flag.NewFlagSet(progname, flag.ExitOnError)
+    flags.Usage = func() {
+        fmt.Fprintf(os.Stderr, "usage: %s [options] Type|name=Ident|Ident...\nAvailable options are:\n", progname)
+        flags.PrintDefaults()
+        os.Exit(1)
+    }
+    output := flags.String("o", "", "output file (default stdout)")
+    dir := flags.String("dir", ".", "directory of the Go package")
+    naming := flags.String("naming", "as-is", "naming policy of the fields and methods, as-is, lowerCamel or snake_case")
+    flags.Parse(os.Args[1:])
+    if flags.NArg() == 0 {
+        flags.Usage()
+    }
+
+    g := &generator{
+        types:   map[string]*ast.TypeSpec{},
+        docs:    map[string]*ast.CommentGroup{},
+        funcs:   map[string]*ast.FuncDecl{},
+        methods: map[string][]*ast.FuncDecl{},
+        seen:    map[string]bool{},
+    }
+    switch *naming {
+    case "as-is":
+        g.naming = lua.NamingAsIs
+    case "lowerCamel":
+        g.naming = lua.NamingLowerCamel
+    case "snake_case":
+        g.naming = lua.NamingSnakeCase
+    default:
+        fatal("unknown naming policy '" + *naming + "'")
+    }
+    if err := g.parse(*dir); err != nil {
+        fatal(err.Error())
+    }
+    for _, arg := range flags.Args() {
+        if err := g.bind(arg); err != nil {
+            fatal(err.Error())
+        }
+    }
+
+    var w io.Writer = os.Stdout
+    if *output != "" {
+        f, err := os.Create(*output)
+        if err != nil {
+            fatal(err.Error())
+        }
+        defer f.Close()
+        w = f
+    }
+    if err := lua.WriteStubs(w, &g.stubs); err != nil {
+        fatal(err.Error())
+    }
+}
@@ -0,0 +1,329 @@
+package lua
+
+/*
+#include "clua.h"
+*/
+import "C"
+import (
+    "bufio"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "path"
+    "sort"
+    "strings"
+    "time"
+    "unsafe"
+)
+
+// Coverage of the lua files run while StartCoverage was active
+type Coverage struct {
+    // Sorted by name
+    Files []*FileCoverage
+}
+
+// Coverage of a file, chunks loaded from the same file are merged
+type FileCoverage struct {
+    // File name, the chunk name without the leading '@'
+    Name string
+    // Executable lines, in order
+    Lines []LineCoverage
+    // Conditional jumps, in line order
+    Branches []BranchCoverage
+}
+
+// Number of times an executable line was run
+type LineCoverage struct {
+    Line int
+    Hits int
+}
+
+// A conditional jump. Block numbers the conditions of a line, Taken counts the times the jump
+// was skipped (Taken[0]) and taken (Taken[1]).
+type BranchCoverage struct {
+    Line  int
+    Block int
+    Taken [2]int
+}
+
+// Starts recording which lines and branches of the lua code are executed.
+//
+// The lines of every chunk whose main function runs are recorded, executed or not; only chunks
+// loaded from files ("@" chunk names) are reported. Coverage uses a C hook called for each
+// instruction, which makes the code run several times slower. The hook installed before (SetHook,
+// SetExecutionLimit, StartProfile or a debugger) keeps receiving its events and is restored by
+// StopCoverage; a hook installed while coverage runs replaces it and stops the recording.
+// Coroutines created before StartCoverage are not covered.
+func (L *State) StartCoverage() error {
+    if C.clua_coverage_start(L.mainState().s) == 0 {
+        return errors.New("lua: coverage already started")
+    }
+    return nil
+}
+
+// Stops recording coverage and returns what was recorded since StartCoverage, or nil if
+// coverage was not started
+func (L *State) StopCoverage() *Coverage {
+    main := L.mainState()
+    n := int(C.clua_coverage_count(main.s))
+    if n < 0 {
+        return nil
+    }
+    C.clua_coverage_stop(main.s)
+    defer C.clua_coverage_release(main.s)
+
+    type branchKey struct{ lineDefined, pc int }
+    type fileData struct {
+        lines    map[int]int
+        branches map[branchKey]*BranchCoverage
+    }
+    files := make(map[string]*fileData)
+    for i := 0; i < n; i++ {
+        cp := C.clua_coverage_proto(main.s, C.int(i))
+        if cp.source == nil || *cp.source != '@' {
+            continue
+        }
+        name := C.GoString(cp.source)[1:]
+        f := files[name]
+        if f == nil {
+            f = &fileData{lines: make(map[int]int), branches: make(map[branchKey]*BranchCoverage)}
+            files[name] = f
+        }
+        count := int(cp.n)
+        lines := unsafe.Slice(cp.lines, count)
+        hits := unsafe.Slice(cp.hits, count)
+        tests := unsafe.Slice(cp.tests, count)
+        branches := unsafe.Slice(cp.branches, 2*count)
+        for pc := 0; pc < count; pc++ {
+            line := int(lines[pc])
+            if line <= 0 {
+                continue
+            }
+            f.lines[line] += int(hits[pc])
+            if tests[pc] == 0 {
+                continue
+            }
+            key := branchKey{int(cp.linedefined), pc}
+            b := f.branches[key]
+            if b == nil {
+                b = &BranchCoverage{Line: line}
+                f.branches[key] = b
+            }
+            b.Taken[0] += int(branches[2*pc])
+            b.Taken[1] += int(branches[2*pc+1])
+        }
+    }
+
+    c := &Coverage{Files: []*FileCoverage{}}
+    for name, f := range files {
+        fc := &FileCoverage{Name: name, Lines: []LineCoverage{}, Branches: []BranchCoverage{}}
+        for line, hits := range f.lines {
+            fc.Lines = append(fc.Lines, LineCoverage{line, hits})
+        }
+        sort.Slice(fc.Lines, func(i, j int) bool { return fc.Lines[i].Line < fc.Lines[j].Line })
+
+        keys := make([]branchKey, 0, len(f.branches))
+        for k := range f.branches {
+            keys = append(keys, k)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+            bi, bj := f.branches[keys[i]], f.branches[keys[j]]
+            if bi.Line != bj.Line {
+                return bi.Line < bj.Line
+            }
+            if keys[i].lineDefined != keys[j].lineDefined {
+                return keys[i].lineDefined < keys[j].lineDefined
+            }
+            return keys[i].pc < keys[j].pc
+        })
+        for i, k := range keys {
+            b := *f.branches[k]
+            if i > 0 && fc.Branches[i-1].Line == b.Line {
+                b.Block = fc.Branches[i-1].Block + 1
+            }
+            fc.Branches = append(fc.Branches, b)
+        }
+        c.Files = append(c.Files, fc)
+    }
+    sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Name < c.Files[j].Name })
+    return c
+}
+
+// Returns the number of executable lines and of lines run at least once
+func (f *FileCoverage) LineCount() (total, hit int) {
+    for _, l := range f.Lines {
+        if l.Hits > 0 {
+            hit++
+        }
+    }
+    return len(f.Lines), hit
+}
+
+// Returns the number of branches (two per condition) and of branches taken at least once
+func (f *FileCoverage) BranchCount() (total, hit int) {
+    for _, b := range f.Branches {
+        for _, t := range b.Taken {
+            if t > 0 {
+                hit++
+            }
+        }
+    }
+    return 2 * len(f.Branches), hit
+}
+
+// Writes the coverage in the LCOV tracefile format (genhtml, codecov, ...)
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+    bw := bufio.NewWriter(w)
+    for _, f := range c.Files {
+        fmt.Fprintf(bw, "TN:\nSF:%s\n", f.Name)
+        hits := make(map[int]int, len(f.Lines))
+        for _, l := range f.Lines {
+            hits[l.Line] = l.Hits
+        }
+        for _, b := range f.Branches {
+            for i, t := range b.Taken {
+                if hits[b.Line] == 0 {
+                    fmt.Fprintf(bw, "BRDA:%d,%d,%d,-\n", b.Line, b.Block, i)
+                } else {
+                    fmt.Fprintf(bw, "BRDA:%d,%d,%d,%d\n", b.Line, b.Block, i, t)
+                }
+            }
+        }
+        total, hit := f.BranchCount()
+        fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", total, hit)
+        for _, l := range f.Lines {
+            fmt.Fprintf(bw, "DA:%d,%d\n", l.Line, l.Hits)
+        }
+        total, hit = f.LineCount()
+        fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", total, hit)
+    }
+    return bw.Flush()
+}
+
+type coberturaReport struct {
+    XMLName         xml.Name           `xml:"coverage"`
+    LineRate        string             `xml:"line-rate,attr"`
+    BranchRate      string             `xml:"branch-rate,attr"`
+    LinesCovered    int                `xml:"lines-covered,attr"`
+    LinesValid      int                `xml:"lines-valid,attr"`
+    BranchesCovered int                `xml:"branches-covered,attr"`
+    BranchesValid   int                `xml:"branches-valid,attr"`
+    Complexity      int                `xml:"complexity,attr"`
+    Version         string             `xml:"version,attr"`
+    Timestamp       int64              `xml:"timestamp,attr"`
+    Sources         []string           `xml:"sources>source"`
+    Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+    Name       string           `xml:"name,attr"`
+    LineRate   string           `xml:"line-rate,attr"`
+    BranchRate string           `xml:"branch-rate,attr"`
+    Complexity int              `xml:"complexity,attr"`
+    Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+    Name       string          `xml:"name,attr"`
+    Filename   string          `xml:"filename,attr"`
+    LineRate   string          `xml:"line-rate,attr"`
+    BranchRate string          `xml:"branch-rate,attr"`
+    Complexity int             `xml:"complexity,attr"`
+    Methods    struct{}        `xml:"methods"`
+    Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+    Number            int    `xml:"number,attr"`
+    Hits              int    `xml:"hits,attr"`
+    Branch            bool   `xml:"branch,attr"`
+    ConditionCoverage string `xml:"condition-coverage,attr,omitempty"`
+}
+
+func coverageRate(hit, total int) string {
+    if total == 0 {
+        return "1"
+    }
+    return fmt.Sprintf("%.4f", float64(hit)/float64(total))
+}
+
+// Writes the coverage as a Cobertura XML report, files are grouped in packages by directory
+func (c *Coverage) WriteCobertura(w io.Writer) error {
+    r := coberturaReport{Version: LUA_VERSION, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Sources: []string{"."}}
+    type counts struct{ lines, linesHit, branches, branchesHit int }
+    packages := map[string]*coberturaPackage{}
+    packageCounts := map[string]*counts{}
+    var names []string
+
+    for _, f := range c.Files {
+        dir := path.Dir(strings.ReplaceAll(f.Name, "\\", "/"))
+        pkg := packages[dir]
+        if pkg == nil {
+            pkg = &coberturaPackage{Name: strings.Trim(strings.ReplaceAll(dir, "/", "."), ".")}
+            packages[dir] = pkg
+            packageCounts[dir] = &counts{}
+            names = append(names, dir)
+        }
+        lines, linesHit := f.LineCount()
+        branches, branchesHit := f.BranchCount()
+        pkgc := packageCounts[dir]
+        pkgc.lines, pkgc.linesHit = pkgc.lines+lines, pkgc.linesHit+linesHit
+        pkgc.branches, pkgc.branchesHit = pkgc.branches+branches, pkgc.branchesHit+branchesHit
+
+        class := coberturaClass{
+            Name:       path.Base(f.Name),
+            Filename:   f.Name,
+            LineRate:   coverageRate(linesHit, lines),
+            BranchRate: coverageRate(branchesHit, branches),
+        }
+        type lineBranches struct{ total, hit int }
+        byLine := map[int]*lineBranches{}
+        for _, b := range f.Branches {
+            lb := byLine[b.Line]
+            if lb == nil {
+                lb = &lineBranches{}
+                byLine[b.Line] = lb
+            }
+            for _, t := range b.Taken {
+                lb.total++
+                if t > 0 {
+                    lb.hit++
+                }
+            }
+        }
+        for _, l := range f.Lines {
+            cl := coberturaLine{Number: l.Line, Hits: l.Hits}
+            if lb := byLine[l.Line]; lb != nil {
+                cl.Branch = true
+                cl.ConditionCoverage = fmt.Sprintf("%d%% (%d/%d)", lb.hit*100/lb.total, lb.hit, lb.total)
+            }
+            class.Lines = append(class.Lines, cl)
+        }
+        pkg.Classes = append(pkg.Classes, class)
+    }
+
+    var total counts
+    for _, dir := range names {
+        pkg, pkgc := packages[dir], packageCounts[dir]
+        pkg.LineRate = coverageRate(pkgc.linesHit, pkgc.lines)
+        pkg.BranchRate = coverageRate(pkgc.branchesHit, pkgc.branches)
+        r.Packages = append(r.Packages, *pkg)
+        total.lines, total.linesHit = total.lines+pkgc.lines, total.linesHit+pkgc.linesHit
+        total.branches, total.branchesHit = total.branches+pkgc.branches, total.branchesHit+pkgc.branchesHit
+    }
+    r.LineRate, r.BranchRate = coverageRate(total.linesHit, total.lines), coverageRate(total.branchesHit, total.branches)
+    r.LinesCovered, r.LinesValid = total.linesHit, total.lines
+    r.BranchesCovered, r.BranchesValid = total.branchesHit, total.branches
+
+    if _, err := io.WriteString(w, xml.Header+"<!DOCTYPE coverage SYSTEM \"http://cobertura.sourceforge.net/xml/coverage-04.dtd\">\n"); err != nil {
+        return err
+    }
+    enc := xml.NewEncoder(w)
+    enc.Indent("", "  ")
+    if err := enc.Encode(r); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, "\n")
+    return err
+}
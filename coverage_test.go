@@ -0,0 +1,146 @@
+package lua
+
+import (
+    "strings"
+    "testing"
+)
+
+const coverageScript = `local function f(x)
+    if x > 0 then
+        return 1
+    end
+    return 0
+end
+f(1)
+f(2)
+`
+
+func runCoverageScript(t *testing.T, L *State) {
+    t.Helper()
+    if r := L.LoadBuffer([]byte(coverageScript), "@cov.lua", "t"); r != 0 {
+        t.Fatal(L.ToString(-1))
+    }
+    if err := L.Call(0, 0); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCoverage(t *testing.T) {
+    L := newTestState(t)
+    if err := L.StartCoverage(); err != nil {
+        t.Fatal(err)
+    }
+    if L.StartCoverage() == nil {
+        t.Error("second coverage started")
+    }
+    runCoverageScript(t, L)
+    c := L.StopCoverage()
+    if c == nil || L.StopCoverage() != nil {
+        t.Fatal("StopCoverage")
+    }
+    if len(c.Files) != 1 || c.Files[0].Name != "cov.lua" {
+        t.Fatalf("files %v", c.Files)
+    }
+    f := c.Files[0]
+    hits := map[int]int{}
+    for _, l := range f.Lines {
+        hits[l.Line] = l.Hits
+    }
+    if hits[2] != 2 || hits[3] != 2 || hits[5] != 0 || hits[7] != 1 {
+        t.Errorf("lines %v", f.Lines)
+    }
+    if len(f.Branches) != 1 || f.Branches[0].Line != 2 || f.Branches[0].Taken != [2]int{2, 0} {
+        t.Errorf("branches %v", f.Branches)
+    }
+
+    var lcov strings.Builder
+    if err := c.WriteLCOV(&lcov); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(lcov.String(), "SF:cov.lua\n") || !strings.Contains(lcov.String(), "DA:5,0\n") {
+        t.Errorf("lcov %s", lcov.String())
+    }
+}
+
+func TestCoverageChainsHook(t *testing.T) {
+    L := newTestState(t)
+    var lines, calls, counts int
+    L.SetHook(LUA_MASKLINE|LUA_MASKCALL|LUA_MASKCOUNT, 10, func(L *State, ar *Debug) {
+        switch ar.Event {
+        case LUA_HOOKLINE:
+            lines++
+        case LUA_HOOKCALL, LUA_HOOKTAILCALL:
+            calls++
+        case LUA_HOOKCOUNT:
+            counts++
+        }
+    })
+    runCoverageScript(t, L)
+    wantLines, wantCalls, wantCounts := lines, calls, counts
+
+    lines, calls, counts = 0, 0, 0
+    if err := L.StartCoverage(); err != nil {
+        t.Fatal(err)
+    }
+    runCoverageScript(t, L)
+    if lines != wantLines || calls != wantCalls || counts == 0 {
+        t.Errorf("%d lines, %d calls, %d counts with coverage, want %d, %d, %d",
+            lines, calls, counts, wantLines, wantCalls, wantCounts)
+    }
+    c := L.StopCoverage()
+    if len(c.Files) != 1 {
+        t.Fatalf("files %v", c.Files)
+    }
+
+    // restored
+    if L.GetHookMask() != LUA_MASKLINE|LUA_MASKCALL|LUA_MASKCOUNT || L.GetHookCount() != 10 {
+        t.Errorf("hook mask %d, count %d", L.GetHookMask(), L.GetHookCount())
+    }
+    lines, calls, counts = 0, 0, 0
+    runCoverageScript(t, L)
+    if lines != wantLines || calls != wantCalls || counts != wantCounts {
+        t.Errorf("%d lines, %d calls, %d counts after coverage", lines, calls, counts)
+    }
+    L.SetHook(0, 0, nil)
+}
+
+func TestCoverageExecutionLimit(t *testing.T) {
+    L := newTestState(t)
+    L.SetExecutionLimit(1000)
+    if err := L.StartCoverage(); err != nil {
+        t.Fatal(err)
+    }
+    err := L.DoString(`while true do end`)
+    if err == nil || !strings.Contains(err.Error(), "quantum exceeded") {
+        t.Errorf("error %v", err)
+    }
+    L.Pop(1)
+    L.StopCoverage()
+
+    err = L.DoString(`while true do end`)
+    if err == nil || !strings.Contains(err.Error(), "quantum exceeded") {
+        t.Errorf("error %v", err)
+    }
+    L.Pop(1)
+}
+
+func TestCoverageProfile(t *testing.T) {
+    L := newTestState(t)
+    if err := L.StartProfile(ProfileOptions{Period: 10}); err != nil {
+        t.Fatal(err)
+    }
+    if err := L.StartCoverage(); err != nil {
+        t.Fatal(err)
+    }
+    runCoverageScript(t, L)
+    if err := L.DoString(`local x = 0 for i = 1, 10000 do x = x + i end`); err != nil {
+        t.Fatal(err)
+    }
+    if c := L.StopCoverage(); len(c.Files) != 1 {
+        t.Fatalf("coverage %v", c)
+    }
+    p := L.StopProfile()
+    if p == nil || len(p.Sample) == 0 {
+        t.Fatal("no samples while coverage was running")
+    }
+}
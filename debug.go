@@ -0,0 +1,175 @@
+package lua
+
+/*
+#include "clua.h"
+#include <lua.h>
+#include <lauxlib.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+    "strings"
+    "unsafe"
+)
+
+// Type of hook functions to use with SetHook
+type HookFunction func(L *State, ar *Debug)
+
+// Wraps a lua_Debug activation record.
+//
+// Records passed to a hook are only valid while the hook runs, records returned by GetStack
+// while the function they describe is active. The fields are filled by GetInfo, except Event
+// and CurrentLine which are already set in hooks for the line events.
+type Debug struct {
+    Event           int
+    Name            string
+    NameWhat        string
+    What            string
+    Source          string
+    ShortSource     string
+    CurrentLine     int
+    LineDefined     int
+    LastLineDefined int
+    NUps            int
+    NParams         int
+    IsVararg        bool
+    IsTailCall      bool
+    FTransfer       int
+    NTransfer       int
+
+    ar *C.lua_Debug
+}
+
+func newDebug(ar *C.lua_Debug) *Debug {
+    d := &Debug{Event: int(ar.event), ar: ar}
+    if d.Event == LUA_HOOKLINE {
+        d.CurrentLine = int(ar.currentline)
+    }
+    return d
+}
+
+// lua_sethook
+//
+// Installs f as the hook for the events in mask (LUA_MASKCALL, LUA_MASKRET, LUA_MASKLINE,
+// LUA_MASKCOUNT), count is the instruction count for LUA_MASKCOUNT. Calls are reported with
+// event LUA_HOOKCALL or LUA_HOOKTAILCALL. A nil f or a zero mask removes the hook.
+// Coroutines created afterwards inherit the hook. Replaces the hook set by SetExecutionLimit.
+// A panic of f, like the error of RaiseError, is raised as a lua error by the hooked code.
+func (L *State) SetHook(mask int, count int, f HookFunction) {
+    if f == nil {
+        mask = 0
+    }
+    L.mainState().hookf = f
+    C.clua_sethook(L.s, C.int(mask), C.int(count))
+}
+
+// lua_gethookmask
+func (L *State) GetHookMask() int {
+    return int(C.lua_gethookmask(L.s))
+}
+
+// lua_gethookcount
+func (L *State) GetHookCount() int {
+    return int(C.lua_gethookcount(L.s))
+}
+
+// lua_getstack
+//
+// Returns the activation record of the function at the given level (0 is the running function)
+// or nil if level is greater than the stack depth.
+func (L *State) GetStack(level int) *Debug {
+    ar := new(C.lua_Debug)
+    if C.lua_getstack(L.s, C.int(level), ar) == 0 {
+        return nil
+    }
+    return newDebug(ar)
+}
+
+// lua_getinfo
+//
+// Fills the fields of ar selected by what. When what starts with '>' the function is popped
+// from the top of the stack and ar may be a new, empty Debug.
+func (L *State) GetInfo(what string, ar *Debug) bool {
+    if ar.ar == nil {
+        ar.ar = new(C.lua_Debug)
+    }
+    Cwhat := C.CString(what)
+    defer C.free(unsafe.Pointer(Cwhat))
+    if C.lua_getinfo(L.s, Cwhat, ar.ar) == 0 {
+        return false
+    }
+    // only the fields selected by what are valid
+    d := ar.ar
+    if strings.ContainsRune(what, 'n') {
+        ar.Name = C.GoString(d.name)
+        ar.NameWhat = C.GoString(d.namewhat)
+    }
+    if strings.ContainsRune(what, 'S') {
+        ar.What = C.GoString(d.what)
+        ar.Source = C.GoStringN(d.source, C.int(d.srclen))
+        ar.ShortSource = C.GoString(&d.short_src[0])
+        ar.LineDefined = int(d.linedefined)
+        ar.LastLineDefined = int(d.lastlinedefined)
+    }
+    if strings.ContainsRune(what, 'l') {
+        ar.CurrentLine = int(d.currentline)
+    }
+    if strings.ContainsRune(what, 'u') {
+        ar.NUps = int(d.nups)
+        ar.NParams = int(d.nparams)
+        ar.IsVararg = d.isvararg != 0
+    }
+    if strings.ContainsRune(what, 't') {
+        ar.IsTailCall = d.istailcall != 0
+    }
+    if strings.ContainsRune(what, 'r') {
+        ar.FTransfer = int(d.ftransfer)
+        ar.NTransfer = int(d.ntransfer)
+    }
+    return true
+}
+
+// lua_getlocal
+//
+// Pushes the value of the n-th local of the function described by ar and returns its name, or
+// returns "" and pushes nothing when there is no such local. With a nil ar it returns the name
+// of the n-th parameter of the function on top of the stack without pushing anything.
+func (L *State) GetLocal(ar *Debug, n int) string {
+    var d *C.lua_Debug
+    if ar != nil {
+        d = ar.ar
+    }
+    return C.GoString(C.lua_getlocal(L.s, d, C.int(n)))
+}
+
+// lua_setlocal
+//
+// Assigns the value on top of the stack to the n-th local of the function described by ar and
+// pops it. Returns the name of the local, or "" (popping nothing) when there is no such local.
+func (L *State) SetLocal(ar *Debug, n int) string {
+    return C.GoString(C.lua_setlocal(L.s, ar.ar, C.int(n)))
+}
+
+// lua_getupvalue
+//
+// Pushes the n-th upvalue of the closure at funcindex and returns its name, ok is false (and
+// nothing is pushed) when there is no such upvalue. Upvalues of C functions have empty names.
+func (L *State) GetUpvalue(funcindex, n int) (string, bool) {
+    name := C.lua_getupvalue(L.s, C.int(funcindex), C.int(n))
+    if name == nil {
+        return "", false
+    }
+    return C.GoString(name), true
+}
+
+// lua_setupvalue
+//
+// Pops a value and assigns it to the n-th upvalue of the closure at funcindex, ok is false
+// (and nothing is popped) when there is no such upvalue.
+func (L *State) SetUpvalue(funcindex, n int) (string, bool) {
+    name := C.lua_setupvalue(L.s, C.int(funcindex), C.int(n))
+    if name == nil {
+        return "", false
+    }
+    return C.GoString(name), true
+}
@@ -0,0 +1,77 @@
+package lua
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestHookPanics(t *testing.T) {
+    L := newTestState(t)
+    count := 0
+    L.SetHook(LUA_MASKCOUNT, 100, func(L *State, ar *Debug) {
+        count++
+        if count%10 == 0 {
+            L.RaiseError("too many instructions")
+        }
+        if count%10 == 5 {
+            panic("plain panic")
+        }
+    })
+    for i := 0; i < 100; i++ {
+        err := L.DoString(`while true do end`)
+        if err == nil || !strings.Contains(err.Error(), "panic") && !strings.Contains(err.Error(), "too many instructions") {
+            t.Fatalf("error %v", err)
+        }
+        L.Pop(1)
+    }
+    // caught by pcall like other lua errors
+    err := L.DoString(`
+local ok, err = pcall(function() while true do end end)
+assert(not ok)`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    L.SetHook(0, 0, nil)
+    if err := L.DoString(`for i = 1, 10000 do end`); err != nil {
+        t.Fatal(err)
+    }
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestHookEvents(t *testing.T) {
+    L := newTestState(t)
+    var lines []int
+    calls := 0
+    L.SetHook(LUA_MASKLINE|LUA_MASKCALL, 0, func(L *State, ar *Debug) {
+        switch ar.Event {
+        case LUA_HOOKLINE:
+            lines = append(lines, ar.CurrentLine)
+        case LUA_HOOKCALL, LUA_HOOKTAILCALL:
+            calls++
+        }
+    })
+    err := L.DoString(`local function f(x)
+    return x + 1
+end
+local y = f(1)
+y = f(y)`)
+    L.SetHook(0, 0, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the closure is created at the line of its end
+    want := []int{3, 4, 2, 5, 2}
+    if len(lines) != len(want) {
+        t.Fatalf("lines %v, want %v", lines, want)
+    }
+    for i := range want {
+        if lines[i] != want[i] {
+            t.Fatalf("lines %v, want %v", lines, want)
+        }
+    }
+    if calls < 3 {
+        t.Errorf("%d calls reported", calls)
+    }
+}
@@ -0,0 +1,201 @@
+package dap
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/textproto"
+    "strconv"
+)
+
+// Base of every message, see https://microsoft.github.io/debug-adapter-protocol/specification
+type message struct {
+    Seq  int    `json:"seq"`
+    Type string `json:"type"`
+}
+
+type request struct {
+    message
+    Command   string          `json:"command"`
+    Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+    message
+    RequestSeq int         `json:"request_seq"`
+    Success    bool        `json:"success"`
+    Command    string      `json:"command"`
+    Message    string      `json:"message,omitempty"`
+    Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+    message
+    Event string      `json:"event"`
+    Body  interface{} `json:"body,omitempty"`
+}
+
+type capabilities struct {
+    SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+    SupportsFunctionBreakpoints      bool `json:"supportsFunctionBreakpoints"`
+    SupportsConditionalBreakpoints   bool `json:"supportsConditionalBreakpoints"`
+    SupportsEvaluateForHovers        bool `json:"supportsEvaluateForHovers"`
+}
+
+type source struct {
+    Name             string `json:"name,omitempty"`
+    Path             string `json:"path,omitempty"`
+    PresentationHint string `json:"presentationHint,omitempty"`
+}
+
+type sourceBreakpoint struct {
+    Line      int    `json:"line"`
+    Condition string `json:"condition,omitempty"`
+}
+
+type setBreakpointsArguments struct {
+    Source      source             `json:"source"`
+    Breakpoints []sourceBreakpoint `json:"breakpoints"`
+    Lines       []int              `json:"lines"`
+}
+
+type functionBreakpoint struct {
+    Name      string `json:"name"`
+    Condition string `json:"condition,omitempty"`
+}
+
+type setFunctionBreakpointsArguments struct {
+    Breakpoints []functionBreakpoint `json:"breakpoints"`
+}
+
+type breakpoint struct {
+    ID       int     `json:"id"`
+    Verified bool    `json:"verified"`
+    Line     int     `json:"line,omitempty"`
+    Source   *source `json:"source,omitempty"`
+}
+
+type breakpointsBody struct {
+    Breakpoints []breakpoint `json:"breakpoints"`
+}
+
+type thread struct {
+    ID   int    `json:"id"`
+    Name string `json:"name"`
+}
+
+type threadsBody struct {
+    Threads []thread `json:"threads"`
+}
+
+type stackTraceArguments struct {
+    ThreadID   int `json:"threadId"`
+    StartFrame int `json:"startFrame"`
+    Levels     int `json:"levels"`
+}
+
+type stackFrame struct {
+    ID               int     `json:"id"`
+    Name             string  `json:"name"`
+    Source           *source `json:"source,omitempty"`
+    Line             int     `json:"line"`
+    Column           int     `json:"column"`
+    PresentationHint string  `json:"presentationHint,omitempty"`
+}
+
+type stackTraceBody struct {
+    StackFrames []stackFrame `json:"stackFrames"`
+    TotalFrames int          `json:"totalFrames"`
+}
+
+type scopesArguments struct {
+    FrameID int `json:"frameId"`
+}
+
+type scope struct {
+    Name               string `json:"name"`
+    PresentationHint   string `json:"presentationHint,omitempty"`
+    VariablesReference int    `json:"variablesReference"`
+    Expensive          bool   `json:"expensive"`
+}
+
+type scopesBody struct {
+    Scopes []scope `json:"scopes"`
+}
+
+type variablesArguments struct {
+    VariablesReference int `json:"variablesReference"`
+}
+
+type variable struct {
+    Name               string `json:"name"`
+    Value              string `json:"value"`
+    Type               string `json:"type,omitempty"`
+    VariablesReference int    `json:"variablesReference"`
+}
+
+type variablesBody struct {
+    Variables []variable `json:"variables"`
+}
+
+type evaluateArguments struct {
+    Expression string `json:"expression"`
+    FrameID    *int   `json:"frameId"`
+    Context    string `json:"context"`
+}
+
+type evaluateBody struct {
+    Result             string `json:"result"`
+    Type               string `json:"type,omitempty"`
+    VariablesReference int    `json:"variablesReference"`
+}
+
+type continueBody struct {
+    AllThreadsContinued bool `json:"allThreadsContinued"`
+}
+
+type stoppedBody struct {
+    Reason            string `json:"reason"`
+    Description       string `json:"description,omitempty"`
+    ThreadID          int    `json:"threadId"`
+    Text              string `json:"text,omitempty"`
+    AllThreadsStopped bool   `json:"allThreadsStopped"`
+    HitBreakpointIDs  []int  `json:"hitBreakpointIds,omitempty"`
+}
+
+type outputBody struct {
+    Category string `json:"category,omitempty"`
+    Output   string `json:"output"`
+}
+
+// Reads a message framed with a Content-Length header
+func readMessage(r *bufio.Reader) ([]byte, error) {
+    header, err := textproto.NewReader(r).ReadMIMEHeader()
+    if err != nil {
+        return nil, err
+    }
+    length, err := strconv.Atoi(header.Get("Content-Length"))
+    if err != nil || length < 0 {
+        return nil, errors.New("dap: invalid Content-Length header")
+    }
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    return body, nil
+}
+
+// Writes v framed with a Content-Length header
+func writeMessage(w io.Writer, v interface{}) error {
+    body, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+        return err
+    }
+    _, err = w.Write(body)
+    return err
+}
@@ -0,0 +1,531 @@
+// Package dap serves the Debug Adapter Protocol on top of a debugger.Debugger, so that editors
+// such as VS Code or Neovim can attach to the lua code running in a lua.State.
+//
+// The host application keeps running its scripts as usual; the editor connects to the server
+// (over TCP or stdio) with an "attach" or "launch" configuration, sets breakpoints, steps and
+// inspects variables. Chunk names of the form "@file" are mapped to paths relative to Root.
+//
+//	d := debugger.New(L)
+//	srv := dap.NewServer(d)
+//	go srv.ListenAndServe("127.0.0.1:4711")
+//	<-srv.Configured()
+//	L.DoFile("main.lua")
+//	srv.Terminated()
+package dap
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/debugger"
+)
+
+// The only thread reported to the client
+const threadID = 1
+
+// Debug Adapter Protocol server for a Debugger
+type Server struct {
+    // Directory chunk names are relative to, the working directory if empty
+    Root string
+
+    d *debugger.Debugger
+
+    mu             sync.Mutex
+    session        *session
+    sources        map[string][]*debugger.Breakpoint
+    functions      []*debugger.Breakpoint
+    configured     chan struct{}
+    configuredOnce sync.Once
+}
+
+// A connected client
+type session struct {
+    s *Server
+
+    wmu sync.Mutex
+    w   io.Writer
+    seq int
+
+    // variablesReference-1 -> loader, valid until execution resumes
+    refs []func() ([]debugger.Variable, error)
+    done chan struct{}
+}
+
+// Creates a server for d
+func NewServer(d *debugger.Debugger) *Server {
+    return &Server{
+        d:          d,
+        sources:    make(map[string][]*debugger.Breakpoint),
+        configured: make(chan struct{}),
+    }
+}
+
+// Closed once the first client sent its configuration (breakpoints) and the script may run
+func (s *Server) Configured() <-chan struct{} {
+    return s.configured
+}
+
+// Listens on the TCP address and serves the clients connecting to it, one at a time
+func (s *Server) ListenAndServe(addr string) error {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    defer l.Close()
+    return s.Serve(l)
+}
+
+// Serves the clients connecting to l, one at a time
+func (s *Server) Serve(l net.Listener) error {
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            return err
+        }
+        s.ServeConn(conn)
+        conn.Close()
+    }
+}
+
+// Serves a client on stdin and stdout. As stdout carries the protocol, the output of print and
+// io.write is redirected to the client first, see RedirectOutput.
+func (s *Server) ServeStdio() error {
+    if err := s.RedirectOutput(); err != nil {
+        return err
+    }
+    return s.ServeConn(struct {
+        io.Reader
+        io.Writer
+    }{os.Stdin, os.Stdout})
+}
+
+// Replaces print, and io.write while the default output is io.stdout, so that they send their
+// text to the connected client as output events instead of writing to stdout. Other writes to
+// io.stdout are not redirected. Like SetBreakpoint on the debugger, it must be called while the
+// state does not run lua code on another goroutine, before the script starts.
+func (s *Server) RedirectOutput() error {
+    L := s.d.L
+    top := L.GetTop()
+    defer L.SetTop(top)
+    if r := L.LoadString(redirectOutput); r != 0 {
+        return fmt.Errorf("dap: %s", L.ToString(-1))
+    }
+    L.PushGoFunction(func(L *lua.State) int {
+        s.Output(L.ToString(1))
+        return 0
+    })
+    return L.Call(1, 0)
+}
+
+// Called with the function sending output events
+const redirectOutput = `
+local output = ...
+local tostring, select, type = tostring, select, type
+function print(...)
+    local s = ""
+    for i = 1, select("#", ...) do
+        s = s .. (i > 1 and "\t" or "") .. tostring((select(i, ...)))
+    end
+    output(s .. "\n")
+end
+if type(io) == "table" then
+    local write, stdout = io.write, io.stdout
+    io.write = function(...)
+        local s = ""
+        for i = 1, select("#", ...) do
+            local v = select(i, ...)
+            if type(v) ~= "string" and type(v) ~= "number" or io.output() ~= stdout then
+                -- the errors of io.write
+                return write(...)
+            end
+            s = s .. v
+        end
+        output(s)
+        return stdout
+    end
+end
+`
+
+// Serves a single client until it disconnects or the connection fails. When the client goes
+// away its breakpoints are cleared and execution is resumed.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+    ss := &session{s: s, w: rw, done: make(chan struct{})}
+    s.mu.Lock()
+    s.session = ss
+    s.mu.Unlock()
+    defer func() {
+        close(ss.done)
+        s.mu.Lock()
+        s.session = nil
+        s.mu.Unlock()
+        s.reset()
+    }()
+    go ss.forwardStops()
+
+    r := bufio.NewReader(rw)
+    for {
+        data, err := readMessage(r)
+        if err != nil {
+            if err == io.EOF {
+                return nil
+            }
+            return err
+        }
+        var req request
+        if err := json.Unmarshal(data, &req); err != nil {
+            return fmt.Errorf("dap: %v", err)
+        }
+        if req.Type != "request" {
+            continue
+        }
+        if !ss.handle(&req) {
+            return nil
+        }
+    }
+}
+
+// Tells the connected client that the script finished
+func (s *Server) Terminated() {
+    if ss := s.current(); ss != nil {
+        ss.send("terminated", nil)
+    }
+}
+
+// Sends text to the debug console of the connected client
+func (s *Server) Output(text string) {
+    if ss := s.current(); ss != nil {
+        ss.send("output", outputBody{Category: "stdout", Output: text})
+    }
+}
+
+func (s *Server) current() *session {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.session
+}
+
+// Removes the breakpoints set by the client and resumes execution
+func (s *Server) reset() {
+    s.mu.Lock()
+    for _, bps := range s.sources {
+        for _, bp := range bps {
+            s.d.ClearBreakpoint(bp)
+        }
+    }
+    for _, bp := range s.functions {
+        s.d.ClearBreakpoint(bp)
+    }
+    s.sources = make(map[string][]*debugger.Breakpoint)
+    s.functions = nil
+    s.mu.Unlock()
+    s.d.Continue()
+}
+
+func (s *Server) root() string {
+    if s.Root != "" {
+        return s.Root
+    }
+    wd, _ := os.Getwd()
+    return wd
+}
+
+// Maps a file path of the client to the chunk name used by breakpoints
+func (s *Server) chunkName(path string) string {
+    if rel, err := filepath.Rel(s.root(), path); err == nil && !strings.HasPrefix(rel, "..") {
+        return filepath.ToSlash(rel)
+    }
+    return filepath.ToSlash(path)
+}
+
+// Maps the source of a running function to a client source
+func (s *Server) source(chunk string) *source {
+    if !strings.HasPrefix(chunk, "@") {
+        name := chunk
+        if strings.HasPrefix(name, "=") {
+            name = name[1:]
+        }
+        return &source{Name: name, PresentationHint: "deemphasize"}
+    }
+    path := filepath.FromSlash(chunk[1:])
+    if !filepath.IsAbs(path) {
+        path = filepath.Join(s.root(), path)
+    }
+    return &source{Name: filepath.Base(path), Path: path}
+}
+
+// Sends the stops of the debugger as events while the session lasts
+func (ss *session) forwardStops() {
+    for {
+        select {
+        case <-ss.done:
+            return
+        case stop := <-ss.s.d.Stopped():
+            select {
+            case <-ss.done:
+                // the client went away meanwhile
+                ss.s.d.Continue()
+                return
+            default:
+            }
+            body := stoppedBody{Reason: stop.Reason, ThreadID: threadID, AllThreadsStopped: true}
+            if stop.Breakpoint != nil {
+                body.HitBreakpointIDs = []int{stop.Breakpoint.ID}
+            }
+            if stop.ConditionError != nil {
+                body.Text = "breakpoint condition: " + stop.ConditionError.Error()
+            }
+            ss.send("stopped", body)
+        }
+    }
+}
+
+// Numbers and writes a message
+func (ss *session) write(m *message, v interface{}) {
+    ss.wmu.Lock()
+    defer ss.wmu.Unlock()
+    ss.seq++
+    m.Seq = ss.seq
+    writeMessage(ss.w, v)
+}
+
+func (ss *session) send(name string, body interface{}) {
+    e := &event{message{Type: "event"}, name, body}
+    ss.write(&e.message, e)
+}
+
+func (ss *session) respond(req *request, body interface{}, err error) {
+    resp := &response{
+        message:    message{Type: "response"},
+        RequestSeq: req.Seq,
+        Success:    err == nil,
+        Command:    req.Command,
+        Body:       body,
+    }
+    if err != nil {
+        resp.Message = err.Error()
+        resp.Body = nil
+    }
+    ss.write(&resp.message, resp)
+}
+
+// Handles a request, returns false when the session ends
+func (ss *session) handle(req *request) bool {
+    var body interface{}
+    var err error
+    switch req.Command {
+    case "initialize":
+        ss.respond(req, capabilities{true, true, true, true}, nil)
+        ss.send("initialized", nil)
+        return true
+    case "launch", "attach":
+    case "configurationDone":
+        ss.s.configuredOnce.Do(func() { close(ss.s.configured) })
+    case "disconnect", "terminate":
+        ss.respond(req, nil, nil)
+        return false
+    case "setBreakpoints":
+        body, err = ss.setBreakpoints(req.Arguments)
+    case "setFunctionBreakpoints":
+        body, err = ss.setFunctionBreakpoints(req.Arguments)
+    case "setExceptionBreakpoints":
+        body = breakpointsBody{[]breakpoint{}}
+    case "threads":
+        body = threadsBody{[]thread{{threadID, "main"}}}
+    case "stackTrace":
+        body, err = ss.stackTrace(req.Arguments)
+    case "scopes":
+        body, err = ss.scopes(req.Arguments)
+    case "variables":
+        body, err = ss.variables(req.Arguments)
+    case "evaluate":
+        body, err = ss.evaluate(req.Arguments)
+    case "continue":
+        ss.refs = nil
+        body, err = continueBody{true}, ss.s.d.Continue()
+    case "next":
+        ss.refs = nil
+        err = ss.s.d.StepOver()
+    case "stepIn":
+        ss.refs = nil
+        err = ss.s.d.StepIn()
+    case "stepOut":
+        ss.refs = nil
+        err = ss.s.d.StepOut()
+    case "pause":
+        ss.s.d.Pause()
+    default:
+        err = fmt.Errorf("unsupported request %q", req.Command)
+    }
+    ss.respond(req, body, err)
+    return true
+}
+
+func (ss *session) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+    var args setBreakpointsArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    s := ss.s
+    chunk := s.chunkName(args.Source.Path)
+    if args.Source.Path == "" {
+        chunk = args.Source.Name
+    }
+    if args.Breakpoints == nil {
+        for _, line := range args.Lines {
+            args.Breakpoints = append(args.Breakpoints, sourceBreakpoint{Line: line})
+        }
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, bp := range s.sources[chunk] {
+        s.d.ClearBreakpoint(bp)
+    }
+    bps := []*debugger.Breakpoint{}
+    result := []breakpoint{}
+    for _, sb := range args.Breakpoints {
+        bp := s.d.SetBreakpoint(chunk, sb.Line, sb.Condition)
+        bps = append(bps, bp)
+        result = append(result, breakpoint{ID: bp.ID, Verified: true, Line: sb.Line, Source: &args.Source})
+    }
+    s.sources[chunk] = bps
+    return breakpointsBody{result}, nil
+}
+
+func (ss *session) setFunctionBreakpoints(raw json.RawMessage) (interface{}, error) {
+    var args setFunctionBreakpointsArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    s := ss.s
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, bp := range s.functions {
+        s.d.ClearBreakpoint(bp)
+    }
+    s.functions = nil
+    result := []breakpoint{}
+    for _, fb := range args.Breakpoints {
+        bp := s.d.SetFunctionBreakpoint(fb.Name, fb.Condition)
+        s.functions = append(s.functions, bp)
+        result = append(result, breakpoint{ID: bp.ID, Verified: true})
+    }
+    return breakpointsBody{result}, nil
+}
+
+// Frame ids are the stack level plus one
+func (ss *session) stackTrace(raw json.RawMessage) (interface{}, error) {
+    var args stackTraceArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    frames, err := ss.s.d.Stack()
+    if err != nil {
+        return nil, err
+    }
+    result := []stackFrame{}
+    for i, f := range frames {
+        if i < args.StartFrame || (args.Levels > 0 && len(result) >= args.Levels) {
+            continue
+        }
+        sf := stackFrame{ID: f.Level + 1, Name: f.Name, Line: f.Line, Column: 1}
+        if sf.Name == "" {
+            switch f.What {
+            case "main":
+                sf.Name = "main chunk"
+            default:
+                sf.Name = fmt.Sprintf("function <%s:%d>", f.ShortSource, f.LineDefined)
+            }
+        }
+        if f.What == "C" {
+            sf.PresentationHint = "subtle"
+            sf.Line = 0
+        } else {
+            sf.Source = ss.s.source(f.Source)
+        }
+        result = append(result, sf)
+    }
+    return stackTraceBody{result, len(frames)}, nil
+}
+
+func (ss *session) scopes(raw json.RawMessage) (interface{}, error) {
+    var args scopesArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    level := args.FrameID - 1
+    d := ss.s.d
+    locals := ss.ref(func() ([]debugger.Variable, error) { return d.Locals(level) })
+    upvalues := ss.ref(func() ([]debugger.Variable, error) { return d.Upvalues(level) })
+    return scopesBody{[]scope{
+        {Name: "Locals", PresentationHint: "locals", VariablesReference: locals},
+        {Name: "Upvalues", VariablesReference: upvalues},
+    }}, nil
+}
+
+func (ss *session) variables(raw json.RawMessage) (interface{}, error) {
+    var args variablesArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    if args.VariablesReference <= 0 || args.VariablesReference > len(ss.refs) {
+        return nil, fmt.Errorf("invalid variablesReference %d", args.VariablesReference)
+    }
+    vars, err := ss.refs[args.VariablesReference-1]()
+    if err != nil {
+        return nil, err
+    }
+    result := []variable{}
+    for _, v := range vars {
+        result = append(result, variable{v.Name, v.Value, v.Type, ss.tableRef(v)})
+    }
+    return variablesBody{result}, nil
+}
+
+func (ss *session) evaluate(raw json.RawMessage) (interface{}, error) {
+    var args evaluateArguments
+    if err := json.Unmarshal(raw, &args); err != nil {
+        return nil, err
+    }
+    level := 0
+    if args.FrameID != nil {
+        level = *args.FrameID - 1
+    }
+    vars, err := ss.s.d.Eval(level, args.Expression)
+    if err != nil {
+        return nil, err
+    }
+    switch len(vars) {
+    case 0:
+        return evaluateBody{Result: "nil"}, nil
+    case 1:
+        return evaluateBody{vars[0].Value, vars[0].Type, ss.tableRef(vars[0])}, nil
+    }
+    values := make([]string, len(vars))
+    for i, v := range vars {
+        values[i] = v.Value
+    }
+    return evaluateBody{Result: strings.Join(values, ", ")}, nil
+}
+
+func (ss *session) ref(load func() ([]debugger.Variable, error)) int {
+    ss.refs = append(ss.refs, load)
+    return len(ss.refs)
+}
+
+// Reference to expand the fields of a table variable, 0 for other values
+func (ss *session) tableRef(v debugger.Variable) int {
+    if v.Handle == 0 {
+        return 0
+    }
+    d, handle := ss.s.d, v.Handle
+    return ss.ref(func() ([]debugger.Variable, error) { return d.Fields(handle) })
+}
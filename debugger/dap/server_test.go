@@ -0,0 +1,186 @@
+package dap
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "net"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/DGHeroin/lua.go"
+    "github.com/DGHeroin/lua.go/debugger"
+)
+
+const testScript = `local function add(a, b)
+    local sum = a + b
+    return sum
+end
+print("start", 1)
+local t = {x = add(40, 2)}
+io.write("done ", t.x, "\n")
+`
+
+// Scripted client on the other end of the connection
+type client struct {
+    t    *testing.T
+    conn net.Conn
+    r    *bufio.Reader
+    seq  int
+    // messages received while waiting for others
+    pending []map[string]interface{}
+}
+
+func (c *client) request(command string, args interface{}) {
+    c.t.Helper()
+    c.seq++
+    raw, _ := json.Marshal(args)
+    req := request{message{c.seq, "request"}, command, raw}
+    if err := writeMessage(c.conn, req); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+func (c *client) read() map[string]interface{} {
+    c.t.Helper()
+    if len(c.pending) > 0 {
+        m := c.pending[0]
+        c.pending = c.pending[1:]
+        return m
+    }
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    data, err := readMessage(c.r)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    var m map[string]interface{}
+    if err := json.Unmarshal(data, &m); err != nil {
+        c.t.Fatal(err)
+    }
+    return m
+}
+
+// Waits for the response to command or the event, keeping the other messages for later
+func (c *client) expect(typ, name string) map[string]interface{} {
+    c.t.Helper()
+    var skipped []map[string]interface{}
+    defer func() { c.pending = append(skipped, c.pending...) }()
+    for i := 0; i < 50; i++ {
+        m := c.read()
+        if m["type"] == typ && (m["command"] == name || m["event"] == name) {
+            if typ == "response" && m["success"] != true {
+                c.t.Fatalf("%s failed: %v", name, m["message"])
+            }
+            body, _ := m["body"].(map[string]interface{})
+            return body
+        }
+        skipped = append(skipped, m)
+    }
+    c.t.Fatalf("no %s %s", typ, name)
+    return nil
+}
+
+func (c *client) call(command string, args interface{}) map[string]interface{} {
+    c.t.Helper()
+    c.request(command, args)
+    return c.expect("response", command)
+}
+
+func TestServer(t *testing.T) {
+    L := lua.NewState()
+    L.OpenLibs()
+    defer L.Close()
+    d := debugger.New(L)
+    defer d.Close()
+    srv := NewServer(d)
+    root := t.TempDir()
+    srv.Root = root
+    if err := srv.RedirectOutput(); err != nil {
+        t.Fatal(err)
+    }
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go srv.Serve(l)
+
+    // the host runs the script once configured
+    result := make(chan error, 1)
+    go func() {
+        <-srv.Configured()
+        if r := L.LoadBuffer([]byte(testScript), "@main.lua", "t"); r != 0 {
+            result <- errors.New(L.ToString(-1))
+            return
+        }
+        err := L.Call(0, 0)
+        srv.Terminated()
+        result <- err
+    }()
+
+    conn, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+    caps := c.call("initialize", map[string]interface{}{"adapterID": "lua"})
+    if caps["supportsConfigurationDoneRequest"] != true {
+        t.Errorf("capabilities %v", caps)
+    }
+    c.expect("event", "initialized")
+    c.call("launch", map[string]interface{}{})
+    bps := c.call("setBreakpoints", map[string]interface{}{
+        "source":      map[string]interface{}{"path": filepath.Join(root, "main.lua")},
+        "breakpoints": []map[string]interface{}{{"line": 3}},
+    })
+    if list, _ := bps["breakpoints"].([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["verified"] != true {
+        t.Fatalf("breakpoints %v", bps)
+    }
+    c.call("configurationDone", nil)
+
+    output := c.expect("event", "output")
+    if output["output"] != "start\t1\n" {
+        t.Errorf("output %q", output["output"])
+    }
+    stopped := c.expect("event", "stopped")
+    if stopped["reason"] != debugger.ReasonBreakpoint {
+        t.Errorf("stopped %v", stopped)
+    }
+
+    trace := c.call("stackTrace", map[string]interface{}{"threadId": threadID})
+    frames := trace["stackFrames"].([]interface{})
+    top := frames[0].(map[string]interface{})
+    if top["line"] != 3.0 || top["name"] != "add" {
+        t.Fatalf("top frame %v", top)
+    }
+    if src := top["source"].(map[string]interface{}); src["path"] != filepath.Join(root, "main.lua") {
+        t.Errorf("source %v", src)
+    }
+
+    scopes := c.call("scopes", map[string]interface{}{"frameId": top["id"]})
+    locals := scopes["scopes"].([]interface{})[0].(map[string]interface{})
+    vars := c.call("variables", map[string]interface{}{"variablesReference": locals["variablesReference"]})
+    values := map[string]interface{}{}
+    for _, v := range vars["variables"].([]interface{}) {
+        v := v.(map[string]interface{})
+        values[v["name"].(string)] = v["value"]
+    }
+    if values["a"] != "40" || values["b"] != "2" || values["sum"] != "42" {
+        t.Errorf("locals %v", values)
+    }
+
+    c.call("continue", map[string]interface{}{"threadId": threadID})
+    output = c.expect("event", "output")
+    if output["output"] != "done 42\n" {
+        t.Errorf("output %q", output["output"])
+    }
+    c.expect("event", "terminated")
+    if err := <-result; err != nil {
+        t.Fatal(err)
+    }
+    c.call("disconnect", nil)
+}
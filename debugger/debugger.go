@@ -0,0 +1,430 @@
+// Package debugger implements breakpoints, stepping and inspection of the lua code running in
+// a lua.State, driven from go.
+//
+// The debugger installs a hook on the State. When execution stops the goroutine running the
+// lua code blocks inside the hook and a Stop is sent on Stopped(); the inspection methods
+// (Stack, Locals, Upvalues, Eval, Fields) are then executed on that goroutine until one of
+// Continue, StepIn, StepOver or StepOut resumes execution.
+package debugger
+
+import (
+    "errors"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+// Returned by the inspection methods when execution is not stopped
+var ErrNotStopped = errors.New("debugger: not stopped")
+
+// Reasons for a Stop
+const (
+    ReasonBreakpoint         = "breakpoint"
+    ReasonFunctionBreakpoint = "function breakpoint"
+    ReasonStep               = "step"
+    ReasonPause              = "pause"
+)
+
+// A line or function breakpoint
+type Breakpoint struct {
+    ID int
+    // Chunk the breakpoint is in, matched against the end of the source of running functions
+    Source string
+    Line   int
+    // Function name for function breakpoints
+    Function string
+    // Lua expression evaluated in the stopped frame, the breakpoint only triggers when it is true
+    Condition string
+    // Number of times the breakpoint triggered
+    Hits int
+}
+
+// Describes why and where execution stopped
+type Stop struct {
+    Reason     string
+    Breakpoint *Breakpoint
+    // Error raised by the breakpoint condition, if any
+    ConditionError error
+    Source         string
+    Line           int
+}
+
+type stepMode int
+
+const (
+    stepNone stepMode = iota
+    stepIn
+    stepOver
+    stepOut
+)
+
+type request struct {
+    fn   func(L *lua.State)
+    done chan struct{}
+}
+
+// Debugger attached to a lua.State
+type Debugger struct {
+    L *lua.State
+
+    mu          sync.Mutex
+    nextID      int
+    lines       map[int][]*Breakpoint
+    functions   map[string][]*Breakpoint
+    pause       bool
+    closed      bool
+    stopped     bool
+    step        stepMode
+    stepDepth   int
+    stepThread  uintptr
+    pendingFunc *Breakpoint
+
+    events   chan *Stop
+    requests chan request
+    // closed by the resume of the current stop, with the step mode in resumeMode
+    resumed    chan struct{}
+    resumeMode stepMode
+
+    // valid while stopped, only touched by the goroutine running lua
+    handles []int
+}
+
+// Attaches a debugger to L by installing a call and line hook.
+//
+// L must not be running lua code on another goroutine when New is called.
+func New(L *lua.State) *Debugger {
+    d := &Debugger{
+        L:         L,
+        lines:     make(map[int][]*Breakpoint),
+        functions: make(map[string][]*Breakpoint),
+        events:    make(chan *Stop, 1),
+        requests:  make(chan request),
+    }
+    L.SetHook(lua.LUA_MASKCALL|lua.LUA_MASKLINE, 0, d.hook)
+    return d
+}
+
+// Detaches the debugger. If execution is stopped it is resumed; the hook is removed right
+// away when stopped, otherwise the next time it runs.
+func (d *Debugger) Close() {
+    d.mu.Lock()
+    d.closed = true
+    stopped := d.stopped
+    d.mu.Unlock()
+    if stopped {
+        d.do(func(L *lua.State) { L.SetHook(0, 0, nil) })
+        d.Continue()
+    }
+}
+
+// Channel receiving a Stop every time execution stops
+func (d *Debugger) Stopped() <-chan *Stop {
+    return d.events
+}
+
+// Sets a breakpoint at line of source. The condition, if not empty, is a lua expression.
+func (d *Debugger) SetBreakpoint(source string, line int, condition string) *Breakpoint {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.nextID++
+    bp := &Breakpoint{ID: d.nextID, Source: filepath.ToSlash(source), Line: line, Condition: condition}
+    d.lines[line] = append(d.lines[line], bp)
+    return bp
+}
+
+// Sets a breakpoint on the first line of every function called name
+func (d *Debugger) SetFunctionBreakpoint(name string, condition string) *Breakpoint {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.nextID++
+    bp := &Breakpoint{ID: d.nextID, Function: name, Condition: condition}
+    d.functions[name] = append(d.functions[name], bp)
+    return bp
+}
+
+// Removes a breakpoint
+func (d *Debugger) ClearBreakpoint(bp *Breakpoint) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if bp.Function != "" {
+        d.functions[bp.Function] = removeBreakpoint(d.functions[bp.Function], bp)
+        if len(d.functions[bp.Function]) == 0 {
+            delete(d.functions, bp.Function)
+        }
+        return
+    }
+    d.lines[bp.Line] = removeBreakpoint(d.lines[bp.Line], bp)
+    if len(d.lines[bp.Line]) == 0 {
+        delete(d.lines, bp.Line)
+    }
+}
+
+// Removes all breakpoints
+func (d *Debugger) ClearBreakpoints() {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.lines = make(map[int][]*Breakpoint)
+    d.functions = make(map[string][]*Breakpoint)
+}
+
+// Returns all breakpoints
+func (d *Debugger) Breakpoints() []*Breakpoint {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    r := []*Breakpoint{}
+    for _, bps := range d.lines {
+        r = append(r, bps...)
+    }
+    for _, bps := range d.functions {
+        r = append(r, bps...)
+    }
+    return r
+}
+
+func removeBreakpoint(bps []*Breakpoint, bp *Breakpoint) []*Breakpoint {
+    r := bps[:0]
+    for _, b := range bps {
+        if b != bp {
+            r = append(r, b)
+        }
+    }
+    return r
+}
+
+// Stops execution at the next line executed
+func (d *Debugger) Pause() {
+    d.mu.Lock()
+    d.pause = true
+    d.mu.Unlock()
+}
+
+// Resumes execution until the next breakpoint
+func (d *Debugger) Continue() error { return d.doResume(stepNone) }
+
+// Resumes execution until the next line, entering called functions
+func (d *Debugger) StepIn() error { return d.doResume(stepIn) }
+
+// Resumes execution until the next line of the current function or of its callers
+func (d *Debugger) StepOver() error { return d.doResume(stepOver) }
+
+// Resumes execution until control returns to the caller of the current function
+func (d *Debugger) StepOut() error { return d.doResume(stepOut) }
+
+func (d *Debugger) doResume(mode stepMode) error {
+    d.mu.Lock()
+    if !d.stopped {
+        d.mu.Unlock()
+        return ErrNotStopped
+    }
+    d.stopped = false
+    d.resumeMode = mode
+    close(d.resumed)
+    d.mu.Unlock()
+    return nil
+}
+
+// Runs fn on the goroutine stopped in the hook. The request is only handed over while the
+// stop it was made in lasts: a resume racing with it makes it fail with ErrNotStopped.
+func (d *Debugger) do(fn func(L *lua.State)) error {
+    d.mu.Lock()
+    stopped, resumed := d.stopped, d.resumed
+    d.mu.Unlock()
+    if !stopped {
+        return ErrNotStopped
+    }
+    r := request{fn, make(chan struct{})}
+    select {
+    case d.requests <- r:
+        <-r.done
+        return nil
+    case <-resumed:
+        return ErrNotStopped
+    }
+}
+
+func (d *Debugger) hook(L *lua.State, ar *lua.Debug) {
+    d.mu.Lock()
+    if d.closed {
+        d.mu.Unlock()
+        L.SetHook(0, 0, nil)
+        return
+    }
+    d.mu.Unlock()
+
+    switch ar.Event {
+    case lua.LUA_HOOKCALL, lua.LUA_HOOKTAILCALL:
+        d.hookCall(L, ar)
+    case lua.LUA_HOOKLINE:
+        d.hookLine(L, ar)
+    }
+}
+
+func (d *Debugger) hookCall(L *lua.State, ar *lua.Debug) {
+    d.mu.Lock()
+    if len(d.functions) == 0 {
+        d.mu.Unlock()
+        return
+    }
+    d.mu.Unlock()
+
+    L.GetInfo("nS", ar)
+    if ar.What == "C" {
+        return
+    }
+    d.mu.Lock()
+    bps := d.functions[ar.Name]
+    if len(bps) > 0 {
+        // stop on the first line of the function
+        d.pendingFunc = bps[0]
+    }
+    d.mu.Unlock()
+}
+
+func (d *Debugger) hookLine(L *lua.State, ar *lua.Debug) {
+    d.mu.Lock()
+    pause, step, pending := d.pause, d.step, d.pendingFunc
+    bps := d.lines[ar.CurrentLine]
+    d.pause, d.pendingFunc = false, nil
+    d.mu.Unlock()
+
+    if pause {
+        d.stop(L, &Stop{Reason: ReasonPause}, ar)
+        return
+    }
+    if pending != nil {
+        stop := &Stop{Reason: ReasonFunctionBreakpoint, Breakpoint: pending}
+        if d.checkCondition(L, pending, stop) {
+            d.stop(L, stop, ar)
+            return
+        }
+    }
+    if step != stepNone && d.stepDone(L, step) {
+        d.stop(L, &Stop{Reason: ReasonStep}, ar)
+        return
+    }
+    if len(bps) == 0 {
+        return
+    }
+    L.GetInfo("S", ar)
+    for _, bp := range bps {
+        if !matchSource(ar.Source, bp.Source) {
+            continue
+        }
+        stop := &Stop{Reason: ReasonBreakpoint, Breakpoint: bp}
+        if d.checkCondition(L, bp, stop) {
+            d.stop(L, stop, ar)
+            return
+        }
+    }
+}
+
+// Returns true if the breakpoint condition holds (or failed to evaluate, which is reported)
+func (d *Debugger) checkCondition(L *lua.State, bp *Breakpoint, stop *Stop) bool {
+    if bp.Condition == "" {
+        return true
+    }
+    ok, err := evalCondition(L, 0, bp.Condition)
+    if err != nil {
+        stop.ConditionError = err
+        return true
+    }
+    return ok
+}
+
+func (d *Debugger) stepDone(L *lua.State, step stepMode) bool {
+    if step == stepIn {
+        return true
+    }
+    d.mu.Lock()
+    depth, thread := d.stepDepth, d.stepThread
+    d.mu.Unlock()
+    if threadID(L) != thread {
+        return false
+    }
+    cur := stackDepth(L)
+    if step == stepOver {
+        return cur <= depth
+    }
+    return cur < depth
+}
+
+func (d *Debugger) stop(L *lua.State, stop *Stop, ar *lua.Debug) {
+    L.GetInfo("Sl", ar)
+    stop.Source = ar.Source
+    stop.Line = ar.CurrentLine
+    if stop.Breakpoint != nil {
+        d.mu.Lock()
+        stop.Breakpoint.Hits++
+        d.mu.Unlock()
+    }
+
+    d.mu.Lock()
+    d.stopped = true
+    d.step = stepNone
+    resumed := make(chan struct{})
+    d.resumed = resumed
+    d.mu.Unlock()
+    d.events <- stop
+
+    for {
+        select {
+        case r := <-d.requests:
+            r.fn(L)
+            close(r.done)
+        case <-resumed:
+            d.releaseHandles(L)
+            d.mu.Lock()
+            mode := d.resumeMode
+            d.step = mode
+            if mode == stepOver || mode == stepOut {
+                d.stepDepth = stackDepth(L)
+                d.stepThread = threadID(L)
+            }
+            d.mu.Unlock()
+            return
+        }
+    }
+}
+
+// Returns true if the chunk name of a running function refers to the breakpoint source
+func matchSource(source, bpSource string) bool {
+    if strings.HasPrefix(source, "@") || strings.HasPrefix(source, "=") {
+        source = source[1:]
+    }
+    source = filepath.ToSlash(source)
+    if source == bpSource {
+        return true
+    }
+    return strings.HasSuffix(source, "/"+strings.TrimPrefix(bpSource, "./"))
+}
+
+// Number of active functions on the stack of L
+func stackDepth(L *lua.State) int {
+    lo, hi := 0, 1
+    if L.GetStack(0) == nil {
+        return 0
+    }
+    for L.GetStack(hi) != nil {
+        lo = hi
+        hi *= 2
+    }
+    for hi-lo > 1 {
+        mid := (lo + hi) / 2
+        if L.GetStack(mid) != nil {
+            lo = mid
+        } else {
+            hi = mid
+        }
+    }
+    return lo + 1
+}
+
+// Identifies the coroutine L runs
+func threadID(L *lua.State) uintptr {
+    L.PushThread()
+    id := L.ToPointer(-1)
+    L.Pop(1)
+    return id
+}
@@ -0,0 +1,363 @@
+package debugger
+
+import (
+    "errors"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+const testScript = `local counter = 0
+local function add(n)
+    local doubled = n * 2
+    counter = counter + doubled
+    return counter
+end
+local function outer(x)
+    local r = add(x)
+    return r + 1
+end
+local t = {name = "t", list = {1, 2}}
+for i = 1, 3 do
+    outer(i)
+end
+result = counter
+`
+
+// A script running on its own goroutine under a debugger
+type session struct {
+    t      *testing.T
+    L      *lua.State
+    d      *Debugger
+    result chan error
+}
+
+// Attaches a debugger, lets setup set the breakpoints and runs the script as main.lua
+func start(t *testing.T, script string, setup func(d *Debugger)) *session {
+    t.Helper()
+    L := lua.NewState()
+    L.OpenLibs()
+    s := &session{t, L, New(L), make(chan error, 1)}
+    if setup != nil {
+        setup(s.d)
+    }
+    go func() {
+        if L.LoadBuffer([]byte(script), "@main.lua", "t") != 0 {
+            s.result <- errors.New(L.ToString(-1))
+            return
+        }
+        s.result <- L.Call(0, 0)
+    }()
+    t.Cleanup(func() {
+        s.d.Close()
+        select {
+        case <-s.result:
+        case <-time.After(5 * time.Second):
+            t.Fatal("script still running")
+        }
+        L.Close()
+    })
+    return s
+}
+
+// Waits for the next stop at line
+func (s *session) wait(reason string, line int) *Stop {
+    s.t.Helper()
+    select {
+    case stop := <-s.d.Stopped():
+        if stop.Reason != reason || stop.Line != line || stop.Source != "@main.lua" {
+            s.t.Fatalf("stopped at %s:%d (%s), want line %d (%s)", stop.Source, stop.Line, stop.Reason, line, reason)
+        }
+        return stop
+    case err := <-s.result:
+        s.t.Fatalf("script ended (%v), want a stop at line %d", err, line)
+    case <-time.After(5 * time.Second):
+        s.t.Fatalf("no stop at line %d", line)
+    }
+    return nil
+}
+
+// Waits for the end of the script, which must not stop again
+func (s *session) finish() {
+    s.t.Helper()
+    select {
+    case err := <-s.result:
+        if err != nil {
+            s.t.Fatal(err)
+        }
+        s.result <- nil
+    case stop := <-s.d.Stopped():
+        s.t.Fatalf("stopped at line %d (%s), want the end", stop.Line, stop.Reason)
+    case <-time.After(5 * time.Second):
+        s.t.Fatal("script still running")
+    }
+}
+
+func (s *session) resume(f func() error) {
+    s.t.Helper()
+    if err := f(); err != nil {
+        s.t.Fatal(err)
+    }
+}
+
+// Returns the variables as name=value
+func (s *session) vars(vs []Variable, err error) map[string]string {
+    s.t.Helper()
+    if err != nil {
+        s.t.Fatal(err)
+    }
+    m := map[string]string{}
+    for _, v := range vs {
+        m[v.Name] = v.Value
+    }
+    return m
+}
+
+func TestLineBreakpoint(t *testing.T) {
+    var bp *Breakpoint
+    s := start(t, testScript, func(d *Debugger) {
+        bp = d.SetBreakpoint("main.lua", 4, "")
+        d.SetBreakpoint("other.lua", 4, "")
+    })
+    for i := 1; i <= 3; i++ {
+        stop := s.wait(ReasonBreakpoint, 4)
+        if stop.Breakpoint != bp || bp.Hits != i {
+            t.Errorf("breakpoint %+v, hit %d", stop.Breakpoint, i)
+        }
+        s.resume(s.d.Continue)
+    }
+    s.finish()
+    if len(s.d.Breakpoints()) != 2 {
+        t.Errorf("breakpoints %v", s.d.Breakpoints())
+    }
+    s.L.GetGlobal("result")
+    if n := s.L.ToInteger(-1); n != 12 {
+        t.Errorf("result %d", n)
+    }
+    s.L.Pop(1)
+}
+
+func TestClearBreakpoint(t *testing.T) {
+    var bp *Breakpoint
+    s := start(t, testScript, func(d *Debugger) {
+        bp = d.SetBreakpoint("main.lua", 4, "")
+    })
+    s.wait(ReasonBreakpoint, 4)
+    s.d.ClearBreakpoint(bp)
+    s.resume(s.d.Continue)
+    s.finish()
+    if bp.Hits != 1 || len(s.d.Breakpoints()) != 0 {
+        t.Errorf("hits %d, breakpoints %v", bp.Hits, s.d.Breakpoints())
+    }
+}
+
+func TestFunctionBreakpoint(t *testing.T) {
+    var bp *Breakpoint
+    s := start(t, testScript, func(d *Debugger) {
+        bp = d.SetFunctionBreakpoint("add", "n == 2")
+    })
+    // on the first line of the function, when the condition holds
+    stop := s.wait(ReasonFunctionBreakpoint, 3)
+    if stop.Breakpoint != bp {
+        t.Errorf("breakpoint %+v", stop.Breakpoint)
+    }
+    if got := s.vars(s.d.Locals(0)); got["n"] != "2" {
+        t.Errorf("locals %v", got)
+    }
+    s.resume(s.d.Continue)
+    s.finish()
+}
+
+func TestConditionalBreakpoint(t *testing.T) {
+    s := start(t, testScript, func(d *Debugger) {
+        d.SetBreakpoint("main.lua", 4, "counter > 1 and doubled == 6")
+        d.SetBreakpoint("main.lua", 9, "r > 100")
+        d.SetBreakpoint("main.lua", 15, "nil + 1")
+    })
+    stop := s.wait(ReasonBreakpoint, 4)
+    if got := s.vars(s.d.Locals(0)); got["n"] != "3" {
+        t.Errorf("locals %v", got)
+    }
+    s.resume(s.d.Continue)
+    // the error of the condition is reported, and stops
+    stop = s.wait(ReasonBreakpoint, 15)
+    if stop.ConditionError == nil || !strings.Contains(stop.ConditionError.Error(), "arithmetic") {
+        t.Errorf("condition error %v", stop.ConditionError)
+    }
+    s.resume(s.d.Continue)
+    s.finish()
+}
+
+func TestStep(t *testing.T) {
+    s := start(t, testScript, func(d *Debugger) {
+        d.SetBreakpoint("main.lua", 8, "x == 1")
+    })
+    s.wait(ReasonBreakpoint, 8)
+    s.resume(s.d.StepIn)
+    s.wait(ReasonStep, 3)
+    s.resume(s.d.StepOver)
+    s.wait(ReasonStep, 4)
+    s.resume(s.d.StepOut)
+    s.wait(ReasonStep, 9)
+    // over the call of outer, in the loop of the main chunk
+    s.resume(s.d.StepOver)
+    s.wait(ReasonStep, 12)
+    s.resume(s.d.StepOver)
+    s.wait(ReasonStep, 13)
+    s.resume(s.d.StepOver)
+    s.wait(ReasonStep, 12)
+    s.d.ClearBreakpoints()
+    s.resume(s.d.Continue)
+    s.finish()
+}
+
+func TestInspect(t *testing.T) {
+    s := start(t, testScript, func(d *Debugger) {
+        d.SetBreakpoint("main.lua", 5, "n == 2")
+    })
+    if _, err := s.d.Stack(); err != ErrNotStopped {
+        t.Errorf("Stack while running: %v", err)
+    }
+    s.wait(ReasonBreakpoint, 5)
+
+    frames, err := s.d.Stack()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for _, f := range frames {
+        got = append(got, f.Name+":"+f.What+":"+strings.TrimPrefix(f.Source, "@"))
+    }
+    if strings.Join(got, " ") != "add:Lua:main.lua outer:Lua:main.lua :main:main.lua" {
+        t.Errorf("stack %v", got)
+    }
+    if frames[0].Line != 5 || frames[1].Line != 8 || frames[2].Line != 13 || frames[0].LineDefined != 2 {
+        t.Errorf("lines %+v", frames)
+    }
+
+    locals := s.vars(s.d.Locals(0))
+    if len(locals) != 2 || locals["n"] != "2" || locals["doubled"] != "4" {
+        t.Errorf("locals %v", locals)
+    }
+    if up := s.vars(s.d.Upvalues(0)); up["counter"] != "6" {
+        t.Errorf("upvalues %v", up)
+    }
+    if up := s.vars(s.d.Upvalues(1)); !strings.HasPrefix(up["add"], "function: 0x") {
+        t.Errorf("upvalues of outer %v", up)
+    }
+    if _, err := s.d.Locals(10); err == nil {
+        t.Error("Locals of a missing level")
+    }
+
+    // locals, upvalues and globals, in the function at the level
+    if got := s.vars(s.d.Eval(0, "n + doubled, counter, type(print)")); got["1"] != "6" || got["2"] != "6" || got["3"] != `"function"` {
+        t.Errorf("Eval %v", got)
+    }
+    if got := s.vars(s.d.Eval(1, "x, r")); got["1"] != "2" || got["2"] != "nil" {
+        t.Errorf("Eval in outer %v", got)
+    }
+    if got := s.vars(s.d.Eval(0, "local a = n * 10 return a")); got["1"] != "20" {
+        t.Errorf("Eval of a statement %v", got)
+    }
+    if _, err := s.d.Eval(0, "error('boom')"); err == nil || !strings.Contains(err.Error(), "boom") {
+        t.Errorf("Eval error %v", err)
+    }
+    if _, err := s.d.Eval(0, "+"); err == nil {
+        t.Error("Eval of a syntax error")
+    }
+
+    // tables of the main chunk get handles
+    main, err := s.d.Locals(2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    handle := 0
+    for _, v := range main {
+        if v.Name == "t" {
+            handle = v.Handle
+        }
+        if strings.HasPrefix(v.Name, "(") {
+            t.Errorf("internal local %s", v.Name)
+        }
+    }
+    if handle == 0 {
+        t.Fatalf("locals of the main chunk %v", main)
+    }
+    fields, err := s.d.Fields(handle)
+    got2 := s.vars(fields, err)
+    if got2["name"] != `"t"` || !strings.HasPrefix(got2["list"], "table: 0x") {
+        t.Errorf("fields %v", got2)
+    }
+    for _, f := range fields {
+        if f.Name == "list" {
+            if items := s.vars(s.d.Fields(f.Handle)); items["[1]"] != "1" || items["[2]"] != "2" {
+                t.Errorf("fields of list %v", items)
+            }
+        }
+    }
+    if _, err := s.d.Fields(1000); err == nil {
+        t.Error("Fields of an invalid handle")
+    }
+    s.resume(s.d.Continue)
+    s.finish()
+    if _, err := s.d.Fields(handle); err != ErrNotStopped {
+        t.Errorf("Fields once resumed: %v", err)
+    }
+}
+
+func TestPauseAndClose(t *testing.T) {
+    s := start(t, `local n = 0 while n < 1e6 do n = n + 1 end result = n`, nil)
+    time.Sleep(10 * time.Millisecond)
+    s.d.Pause()
+    s.wait(ReasonPause, 1)
+    if err := s.d.StepIn(); err != nil {
+        t.Fatal(err)
+    }
+    s.wait(ReasonStep, 1)
+    // resumes the script without the hook
+    s.d.Close()
+    s.finish()
+    if err := s.d.Continue(); err != ErrNotStopped {
+        t.Errorf("Continue once closed: %v", err)
+    }
+    s.L.GetGlobal("result")
+    if n := s.L.ToInteger(-1); n != 1e6 {
+        t.Errorf("result %d", n)
+    }
+    s.L.Pop(1)
+}
+
+// Inspection racing with the resume: the requests run while stopped or fail, without blocking
+func TestInspectWhileResuming(t *testing.T) {
+    s := start(t, testScript, func(d *Debugger) {
+        d.SetBreakpoint("main.lua", 4, "")
+    })
+    for i := 0; i < 3; i++ {
+        s.wait(ReasonBreakpoint, 4)
+        var wg sync.WaitGroup
+        for j := 0; j < 4; j++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                // until resumed, or served by the next stop
+                for k := 0; k < 100; k++ {
+                    _, err := s.d.Locals(0)
+                    if err == ErrNotStopped {
+                        return
+                    }
+                    if err != nil {
+                        t.Error(err)
+                        return
+                    }
+                }
+            }()
+        }
+        time.Sleep(time.Millisecond)
+        s.resume(s.d.Continue)
+        wg.Wait()
+    }
+    s.finish()
+}
@@ -0,0 +1,276 @@
+package debugger
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/DGHeroin/lua.go"
+)
+
+// An active function on the stack of the stopped State, level 0 is the innermost
+type Frame struct {
+    Level       int
+    Name        string
+    What        string
+    Source      string
+    ShortSource string
+    Line        int
+    LineDefined int
+}
+
+// A named lua value. Tables get a Handle to list their fields with Fields while stopped.
+type Variable struct {
+    Name   string
+    Type   string
+    Value  string
+    Handle int
+}
+
+// Returns the active functions on the stack of the stopped State
+func (d *Debugger) Stack() ([]Frame, error) {
+    frames := []Frame{}
+    err := d.do(func(L *lua.State) {
+        for level := 0; ; level++ {
+            ar := L.GetStack(level)
+            if ar == nil {
+                break
+            }
+            L.GetInfo("nSl", ar)
+            frames = append(frames, Frame{level, ar.Name, ar.What, ar.Source, ar.ShortSource, ar.CurrentLine, ar.LineDefined})
+        }
+    })
+    return frames, err
+}
+
+// Returns the locals visible in the function at level, in declaration order
+func (d *Debugger) Locals(level int) ([]Variable, error) {
+    var vars []Variable
+    var ferr error
+    err := d.do(func(L *lua.State) {
+        ar := L.GetStack(level)
+        if ar == nil {
+            ferr = fmt.Errorf("debugger: no function at level %d", level)
+            return
+        }
+        vars = []Variable{}
+        for i := 1; ; i++ {
+            name := L.GetLocal(ar, i)
+            if name == "" {
+                break
+            }
+            if !strings.HasPrefix(name, "(") {
+                vars = append(vars, d.variable(L, name, -1))
+            }
+            L.Pop(1)
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vars, ferr
+}
+
+// Returns the upvalues of the function at level
+func (d *Debugger) Upvalues(level int) ([]Variable, error) {
+    var vars []Variable
+    var ferr error
+    err := d.do(func(L *lua.State) {
+        ar := L.GetStack(level)
+        if ar == nil {
+            ferr = fmt.Errorf("debugger: no function at level %d", level)
+            return
+        }
+        L.GetInfo("f", ar)
+        vars = []Variable{}
+        for i := 1; ; i++ {
+            name, ok := L.GetUpvalue(-1, i)
+            if !ok {
+                break
+            }
+            vars = append(vars, d.variable(L, name, -1))
+            L.Pop(1)
+        }
+        L.Pop(1)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vars, ferr
+}
+
+// Evaluates a lua expression in the function at level. Locals and upvalues of the function
+// are visible (as copies) together with its globals. Statements are accepted too, in which
+// case the values they return are reported.
+func (d *Debugger) Eval(level int, expr string) ([]Variable, error) {
+    var vars []Variable
+    var ferr error
+    err := d.do(func(L *lua.State) {
+        top := L.GetTop()
+        if ferr = evalIn(L, level, expr); ferr != nil {
+            return
+        }
+        vars = []Variable{}
+        for i := top + 1; i <= L.GetTop(); i++ {
+            vars = append(vars, d.variable(L, strconv.Itoa(i-top), i))
+        }
+        L.SetTop(top)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vars, ferr
+}
+
+// Returns the fields of the table with the given handle, keys are formatted as lua literals
+func (d *Debugger) Fields(handle int) ([]Variable, error) {
+    var vars []Variable
+    var ferr error
+    err := d.do(func(L *lua.State) {
+        if handle <= 0 || handle > len(d.handles) {
+            ferr = fmt.Errorf("debugger: invalid handle %d", handle)
+            return
+        }
+        L.RawGeti(lua.LUA_REGISTRYINDEX, d.handles[handle-1])
+        vars = []Variable{}
+        L.PushNil()
+        for L.Next(-2) != 0 {
+            vars = append(vars, d.variable(L, formatKey(L, -2), -1))
+            L.Pop(1)
+        }
+        L.Pop(1)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return vars, ferr
+}
+
+// Describes the value at index, tables are pinned in the registry and given a handle
+func (d *Debugger) variable(L *lua.State, name string, index int) Variable {
+    v := Variable{Name: name, Type: L.LTypename(index), Value: formatValue(L, index)}
+    if L.IsTable(index) {
+        L.PushValue(index)
+        d.handles = append(d.handles, L.Ref(lua.LUA_REGISTRYINDEX))
+        v.Handle = len(d.handles)
+    }
+    return v
+}
+
+func (d *Debugger) releaseHandles(L *lua.State) {
+    for _, ref := range d.handles {
+        L.Unref(lua.LUA_REGISTRYINDEX, ref)
+    }
+    d.handles = nil
+}
+
+// Formats the value at index without calling metamethods
+func formatValue(L *lua.State, index int) string {
+    switch L.Type(index) {
+    case lua.LUA_TNIL:
+        return "nil"
+    case lua.LUA_TBOOLEAN:
+        return strconv.FormatBool(L.ToBoolean(index))
+    case lua.LUA_TNUMBER:
+        if L.IsInteger(index) {
+            n, _ := L.ToIntegerX(index)
+            return strconv.FormatInt(n, 10)
+        }
+        return strconv.FormatFloat(L.ToNumber(index), 'g', 14, 64)
+    case lua.LUA_TSTRING:
+        return strconv.Quote(L.ToString(index))
+    }
+    return fmt.Sprintf("%s: 0x%x", L.LTypename(index), L.ToPointer(index))
+}
+
+func formatKey(L *lua.State, index int) string {
+    if L.Type(index) == lua.LUA_TSTRING {
+        k := L.ToString(index)
+        if isIdentifier(k) {
+            return k
+        }
+    }
+    return "[" + formatValue(L, index) + "]"
+}
+
+func isIdentifier(s string) bool {
+    if s == "" {
+        return false
+    }
+    for i, c := range s {
+        if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && (i == 0 || !(c >= '0' && c <= '9')) {
+            return false
+        }
+    }
+    return true
+}
+
+// Evaluates expr in the function at level, leaving its results on the stack
+func evalIn(L *lua.State, level int, expr string) error {
+    ar := L.GetStack(level)
+    if ar == nil {
+        return fmt.Errorf("debugger: no function at level %d", level)
+    }
+    if L.LoadString("return "+expr) != 0 {
+        L.Pop(1)
+        if L.LoadString(expr) != 0 {
+            err := errors.New(L.ToString(-1))
+            L.Pop(1)
+            return err
+        }
+    }
+    chunk := L.GetTop()
+
+    // environment with the upvalues, then the locals, falling back to the function globals
+    L.NewTable()
+    env := L.GetTop()
+    L.NewTable()
+    L.RawGeti(lua.LUA_REGISTRYINDEX, lua.LUA_RIDX_GLOBALS)
+    L.GetInfo("f", ar)
+    for i := 1; ; i++ {
+        name, ok := L.GetUpvalue(-1, i)
+        if !ok {
+            break
+        }
+        if name == "_ENV" {
+            L.Replace(-3)
+        } else if name != "" {
+            L.SetField(env, name)
+        } else {
+            L.Pop(1)
+        }
+    }
+    L.Pop(1)
+    L.SetField(-2, "__index")
+    L.SetMetaTable(env)
+    for i := 1; ; i++ {
+        name := L.GetLocal(ar, i)
+        if name == "" {
+            break
+        }
+        if strings.HasPrefix(name, "(") {
+            L.Pop(1)
+            continue
+        }
+        L.SetField(env, name)
+    }
+    L.SetUpvalue(chunk, 1)
+
+    if L.PCall(0, lua.LUA_MULTRET, 0) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    return nil
+}
+
+// Evaluates a breakpoint condition in the function at level
+func evalCondition(L *lua.State, level int, cond string) (bool, error) {
+    top := L.GetTop()
+    defer L.SetTop(top)
+    if err := evalIn(L, level, cond); err != nil {
+        return false, err
+    }
+    return L.GetTop() > top && L.ToBoolean(top+1), nil
+}
@@ -3,41 +3,44 @@ package main
 import (
     "github.com/DGHeroin/lua.go"
     "log"
+    "sync"
     "time"
 )
 
 type User struct {
-    L *lua.State
-    ref int
+    mu *sync.Mutex
+    cb *lua.Value
     count int
 }
 
 func (u *User) serve() {
     idx := 0
     for {
-        u.L.Lock()
-        if err := u.L.CallX(u.ref, false, 0, idx); err != nil {
+        u.mu.Lock()
+        if _, err := u.cb.Call(idx); err != nil {
             log.Println(err)
         }
         u.count++
-        u.L.Unlock()
+        u.mu.Unlock()
         idx++
     }
 }
-func (u*User) Setcb(ref int) {
-    u.ref = ref
-    log.Println(ref)
+func (u*User) Setcb(cb *lua.Value) {
+    u.cb = cb
+    log.Println(cb)
 }
 func main() {
     L := lua.NewState()
     L.OpenLibs()
     L.OpenLibsExt()
-    user := &User{L: L}
-    L.RegisterGoStruct("user", user)
+    mu := &sync.Mutex{}
+    user := &User{mu: mu}
+    L.PushGoStruct(user)
+    L.SetGlobal("user")
     L.DoString(`
 print(user)
 vv = 0
-user.Setcb(function(val)
+user:Setcb(function(val)
     vv = vv + 1
 end)
 `)
@@ -47,14 +50,13 @@ end)
     lastVal := 0
     for {
         time.Sleep(time.Second)
-        L.Lock()
+        mu.Lock()
         L.GetGlobal("vv")
         t := L.ToInteger(-1)
+        L.Pop(1)
         log.Println(t - lastVal, user.count)
         user.count = 0
         lastVal = t
-        L.Unlock()
+        mu.Unlock()
     }
-
-    L.WaitClose()
 }
@@ -0,0 +1,185 @@
+package lua
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+// Calls the Go function fn with the values of args followed by the lua arguments, from
+// len(args)+1 to the top of the stack, and pushes its results. Arguments and results are
+// converted like the fields of PushGoStruct; a last error result is not returned but raised
+// when not nil. what names fn in the error messages.
+func (L *State) callGoFunc(fn reflect.Value, args []reflect.Value, what string) int {
+    t := fn.Type()
+    k := len(args)
+    // number of lua arguments before the variadic ones
+    n := t.NumIn() - k
+    if t.IsVariadic() {
+        n--
+    }
+    // missing arguments are nil
+    for L.GetTop()-k < n {
+        L.PushNil()
+    }
+    if !t.IsVariadic() && L.GetTop()-k > n {
+        L.PushString(fmt.Sprintf("Too many arguments to %s: %d instead of %d", what, L.GetTop()-k, n))
+        return -1
+    }
+    in := make([]reflect.Value, L.GetTop())
+    copy(in, args)
+    for i := k; i < len(in); i++ {
+        at := t.In(min(i, t.NumIn()-1))
+        if t.IsVariadic() && i >= t.NumIn()-1 {
+            at = at.Elem()
+        }
+        x, ok := L.toGoValue(i+1, at)
+        if !ok {
+            L.PushString(fmt.Sprintf("Wrong argument #%d to %s: %s expected, got %s", i-k+1, what, at, L.LTypename(i+1)))
+            return -1
+        }
+        in[i] = x
+    }
+
+    out := fn.Call(in)
+    if len(out) > 0 && t.Out(len(out)-1) == typeOfError {
+        if err := out[len(out)-1]; !err.IsNil() {
+            L.PushString(err.Interface().(error).Error())
+            return -1
+        }
+        out = out[:len(out)-1]
+    }
+    for _, r := range out {
+        if !L.pushGoValue(r) {
+            L.PushString("Unsupported type of result of " + what + ": " + r.Type().String())
+            return -1
+        }
+    }
+    return len(out)
+}
+
+// Pushes the Go function f as a lua function: LuaGoFunction values as they are, other functions
+// with their arguments and results converted, see callGoFunc
+func (L *State) pushGoFunc(f reflect.Value) {
+    switch g := f.Interface().(type) {
+    case LuaGoFunction:
+        L.PushGoClosure(g)
+    case func(*State) int:
+        L.PushGoClosure(g)
+    default:
+        // the function, not the field holding it
+        fn := reflect.ValueOf(g)
+        what := "function " + f.Type().String()
+        L.PushGoClosure(func(L *State) int {
+            return L.callGoFunc(fn, nil, what)
+        })
+    }
+}
+
+// Returns a function of type t calling the lua function at index in a protected call with the
+// message handler of Call. Arguments are pushed like the fields of PushGoStruct and the results
+// converted to the results of t; errors, including results of the wrong type, are returned
+// when the last result of t is an error and panic with a *LuaError otherwise.
+func (L *State) luaFunc(index int, t reflect.Type) reflect.Value {
+    fn := L.newValue(index)
+    nout := t.NumOut()
+    witherr := nout > 0 && t.Out(nout-1) == typeOfError
+    if witherr {
+        nout--
+    }
+    return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+        L := fn.L
+        L.releaseRefs()
+        out := make([]reflect.Value, t.NumOut())
+        for i := range out {
+            out[i] = reflect.Zero(t.Out(i))
+        }
+        fail := func(err error) []reflect.Value {
+            if !witherr {
+                panic(err)
+            }
+            out[nout] = reflect.ValueOf(&err).Elem()
+            return out
+        }
+
+        top := L.GetTop()
+        fn.Push(L)
+        if t.IsVariadic() {
+            last := args[len(args)-1]
+            args = args[:len(args)-1]
+            for i := 0; i < last.Len(); i++ {
+                args = append(args, last.Index(i))
+            }
+        }
+        for _, arg := range args {
+            if !L.pushGoValue(arg) {
+                L.SetTop(top)
+                return fail(&LuaError{0, "Unsupported type of argument: " + arg.Type().String(), nil})
+            }
+        }
+        if err := L.Call(len(args), nout); err != nil {
+            L.SetTop(top)
+            return fail(err)
+        }
+        for i := 0; i < nout; i++ {
+            x, ok := L.toGoValue(top+1+i, t.Out(i))
+            if !ok {
+                err := &LuaError{0, fmt.Sprintf("Wrong result #%d: %s expected, got %s", i+1, t.Out(i), L.LTypename(top+1+i)), L.StackTrace()}
+                L.SetTop(top)
+                return fail(err)
+            }
+            out[i] = x
+        }
+        L.SetTop(top)
+        return out
+    })
+}
+
+// Sets the Go function pointed to by fnPtr, like a *func(string, int) (bool, error), to call the
+// lua function name, which may be a dotted path like "handlers.onEvent". The function is
+// looked up once: later assignments of name in lua do not change it. Arguments and results are
+// converted like the fields of PushGoStruct. The call is protected with the message handler of
+// Call: lua errors and results of the wrong type are returned as a *LuaError when the last
+// result of the function is an error, and panic otherwise.
+func (L *State) Bind(name string, fnPtr interface{}) error {
+    p := reflect.ValueOf(fnPtr)
+    if p.Kind() != reflect.Ptr || p.IsNil() || p.Elem().Kind() != reflect.Func {
+        return fmt.Errorf("lua: Bind of %s needs a non-nil pointer to a function, got %T", name, fnPtr)
+    }
+    top := L.GetTop()
+    defer L.SetTop(top)
+    if err := L.getPath(name); err != nil {
+        return err
+    }
+    if L.Type(-1) != LUA_TFUNCTION {
+        if !L.GetMetaField(-1, "__call") {
+            return fmt.Errorf("lua: cannot bind %s: function expected, got %s", name, L.LTypename(-1))
+        }
+        L.Pop(1)
+    }
+    p.Elem().Set(L.luaFunc(-1, p.Elem().Type()))
+    return nil
+}
+
+// Returns a Go function of type F calling the lua function name, see Bind
+func Func[F any](L *State, name string) (F, error) {
+    var f F
+    err := L.Bind(name, &f)
+    return f, err
+}
+
+// Pushes the value of the dotted path name from the global table, nil when a part is missing
+// or not a table
+func (L *State) getPath(name string) error {
+    L.pushHelper(`local v = _ENV
+for i = 1, select("#", ...) do
+    if type(v) ~= "table" then return nil end
+    v = v[select(i, ...)]
+end
+return v`)
+    parts := strings.Split(name, ".")
+    for _, part := range parts {
+        L.PushString(part)
+    }
+    return L.Call(len(parts), 1)
+}
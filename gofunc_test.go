@@ -0,0 +1,166 @@
+package lua
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+type testButton struct {
+    Label   string
+    OnClick func(x, y int) (string, error)
+    Filter  func(string) bool
+}
+
+func TestGoFuncFields(t *testing.T) {
+    L := newTestState(t)
+    b := &testButton{Label: "ok"}
+    L.PushGoStruct(b)
+    L.SetGlobal("b")
+
+    // lua functions assigned to Go fields
+    mustRun(t, L, `
+b.OnClick = function(x, y)
+    if x < 0 then error("negative") end
+    return b.Label .. ":" .. (x + y)
+end
+b.Filter = function(s) return #s > 2 end
+`)
+    s, err := b.OnClick(1, 2)
+    if s != "ok:3" || err != nil {
+        t.Errorf("OnClick = %q, %v", s, err)
+    }
+    if !b.Filter("long") || b.Filter("a") {
+        t.Error("Filter")
+    }
+    // lua errors are returned with the error result
+    _, err = b.OnClick(-1, 0)
+    var lerr *LuaError
+    if !errors.As(err, &lerr) || !strings.Contains(err.Error(), "negative") {
+        t.Errorf("error %v", err)
+    }
+    // and panic without
+    mustRun(t, L, `b.Filter = function(s) return "not a boolean" end`)
+    func() {
+        defer func() {
+            if r := recover(); r == nil || !strings.Contains(r.(error).Error(), "Wrong result #1") {
+                t.Errorf("panic %v", r)
+            }
+        }()
+        b.Filter("x")
+    }()
+
+    // Go functions in fields called from lua, errors raised
+    b.OnClick = func(x, y int) (string, error) {
+        if y == 0 {
+            return "", errors.New("zero")
+        }
+        return strings.Repeat("x", x*y), nil
+    }
+    mustRun(t, L, `
+assert(b.OnClick(2, 3) == "xxxxxx")
+local ok, err = pcall(b.OnClick, 1, 0)
+assert(not ok and err:find("zero"), err)
+-- round trip of a Go function through lua
+local f = b.OnClick
+b.OnClick = nil
+assert(b.OnClick == nil)
+b.OnClick = f
+`)
+    if s, err := b.OnClick(1, 2); s != "xx" || err != nil {
+        t.Errorf("OnClick = %q, %v", s, err)
+    }
+    mustFail(t, L, `b.OnClick(1, "two")`, "Wrong argument #2")
+    mustFail(t, L, `b.OnClick(1, 2, 3)`, "Too many arguments")
+    mustFail(t, L, `b.OnClick = 42`, "Wrong assignment to field OnClick")
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestGoFuncValues(t *testing.T) {
+    L := newTestState(t)
+    handlers := map[string]func(...int) int{
+        "sum": func(xs ...int) int {
+            n := 0
+            for _, x := range xs {
+                n += x
+            }
+            return n
+        },
+    }
+    L.PushGoMap(handlers)
+    L.SetGlobal("handlers")
+    mustRun(t, L, `
+assert(handlers.sum() == 0 and handlers.sum(1, 2, 3) == 6)
+handlers.max = function(...)
+    local m = 0
+    for _, x in ipairs({...}) do m = math.max(m, x) end
+    return m
+end
+`)
+    if got := handlers["max"](3, 9, 4); got != 9 {
+        t.Errorf("max = %d", got)
+    }
+}
+
+func TestBind(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `
+handlers = {events = {}}
+function handlers.events.on(name, n)
+    if name == "" then error("empty name") end
+    return name:upper(), n * 2
+end
+function handlers.count() return "many" end
+callable = setmetatable({}, {__call = function(self, x) return x + 1 end})
+notfunc = 1
+`)
+    var on func(string, int) (string, int, error)
+    if err := L.Bind("handlers.events.on", &on); err != nil {
+        t.Fatal(err)
+    }
+    s, n, err := on("click", 21)
+    if s != "CLICK" || n != 42 || err != nil {
+        t.Errorf("on = %q, %d, %v", s, n, err)
+    }
+    _, _, err = on("", 1)
+    if _, ok := err.(*LuaError); !ok || !strings.Contains(err.Error(), "empty name") {
+        t.Errorf("error %v", err)
+    }
+    // looked up once
+    mustRun(t, L, `handlers.events.on = nil`)
+    if s, _, _ := on("x", 1); s != "X" {
+        t.Errorf("on = %q", s)
+    }
+
+    // results of the wrong type
+    count, err := Func[func() (int, error)](L, "handlers.count")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := count(); err == nil || !strings.Contains(err.Error(), "Wrong result #1: int expected, got string") {
+        t.Errorf("error %v", err)
+    }
+
+    inc, err := Func[func(int) int](L, "callable")
+    if err != nil || inc(1) != 2 {
+        t.Errorf("callable table: %v", err)
+    }
+
+    for _, name := range []string{"missing", "handlers.missing.on", "notfunc", "handlers"} {
+        if _, err := Func[func()](L, name); err == nil || !strings.Contains(err.Error(), "function expected") {
+            t.Errorf("Bind of %s: %v", name, err)
+        }
+    }
+    var notptr func()
+    if err := L.Bind("callable", notptr); err == nil {
+        t.Error("Bind of a function value")
+    }
+    if err := L.Bind("callable", (*func())(nil)); err == nil {
+        t.Error("Bind of a nil pointer")
+    }
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
@@ -10,18 +10,27 @@ package lua
 import "C"
 
 import (
+    "fmt"
     "reflect"
     "sync"
+    "time"
     "unsafe"
+
+    "github.com/DGHeroin/lua.go/bytecode"
 )
 
 // Type of allocation functions to use with NewStateAlloc
 type Alloc func(ptr unsafe.Pointer, osize uint, nsize uint) unsafe.Pointer
 
-// This is the type of go function that can be registered as lua functions
+// This is the type of go function that can be registered as lua functions. It returns the
+// number of results, or -1 after pushing an error value to raise it as a lua error.
 type LuaGoFunction func(L *State) int
 
+// Type of warning functions to use with SetWarnF
+type WarnFunction func(L *State, msg string, tocont bool)
+
 // Wrapper to keep cgo from complaining about incomplete ptr type
+//
 //export State
 type State struct {
     // Wrapped lua_State object
@@ -35,6 +44,44 @@ type State struct {
 
     // Freelist for funcs indices, to allow for freeing
     freeIndices []uint
+
+    // Codecs used by Snapshot/Restore for go objects, by type and by the name written in the
+    // snapshots
+    snapshotCodecs map[reflect.Type]*snapshotCodec
+    snapshotNames  map[string]*snapshotCodec
+
+    // Warning function installed with SetWarnF
+    warnf WarnFunction
+
+    // Hook function installed with SetHook
+    hookf HookFunction
+
+    // Profiler started with StartProfile
+    profiler *cpuProfiler
+
+    // Profiler started with StartMemProfile
+    memProfiler *memProfiler
+
+    // State of the main thread when this one wraps a coroutine, nil otherwise
+    main *State
+
+    // Naming of struct fields and methods set with SetNamingPolicy
+    naming NamingPolicy
+
+    // Registry references of the functions calling struct methods, see pushGoMethod
+    methodRefs map[*structMethod]int
+
+    // Types registered with RegisterType, by pointer type
+    types map[reflect.Type]*typeClass
+
+    // Registry references of lua values no longer used by Go, see Value
+    released releasedRefs
+
+    // Error and stack trace recorded by the message handler of Call
+    msgError *LuaError
+
+    // Registry references of the helper functions of Value, by code
+    helpers map[string]int
 }
 
 var goStates map[uintptr]*State
@@ -64,171 +111,406 @@ func getGoState(gostateindex uintptr) *State {
 }
 
 //export golua_callgofunction
-func golua_callgofunction(gostateindex uintptr, fid uint) int {
+func golua_callgofunction(gostateindex uintptr, fid uint) (r int) {
     L1 := getGoState(gostateindex)
     if fid < 0 {
         panic(&LuaError{0, "Requested execution of an unknown function", L1.StackTrace()})
     }
     f := L1.registry[fid].(LuaGoFunction)
+    defer L1.recoverPanic(&r)
     return f(L1)
 }
 
+// Turns the panic of a Go callback, like the errors of RaiseError and ArgError, into the lua
+// error raised by its C caller when *r is -1: the panic must not unwind the C frames of lua.
+func (L *State) recoverPanic(r *int) {
+    p := recover()
+    if p == nil {
+        return
+    }
+    switch e := p.(type) {
+    case error:
+        L.PushString(e.Error())
+    case string:
+        L.PushString(e)
+    default:
+        L.PushString(fmt.Sprint(p))
+    }
+    *r = -1
+}
+
 var typeOfBytes = reflect.TypeOf([]byte(nil))
+var typeOfInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+// Pushes a go value converted for lua: booleans, numbers, strings and []byte as lua values,
+// time.Time as its unix time in seconds, maps, slices and arrays as proxies (see PushGoMap and
+// PushGoSlice), structs and pointers to structs with PushGoStruct, functions as lua functions
+// (see pushGoFunc) and *Value as the value it holds. Proxies of values stored in other go
+// objects, like struct fields, refer to them. Pointers to other types are followed, nil
+// pointers, functions and interfaces are nil. Returns false for the other types.
+func (L *State) pushGoValue(v reflect.Value) bool {
+    for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr && (v.Type().Elem().Kind() != reflect.Struct || v.Type().Elem() == typeOfTime) {
+        if v.IsNil() {
+            L.PushNil()
+            return true
+        }
+        v = v.Elem()
+    }
 
-//export golua_interface_newindex_callback
-func golua_interface_newindex_callback(gostateindex uintptr, iid uint, field_name_cstr *C.char) int {
-    L := getGoState(gostateindex)
-    iface := L.registry[iid]
-    ifacevalue := reflect.ValueOf(iface).Elem()
+    switch v.Kind() {
+    case reflect.Invalid:
+        L.PushNil()
+        return true
+
+    case reflect.Bool:
+        L.PushBoolean(v.Bool())
+        return true
+
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        L.PushInteger(v.Int())
+        return true
+
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        L.PushInteger(int64(v.Uint()))
+        return true
+
+    case reflect.String:
+        L.PushString(v.String())
+        return true
+
+    case reflect.Float32, reflect.Float64:
+        L.PushNumber(v.Float())
+        return true
+
+    case reflect.Slice:
+        if v.Type() == typeOfBytes {
+            L.PushBytes(v.Bytes())
+            return true
+        }
+        // slices in place, like struct fields, see the appends
+        if v.CanAddr() && v.Addr().CanInterface() {
+            L.PushGoSlice(v.Addr().Interface())
+            return true
+        }
+        if v.CanInterface() {
+            L.PushGoSlice(v.Interface())
+            return true
+        }
+
+    case reflect.Array:
+        // arrays are proxied in place when possible, a copy otherwise
+        if !v.CanAddr() {
+            c := reflect.New(v.Type())
+            c.Elem().Set(v)
+            v = c.Elem()
+        }
+        if v.Addr().CanInterface() {
+            L.PushGoSlice(v.Addr().Interface())
+            return true
+        }
+
+    case reflect.Map:
+        if v.CanInterface() {
+            L.PushGoMap(v.Interface())
+            return true
+        }
 
-    field_name := C.GoString(field_name_cstr)
+    case reflect.Struct:
+        if v.Type() == typeOfTime {
+            L.PushInteger(v.Interface().(time.Time).Unix())
+            return true
+        }
+        // structs in place when possible, a copy otherwise
+        if !v.CanAddr() {
+            c := reflect.New(v.Type())
+            c.Elem().Set(v)
+            v = c.Elem()
+        }
+        if v.Addr().CanInterface() {
+            L.PushGoStruct(v.Addr().Interface())
+            return true
+        }
 
-    fval := ifacevalue.FieldByName(field_name)
+    case reflect.Ptr:
+        if v.IsNil() {
+            L.PushNil()
+            return true
+        }
+        if v.Type() == typeOfValue && v.CanInterface() {
+            x := v.Interface().(*Value)
+            if x.ref == LUA_NOREF || x.L != L.mainState() {
+                return false
+            }
+            x.Push(L)
+            return true
+        }
+        if v.CanInterface() {
+            L.PushGoStruct(v.Interface())
+            return true
+        }
 
-    if fval.Kind() == reflect.Ptr {
-        fval = fval.Elem()
+    case reflect.Func:
+        if v.IsNil() {
+            L.PushNil()
+            return true
+        }
+        if v.CanInterface() {
+            L.pushGoFunc(v)
+            return true
+        }
     }
+    return false
+}
 
-    luatype := LuaValType(C.lua_type(L.s, 3))
+// Converts the lua value at index to a go value of type t, returns false if it has another
+// type. Numbers must be integers for the integer types, strings are only converted to strings
+// and []byte, time.Time is converted from unix times in seconds and RFC 3339 strings. Go
+// objects pushed with PushGoStruct, PushGoMap or PushGoSlice are converted back when their type
+// is assignable to t, and nil is the zero value of pointers, maps, slices, functions and
+// interfaces. Tables are copied into new structs (by lua field name, not setting read-only
+// fields, see PushGoStruct), maps and slices (from sequences), lua functions are wrapped in Go
+// functions of type t (see luaFunc).
+// Tables, functions, threads and other user data are held by a *Value for *Value and interface{}.
+func (L *State) toGoValue(index int, t reflect.Type) (reflect.Value, bool) {
+    luatype := L.Type(index)
+    if t == typeOfValue {
+        switch luatype {
+        case LUA_TNIL:
+            return reflect.Zero(t), true
+        case LUA_TTABLE, LUA_TFUNCTION, LUA_TUSERDATA, LUA_TTHREAD:
+            return reflect.ValueOf(L.newValue(index)), true
+        }
+        return reflect.Value{}, false
+    }
+    if luatype == LUA_TUSERDATA {
+        var obj interface{}
+        if L.IsGoStruct(index) {
+            obj = L.ToGoStruct(index)
+        } else if L.IsGoMap(index) {
+            obj = L.ToGoMap(index)
+        } else if L.IsGoSlice(index) {
+            obj = L.ToGoSlice(index)
+        }
+        v := reflect.ValueOf(obj)
+        if obj != nil && v.Type().AssignableTo(t) {
+            return v, true
+        }
+        // copy of a struct pushed with PushGoStruct
+        if obj != nil && v.Kind() == reflect.Ptr && v.Type().Elem().AssignableTo(t) {
+            return v.Elem(), true
+        }
+        // other user data
+        if obj == nil && t == typeOfInterface {
+            return reflect.ValueOf(L.newValue(index)), true
+        }
+        return reflect.Value{}, false
+    }
 
-    switch fval.Kind() {
+    v := reflect.New(t).Elem()
+    switch t.Kind() {
     case reflect.Bool:
         if luatype == LUA_TBOOLEAN {
-            fval.SetBool(int(C.lua_toboolean(L.s, 3)) != 0)
-            return 1
-        } else {
-            L.PushString("Wrong assignment to field " + field_name)
-            return -1
+            v.SetBool(L.ToBoolean(index))
+            return v, true
         }
 
-    case reflect.Int:
-        fallthrough
-    case reflect.Int8:
-        fallthrough
-    case reflect.Int16:
-        fallthrough
-    case reflect.Int32:
-        fallthrough
-    case reflect.Int64:
-        if luatype == LUA_TNUMBER {
-            fval.SetInt(int64(C.lua_tointegerx(L.s, 3, nil)))
-            return 1
-        } else {
-            L.PushString("Wrong assignment to field " + field_name)
-            return -1
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, isnum := L.ToIntegerX(index)
+        if luatype == LUA_TNUMBER && isnum && !v.OverflowInt(n) {
+            v.SetInt(n)
+            return v, true
         }
 
-    case reflect.Uint:
-        fallthrough
-    case reflect.Uint8:
-        fallthrough
-    case reflect.Uint16:
-        fallthrough
-    case reflect.Uint32:
-        fallthrough
-    case reflect.Uint64:
-        if luatype == LUA_TNUMBER {
-            fval.SetUint(uint64(C.lua_tointegerx(L.s, 3, nil)))
-            return 1
-        } else {
-            L.PushString("Wrong assignment to field " + field_name)
-            return -1
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        n, isnum := L.ToIntegerX(index)
+        if luatype == LUA_TNUMBER && isnum && n >= 0 && !v.OverflowUint(uint64(n)) {
+            v.SetUint(uint64(n))
+            return v, true
         }
 
     case reflect.String:
         if luatype == LUA_TSTRING {
-            fval.SetString(C.GoString(C.lua_tolstring(L.s, 3, nil)))
-            return 1
-        } else {
-            L.PushString("Wrong assignment to field " + field_name)
-            return -1
+            v.SetString(L.ToString(index))
+            return v, true
         }
 
-    case reflect.Float32:
-        fallthrough
-    case reflect.Float64:
+    case reflect.Float32, reflect.Float64:
         if luatype == LUA_TNUMBER {
-            fval.SetFloat(float64(C.lua_tonumberx(L.s, 3, nil)))
-            return 1
-        } else {
-            L.PushString("Wrong assignment to field " + field_name)
-            return -1
+            v.SetFloat(L.ToNumber(index))
+            return v, true
         }
+
     case reflect.Slice:
-        if fval.Type() == typeOfBytes {
+        if t == typeOfBytes && luatype == LUA_TSTRING {
+            v.SetBytes(L.ToBytes(index))
+            return v, true
+        }
+        if luatype == LUA_TNIL {
+            return v, true
+        }
+        if luatype == LUA_TTABLE {
+            // copy of a sequence
+            index = L.AbsIndex(index)
+            n := int(L.RawLen(index))
+            v.Set(reflect.MakeSlice(t, n, n))
+            for i := 0; i < n; i++ {
+                L.RawGeti(index, i+1)
+                elem, ok := L.toGoValue(-1, t.Elem())
+                L.Pop(1)
+                if !ok {
+                    return reflect.Value{}, false
+                }
+                v.Index(i).Set(elem)
+            }
+            return v, true
+        }
+
+    case reflect.Struct:
+        if t == typeOfTime {
+            if n, isint := L.ToIntegerX(index); luatype == LUA_TNUMBER && isint {
+                v.Set(reflect.ValueOf(time.Unix(n, 0)))
+                return v, true
+            }
             if luatype == LUA_TSTRING {
-                fval.SetBytes(L.ToBytes(3))
-                return 1
-            } else {
-                L.PushString("Wrong assignment to field " + field_name)
-                return -1
+                if tm, err := time.Parse(time.RFC3339Nano, L.ToString(index)); err == nil {
+                    v.Set(reflect.ValueOf(tm))
+                    return v, true
+                }
             }
+            break
+        }
+        // fields named by the keys, the others are zero
+        if luatype == LUA_TTABLE && L.setStructFields(v, index) {
+            return v, true
         }
-    }
 
-    L.PushString("Unsupported type of field " + field_name + ": " + fval.Type().String())
-    return -1
-}
+    case reflect.Ptr:
+        if luatype == LUA_TNIL {
+            return v, true
+        }
+        if elem, ok := L.toGoValue(index, t.Elem()); ok {
+            v.Set(reflect.New(t.Elem()))
+            v.Elem().Set(elem)
+            return v, true
+        }
 
-//export golua_interface_index_callback
-func golua_interface_index_callback(gostateindex uintptr, iid uint, field_name *C.char) int {
-    L := getGoState(gostateindex)
-    iface := L.registry[iid]
-    ifacevalue := reflect.ValueOf(iface).Elem()
+    case reflect.Map:
+        if luatype == LUA_TNIL {
+            return v, true
+        }
+        if luatype == LUA_TTABLE {
+            // copy of the table
+            index = L.AbsIndex(index)
+            v.Set(reflect.MakeMap(t))
+            L.PushNil()
+            for L.Next(index) != 0 {
+                k, ok := L.toGoValue(-2, t.Key())
+                var x reflect.Value
+                if ok {
+                    x, ok = L.toGoValue(-1, t.Elem())
+                }
+                L.Pop(1)
+                if !ok {
+                    L.Pop(1)
+                    return reflect.Value{}, false
+                }
+                v.SetMapIndex(k, x)
+            }
+            return v, true
+        }
 
-    fval := ifacevalue.FieldByName(C.GoString(field_name))
+    case reflect.Func:
+        if luatype == LUA_TNIL {
+            return v, true
+        }
+        if luatype == LUA_TFUNCTION {
+            return L.luaFunc(index, t), true
+        }
 
-    if fval.Kind() == reflect.Ptr {
-        fval = fval.Elem()
+    case reflect.Interface:
+        if t.NumMethod() > 0 {
+            break
+        }
+        switch luatype {
+        case LUA_TNIL:
+            return v, true
+        case LUA_TBOOLEAN:
+            v.Set(reflect.ValueOf(L.ToBoolean(index)))
+            return v, true
+        case LUA_TNUMBER:
+            if n, isnum := L.ToIntegerX(index); isnum && L.IsInteger(index) {
+                v.Set(reflect.ValueOf(n))
+            } else {
+                v.Set(reflect.ValueOf(L.ToNumber(index)))
+            }
+            return v, true
+        case LUA_TSTRING:
+            v.Set(reflect.ValueOf(L.ToString(index)))
+            return v, true
+        case LUA_TTABLE, LUA_TFUNCTION, LUA_TTHREAD:
+            v.Set(reflect.ValueOf(L.newValue(index)))
+            return v, true
+        }
     }
+    return reflect.Value{}, false
+}
 
-    switch fval.Kind() {
-    case reflect.Bool:
-        L.PushBoolean(fval.Bool())
-        return 1
-
-    case reflect.Int:
-        fallthrough
-    case reflect.Int8:
-        fallthrough
-    case reflect.Int16:
-        fallthrough
-    case reflect.Int32:
-        fallthrough
-    case reflect.Int64:
-        L.PushInteger(fval.Int())
-        return 1
-
-    case reflect.Uint:
-        fallthrough
-    case reflect.Uint8:
-        fallthrough
-    case reflect.Uint16:
-        fallthrough
-    case reflect.Uint32:
-        fallthrough
-    case reflect.Uint64:
-        L.PushInteger(int64(fval.Uint()))
-        return 1
-
-    case reflect.String:
-        L.PushString(fval.String())
-        return 1
+//export golua_interface_newindex_callback
+func golua_interface_newindex_callback(gostateindex uintptr, iid uint, field_name *C.char, field_len C.size_t) int {
+    L := getGoState(gostateindex)
+    v := reflect.ValueOf(L.registry[iid])
+    info := structInfoOf(v.Type().Elem(), L.naming)
+    // only used for the lookup and the messages, not copied
+    name := unsafe.String((*byte)(unsafe.Pointer(field_name)), int(field_len))
+
+    f, ok := info.fields[name]
+    var fval reflect.Value
+    if ok {
+        fval, ok = f.get(v.Elem())
+    }
+    if !ok || !fval.CanSet() {
+        L.PushString("Unknown field " + name)
+        return -1
+    }
+    if f.readonly {
+        L.PushString("Field " + name + " is read-only")
+        return -1
+    }
+    if !f.set(L, fval, 3) {
+        L.PushString("Wrong assignment to field " + name)
+        return -1
+    }
+    return 1
+}
 
-    case reflect.Float32:
-        fallthrough
-    case reflect.Float64:
-        L.PushNumber(fval.Float())
-        return 1
-    case reflect.Slice:
-        if fval.Type() == typeOfBytes {
-            L.PushBytes(fval.Bytes())
+//export golua_interface_index_callback
+func golua_interface_index_callback(gostateindex uintptr, iid uint, field_name *C.char, field_len C.size_t) int {
+    L := getGoState(gostateindex)
+    v := reflect.ValueOf(L.registry[iid])
+    info := structInfoOf(v.Type().Elem(), L.naming)
+    name := unsafe.String((*byte)(unsafe.Pointer(field_name)), int(field_len))
+
+    if f, ok := info.fields[name]; ok {
+        // nil in a nil embedded pointer
+        fval, ok := f.get(v.Elem())
+        if !ok || f.omitempty && fval.IsZero() {
+            L.PushNil()
             return 1
         }
+        if !L.pushGoValue(fval) {
+            L.PushString("Unsupported type of field: " + fval.Type().String())
+            return -1
+        }
+        return 1
     }
-
-    L.PushString("Unsupported type of field: " + fval.Type().String())
-    return -1
+    if m, ok := info.methods[name]; ok {
+        L.pushGoMethod(m)
+        return 1
+    }
+    // unknown names are nil
+    L.PushNil()
+    return 1
 }
 
 //export golua_gchook
@@ -265,5 +547,121 @@ func go_panic_msghandler(gostateindex uintptr, z *C.char) {
     L := getGoState(gostateindex)
     s := C.GoString(z)
 
-    panic(&LuaError{LUA_ERRERR, s, L.StackTrace()})
+    // returned by callEx: panicking here would skip the end of lua_pcall
+    L.msgError = &LuaError{LUA_ERRRUN, s, L.StackTrace()}
+}
+
+//export golua_interface_serialize_callback
+func golua_interface_serialize_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    iface := L.registry[iid]
+    t := reflect.TypeOf(iface)
+
+    codec, ok := L.snapshotCodecs[t]
+    if !ok {
+        L.PushString("No snapshot codec registered for go type " + t.String())
+        return -1
+    }
+    data, err := codec.Encode(iface)
+    if err != nil {
+        L.PushString("Unable to encode go value of type " + t.String() + ": " + err.Error())
+        return -1
+    }
+
+    L.CreateTable(0, 2)
+    L.PushString(codec.name)
+    L.SetField(-2, "type")
+    L.PushBytes(data)
+    L.SetField(-2, "data")
+    return 1
+}
+
+//export golua_interface_deserialize_callback
+func golua_interface_deserialize_callback(gostateindex uintptr) int {
+    L := getGoState(gostateindex)
+    if !L.IsTable(1) {
+        L.PushString("Malformed go value in serialized data")
+        return -1
+    }
+    L.GetField(1, "type")
+    name := L.ToString(-1)
+    L.GetField(1, "data")
+    data := L.ToBytes(-1)
+    L.Pop(2)
+
+    codec, ok := L.snapshotNames[name]
+    if !ok {
+        L.PushString("No snapshot codec registered with name " + name)
+        return -1
+    }
+    iface, err := codec.Decode(data)
+    if err != nil {
+        L.PushString("Unable to decode go value of type " + name + ": " + err.Error())
+        return -1
+    }
+    L.PushGoStruct(iface)
+    return 1
+}
+
+//export golua_verifybytecode
+func golua_verifybytecode(s *C.lua_State, code *C.char, n C.size_t) C.int {
+    c, err := bytecode.Parse(C.GoBytes(unsafe.Pointer(code), C.int(n)))
+    if err == nil {
+        err = bytecode.Verify(c)
+    }
+    if err == nil {
+        return 0
+    }
+    msg := C.CString("serialize.unpack: " + err.Error())
+    defer C.free(unsafe.Pointer(msg))
+    C.lua_pushstring(s, msg)
+    return 1
+}
+
+//export golua_callhook
+func golua_callhook(gostateindex uintptr, s *C.lua_State, ar *C.lua_Debug) (r int) {
+    L := getGoState(gostateindex)
+    if L == nil || L.hookf == nil {
+        return 0
+    }
+    th := L.threadState(s)
+    defer th.recoverPanic(&r)
+    L.hookf(th, newDebug(ar))
+    return 0
+}
+
+//export golua_memprof_record
+func golua_memprof_record(gostateindex uintptr, s *C.lua_State, size C.size_t) C.int {
+    L := getGoState(gostateindex)
+    if L == nil || L.memProfiler == nil {
+        return -1
+    }
+    return C.int(L.memProfiler.record(L.threadState(s), uint(size)))
+}
+
+//export golua_memprof_free
+func golua_memprof_free(gostateindex uintptr, site C.int, size C.size_t) {
+    L := getGoState(gostateindex)
+    if L == nil || L.memProfiler == nil {
+        return
+    }
+    L.memProfiler.free(int(site), uint(size))
+}
+
+//export golua_memprof_resize
+func golua_memprof_resize(gostateindex uintptr, site C.int, osize, nsize C.size_t) {
+    L := getGoState(gostateindex)
+    if L == nil || L.memProfiler == nil {
+        return
+    }
+    L.memProfiler.resize(int(site), uint(osize), uint(nsize))
+}
+
+//export golua_callwarnf
+func golua_callwarnf(gostateindex uintptr, msg *C.char, tocont C.int) {
+    L := getGoState(gostateindex)
+    if L == nil || L.warnf == nil {
+        return
+    }
+    L.warnf(L, C.GoString(msg), tocont != 0)
 }
@@ -0,0 +1,130 @@
+package lua
+
+/*
+#include <lua.h>
+
+void clua_pushgomap(lua_State *L, unsigned int iid);
+int clua_isgomap(lua_State *L, int n);
+unsigned int clua_togomap(lua_State *L, int index);
+*/
+import "C"
+
+import (
+    "reflect"
+)
+
+// Pushes a Go map onto the stack as user data proxying it: lua code reads and writes the map
+// directly, m[k] = nil deletes k, #m is its length and pairs(m) iterates over it.
+//
+// Keys and values are converted like the fields of PushGoStruct; map, and pointer to struct,
+// values are proxied too. Panics if m is not a map.
+func (L *State) PushGoMap(m interface{}) {
+    if reflect.TypeOf(m).Kind() != reflect.Map {
+        panic("lua: PushGoMap of a " + reflect.TypeOf(m).String())
+    }
+    iid := L.register(m)
+    C.clua_pushgomap(L.s, C.uint(iid))
+}
+
+// Returns true if the value at index is user data pushed with PushGoMap
+func (L *State) IsGoMap(index int) bool {
+    return C.clua_isgomap(L.s, C.int(index)) != 0
+}
+
+// Returns the map pushed with PushGoMap at index, nil for other values
+func (L *State) ToGoMap(index int) interface{} {
+    if !L.IsGoMap(index) {
+        return nil
+    }
+    iid := C.clua_togomap(L.s, C.int(index))
+    return L.mainState().registry[iid]
+}
+
+//export golua_map_index_callback
+func golua_map_index_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    m := reflect.ValueOf(L.registry[iid])
+
+    // keys of another type are not in the map, like for tables
+    k, ok := L.toGoValue(2, m.Type().Key())
+    if !ok {
+        L.PushNil()
+        return 1
+    }
+    if !L.pushGoValue(m.MapIndex(k)) {
+        L.PushString("Unsupported type of map value: " + m.Type().Elem().String())
+        return -1
+    }
+    return 1
+}
+
+//export golua_map_newindex_callback
+func golua_map_newindex_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    m := reflect.ValueOf(L.registry[iid])
+
+    k, ok := L.toGoValue(2, m.Type().Key())
+    if !ok {
+        L.PushString("Wrong key type for " + m.Type().String() + ": " + L.LTypename(2))
+        return -1
+    }
+    if L.IsNil(3) {
+        m.SetMapIndex(k, reflect.Value{})
+        return 0
+    }
+    v, ok := L.toGoValue(3, m.Type().Elem())
+    if !ok {
+        L.PushString("Wrong value type for " + m.Type().String() + ": " + L.LTypename(3))
+        return -1
+    }
+    if m.IsNil() {
+        L.PushString("Assignment to entry in nil map")
+        return -1
+    }
+    m.SetMapIndex(k, v)
+    return 0
+}
+
+//export golua_map_len_callback
+func golua_map_len_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    L.PushInteger(int64(reflect.ValueOf(L.registry[iid]).Len()))
+    return 1
+}
+
+// Keys of a map being iterated by pairs
+type mapIterator struct {
+    m    reflect.Value
+    keys []reflect.Value
+}
+
+//export golua_map_pairs_callback
+func golua_map_pairs_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    m := reflect.ValueOf(L.registry[iid])
+    L.PushGoStruct(&mapIterator{m, m.MapKeys()})
+    return 1
+}
+
+// Returns the next entry of the map, skipping the keys deleted since pairs was called
+//
+//export golua_map_next_callback
+func golua_map_next_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    it := L.registry[iid].(*mapIterator)
+    for len(it.keys) > 0 {
+        k := it.keys[0]
+        it.keys = it.keys[1:]
+        v := it.m.MapIndex(k)
+        if !v.IsValid() {
+            continue
+        }
+        if !L.pushGoValue(k) || !L.pushGoValue(v) {
+            L.PushString("Unsupported type of map entry: " + it.m.Type().String())
+            return -1
+        }
+        return 2
+    }
+    L.PushNil()
+    return 1
+}
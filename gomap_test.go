@@ -0,0 +1,141 @@
+package lua
+
+import (
+    "sort"
+    "strings"
+    "testing"
+)
+
+// Runs src, which must not fail
+func mustRun(t *testing.T, L *State, src string) {
+    t.Helper()
+    if err := L.DoString(src); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Runs src, which must fail with an error containing msg
+func mustFail(t *testing.T, L *State, src, msg string) {
+    t.Helper()
+    err := L.DoString(src)
+    if err == nil || !strings.Contains(err.Error(), msg) {
+        t.Fatalf("%s: error %v, want %q", src, err, msg)
+    }
+    L.Pop(1)
+}
+
+func TestGoMap(t *testing.T) {
+    L := newTestState(t)
+    m := map[string]int{"a": 1, "b": 2}
+    L.PushGoMap(m)
+    if !L.IsGoMap(-1) || L.ToGoMap(-1).(map[string]int)["a"] != 1 {
+        t.Fatal("IsGoMap/ToGoMap")
+    }
+    L.SetGlobal("m")
+    L.PushInteger(1)
+    if L.IsGoMap(-1) || L.ToGoMap(-1) != nil {
+        t.Error("IsGoMap of an integer")
+    }
+    L.Pop(1)
+
+    mustRun(t, L, `
+assert(m.a == 1 and m["b"] == 2)
+assert(m.missing == nil and m[1] == nil and m[true] == nil)
+assert(#m == 2)
+m.c = 3
+m.a = m.a + 10
+m.b = nil
+assert(#m == 2)
+`)
+    if len(m) != 2 || m["a"] != 11 || m["c"] != 3 {
+        t.Errorf("map %v", m)
+    }
+    // written by Go, seen by lua
+    m["d"] = 4
+    mustRun(t, L, `assert(m.d == 4 and #m == 3)`)
+
+    mustFail(t, L, `m[1] = 1`, "Wrong key type")
+    mustFail(t, L, `m.x = "text"`, "Wrong value type")
+    mustFail(t, L, `m.x = 1.5`, "Wrong value type")
+    if _, ok := m["x"]; ok {
+        t.Error("failed assignment stored")
+    }
+
+    var nilMap map[string]int
+    L.PushGoMap(nilMap)
+    L.SetGlobal("n")
+    mustRun(t, L, `assert(n.a == nil and #n == 0) for k in pairs(n) do error("entry") end`)
+    mustFail(t, L, `n.a = 1`, "nil map")
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestGoMapPairs(t *testing.T) {
+    L := newTestState(t)
+    m := map[int]string{}
+    for i := 1; i <= 100; i++ {
+        m[i] = strings.Repeat("x", i)
+    }
+    L.PushGoMap(m)
+    L.SetGlobal("m")
+    mustRun(t, L, `
+local n, sum = 0, 0
+for k, v in pairs(m) do
+    assert(#v == k)
+    n, sum = n + 1, sum + k
+end
+assert(n == 100 and sum == 5050, n)
+
+-- deleting the entries while iterating, the deleted ones are not visited
+local seen = {}
+for k in pairs(m) do
+    assert(not seen[k], "visited twice")
+    seen[k] = true
+    m[k] = nil
+    m[k % 2 == 0 and k - 1 or k + 1] = nil
+end
+assert(#m == 0)
+local visited = 0
+for _ in pairs(seen) do visited = visited + 1 end
+assert(visited == 50, visited)
+`)
+    if len(m) != 0 {
+        t.Errorf("%d entries left", len(m))
+    }
+
+    // entries added during the iteration are not visited
+    m[1], m[2] = "a", "b"
+    mustRun(t, L, `
+local n = 0
+for k in pairs(m) do n = n + 1 m[k + 100] = "new" end
+assert(n == 2 and #m == 4)
+`)
+    keys := []int{}
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Ints(keys)
+    if len(keys) != 4 || keys[2] < 100 {
+        t.Errorf("keys %v", keys)
+    }
+}
+
+func TestGoMapNested(t *testing.T) {
+    L := newTestState(t)
+    type item struct{ Count int }
+    m := map[string]map[string]int{"a": {"x": 1}}
+    items := map[string]*item{"i": {1}}
+    L.PushGoMap(m)
+    L.SetGlobal("m")
+    L.PushGoMap(items)
+    L.SetGlobal("items")
+    mustRun(t, L, `
+m.a.y = 2
+m.b = {z = 3}
+items.i.Count = items.i.Count + 1
+`)
+    if m["a"]["y"] != 2 || m["b"]["z"] != 3 || items["i"].Count != 2 {
+        t.Errorf("maps %v %v", m, items["i"])
+    }
+}
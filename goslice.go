@@ -0,0 +1,267 @@
+package lua
+
+/*
+#include <lua.h>
+
+void clua_pushgoslice(lua_State *L, unsigned int iid);
+int clua_isgoslice(lua_State *L, int n);
+unsigned int clua_togoslice(lua_State *L, int index);
+*/
+import "C"
+
+import (
+    "fmt"
+    "reflect"
+)
+
+// Pushes a Go slice onto the stack as user data proxying it, indexed from 1 like lua
+// sequences: lua code reads and writes the elements directly, #s is its length and ipairs(s)
+// iterates over it. Reading outside of the slice gives nil, writing is an error except at #s+1,
+// which appends.
+//
+// s:append(v...) appends values and returns s, s:slice(i, j) returns the elements i to j
+// (inclusive, by default 1 and #s) as a new proxy sharing them.
+//
+// s can be a slice, a pointer to a slice whose appends are then seen by the Go code, or a
+// pointer to an array that cannot be appended to. Elements are converted like the fields of
+// PushGoStruct, []float64, []float32, []int, []int32 and []int64 without reflection. Panics for
+// other types.
+func (L *State) PushGoSlice(s interface{}) {
+    t := reflect.TypeOf(s)
+    if t.Kind() != reflect.Slice && (t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Slice && t.Elem().Kind() != reflect.Array) {
+        panic("lua: PushGoSlice of a " + t.String())
+    }
+    iid := L.register(s)
+    C.clua_pushgoslice(L.s, C.uint(iid))
+}
+
+// Returns true if the value at index is user data pushed with PushGoSlice
+func (L *State) IsGoSlice(index int) bool {
+    return C.clua_isgoslice(L.s, C.int(index)) != 0
+}
+
+// Returns the slice pushed with PushGoSlice at index, with its appends, or the pointer to an
+// array; nil for other values
+func (L *State) ToGoSlice(index int) interface{} {
+    if !L.IsGoSlice(index) {
+        return nil
+    }
+    iid := C.clua_togoslice(L.s, C.int(index))
+    s := L.mainState().registry[iid]
+    if v := reflect.ValueOf(s); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Slice {
+        return v.Elem().Interface()
+    }
+    return s
+}
+
+// Returns the elements of a slice proxy: the slice, the slice pointed to, or a slice of the
+// array pointed to
+func sliceValue(s interface{}) reflect.Value {
+    v := reflect.ValueOf(s)
+    if v.Kind() == reflect.Ptr {
+        v = v.Elem()
+    }
+    if v.Kind() == reflect.Array {
+        v = v.Slice(0, v.Len())
+    }
+    return v
+}
+
+// Follows the pointers to the slices handled without reflection
+func numericSlice(s interface{}) interface{} {
+    switch p := s.(type) {
+    case *[]float64:
+        return *p
+    case *[]float32:
+        return *p
+    case *[]int:
+        return *p
+    case *[]int32:
+        return *p
+    case *[]int64:
+        return *p
+    }
+    return s
+}
+
+// Returns the 0 based index i of the slice element at the lua index at 2, ok false if it is
+// not an integer
+func (L *State) sliceIndex() (i int, ok bool) {
+    n, isnum := L.ToIntegerX(2)
+    if L.Type(2) != LUA_TNUMBER || !isnum {
+        return 0, false
+    }
+    return int(n - 1), true
+}
+
+//export golua_slice_index_callback
+func golua_slice_index_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    s := L.registry[iid]
+    i, ok := L.sliceIndex()
+
+    switch a := numericSlice(s).(type) {
+    case []float64:
+        if ok && i >= 0 && i < len(a) {
+            L.PushNumber(a[i])
+            return 1
+        }
+    case []float32:
+        if ok && i >= 0 && i < len(a) {
+            L.PushNumber(float64(a[i]))
+            return 1
+        }
+    case []int:
+        if ok && i >= 0 && i < len(a) {
+            L.PushInteger(int64(a[i]))
+            return 1
+        }
+    case []int32:
+        if ok && i >= 0 && i < len(a) {
+            L.PushInteger(int64(a[i]))
+            return 1
+        }
+    case []int64:
+        if ok && i >= 0 && i < len(a) {
+            L.PushInteger(a[i])
+            return 1
+        }
+    default:
+        v := sliceValue(s)
+        if ok && i >= 0 && i < v.Len() {
+            if !L.pushGoValue(v.Index(i)) {
+                L.PushString("Unsupported type of slice element: " + v.Type().Elem().String())
+                return -1
+            }
+            return 1
+        }
+    }
+    // like sequences, nothing outside of the slice
+    L.PushNil()
+    return 1
+}
+
+//export golua_slice_newindex_callback
+func golua_slice_newindex_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    s := L.registry[iid]
+    i, ok := L.sliceIndex()
+    if !ok {
+        L.PushString("Wrong index type for slice: " + L.LTypename(2))
+        return -1
+    }
+
+    v := sliceValue(s)
+    if i == v.Len() {
+        return L.sliceAppend(iid, 3)
+    }
+    if i < 0 || i > v.Len() {
+        L.PushString(fmt.Sprintf("Index %d out of range of slice of length %d", i+1, v.Len()))
+        return -1
+    }
+
+    isnumber := L.Type(3) == LUA_TNUMBER
+    switch a := numericSlice(s).(type) {
+    case []float64:
+        if isnumber {
+            a[i] = L.ToNumber(3)
+            return 0
+        }
+    case []float32:
+        if isnumber {
+            a[i] = float32(L.ToNumber(3))
+            return 0
+        }
+    case []int:
+        if n, isint := L.ToIntegerX(3); isnumber && isint && int64(int(n)) == n {
+            a[i] = int(n)
+            return 0
+        }
+    case []int32:
+        if n, isint := L.ToIntegerX(3); isnumber && isint && int64(int32(n)) == n {
+            a[i] = int32(n)
+            return 0
+        }
+    case []int64:
+        if n, isint := L.ToIntegerX(3); isnumber && isint {
+            a[i] = n
+            return 0
+        }
+    default:
+        if x, ok := L.toGoValue(3, v.Type().Elem()); ok {
+            v.Index(i).Set(x)
+            return 0
+        }
+    }
+    L.PushString("Wrong value type for " + v.Type().String() + ": " + L.LTypename(3))
+    return -1
+}
+
+//export golua_slice_len_callback
+func golua_slice_len_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    L.PushInteger(int64(sliceValue(L.registry[iid]).Len()))
+    return 1
+}
+
+// Appends the values from index to the top of the stack to the slice registered at iid
+func (L *State) sliceAppend(iid uint, index int) int {
+    s := L.registry[iid]
+    v := reflect.ValueOf(s)
+    if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Array {
+        L.PushString("Cannot append to an array: " + v.Type().Elem().String())
+        return -1
+    }
+    sv := sliceValue(s)
+    xs := make([]reflect.Value, 0, L.GetTop()-index+1)
+    for i := index; i <= L.GetTop(); i++ {
+        x, ok := L.toGoValue(i, sv.Type().Elem())
+        if !ok {
+            L.PushString("Wrong value type for " + sv.Type().String() + ": " + L.LTypename(i))
+            return -1
+        }
+        xs = append(xs, x)
+    }
+    sv = reflect.Append(sv, xs...)
+    if v.Kind() == reflect.Ptr {
+        v.Elem().Set(sv)
+    } else {
+        L.registry[iid] = sv.Interface()
+    }
+    return 0
+}
+
+//export golua_slice_append_callback
+func golua_slice_append_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    if r := L.sliceAppend(iid, 2); r < 0 {
+        return r
+    }
+    L.PushValue(1)
+    return 1
+}
+
+//export golua_slice_slice_callback
+func golua_slice_slice_callback(gostateindex uintptr, iid uint) int {
+    L := getGoState(gostateindex)
+    v := sliceValue(L.registry[iid])
+    i, j := int64(1), int64(v.Len())
+    if n, isint := L.ToIntegerX(2); isint {
+        i = n
+    } else if !L.IsNoneOrNil(2) {
+        L.PushString("Wrong start index type for slice: " + L.LTypename(2))
+        return -1
+    }
+    if n, isint := L.ToIntegerX(3); isint {
+        j = n
+    } else if !L.IsNoneOrNil(3) {
+        L.PushString("Wrong end index type for slice: " + L.LTypename(3))
+        return -1
+    }
+    if i < 1 || j > int64(v.Len()) || i > j+1 {
+        L.PushString(fmt.Sprintf("Slice bounds %d:%d out of range of slice of length %d", i, j, v.Len()))
+        return -1
+    }
+    L.PushGoSlice(v.Slice(int(i-1), int(j)).Interface())
+    return 1
+}
@@ -0,0 +1,138 @@
+package lua
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestGoSlice(t *testing.T) {
+    L := newTestState(t)
+    // the numeric slices handled without reflection, and another one
+    for _, s := range []interface{}{
+        []float64{1, 2, 3}, []float32{1, 2, 3}, []int{1, 2, 3}, []int32{1, 2, 3}, []int64{1, 2, 3},
+        []uint8{1, 2, 3},
+    } {
+        L.PushGoSlice(s)
+        L.SetGlobal("s")
+        mustRun(t, L, `
+assert(#s == 3 and s[1] == 1 and s[3] == 3)
+assert(s[0] == nil and s[4] == nil and s[-1] == nil and s.x == nil and s[1.5] == nil)
+s[2] = 20
+local sum = 0
+for i, v in ipairs(s) do sum = sum + v end
+assert(sum == 24)
+`)
+        if got := reflect.ValueOf(s).Index(1).Convert(reflect.TypeOf(0.0)).Float(); got != 20 {
+            t.Errorf("%T: element 2 is %v", s, got)
+        }
+        mustFail(t, L, `s[5] = 1`, "Index 5 out of range of slice of length 3")
+        mustFail(t, L, `s[0] = 1`, "Index 0 out of range")
+        mustFail(t, L, `s.x = 1`, "Wrong index type")
+        mustFail(t, L, `s[1] = "one"`, "Wrong value type")
+        switch s.(type) {
+        case []float64, []float32:
+        default:
+            mustFail(t, L, `s[1] = 1.5`, "Wrong value type")
+        }
+    }
+    // []uint8
+    mustFail(t, L, `s[1] = 300`, "Wrong value type")
+
+    ints := []int32{1}
+    L.PushGoSlice(ints)
+    L.SetGlobal("s")
+    mustFail(t, L, `s[1] = 1 << 40`, "Wrong value type")
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestGoSliceAppend(t *testing.T) {
+    L := newTestState(t)
+
+    // appends through a pointer are seen by Go
+    names := []string{"a"}
+    L.PushGoSlice(&names)
+    L.SetGlobal("p")
+    mustRun(t, L, `
+p[2] = "b"
+assert(p:append("c", "d") == p)
+assert(#p == 4 and p[4] == "d")
+`)
+    if !reflect.DeepEqual(names, []string{"a", "b", "c", "d"}) {
+        t.Errorf("names %v", names)
+    }
+
+    // appends to a plain slice are only seen through the proxy
+    plain := make([]string, 1, 10)
+    plain[0] = "a"
+    L.PushGoSlice(plain)
+    L.SetGlobal("s")
+    mustRun(t, L, `s:append("b", "c") assert(#s == 3 and s[3] == "c")`)
+    if len(plain) != 1 {
+        t.Errorf("plain slice of length %d", len(plain))
+    }
+    L.GetGlobal("s")
+    if got := L.ToGoSlice(-1).([]string); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+        t.Errorf("ToGoSlice %v", got)
+    }
+    L.Pop(1)
+    mustFail(t, L, `s:append("d", 1)`, "Wrong value type")
+    mustRun(t, L, `assert(#s == 3)`)
+
+    // arrays are modified in place, and refuse appends
+    var array [3]int
+    L.PushGoSlice(&array)
+    L.SetGlobal("a")
+    mustRun(t, L, `a[1] = 1 a[3] = 3 assert(#a == 3)`)
+    if array != [3]int{1, 0, 3} {
+        t.Errorf("array %v", array)
+    }
+    mustFail(t, L, `a[4] = 4`, "Cannot append to an array")
+    mustFail(t, L, `a:append(4)`, "Cannot append to an array")
+    L.GetGlobal("a")
+    if L.ToGoSlice(-1) != &array {
+        t.Error("ToGoSlice of an array")
+    }
+    L.Pop(1)
+}
+
+func TestGoSliceSlice(t *testing.T) {
+    L := newTestState(t)
+    s := []int{1, 2, 3, 4, 5}
+    L.PushGoSlice(s)
+    L.SetGlobal("s")
+    mustRun(t, L, `
+local sub = s:slice(2, 4)
+assert(#sub == 3 and sub[1] == 2 and sub[3] == 4)
+-- sharing the elements
+sub[1] = 20
+assert(s[2] == 20)
+s[4] = 40
+assert(sub[3] == 40)
+assert(#s:slice() == 5 and #s:slice(3) == 3 and #s:slice(nil, 2) == 2)
+assert(#s:slice(3, 2) == 0 and #s:slice(6, 5) == 0)
+`)
+    if !reflect.DeepEqual(s, []int{1, 20, 3, 40, 5}) {
+        t.Errorf("slice %v", s)
+    }
+    mustFail(t, L, `s:slice(0, 2)`, "Slice bounds 0:2 out of range of slice of length 5")
+    mustFail(t, L, `s:slice(2, 6)`, "Slice bounds 2:6 out of range")
+    mustFail(t, L, `s:slice(4, 2)`, "Slice bounds 4:2 out of range")
+    mustFail(t, L, `s:slice("a")`, "Wrong start index type")
+    mustFail(t, L, `s:slice(1, {})`, "Wrong end index type")
+}
+
+func TestPushGoSlicePanics(t *testing.T) {
+    L := newTestState(t)
+    for _, v := range []interface{}{42, [2]int{}, map[int]int{}, new(int)} {
+        func() {
+            defer func() {
+                if recover() == nil {
+                    t.Errorf("PushGoSlice of a %T", v)
+                }
+            }()
+            L.PushGoSlice(v)
+        }()
+    }
+}
@@ -0,0 +1,348 @@
+package lua
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "sync"
+    "unicode"
+)
+
+// How the fields and methods of Go structs are named in lua, see SetNamingPolicy
+type NamingPolicy int
+
+const (
+    // Names spelled like in Go: Name, UserID, HTTPServer
+    NamingAsIs NamingPolicy = iota
+    // Names starting with a lower case word: name, userID, httpServer
+    NamingLowerCamel
+    // Lower case words separated by underscores: name, user_id, http_server
+    NamingSnakeCase
+)
+
+// Sets how lua code names the fields and methods of the Go structs pushed with PushGoStruct,
+// NamingAsIs by default. The names given by lua and json tags are kept as they are.
+func (L *State) SetNamingPolicy(p NamingPolicy) {
+    L.mainState().naming = p
+}
+
+// Returns the lua name of the Go field or method name
+func (p NamingPolicy) Apply(name string) string {
+    switch p {
+    case NamingLowerCamel:
+        r := []rune(name)
+        // the leading upper case word, like HTTP in HTTPServer but all of ID
+        n := 0
+        for n < len(r) && unicode.IsUpper(r[n]) {
+            n++
+        }
+        if n > 1 && n < len(r) && unicode.IsLower(r[n]) {
+            n--
+        }
+        if n == 0 {
+            n = 1
+        }
+        for i := 0; i < n && i < len(r); i++ {
+            r[i] = unicode.ToLower(r[i])
+        }
+        return string(r)
+
+    case NamingSnakeCase:
+        r := []rune(name)
+        var b strings.Builder
+        for i, c := range r {
+            if i > 0 && unicode.IsUpper(c) {
+                prev := r[i-1]
+                // before a word, or before the last letter of an upper case word followed by a lower case one
+                if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && i+1 < len(r) && unicode.IsLower(r[i+1]) {
+                    b.WriteByte('_')
+                }
+            }
+            b.WriteRune(unicode.ToLower(c))
+        }
+        return b.String()
+    }
+    return name
+}
+
+// Returns the lua name of a struct field: the name of its lua tag, the name of its json tag or
+// the Go name following the policy. ok is false for the fields excluded with the tag "-".
+func (p NamingPolicy) FieldName(name string, tag reflect.StructTag) (luaname string, ok bool) {
+    luaname, _, _, ok = p.field(name, tag)
+    return luaname, ok
+}
+
+// Like FieldName with the readonly and omitempty options of the lua tag
+func (p NamingPolicy) field(name string, tag reflect.StructTag) (luaname string, readonly, omitempty, ok bool) {
+    s, islua := tag.Lookup("lua")
+    if !islua {
+        s = tag.Get("json")
+    }
+    if s == "-" {
+        return "", false, false, false
+    }
+    opts := strings.Split(s, ",")
+    if islua {
+        for _, opt := range opts[1:] {
+            switch strings.TrimSpace(opt) {
+            case "readonly":
+                readonly = true
+            case "omitempty":
+                omitempty = true
+            }
+        }
+    }
+    if luaname = opts[0]; luaname == "" {
+        luaname = p.Apply(name)
+    }
+    return luaname, readonly, omitempty, true
+}
+
+// Exported field of a struct seen from lua
+type structField struct {
+    name  string
+    index []int
+    // assignments from lua are errors
+    readonly bool
+    // zero values are nil in lua
+    omitempty bool
+    // returns the field of a struct, false when it is in a nil embedded pointer
+    get func(v reflect.Value) (reflect.Value, bool)
+    // assigns the lua value at index to the field, false if it has a wrong type
+    set func(L *State, f reflect.Value, index int) bool
+}
+
+// Exported method of a pointer to a struct seen from lua
+type structMethod struct {
+    name   string
+    goname string
+    // the method expression, taking the receiver first
+    fn   reflect.Value
+    recv reflect.Type
+    // calls the method with the receiver at 1, see pushGoMethod
+    call LuaGoFunction
+}
+
+// Fields and methods of a struct type for a naming policy, built once by structInfoOf
+type structInfo struct {
+    fields  map[string]*structField
+    methods map[string]*structMethod
+}
+
+type structInfoKey struct {
+    t      reflect.Type
+    naming NamingPolicy
+}
+
+// Cache of the structInfo by structInfoKey, shared by the states
+var structInfos sync.Map
+
+// Returns the fields and methods of the struct type t seen from lua with the naming policy p
+func structInfoOf(t reflect.Type, p NamingPolicy) *structInfo {
+    key := structInfoKey{t, p}
+    if info, ok := structInfos.Load(key); ok {
+        return info.(*structInfo)
+    }
+
+    info := &structInfo{fields: map[string]*structField{}, methods: map[string]*structMethod{}}
+    for _, f := range structFields(t, p) {
+        // the shallowest one when several fields have the name
+        if prev, ok := info.fields[f.name]; !ok || len(f.index) < len(prev.index) {
+            f := f
+            info.fields[f.name] = &f
+        }
+    }
+    pt := reflect.PointerTo(t)
+    for i := 0; i < pt.NumMethod(); i++ {
+        m := pt.Method(i)
+        sm := &structMethod{name: p.Apply(m.Name), goname: m.Name, fn: m.Func, recv: pt}
+        sm.call = sm.callback
+        info.methods[sm.name] = sm
+    }
+    actual, _ := structInfos.LoadOrStore(key, info)
+    return actual.(*structInfo)
+}
+
+// Returns the fields of the struct type t accessible from lua, promoted fields of embedded
+// structs included but not the ones of excluded embedded structs
+func structFields(t reflect.Type, p NamingPolicy) []structField {
+    var fields []structField
+    var excluded [][]int
+    for _, sf := range reflect.VisibleFields(t) {
+        name, readonly, omitempty, ok := p.field(sf.Name, sf.Tag)
+        if !ok && sf.Anonymous {
+            excluded = append(excluded, sf.Index)
+        }
+        for _, e := range excluded {
+            ok = ok && (len(sf.Index) <= len(e) || !reflect.DeepEqual(sf.Index[:len(e)], e))
+        }
+        if ok && sf.IsExported() {
+            fields = append(fields, structField{name, sf.Index, readonly, omitempty, fieldGetter(sf.Index), fieldSetter(sf.Type)})
+        }
+    }
+    return fields
+}
+
+func fieldGetter(index []int) func(v reflect.Value) (reflect.Value, bool) {
+    if len(index) == 1 {
+        i := index[0]
+        return func(v reflect.Value) (reflect.Value, bool) {
+            return v.Field(i), true
+        }
+    }
+    return func(v reflect.Value) (reflect.Value, bool) {
+        f, err := v.FieldByIndexErr(index)
+        return f, err == nil
+    }
+}
+
+// Returns the function assigning lua values to fields of type t, without toGoValue for the
+// basic types
+func fieldSetter(t reflect.Type) func(L *State, f reflect.Value, index int) bool {
+    switch t.Kind() {
+    case reflect.Bool:
+        return func(L *State, f reflect.Value, index int) bool {
+            if L.Type(index) != LUA_TBOOLEAN {
+                return false
+            }
+            f.SetBool(L.ToBoolean(index))
+            return true
+        }
+
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return func(L *State, f reflect.Value, index int) bool {
+            n, isnum := L.ToIntegerX(index)
+            if L.Type(index) != LUA_TNUMBER || !isnum || f.OverflowInt(n) {
+                return false
+            }
+            f.SetInt(n)
+            return true
+        }
+
+    case reflect.String:
+        return func(L *State, f reflect.Value, index int) bool {
+            if L.Type(index) != LUA_TSTRING {
+                return false
+            }
+            f.SetString(L.ToString(index))
+            return true
+        }
+
+    case reflect.Float32, reflect.Float64:
+        return func(L *State, f reflect.Value, index int) bool {
+            if L.Type(index) != LUA_TNUMBER {
+                return false
+            }
+            f.SetFloat(L.ToNumber(index))
+            return true
+        }
+
+    case reflect.Struct:
+        if t != typeOfTime {
+            return func(L *State, f reflect.Value, index int) bool {
+                if L.Type(index) != LUA_TTABLE {
+                    return setField(L, f, index)
+                }
+                return mergeStruct(L, f, index)
+            }
+        }
+
+    case reflect.Ptr:
+        if t.Elem().Kind() != reflect.Struct || t.Elem() == typeOfTime {
+            // pointers to simple types are assigned through
+            elem := fieldSetter(t.Elem())
+            return func(L *State, f reflect.Value, index int) bool {
+                if !f.IsNil() {
+                    return elem(L, f.Elem(), index)
+                }
+                return setField(L, f, index)
+            }
+        }
+        return func(L *State, f reflect.Value, index int) bool {
+            if L.Type(index) != LUA_TTABLE || f.IsNil() {
+                return setField(L, f, index)
+            }
+            return mergeStruct(L, f.Elem(), index)
+        }
+    }
+    return setField
+}
+
+// Sets the fields of the struct f named by the keys of the table at index, keeping the others.
+// The fields are set on a copy assigned to f when they all are, so that f is unchanged on errors.
+func mergeStruct(L *State, f reflect.Value, index int) bool {
+    v := reflect.New(f.Type()).Elem()
+    v.Set(f)
+    if !L.setStructFields(v, index) {
+        return false
+    }
+    f.Set(v)
+    return true
+}
+
+// Sets the fields of the struct v named by the keys of the table at index. Returns false for
+// keys that are not the names of fields, read-only fields and values of a wrong type.
+func (L *State) setStructFields(v reflect.Value, index int) bool {
+    index = L.AbsIndex(index)
+    L.PushNil()
+    for L.Next(index) != 0 {
+        var f reflect.Value
+        var info *structField
+        ok := L.Type(-2) == LUA_TSTRING
+        if ok {
+            f, info, ok = L.structField(v, L.ToString(-2))
+        }
+        ok = ok && !info.readonly && f.CanSet() && info.set(L, f, -1)
+        L.Pop(1)
+        if !ok {
+            L.Pop(1)
+            return false
+        }
+    }
+    return true
+}
+
+func setField(L *State, f reflect.Value, index int) bool {
+    v, ok := L.toGoValue(index, f.Type())
+    if ok {
+        f.Set(v)
+    }
+    return ok
+}
+
+// Returns the field of the struct v named name in lua; ok is false without such a field or when
+// it is in a nil embedded pointer
+func (L *State) structField(v reflect.Value, name string) (f reflect.Value, info *structField, ok bool) {
+    info, ok = structInfoOf(v.Type(), L.mainState().naming).fields[name]
+    if !ok {
+        return reflect.Value{}, nil, false
+    }
+    f, ok = info.get(v)
+    return f, info, ok
+}
+
+// Pushes the function calling the method m, for calls like obj:Method(...). The function is
+// created once per state and kept in the registry.
+func (L *State) pushGoMethod(m *structMethod) {
+    L = L.mainState()
+    if ref, ok := L.methodRefs[m]; ok {
+        L.RawGeti(LUA_REGISTRYINDEX, ref)
+        return
+    }
+    if L.methodRefs == nil {
+        L.methodRefs = map[*structMethod]int{}
+    }
+    L.PushGoClosure(m.call)
+    L.PushValue(-1)
+    L.methodRefs[m] = L.Ref(LUA_REGISTRYINDEX)
+}
+
+// Calls the method with the receiver at 1 and the following arguments
+func (m *structMethod) callback(L *State) int {
+    recv := L.ToGoStruct(1)
+    if recv == nil || reflect.TypeOf(recv) != m.recv {
+        L.PushString(fmt.Sprintf("Wrong receiver of method %s: %s expected, got %s (call it with obj:%s(...))", m.goname, m.recv, L.LTypename(1), m.name))
+        return -1
+    }
+    return L.callGoFunc(m.fn, []reflect.Value{reflect.ValueOf(recv)}, "method "+m.goname)
+}
@@ -0,0 +1,283 @@
+package lua
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+type testVec struct {
+    X, Y float64
+}
+
+type testBase struct {
+    ID   int64 `lua:"id,readonly"`
+    Kind string
+}
+
+type testExtra struct {
+    Note string
+}
+
+type testUnit struct {
+    testBase
+    *testExtra
+    Name    string
+    Pos     testVec
+    Target  *testVec
+    Created time.Time
+    Tags    []string
+    private int
+}
+
+func TestGoStructFields(t *testing.T) {
+    L := newTestState(t)
+    u := &testUnit{testBase: testBase{ID: 7, Kind: "tank"}, Name: "u1", Pos: testVec{1, 2}}
+    L.PushGoStruct(u)
+    L.SetGlobal("u")
+    mustRun(t, L, `
+-- promoted fields of embedded structs
+assert(u.id == 7 and u.Kind == "tank")
+u.Kind = "ship"
+-- nested structs are proxies of the field
+local pos = u.Pos
+assert(pos.X == 1 and pos.Y == 2)
+pos.X = 10
+assert(u.Pos.X == 10)
+-- nil pointers, embedded or not, are nil
+assert(u.Target == nil and u.Note == nil)
+assert(u.private == nil and u.Unknown == nil)
+u.Created = 1000
+assert(u.Created == 1000)
+u.Tags = {"a", "b"}
+assert(#u.Tags == 2)
+`)
+    if u.Kind != "ship" || u.Pos.X != 10 || u.Created.Unix() != 1000 || len(u.Tags) != 2 {
+        t.Errorf("unit %+v", u)
+    }
+
+    mustFail(t, L, `u.id = 8`, "Field id is read-only")
+    mustFail(t, L, `u.private = 1`, "Unknown field private")
+    // in the nil embedded pointer
+    mustFail(t, L, `u.Note = "x"`, "Unknown field Note")
+    mustFail(t, L, `u.Name = 1`, "Wrong assignment to field Name")
+
+    u.testExtra = &testExtra{"n"}
+    target := &testVec{5, 6}
+    u.Target = target
+    mustRun(t, L, `
+assert(u.Note == "n")
+u.Note = "m"
+u.Target.Y = 60
+`)
+    if u.Note != "m" || target.Y != 60 {
+        t.Errorf("unit %+v", u)
+    }
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestGoStructTableAssignment(t *testing.T) {
+    L := newTestState(t)
+    u := &testUnit{testBase: testBase{ID: 7}, Pos: testVec{1, 2}}
+    L.PushGoStruct(u)
+    L.SetGlobal("u")
+
+    // merged into the struct field, the other fields are kept
+    mustRun(t, L, `u.Pos = {Y = 20}`)
+    if u.Pos != (testVec{1, 20}) {
+        t.Errorf("Pos %+v", u.Pos)
+    }
+    // a nil pointer gets a new struct, a pointer the fields
+    mustRun(t, L, `u.Target = {X = 3}`)
+    target := u.Target
+    if target == nil || *target != (testVec{3, 0}) {
+        t.Fatalf("Target %+v", u.Target)
+    }
+    mustRun(t, L, `u.Target = {Y = 4}`)
+    if u.Target != target || *target != (testVec{3, 4}) {
+        t.Errorf("Target %+v", u.Target)
+    }
+    mustRun(t, L, `u.Target = nil`)
+    if u.Target != nil {
+        t.Error("Target not cleared")
+    }
+
+    // the struct is unchanged when a field cannot be set
+    mustFail(t, L, `u.Pos = {X = 100, Y = "y"}`, "Wrong assignment to field Pos")
+    mustFail(t, L, `u.Pos = {X = 100, Z = 1}`, "Wrong assignment to field Pos")
+    if u.Pos != (testVec{1, 20}) {
+        t.Errorf("Pos %+v", u.Pos)
+    }
+
+    type holder struct {
+        Base testBase
+        Ptr  *testBase
+    }
+    h := &holder{Base: testBase{ID: 1, Kind: "a"}}
+    L.PushGoStruct(h)
+    L.SetGlobal("h")
+    mustRun(t, L, `h.Base = {Kind = "b"}`)
+    if h.Base != (testBase{1, "b"}) {
+        t.Errorf("Base %+v", h.Base)
+    }
+    // read-only fields are not set by tables either
+    mustFail(t, L, `h.Base = {id = 2}`, "Wrong assignment to field Base")
+    mustFail(t, L, `h.Ptr = {id = 2}`, "Wrong assignment to field Ptr")
+    if h.Base.ID != 1 || h.Ptr != nil {
+        t.Errorf("holder %+v", h)
+    }
+
+    // new structs converted from tables start from the zero value
+    var got testBase
+    L.pushGoFunc(reflect.ValueOf(func(b testBase) { got = b }))
+    L.SetGlobal("take")
+    mustRun(t, L, `take({Kind = "c"})`)
+    if got != (testBase{Kind: "c"}) {
+        t.Errorf("converted %+v", got)
+    }
+    mustFail(t, L, `take({id = 3})`, "Wrong argument #1")
+}
+
+func TestNamingPolicy(t *testing.T) {
+    tests := []struct {
+        name              string
+        lowerCamel, snake string
+    }{
+        {"Name", "name", "name"},
+        {"UserID", "userID", "user_id"},
+        {"ID", "id", "id"},
+        {"HTTPServer", "httpServer", "http_server"},
+        {"ServeHTTP", "serveHTTP", "serve_http"},
+        {"Vec2D", "vec2D", "vec2_d"},
+        {"already_snake", "already_snake", "already_snake"},
+    }
+    for _, tt := range tests {
+        if got := NamingAsIs.Apply(tt.name); got != tt.name {
+            t.Errorf("NamingAsIs(%s) = %s", tt.name, got)
+        }
+        if got := NamingLowerCamel.Apply(tt.name); got != tt.lowerCamel {
+            t.Errorf("NamingLowerCamel(%s) = %s, want %s", tt.name, got, tt.lowerCamel)
+        }
+        if got := NamingSnakeCase.Apply(tt.name); got != tt.snake {
+            t.Errorf("NamingSnakeCase(%s) = %s, want %s", tt.name, got, tt.snake)
+        }
+    }
+}
+
+type testTagged struct {
+    UserID   int
+    Renamed  string `lua:"alias"`
+    FromJSON string `json:"from_json,omitempty"`
+    Both     string `lua:"lua_name" json:"json_name"`
+    Hidden   string `lua:"-"`
+    JSONOnly string `json:"-"`
+    Fixed    int    `lua:",readonly"`
+    Optional string `lua:",omitempty"`
+}
+
+func (t *testTagged) GetUserID() int { return t.UserID }
+
+func TestGoStructTags(t *testing.T) {
+    for _, tt := range []struct {
+        policy        NamingPolicy
+        userID, fixed string
+        optional, get string
+    }{
+        {NamingAsIs, "UserID", "Fixed", "Optional", "GetUserID"},
+        {NamingLowerCamel, "userID", "fixed", "optional", "getUserID"},
+        {NamingSnakeCase, "user_id", "fixed", "optional", "get_user_id"},
+    } {
+        L := newTestState(t)
+        L.SetNamingPolicy(tt.policy)
+        v := &testTagged{UserID: 1, Renamed: "r", FromJSON: "j", Both: "b", Hidden: "h", JSONOnly: "x", Fixed: 2}
+        L.PushGoStruct(v)
+        L.SetGlobal("v")
+        L.PushString(tt.userID)
+        L.SetGlobal("userID")
+        L.PushString(tt.fixed)
+        L.SetGlobal("fixed")
+        L.PushString(tt.optional)
+        L.SetGlobal("optional")
+        L.PushString(tt.get)
+        L.SetGlobal("get")
+        mustRun(t, L, `
+assert(v[userID] == 1 and v[get](v) == 1)
+-- the names of tags are kept as they are
+assert(v.alias == "r" and v.Renamed == nil)
+assert(v.from_json == "j" and v.lua_name == "b" and v.json_name == nil)
+assert(v.Hidden == nil and v.hidden == nil and v.JSONOnly == nil and v.json_only == nil)
+assert(v[fixed] == 2)
+-- the zero value is nil with omitempty
+assert(v[optional] == nil)
+v[optional] = "set"
+assert(v[optional] == "set")
+v.alias = "r2"
+`)
+        if v.Renamed != "r2" || v.Optional != "set" {
+            t.Errorf("%v: %+v", tt.policy, v)
+        }
+        mustFail(t, L, `v[fixed] = 3`, "is read-only")
+        mustFail(t, L, `v.Hidden = "x"`, "Unknown field Hidden")
+        if v.Fixed != 2 || v.Hidden != "h" {
+            t.Errorf("%v: %+v", tt.policy, v)
+        }
+    }
+
+    name, ok := NamingSnakeCase.FieldName("FromJSON", `json:"from_json,omitempty"`)
+    if name != "from_json" || !ok {
+        t.Errorf("FieldName %s %v", name, ok)
+    }
+    if _, ok := NamingSnakeCase.FieldName("Hidden", `lua:"-" json:"hidden"`); ok {
+        t.Error("FieldName of a hidden field")
+    }
+}
+
+type benchStruct struct {
+    X int
+}
+
+func (s *benchStruct) Add(n int) int {
+    s.X += n
+    return s.X
+}
+
+// Runs the loop body b.N times in lua, with obj a struct and f a Go function
+func benchLoop(b *testing.B, body string) {
+    L := NewState()
+    defer L.Close()
+    L.OpenLibs()
+    L.PushGoStruct(&benchStruct{})
+    L.SetGlobal("obj")
+    L.Register("f", func(L *State) int {
+        L.PushInteger(int64(L.ToInteger(1) + 1))
+        return 1
+    })
+    if err := L.DoString("function loop(n) local obj, f, x = obj, f, 0 for i = 1, n do " + body + " end end"); err != nil {
+        b.Fatal(err)
+    }
+    L.GetGlobal("loop")
+    L.PushInteger(int64(b.N))
+    b.ResetTimer()
+    if err := L.Call(1, 0); err != nil {
+        b.Fatal(err)
+    }
+}
+
+// The call of a global Go function, see the performance section of the README
+func BenchmarkGlobalCall(b *testing.B) {
+    benchLoop(b, "x = f(x)")
+}
+
+func BenchmarkStructFieldGet(b *testing.B) {
+    benchLoop(b, "x = obj.X")
+}
+
+func BenchmarkStructFieldSet(b *testing.B) {
+    benchLoop(b, "obj.X = i")
+}
+
+func BenchmarkStructMethodCall(b *testing.B) {
+    benchLoop(b, "x = obj:Add(1)")
+}
@@ -0,0 +1,226 @@
+package lua
+
+/*
+#include <lua.h>
+#include <lauxlib.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+    "fmt"
+    "reflect"
+    "unsafe"
+)
+
+// Function implementing a method, getter, setter or metamethod of a type registered with
+// RegisterType. self is the value it is called for, the arguments are on the stack like for a
+// LuaGoFunction, and it returns the number of results, or -1 after pushing an error message.
+type TypeFunc[T any] func(L *State, self *T) int
+
+// Lua class of a Go type, see RegisterType
+type TypeSpec[T any] struct {
+    // Name of the metatable and of the global class table
+    Name string
+    // Creates a value from the arguments at 1 and more, for Name(...) in lua; nil if lua code
+    // cannot create values
+    Constructor func(L *State) (*T, error)
+    // Methods called with obj:name(...), the arguments start at 2. They are also fields of the
+    // class table, Name.name(obj, ...).
+    Methods map[string]TypeFunc[T]
+    // Getters called for obj.name, pushing the value
+    Getters map[string]TypeFunc[T]
+    // Setters called for obj.name = v, v is at 3
+    Setters map[string]TypeFunc[T]
+    // Metamethods by event, like "__tostring", "__eq", "__lt", "__le", "__add" and the other
+    // arithmetic and bitwise operators, "__concat", "__len", "__call", "__close" or "__gc". self
+    // is the first operand of type T; the operands stay at 1 and 2. "__index" and "__newindex"
+    // are called for the names without getter, method or setter.
+    Metamethods map[string]TypeFunc[T]
+}
+
+// Type registered with RegisterType in a state
+type typeClass struct {
+    name  string
+    cname *C.char
+}
+
+// Registers the Go type T as a lua class: its values are pushed with PushType as user data with
+// the metatable spec.Name, and the global table spec.Name holds the methods and creates values
+// when called.
+//
+// Without metamethods for them, values are converted to strings as "Name: 0x...", are equal
+// when they point to the same T, and reading an unknown name gives nil while assigning it is
+// an error. Returns an error if the name is empty or already used by a metatable.
+func RegisterType[T any](L *State, spec TypeSpec[T]) error {
+    L = L.mainState()
+    if spec.Name == "" {
+        return fmt.Errorf("lua: registering %v without name", reflect.TypeOf((*T)(nil)).Elem())
+    }
+    if !L.NewMetaTable(spec.Name) {
+        L.Pop(1)
+        return fmt.Errorf("lua: metatable %s already exists", spec.Name)
+    }
+    if L.types == nil {
+        L.types = map[reflect.Type]*typeClass{}
+    }
+    class := &typeClass{spec.Name, C.CString(spec.Name)}
+    L.types[reflect.TypeOf((*T)(nil))] = class
+
+    // the operand of type T of metamethods, the first argument of the other functions
+    self := func(L *State, operands int) *T {
+        for i := 1; i <= operands; i++ {
+            if v := checkType[T](L, i, class); v != nil {
+                return v
+            }
+        }
+        return nil
+    }
+    wrap := func(what string, operands int, f TypeFunc[T]) LuaGoFunction {
+        return func(L *State) int {
+            v := self(L, operands)
+            if v == nil {
+                L.PushString(fmt.Sprintf("Wrong receiver of %s: %s expected, got %s", what, spec.Name, L.LTypename(1)))
+                return -1
+            }
+            return f(L, v)
+        }
+    }
+
+    // methods, kept in the class table
+    L.NewTable()
+    methods := map[string]int{}
+    for name, f := range spec.Methods {
+        L.PushGoClosure(wrap(spec.Name+"."+name, 1, f))
+        L.PushValue(-1)
+        methods[name] = L.Ref(LUA_REGISTRYINDEX)
+        L.SetField(-2, name)
+    }
+    if spec.Constructor != nil {
+        L.NewTable()
+        L.PushGoClosure(func(L *State) int {
+            // without the class table
+            L.Remove(1)
+            v, err := spec.Constructor(L)
+            if err != nil {
+                L.PushString(err.Error())
+                return -1
+            }
+            PushType(L, v)
+            return 1
+        })
+        L.SetField(-2, "__call")
+        L.SetMetaTable(-2)
+    }
+    L.SetGlobal(spec.Name)
+
+    // the metatable is on the top of the stack
+    for event, f := range spec.Metamethods {
+        if event == "__index" || event == "__newindex" || event == "__gc" {
+            continue
+        }
+        L.PushGoClosure(wrap(spec.Name+" "+event, 2, f))
+        L.SetField(-2, event)
+    }
+    if spec.Metamethods["__tostring"] == nil {
+        L.PushGoClosure(func(L *State) int {
+            L.PushString(fmt.Sprintf("%s: %p", spec.Name, self(L, 1)))
+            return 1
+        })
+        L.SetField(-2, "__tostring")
+    }
+    if spec.Metamethods["__eq"] == nil {
+        L.PushGoClosure(func(L *State) int {
+            L.PushBoolean(checkType[T](L, 1, class) == checkType[T](L, 2, class))
+            return 1
+        })
+        L.SetField(-2, "__eq")
+    }
+
+    index, newindex := spec.Metamethods["__index"], spec.Metamethods["__newindex"]
+    L.PushGoClosure(wrap(spec.Name+" __index", 1, func(L *State, v *T) int {
+        if L.Type(2) == LUA_TSTRING {
+            name := L.ToString(2)
+            if get, ok := spec.Getters[name]; ok {
+                return get(L, v)
+            }
+            if ref, ok := methods[name]; ok {
+                L.RawGeti(LUA_REGISTRYINDEX, ref)
+                return 1
+            }
+        }
+        if index != nil {
+            return index(L, v)
+        }
+        L.PushNil()
+        return 1
+    }))
+    L.SetField(-2, "__index")
+    L.PushGoClosure(wrap(spec.Name+" __newindex", 1, func(L *State, v *T) int {
+        if L.Type(2) == LUA_TSTRING {
+            if set, ok := spec.Setters[L.ToString(2)]; ok {
+                return set(L, v)
+            }
+        }
+        if newindex != nil {
+            return newindex(L, v)
+        }
+        L.PushString(fmt.Sprintf("Cannot assign %s of %s", L.ToString(2), spec.Name))
+        return -1
+    }))
+    L.SetField(-2, "__newindex")
+
+    // releases the value after the __gc metamethod of spec
+    gc := spec.Metamethods["__gc"]
+    L.PushGoClosure(func(L *State) int {
+        p := C.luaL_testudata(L.s, 1, class.cname)
+        if p == nil {
+            return 0
+        }
+        if v := checkType[T](L, 1, class); v != nil && gc != nil {
+            gc(L, v)
+            L.SetTop(1)
+        }
+        L.unregister(uint(*(*C.uint)(p)))
+        return 0
+    })
+    L.SetField(-2, "__gc")
+    L.Pop(1)
+    return nil
+}
+
+// Pushes v as user data of the type registered with RegisterType, nil if v is nil. Panics if
+// T is not registered.
+func PushType[T any](L *State, v *T) {
+    class := L.mainState().types[reflect.TypeOf(v)]
+    if class == nil {
+        panic("lua: PushType of unregistered type " + reflect.TypeOf(v).Elem().String())
+    }
+    if v == nil {
+        L.PushNil()
+        return
+    }
+    iid := L.register(v)
+    p := L.NewUserdata(unsafe.Sizeof(C.uint(0)))
+    *(*C.uint)(p) = C.uint(iid)
+    C.luaL_setmetatable(L.s, class.cname)
+}
+
+// Returns the value at index if it was pushed with PushType, nil otherwise. Unlike CheckUdata it
+// does not raise an error: Go functions push a message and return -1 instead.
+func CheckType[T any](L *State, index int) *T {
+    class := L.mainState().types[reflect.TypeOf((*T)(nil))]
+    if class == nil {
+        return nil
+    }
+    return checkType[T](L, index, class)
+}
+
+func checkType[T any](L *State, index int, class *typeClass) *T {
+    p := C.luaL_testudata(L.s, C.int(index), class.cname)
+    if p == nil {
+        return nil
+    }
+    v, _ := L.mainState().registry[*(*C.uint)(p)].(*T)
+    return v
+}
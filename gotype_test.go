@@ -0,0 +1,201 @@
+package lua
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+type testVec2 struct {
+    X, Y float64
+}
+
+// Number of Go objects held by lua
+func liveObjects(L *State) int {
+    return len(L.registry) - len(L.freeIndices)
+}
+
+func registerVec2(t *testing.T, L *State, gc func(v *testVec2), closed func(v *testVec2)) {
+    t.Helper()
+    // the other operand of binary operators, a number or a vector
+    operand := func(L *State, self *testVec2) (other *testVec2, scalar float64, ok bool) {
+        for i := 1; i <= 2; i++ {
+            if v := CheckType[testVec2](L, i); v != nil && v != self {
+                return v, 0, true
+            }
+            if L.Type(i) == LUA_TNUMBER {
+                return nil, L.ToNumber(i), true
+            }
+        }
+        return self, 0, CheckType[testVec2](L, 1) == self && CheckType[testVec2](L, 2) == self
+    }
+    err := RegisterType(L, TypeSpec[testVec2]{
+        Name: "Vec2",
+        Constructor: func(L *State) (*testVec2, error) {
+            if !L.IsNumber(1) || !L.IsNumber(2) {
+                return nil, errors.New("Vec2 expects two numbers")
+            }
+            return &testVec2{L.ToNumber(1), L.ToNumber(2)}, nil
+        },
+        Methods: map[string]TypeFunc[testVec2]{
+            "scale": func(L *State, v *testVec2) int {
+                k := L.ToNumber(2)
+                v.X, v.Y = v.X*k, v.Y*k
+                L.PushValue(1)
+                return 1
+            },
+        },
+        Getters: map[string]TypeFunc[testVec2]{
+            "x": func(L *State, v *testVec2) int { L.PushNumber(v.X); return 1 },
+            "y": func(L *State, v *testVec2) int { L.PushNumber(v.Y); return 1 },
+        },
+        Setters: map[string]TypeFunc[testVec2]{
+            "x": func(L *State, v *testVec2) int { v.X = L.ToNumber(3); return 0 },
+        },
+        Metamethods: map[string]TypeFunc[testVec2]{
+            "__add": func(L *State, v *testVec2) int {
+                other, _, ok := operand(L, v)
+                if !ok || other == nil {
+                    L.PushString("Vec2 + expects two vectors")
+                    return -1
+                }
+                PushType(L, &testVec2{v.X + other.X, v.Y + other.Y})
+                return 1
+            },
+            "__mul": func(L *State, v *testVec2) int {
+                _, k, ok := operand(L, v)
+                if !ok {
+                    L.PushString("Vec2 * expects a number")
+                    return -1
+                }
+                PushType(L, &testVec2{v.X * k, v.Y * k})
+                return 1
+            },
+            "__unm": func(L *State, v *testVec2) int {
+                PushType(L, &testVec2{-v.X, -v.Y})
+                return 1
+            },
+            "__lt": func(L *State, v *testVec2) int {
+                a, b := CheckType[testVec2](L, 1), CheckType[testVec2](L, 2)
+                L.PushBoolean(a.X*a.X+a.Y*a.Y < b.X*b.X+b.Y*b.Y)
+                return 1
+            },
+            "__len": func(L *State, v *testVec2) int { L.PushInteger(2); return 1 },
+            "__concat": func(L *State, v *testVec2) int {
+                // with __tostring
+                L.PushString(L.LToString(1) + L.LToString(2))
+                return 1
+            },
+            "__call": func(L *State, v *testVec2) int {
+                L.PushNumber(v.X + v.Y)
+                return 1
+            },
+            "__close": func(L *State, v *testVec2) int { closed(v); return 0 },
+            "__gc":    func(L *State, v *testVec2) int { gc(v); return 0 },
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRegisterType(t *testing.T) {
+    L := newTestState(t)
+    registerVec2(t, L, func(*testVec2) {}, func(*testVec2) {})
+    mustRun(t, L, `
+local v = Vec2(3, 4)
+assert(v.x == 3 and v.y == 4 and v.z == nil)
+v.x = 6
+assert(v.x == 6)
+assert(v:scale(0.5) == v and v.x == 3 and v.y == 2)
+assert(Vec2.scale(v, 2) == v and v.x == 6)
+assert(tostring(v):find("^Vec2: 0x"))
+assert(v == v and v ~= Vec2(6, 4))
+`)
+    mustFail(t, L, `Vec2(1)`, "Vec2 expects two numbers")
+    mustFail(t, L, `Vec2(1, 2).y = 3`, "Cannot assign y of Vec2")
+    mustFail(t, L, `Vec2.scale({}, 2)`, "Wrong receiver of Vec2.scale: Vec2 expected, got table")
+
+    L.PushGoFunction(func(L *State) int {
+        v := CheckType[testVec2](L, 1)
+        if v == nil {
+            L.PushNil()
+            return 1
+        }
+        L.PushNumber(v.X)
+        return 1
+    })
+    L.SetGlobal("getx")
+    mustRun(t, L, `assert(getx(Vec2(7, 0)) == 7 and getx({}) == nil and getx() == nil)`)
+
+    if err := RegisterType(L, TypeSpec[testVec2]{Name: "Vec2"}); err == nil {
+        t.Error("Vec2 registered twice")
+    }
+    if err := RegisterType(L, TypeSpec[testVec2]{}); err == nil {
+        t.Error("registered without name")
+    }
+    func() {
+        defer func() {
+            if recover() == nil {
+                t.Error("PushType of an unregistered type")
+            }
+        }()
+        PushType(L, &testBase{})
+    }()
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestRegisterTypeOperators(t *testing.T) {
+    L := newTestState(t)
+    registerVec2(t, L, func(*testVec2) {}, func(*testVec2) {})
+    mustRun(t, L, `
+local a, b = Vec2(1, 2), Vec2(3, 4)
+local c = a + b
+assert(c.x == 4 and c.y == 6)
+-- self is the operand of type Vec2, on either side
+local d, e = a * 2, 3 * a
+assert(d.x == 2 and d.y == 4 and e.x == 3 and e.y == 6)
+local n = -a
+assert(n.x == -1 and n.y == -2)
+assert(a < b and not (b < a))
+assert(#a == 2)
+assert(a(10) == 3)
+assert(("v=" .. a):find("^v=Vec2: "))
+`)
+    mustFail(t, L, `local x = Vec2(1, 2) + 1`, "Vec2 + expects two vectors")
+}
+
+func TestRegisterTypeCloseAndGC(t *testing.T) {
+    L := newTestState(t)
+    var closed, collected []string
+    registerVec2(t, L,
+        func(v *testVec2) { collected = append(collected, fmt.Sprint(v.X)) },
+        func(v *testVec2) { closed = append(closed, fmt.Sprint(v.X)) })
+    live := liveObjects(L)
+
+    mustRun(t, L, `
+do
+    local a <close> = Vec2(1, 0)
+    local b <close> = Vec2(2, 0)
+end
+local ok = pcall(function()
+    local c <close> = Vec2(3, 0)
+    error("boom")
+end)
+assert(not ok)
+`)
+    if strings.Join(closed, ",") != "2,1,3" {
+        t.Errorf("closed %v", closed)
+    }
+
+    mustRun(t, L, `for i = 1, 100 do local v = Vec2(i, 0) end collectgarbage() collectgarbage()`)
+    if len(collected) != 103 {
+        t.Errorf("%d values collected", len(collected))
+    }
+    if n := liveObjects(L); n != live {
+        t.Errorf("%d Go objects held after the collection, %d before", n, live)
+    }
+}
@@ -7,9 +7,55 @@ package lua
 #include <lualib.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
+
+static void clua_checkversion(lua_State *L) {
+    luaL_checkversion(L);
+}
+
+static luaL_Buffer *clua_newbuffer(lua_State *L) {
+    luaL_Buffer *b = (luaL_Buffer *)malloc(sizeof(luaL_Buffer));
+    luaL_buffinit(L, b);
+    return b;
+}
+
+static void clua_addgostring(luaL_Buffer *b, _GoString_ s) {
+    luaL_addlstring(b, _GoStringPtr(s), _GoStringLen(s));
+}
+
+static void clua_addchar(luaL_Buffer *b, char c) {
+    luaL_addchar(b, c);
+}
+
+// pushes the message of luaL_argerror without raising it
+static void clua_pushargerror(lua_State *L, int arg, _GoString_ extramsg) {
+    lua_Debug ar;
+    const char *msg;
+    lua_pushlstring(L, _GoStringPtr(extramsg), _GoStringLen(extramsg));
+    msg = lua_tostring(L, -1);
+    if (!lua_getstack(L, 0, &ar)) {
+        lua_pushfstring(L, "bad argument #%d (%s)", arg, msg);
+    } else {
+        lua_getinfo(L, "n", &ar);
+        if (ar.namewhat != NULL && strcmp(ar.namewhat, "method") == 0 && --arg == 0) {
+            lua_pushfstring(L, "calling '%s' on bad self (%s)", ar.name, msg);
+        } else {
+            lua_pushfstring(L, "bad argument #%d to '%s' (%s)", arg, ar.name ? ar.name : "?", msg);
+        }
+    }
+    lua_remove(L, -2);
+}
 */
 import "C"
-import "unsafe"
+import (
+    "errors"
+    "os/exec"
+    "runtime"
+    "syscall"
+    "unsafe"
+
+    "github.com/DGHeroin/lua.go/bytecode"
+)
 
 type LuaError struct {
     code       int
@@ -33,17 +79,20 @@ func (err *LuaError) StackTrace() []LuaStackEntry {
 // WARNING: before b30b2c62c6712c6683a9d22ff0abfa54c8267863 the function ArgCheck had the opposite behaviour
 func (L *State) Argcheck(cond bool, narg int, extramsg string) {
     if !cond {
-        Cextramsg := C.CString(extramsg)
-        defer C.free(unsafe.Pointer(Cextramsg))
-        C.luaL_argerror(L.s, C.int(narg), Cextramsg)
+        L.ArgError(narg, extramsg)
     }
 }
 
 // luaL_argerror
+//
+// Raises the error of luaL_argerror with a panic, which Go functions called by lua turn into a
+// lua error when they return: raising it from C would jump over the Go frames. It never
+// returns.
 func (L *State) ArgError(narg int, extramsg string) int {
-    Cextramsg := C.CString(extramsg)
-    defer C.free(unsafe.Pointer(Cextramsg))
-    return int(C.luaL_argerror(L.s, C.int(narg), Cextramsg))
+    C.clua_pushargerror(L.s, C.int(narg), extramsg)
+    msg := L.ToString(-1)
+    L.Pop(1)
+    panic(&LuaError{LUA_ERRRUN, msg, L.StackTrace()})
 }
 
 // luaL_callmeta
@@ -76,10 +125,38 @@ func (L *State) CheckString(narg int) string {
 
 // luaL_checkoption
 //
-// BUG(everyone_involved): not implemented
+// Returns the index in lst of the string argument narg, raises an argument error when it is
+// not one of them. An empty def means the argument has no default, see OptOption for an empty
+// default.
 func (L *State) CheckOption(narg int, def string, lst []string) int {
-    // TODO: complication: lst conversion to const char* lst[] from string slice
-    return 0
+    if def != "" {
+        return L.OptOption(narg, def, lst)
+    }
+    if !L.IsString(narg) {
+        L.ArgError(narg, "string expected, got "+L.LTypename(narg))
+    }
+    return L.option(narg, L.ToString(narg), lst)
+}
+
+// luaL_checkoption with a default
+//
+// Like CheckOption, but def is used when the argument is absent or nil. def may be any string,
+// the empty one included.
+func (L *State) OptOption(narg int, def string, lst []string) int {
+    if L.IsNoneOrNil(narg) {
+        return L.option(narg, def, lst)
+    }
+    return L.CheckOption(narg, "", lst)
+}
+
+// Compares the option in Go, raising the error with ArgError
+func (L *State) option(narg int, name string, lst []string) int {
+    for i, s := range lst {
+        if s == name {
+            return i
+        }
+    }
+    return L.ArgError(narg, "invalid option '"+name+"'")
 }
 
 // luaL_checktype
@@ -94,6 +171,11 @@ func (L *State) CheckUdata(narg int, tname string) unsafe.Pointer {
     return unsafe.Pointer(C.luaL_checkudata(L.s, C.int(narg), Ctname))
 }
 
+// luaL_checkversion
+func (L *State) CheckVersion() {
+    C.clua_checkversion(L.s)
+}
+
 // Executes file, returns nil for no errors or the lua error string on failure
 func (L *State) DoFile(filename string) error {
     if r := L.LoadFile(filename); r != 0 {
@@ -117,6 +199,50 @@ func (L *State) MustDoString(str string) {
     }
 }
 
+// Like luaL_execresult but takes the error returned by exec.Cmd.Run or Wait
+func (L *State) ExecResult(err error) int {
+    if err == nil {
+        L.PushBoolean(true)
+        L.PushString("exit")
+        L.PushInteger(0)
+        return 3
+    }
+    var exitErr *exec.ExitError
+    if !errors.As(err, &exitErr) {
+        return L.FileResult(err, "")
+    }
+    L.PushNil()
+    if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+        L.PushString("signal")
+        L.PushInteger(int64(ws.Signal()))
+    } else {
+        L.PushString("exit")
+        L.PushInteger(int64(exitErr.ExitCode()))
+    }
+    return 3
+}
+
+// Like luaL_fileresult but takes a go error instead of reading errno
+func (L *State) FileResult(err error, fname string) int {
+    if err == nil {
+        L.PushBoolean(true)
+        return 1
+    }
+    L.PushNil()
+    if fname != "" {
+        L.PushString(fname + ": " + err.Error())
+    } else {
+        L.PushString(err.Error())
+    }
+    var errno syscall.Errno
+    if errors.As(err, &errno) {
+        L.PushInteger(int64(errno))
+    } else {
+        L.PushInteger(0)
+    }
+    return 3
+}
+
 // luaL_getmetafield
 func (L *State) GetMetaField(obj int, e string) bool {
     Ce := C.CString(e)
@@ -145,6 +271,11 @@ func (L *State) GSub(s string, p string, r string) string {
     return C.GoString(C.luaL_gsub(L.s, Cs, Cp, Cr))
 }
 
+// luaL_len
+func (L *State) LLen(index int) int64 {
+    return int64(C.luaL_len(L.s, C.int(index)))
+}
+
 // luaL_loadfile
 func (L *State) LoadFile(filename string) int {
     Cfilename := C.CString(filename)
@@ -159,12 +290,54 @@ func (L *State) LoadString(s string) int {
     return int(C.luaL_loadstring(L.s, Cs))
 }
 
+// luaL_loadbufferx
+//
+// Unlike Load the status is returned and the error message left on the stack when the chunk
+// cannot be loaded. mode is "t", "b", "bt" or "" for the default.
+func (L *State) LoadBuffer(bs []byte, name string, mode string) int {
+    Cbs := C.CBytes(bs)
+    Cname := C.CString(name)
+    defer C.free(Cbs)
+    defer C.free(unsafe.Pointer(Cname))
+    var Cmode *C.char
+    if mode != "" {
+        Cmode = C.CString(mode)
+        defer C.free(unsafe.Pointer(Cmode))
+    }
+    return int(C.luaL_loadbufferx(L.s, (*C.char)(Cbs), C.size_t(len(bs)), Cname, Cmode))
+}
+
+// Like LoadBuffer, but binary chunks are checked with bytecode.Verify and refused with
+// LUA_ERRSYNTAX when malformed bytecode could corrupt memory. Text chunks are compiled as usual.
+func (L *State) LoadVerified(bs []byte, name string) int {
+    if !bytecode.IsChunk(bs) {
+        return L.LoadBuffer(bs, name, "t")
+    }
+    c, err := bytecode.Parse(bs)
+    if err == nil {
+        err = bytecode.Verify(c)
+    }
+    if err != nil {
+        if len(name) > 0 && (name[0] == '@' || name[0] == '=') {
+            name = name[1:]
+        }
+        L.PushString(name + ": " + err.Error())
+        return LUA_ERRSYNTAX
+    }
+    return L.LoadBuffer(bs, name, "b")
+}
+
 // lua_dump
 func (L *State) Dump() int {
-    ret := int(C.dump_chunk(L.s))
+    ret := int(C.dump_chunk(L.s, 0))
     return ret
 }
 
+// Like Dump but leaves out the debug information (line numbers, names of locals and upvalues)
+func (L *State) DumpStrip() int {
+    return int(C.dump_chunk(L.s, 1))
+}
+
 // lua_load
 func (L *State) Load(bs []byte, name string) int {
     chunk := C.CString(string(bs))
@@ -178,6 +351,15 @@ func (L *State) Load(bs []byte, name string) int {
     return 0
 }
 
+// luaL_newlib
+//
+// Creates a new table and registers there the functions in funcs
+func (L *State) NewLib(funcs map[string]LuaGoFunction) {
+    C.clua_checkversion(L.s)
+    L.CreateTable(0, len(funcs))
+    L.SetFuncs(funcs, 0)
+}
+
 // luaL_newmetatable
 func (L *State) NewMetaTable(tname string) bool {
     Ctname := C.CString(tname)
@@ -224,6 +406,74 @@ func (L *State) Ref(t int) int {
     return int(C.luaL_ref(L.s, C.int(t)))
 }
 
+// luaL_requiref
+//
+// Calls openf with modname as argument if modname is not yet in package.loaded, and sets the result
+// as package.loaded[modname] (and as global modname when glb is true). Leaves the module on the stack.
+func (L *State) RequireF(modname string, openf LuaGoFunction, glb bool) {
+    L.GetField(LUA_REGISTRYINDEX, C.LUA_LOADED_TABLE)
+    L.GetField(-1, modname)
+    if !L.ToBoolean(-1) {
+        L.Pop(1)
+        L.PushGoClosure(openf)
+        L.PushString(modname)
+        L.MustCall(1, 1)
+        L.PushValue(-1)
+        L.SetField(-3, modname)
+    }
+    L.Remove(-2)
+    if glb {
+        L.PushValue(-1)
+        L.SetGlobal(modname)
+    }
+}
+
+// luaL_setfuncs
+//
+// Registers the functions in funcs into the table below the nup upvalues on top of the stack and pops
+// the upvalues. Every function gets a copy of the upvalues, a go function reads them with UpvalueIndex.
+func (L *State) SetFuncs(funcs map[string]LuaGoFunction, nup int) {
+    L.CheckStack(nup + 1)
+    for name, f := range funcs {
+        for i := 0; i < nup; i++ {
+            L.PushValue(-nup)
+        }
+        L.PushGoFunction(f)
+        L.Insert(-(nup + 1))
+        C.clua_pushcallbackn(L.s, C.int(nup+1))
+        L.SetField(-(nup + 2), name)
+    }
+    L.Pop(nup)
+}
+
+// luaL_testudata
+func (L *State) TestUdata(narg int, tname string) unsafe.Pointer {
+    Ctname := C.CString(tname)
+    defer C.free(unsafe.Pointer(Ctname))
+    return unsafe.Pointer(C.luaL_testudata(L.s, C.int(narg), Ctname))
+}
+
+// luaL_tolstring
+//
+// Converts the value at index to a string (honouring __tostring and __name), pushes it and returns it
+func (L *State) LToString(index int) string {
+    var size C.size_t
+    r := C.luaL_tolstring(L.s, C.int(index), &size)
+    return C.GoStringN(r, C.int(size))
+}
+
+// luaL_traceback
+//
+// Pushes a traceback of the stack of L1, starting at level, with msg prepended when it is not empty
+func (L *State) Traceback(L1 *State, msg string, level int) {
+    var Cmsg *C.char
+    if msg != "" {
+        Cmsg = C.CString(msg)
+        defer C.free(unsafe.Pointer(Cmsg))
+    }
+    C.luaL_traceback(L.s, L1.s, Cmsg, C.int(level))
+}
+
 // luaL_typename
 func (L *State) LTypename(index int) string {
     return C.GoString(C.lua_typename(L.s, C.lua_type(L.s, C.int(index))))
@@ -238,3 +488,90 @@ func (L *State) Unref(t int, ref int) {
 func (L *State) Where(lvl int) {
     C.luaL_where(L.s, C.int(lvl))
 }
+
+// Returns the pseudo-index of the i-th upvalue added with SetFuncs to the running go function
+//
+// The first upvalue of the closure is taken by the go function itself, so UpvalueIndex(1) is
+// lua_upvalueindex(2).
+func UpvalueIndex(i int) int {
+    return LUA_REGISTRYINDEX - (i + 1)
+}
+
+// Wraps a luaL_Buffer, used to build large strings inside the lua VM.
+//
+// The buffer uses a slot on the stack: between buffer operations the stack must be balanced,
+// like with luaL_Buffer. PushResult pushes the final string and releases the buffer, Close
+// releases it without result. A buffer dropped without either, like when a lua error stops a
+// Go function, is released when it is garbage collected.
+type Buffer struct {
+    L *State
+    b *C.luaL_Buffer
+}
+
+// luaL_buffinit
+func (L *State) NewBuffer() *Buffer {
+    b := &Buffer{L, C.clua_newbuffer(L.s)}
+    runtime.SetFinalizer(b, (*Buffer).free)
+    return b
+}
+
+func (b *Buffer) free() {
+    if b.b != nil {
+        C.free(unsafe.Pointer(b.b))
+        b.b = nil
+    }
+    runtime.SetFinalizer(b, nil)
+}
+
+// luaL_addlstring
+func (b *Buffer) AddString(s string) {
+    C.clua_addgostring(b.b, s)
+}
+
+// luaL_addlstring
+func (b *Buffer) AddBytes(p []byte) {
+    if len(p) == 0 {
+        return
+    }
+    C.luaL_addlstring(b.b, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
+}
+
+// luaL_addchar
+func (b *Buffer) AddChar(c byte) {
+    C.clua_addchar(b.b, C.char(c))
+}
+
+// luaL_addvalue
+//
+// Adds the value on top of the stack to the buffer and pops it
+func (b *Buffer) AddValue() {
+    C.luaL_addvalue(b.b)
+}
+
+// Implements io.Writer
+func (b *Buffer) Write(p []byte) (int, error) {
+    b.AddBytes(p)
+    return len(p), nil
+}
+
+// Implements io.StringWriter
+func (b *Buffer) WriteString(s string) (int, error) {
+    b.AddString(s)
+    return len(s), nil
+}
+
+// luaL_pushresult
+func (b *Buffer) PushResult() {
+    C.luaL_pushresult(b.b)
+    b.free()
+}
+
+// Releases the buffer without pushing its content, removing its slot from the top of the stack.
+// Does nothing once the buffer is released.
+func (b *Buffer) Close() {
+    if b.b == nil {
+        return
+    }
+    b.L.Pop(1)
+    b.free()
+}
@@ -0,0 +1,117 @@
+package lua
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestCheckOption(t *testing.T) {
+    L := newTestState(t)
+    modes := []string{"", "read", "write"}
+    L.Register("check", func(L *State) int {
+        L.PushInteger(int64(L.CheckOption(1, "", modes)))
+        return 1
+    })
+    L.Register("def", func(L *State) int {
+        L.PushInteger(int64(L.CheckOption(1, "write", modes)))
+        return 1
+    })
+    L.Register("opt", func(L *State) int {
+        L.PushInteger(int64(L.OptOption(1, "", modes)))
+        return 1
+    })
+    tests := []struct {
+        call string
+        want int
+        err  string
+    }{
+        {`check("read")`, 1, ""},
+        {`check("")`, 0, ""},
+        {`check()`, 0, "bad argument #1 to 'check' (string expected, got no value)"},
+        {`check("x")`, 0, "bad argument #1 to 'check' (invalid option 'x')"},
+        {`opt()`, 0, ""},
+        {`opt(nil)`, 0, ""},
+        {`opt("write")`, 2, ""},
+        {`opt("writ")`, 0, "invalid option 'writ'"},
+        {`def()`, 2, ""},
+        {`def(nil)`, 2, ""},
+        {`def("read")`, 1, ""},
+        {`def(1)`, 0, "invalid option '1'"},
+    }
+    for _, tt := range tests {
+        // many times: the errors must leave the state usable
+        for i := 0; i < 100; i++ {
+            err := L.DoString("result = " + tt.call)
+            if tt.err != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.err) {
+                    t.Fatalf("%s: error %v, want %q", tt.call, err, tt.err)
+                }
+                // the error message
+                L.Pop(1)
+                continue
+            }
+            if err != nil {
+                t.Fatalf("%s: %v", tt.call, err)
+            }
+            L.GetGlobal("result")
+            if got := L.ToInteger(-1); got != tt.want {
+                t.Errorf("%s = %d, want %d", tt.call, got, tt.want)
+            }
+            L.Pop(1)
+        }
+    }
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestBuffer(t *testing.T) {
+    L := newTestState(t)
+    b := L.NewBuffer()
+    b.AddString("hello")
+    b.AddChar(' ')
+    // larger than LUAL_BUFFERSIZE, moving the content to a box on the stack
+    big := strings.Repeat("x", 10000)
+    b.WriteString(big)
+    L.PushInteger(42)
+    b.AddValue()
+    b.PushResult()
+    if got := L.ToString(-1); got != "hello "+big+"42" {
+        t.Errorf("PushResult pushed %d bytes", len(got))
+    }
+    L.Pop(1)
+
+    b = L.NewBuffer()
+    b.AddBytes(make([]byte, 10000))
+    b.Close()
+    b.Close()
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestGoFunctionPanics(t *testing.T) {
+    L := newTestState(t)
+    L.Register("raise", func(L *State) int {
+        L.RaiseError("boom")
+        return 0
+    })
+    L.Register("panics", func(L *State) int {
+        var m map[string]int
+        m["x"] = 1
+        return 0
+    })
+    err := L.DoString(`
+for i = 1, 100 do
+    local ok, err = pcall(raise)
+    assert(not ok and err:find("boom"), err)
+    ok, err = pcall(panics)
+    assert(not ok and err:find("nil map"), err)
+end`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := L.DoString(`raise()`); err == nil || !strings.Contains(err.Error(), "boom") {
+        t.Errorf("error %v", err)
+    }
+}
@@ -32,7 +32,7 @@ type LuaStackEntry struct {
 }
 
 func newState(L *C.lua_State) *State {
-    newstate := &State{L, 0, make([]interface{}, 0, 8), make([]uint, 0, 8)}
+    newstate := &State{s: L, registry: make([]interface{}, 0, 8), freeIndices: make([]uint, 0, 8)}
     registerGoState(newstate)
     C.clua_setgostate(L, C.size_t(newstate.Index))
     C.clua_initstate(L)
@@ -65,8 +65,31 @@ func (L *State) getFreeIndex() (index uint, ok bool) {
     return 0, false
 }
 
+// Returns the State of the main thread, which owns the go object registry
+func (L *State) mainState() *State {
+    if L.main != nil {
+        return L.main
+    }
+    return L
+}
+
+// Returns a State for the coroutine s sharing the registry of L
+func (L *State) threadState(s *C.lua_State) *State {
+    if s == L.s {
+        return L
+    }
+    main := L.mainState()
+    if s == main.s {
+        return main
+    }
+    return &State{s: s, Index: L.Index, main: main}
+}
+
 // returns the registered function id
 func (L *State) register(f interface{}) uint {
+    if L.main != nil {
+        return L.main.register(f)
+    }
     // fmt.Printf("Registering %v\n")
     index, ok := L.getFreeIndex()
     // fmt.Printf("\tfreeindex: index = %v, ok = %v\n", index, ok)
@@ -92,6 +115,10 @@ func (L *State) register(f interface{}) uint {
 }
 
 func (L *State) unregister(fid uint) {
+    if L.main != nil {
+        L.main.unregister(fid)
+        return
+    }
     // fmt.Printf("Unregistering %d (len: %d, value: %v)\n", fid, len(L.registry), L.registry[fid])
     if (fid < uint(len(L.registry))) && (L.registry[fid] != nil) {
         L.registry[fid] = nil
@@ -136,6 +163,15 @@ func (L *State) SetMetaMethod(methodName string, f LuaGoFunction) {
 // Pushes a Go struct onto the stack as user data.
 //
 // The user data will be rigged so that lua code can access and change to public members of simple types directly
+// and call the exported methods of the pointer with obj:Method(...).
+//
+// Fields are named by the SetNamingPolicy policy, or by their tag: `lua:"name,readonly,omitempty"`
+// renames the field, forbids its assignment from lua or makes its zero value nil in lua, and
+// `lua:"-"` hides it. Without a lua tag, the name of a json tag is used.
+//
+// A table assigned to a field holding a struct, or a non-nil pointer to a struct, sets the fields
+// named by its keys and keeps the others. Tables converted to new structs, like the arguments of
+// Go functions, start from the zero value. Read-only fields cannot be set by tables either.
 func (L *State) PushGoStruct(iface interface{}) {
     iid := L.register(iface)
     C.clua_pushgostruct(L.s, C.uint(iid))
@@ -200,12 +236,20 @@ func (L *State) callEx(nargs, nresults int, catch bool) (err error) {
     // We must record where we put the error handler in the stack otherwise it will be impossible to remove after the pcall when nresults == LUA_MULTRET
     erridx := L.GetTop() - nargs - 1
     L.Insert(erridx)
+    L.mainState().msgError = nil
     r := L.pcall(nargs, nresults, erridx)
     L.Remove(erridx)
 
     // r := L.pcall(nargs, nresults, 0)
     if r != 0 {
-        err = &LuaError{r, L.ToString(-1), L.StackTrace()}
+        // with the stack trace of the message handler, if it was called
+        lerr := L.mainState().msgError
+        L.mainState().msgError = nil
+        if lerr == nil {
+            lerr = &LuaError{r, L.ToString(-1), L.StackTrace()}
+        }
+        lerr.code = r
+        err = lerr
         if !catch {
             panic(err)
         }
@@ -213,6 +257,20 @@ func (L *State) callEx(nargs, nresults int, catch bool) (err error) {
     return
 }
 
+// lua_absindex
+func (L *State) AbsIndex(index int) int {
+    return int(C.lua_absindex(L.s, C.int(index)))
+}
+
+// lua_arith
+//
+// It raises a lua error for operands without a suitable metamethod or when a metamethod fails,
+// which jumps over the Go frames and aborts the Go runtime, even in a Go function called by
+// lua: only use it with operands that cannot fail.
+func (L *State) Arith(op ArithOp) {
+    C.lua_arith(L.s, C.int(op))
+}
+
 // lua_call
 func (L *State) Call(nargs, nresults int) (err error) {
     return L.callEx(nargs, nresults, true)
@@ -223,15 +281,48 @@ func (L *State) MustCall(nargs, nresults int) {
     L.callEx(nargs, nresults, false)
 }
 
+// lua_pcall
+//
+// Unlike Call no message handler is installed: the error object is left on the stack and the
+// status code returned
+func (L *State) PCall(nargs, nresults, errfunc int) int {
+    return L.pcall(nargs, nresults, errfunc)
+}
+
 // lua_checkstack
 func (L *State) CheckStack(extra int) bool {
     return C.lua_checkstack(L.s, C.int(extra)) != 0
 }
 
+// lua_closeslot
+func (L *State) CloseSlot(index int) {
+    C.lua_closeslot(L.s, C.int(index))
+}
+
+// lua_compare
+//
+// It raises a lua error for operands without a suitable metamethod or when a metamethod fails,
+// which jumps over the Go frames and aborts the Go runtime, even in a Go function called by
+// lua: only use it with operands that cannot fail. Equal and LessThan compare in a protected
+// call.
+func (L *State) Compare(index1, index2 int, op CompareOp) bool {
+    return C.lua_compare(L.s, C.int(index1), C.int(index2), C.int(op)) != 0
+}
+
 // lua_close
 func (L *State) Close() {
+    if L.memProfiler != nil {
+        L.StopMemProfile()
+    }
     C.lua_close(L.s)
     unregisterGoState(L)
+    // the references of the values held by Go went with the registry
+    L.released.Lock()
+    L.released.refs, L.released.closed = nil, true
+    L.released.Unlock()
+    for _, class := range L.types {
+        C.free(unsafe.Pointer(class.cname))
+    }
 }
 
 // lua_concat
@@ -239,15 +330,23 @@ func (L *State) Concat(n int) {
     C.lua_concat(L.s, C.int(n))
 }
 
+// lua_copy
+func (L *State) Copy(fromidx, toidx int) {
+    C.lua_copy(L.s, C.int(fromidx), C.int(toidx))
+}
+
 // lua_createtable
 func (L *State) CreateTable(narr int, nrec int) {
     C.lua_createtable(L.s, C.int(narr), C.int(nrec))
 }
 
-// // lua_equal
-// func (L *State) Equal(index1, index2 int) bool {
-//    return C.lua_equal(L.s, C.int(index1), C.int(index2)) == 1
-// }
+// lua_compare with LUA_OPEQ, in a protected call
+//
+// Unlike Compare, errors raised by the __eq metamethod panic with a *LuaError, which Go
+// functions called by lua turn into a lua error. Invalid indices are not equal.
+func (L *State) Equal(index1, index2 int) bool {
+    return L.compare(index1, index2, LUA_OPEQ)
+}
 
 // lua_gc
 func (L *State) GC(what, data int) int {
@@ -257,6 +356,11 @@ func (L *State) GC(what, data int) int {
 // lua_getfenv
 // func (L *State) GetfEnv(index int) { C.lua_getfenv(L.s, C.int(index)) }
 
+// lua_getextraspace
+func (L *State) GetExtraSpace() unsafe.Pointer {
+    return C.clua_getextraspace(L.s)
+}
+
 // lua_getfield
 func (L *State) GetField(index int, k string) {
     Ck := C.CString(k)
@@ -272,6 +376,16 @@ func (L *State) GetGlobal(name string) {
     C.lua_getglobal(L.s, CName)
 }
 
+// lua_geti
+func (L *State) GetI(index int, n int64) LuaValType {
+    return LuaValType(C.lua_geti(L.s, C.int(index), C.lua_Integer(n)))
+}
+
+// lua_getiuservalue
+func (L *State) GetIUserValue(index int, n int) LuaValType {
+    return LuaValType(C.lua_getiuservalue(L.s, C.int(index), C.int(n)))
+}
+
 // lua_getmetatable
 func (L *State) GetMetaTable(index int) bool {
     return C.lua_getmetatable(L.s, C.int(index)) != 0
@@ -293,6 +407,9 @@ func (L *State) IsBoolean(index int) bool {
     return LuaValType(C.lua_type(L.s, C.int(index))) == LUA_TBOOLEAN
 }
 
+// lua_iscfunction
+func (L *State) IsCFunction(index int) bool { return C.lua_iscfunction(L.s, C.int(index)) != 0 }
+
 // Returns true if the value at index is a LuaGoFunction
 func (L *State) IsGoFunction(index int) bool {
     return C.clua_isgofunction(L.s, C.int(index)) != 0
@@ -313,6 +430,9 @@ func (L *State) IsLightUserdata(index int) bool {
     return LuaValType(C.lua_type(L.s, C.int(index))) == LUA_TLIGHTUSERDATA
 }
 
+// lua_isinteger
+func (L *State) IsInteger(index int) bool { return C.lua_isinteger(L.s, C.int(index)) != 0 }
+
 // lua_isnil
 func (L *State) IsNil(index int) bool { return LuaValType(C.lua_type(L.s, C.int(index))) == LUA_TNIL }
 
@@ -338,13 +458,42 @@ func (L *State) IsThread(index int) bool {
     return LuaValType(C.lua_type(L.s, C.int(index))) == LUA_TTHREAD
 }
 
+// lua_isyieldable
+func (L *State) IsYieldable() bool { return C.lua_isyieldable(L.s) != 0 }
+
 // lua_isuserdata
 func (L *State) IsUserdata(index int) bool { return C.lua_isuserdata(L.s, C.int(index)) == 1 }
 
-// // lua_lessthan
-// func (L *State) LessThan(index1, index2 int) bool {
-//    return C.lua_lessthan(L.s, C.int(index1), C.int(index2)) == 1
-// }
+// lua_len
+//
+// Pushes the length of the value at index, honouring the __len metamethod.
+// It raises a lua error for operands without a suitable metamethod or when a metamethod fails,
+// which jumps over the Go frames and aborts the Go runtime, even in a Go function called by
+// lua: only use it with operands that cannot fail.
+func (L *State) Len(index int) {
+    C.lua_len(L.s, C.int(index))
+}
+
+// lua_compare with LUA_OPLT, in a protected call
+//
+// Unlike Compare, errors raised by the __lt metamethod or for values that cannot be compared
+// panic with a *LuaError, which Go functions called by lua turn into a lua error.
+func (L *State) LessThan(index1, index2 int) bool {
+    return L.compare(index1, index2, LUA_OPLT)
+}
+
+// Compares in a protected call, see Equal and LessThan
+func (L *State) compare(index1, index2 int, op CompareOp) bool {
+    switch C.clua_compare(L.s, C.int(index1), C.int(index2), C.int(op)) {
+    case 0:
+        return false
+    case 1:
+        return true
+    }
+    err := &LuaError{LUA_ERRRUN, L.ToString(-1), L.StackTrace()}
+    L.Pop(1)
+    panic(err)
+}
 
 // Creates a new lua interpreter state with the given allocation function
 func NewStateAlloc(f Alloc) *State {
@@ -359,11 +508,8 @@ func (L *State) NewTable() {
 
 // lua_newthread
 func (L *State) NewThread() *State {
-    // TODO: call newState with result from C.lua_newthread and return it
-    // TODO: should have same lists as parent
-    //		but may complicate gc
     s := C.lua_newthread(L.s)
-    return &State{s, 0, nil, nil}
+    return &State{s: s, Index: L.Index, main: L.mainState()}
 }
 
 // lua_next
@@ -371,11 +517,10 @@ func (L *State) Next(index int) int {
     return int(C.lua_next(L.s, C.int(index)))
 }
 
-//
-// // lua_objlen
-// func (L *State) ObjLen(index int) uint {
-//    return uint(C.lua_objlen(L.s, C.int(index)))
-// }
+// Creates a new user data object of specified size with nuvalue user values and returns it
+func (L *State) NewUserdataUV(size uintptr, nuvalue int) unsafe.Pointer {
+    return unsafe.Pointer(C.lua_newuserdatauv(L.s, C.size_t(size), C.int(nuvalue)))
+}
 
 // lua_pop
 func (L *State) Pop(n int) {
@@ -403,6 +548,10 @@ func (L *State) PushString(str string) {
 }
 
 func (L *State) PushBytes(b []byte) {
+    if len(b) == 0 {
+        C.lua_pushlstring(L.s, nil, 0)
+        return
+    }
     C.lua_pushlstring(L.s, (*C.char)(unsafe.Pointer(&b[0])), C.size_t(len(b)))
 }
 
@@ -441,11 +590,21 @@ func (L *State) RawGet(index int) {
     C.lua_rawget(L.s, C.int(index))
 }
 
+// lua_rawgetp
+func (L *State) RawGetP(index int, p unsafe.Pointer) LuaValType {
+    return LuaValType(C.lua_rawgetp(L.s, C.int(index), p))
+}
+
 // lua_rawgeti
 func (L *State) RawGeti(index int, n int) {
     C.lua_rawgeti(L.s, C.int(index), C.longlong(n))
 }
 
+// lua_rawlen
+func (L *State) RawLen(index int) uint {
+    return uint(C.lua_rawlen(L.s, C.int(index)))
+}
+
 // lua_rawset
 func (L *State) RawSet(index int) {
     C.lua_rawset(L.s, C.int(index))
@@ -456,6 +615,11 @@ func (L *State) RawSeti(index int, n int) {
     C.lua_rawseti(L.s, C.int(index), C.longlong(n))
 }
 
+// lua_rawsetp
+func (L *State) RawSetP(index int, p unsafe.Pointer) {
+    C.lua_rawsetp(L.s, C.int(index), p)
+}
+
 // Registers a Go function as a global variable
 func (L *State) Register(name string, f LuaGoFunction) {
     L.PushGoFunction(f)
@@ -472,11 +636,21 @@ func (L *State) Replace(index int) {
     C.clua_lua_replace(L.s, C.int(index))
 }
 
+// lua_resetthread
+func (L *State) ResetThread() int {
+    return int(C.lua_resetthread(L.s))
+}
+
 // lua_resume
 func (L *State) Resume(narg int) int {
     return int(C.lua_resume(L.s, nil, C.int(narg), nil))
 }
 
+// lua_rotate
+func (L *State) Rotate(index int, n int) {
+    C.lua_rotate(L.s, C.int(index), C.int(n))
+}
+
 // lua_setallocf
 func (L *State) SetAllocf(f Alloc) {
     C.clua_setallocf(L.s, unsafe.Pointer(&f))
@@ -502,6 +676,16 @@ func (L *State) SetGlobal(name string) {
     C.lua_setglobal(L.s, Cname)
 }
 
+// lua_seti
+func (L *State) SetI(index int, n int64) {
+    C.lua_seti(L.s, C.int(index), C.lua_Integer(n))
+}
+
+// lua_setiuservalue
+func (L *State) SetIUserValue(index int, n int) bool {
+    return C.lua_setiuservalue(L.s, C.int(index), C.int(n)) != 0
+}
+
 // lua_setmetatable
 func (L *State) SetMetaTable(index int) {
     C.lua_setmetatable(L.s, C.int(index))
@@ -512,6 +696,18 @@ func (L *State) SetTable(index int) {
     C.lua_settable(L.s, C.int(index))
 }
 
+// lua_setwarnf
+//
+// Installs f as the warning function, nil turns warnings off
+func (L *State) SetWarnF(f WarnFunction) {
+    L.mainState().warnf = f
+    if f == nil {
+        C.clua_setwarnf(L.s, 0)
+    } else {
+        C.clua_setwarnf(L.s, 1)
+    }
+}
+
 // lua_settop
 func (L *State) SetTop(index int) {
     C.lua_settop(L.s, C.int(index))
@@ -522,11 +718,29 @@ func (L *State) Status() int {
     return int(C.lua_status(L.s))
 }
 
+// lua_stringtonumber
+//
+// Pushes the number s converts to and returns true, or pushes nothing and returns false
+func (L *State) StringToNumber(s string) bool {
+    Cs := C.CString(s)
+    defer C.free(unsafe.Pointer(Cs))
+    return C.lua_stringtonumber(L.s, Cs) != 0
+}
+
 // lua_toboolean
 func (L *State) ToBoolean(index int) bool {
     return C.lua_toboolean(L.s, C.int(index)) != 0
 }
 
+// lua_toclose
+//
+// It raises a lua error when the value has no __close metamethod, which jumps over the Go
+// frames and aborts the Go runtime: only use it with values that have one. Lua errors raised
+// later close the slot the same way.
+func (L *State) ToClose(index int) {
+    C.lua_toclose(L.s, C.int(index))
+}
+
 // Returns the value at index as a Go function (it must be something pushed with PushGoFunction)
 func (L *State) ToGoFunction(index int) (f LuaGoFunction) {
     if !L.IsGoFunction(index) {
@@ -536,7 +750,7 @@ func (L *State) ToGoFunction(index int) (f LuaGoFunction) {
     if fid < 0 {
         return nil
     }
-    return L.registry[fid].(LuaGoFunction)
+    return L.mainState().registry[fid].(LuaGoFunction)
 }
 
 // Returns the value at index as a Go Struct (it must be something pushed with PushGoStruct)
@@ -548,7 +762,7 @@ func (L *State) ToGoStruct(index int) (f interface{}) {
     if fid < 0 {
         return nil
     }
-    return L.registry[fid]
+    return L.mainState().registry[fid]
 }
 
 // lua_tostring
@@ -569,11 +783,25 @@ func (L *State) ToInteger(index int) int {
     return int(C.lua_tointegerx(L.s, C.int(index), nil))
 }
 
+// lua_tointegerx
+func (L *State) ToIntegerX(index int) (int64, bool) {
+    var isnum C.int
+    n := C.lua_tointegerx(L.s, C.int(index), &isnum)
+    return int64(n), isnum != 0
+}
+
 // lua_tonumber
 func (L *State) ToNumber(index int) float64 {
     return float64(C.lua_tonumberx(L.s, C.int(index), nil))
 }
 
+// lua_tonumberx
+func (L *State) ToNumberX(index int) (float64, bool) {
+    var isnum C.int
+    n := C.lua_tonumberx(L.s, C.int(index), &isnum)
+    return float64(n), isnum != 0
+}
+
 // lua_topointer
 func (L *State) ToPointer(index int) uintptr {
     return uintptr(C.lua_topointer(L.s, C.int(index)))
@@ -581,8 +809,11 @@ func (L *State) ToPointer(index int) uintptr {
 
 // lua_tothread
 func (L *State) ToThread(index int) *State {
-    // TODO: find a way to link lua_State* to existing *State, return that
-    return &State{}
+    s := C.lua_tothread(L.s, C.int(index))
+    if s == nil {
+        return nil
+    }
+    return L.threadState(s)
 }
 
 // lua_touserdata
@@ -600,6 +831,32 @@ func (L *State) Typename(tp int) string {
     return C.GoString(C.lua_typename(L.s, C.int(tp)))
 }
 
+// lua_upvalueid
+func (L *State) UpvalueId(funcindex, n int) uintptr {
+    return uintptr(C.lua_upvalueid(L.s, C.int(funcindex), C.int(n)))
+}
+
+// lua_upvaluejoin
+func (L *State) UpvalueJoin(funcindex1, n1, funcindex2, n2 int) {
+    C.lua_upvaluejoin(L.s, C.int(funcindex1), C.int(n1), C.int(funcindex2), C.int(n2))
+}
+
+// lua_version
+func (L *State) Version() float64 {
+    return float64(C.lua_version(L.s))
+}
+
+// lua_warning
+func (L *State) Warning(msg string, tocont bool) {
+    Cmsg := C.CString(msg)
+    defer C.free(unsafe.Pointer(Cmsg))
+    cont := 0
+    if tocont {
+        cont = 1
+    }
+    C.lua_warning(L.s, Cmsg, C.int(cont))
+}
+
 // lua_xmove
 func XMove(from *State, to *State, n int) {
     C.lua_xmove(from.s, to.s, C.int(n))
@@ -652,7 +909,7 @@ func (L *State) OpenGoLibs() {
 
 }
 func (L *State) OpenLibsExt() {
-    //L.registerLib("serialize", C.luaopen_serialize)
+    L.registerLib("serialize", C.luaopen_serialize)
     L.registerLib("cmsgpack", C.luaopen_cmsgpack)
     L.registerLib("pb", C.luaopen_pb)
     L.registerLib("cjson", C.luaopen_cjson)
@@ -704,7 +961,7 @@ func (L *State) StackTraceString() string {
 func (L *State) RaiseError(msg string) {
     st := L.StackTrace()
     prefix := ""
-    if len(st) >= 1 {
+    if len(st) >= 2 {
         prefix = fmt.Sprintf("%s:%d: ", st[1].ShortSource, st[1].CurrentLine)
     }
     panic(&LuaError{0, prefix + msg, st})
@@ -9,6 +9,12 @@ import "C"
 
 type LuaValType int
 
+// Operations for Arith
+type ArithOp int
+
+// Operations for Compare
+type CompareOp int
+
 const (
     LUA_TNIL           = LuaValType(C.LUA_TNIL)
     LUA_TNUMBER        = LuaValType(C.LUA_TNUMBER)
@@ -68,3 +74,39 @@ const (
     LUA_DBLIBNAME   = C.LUA_DBLIBNAME
     LUA_LOADLIBNAME = C.LUA_LOADLIBNAME
 )
+
+const (
+    LUA_OK = C.LUA_OK
+
+    LUA_RIDX_MAINTHREAD = C.LUA_RIDX_MAINTHREAD
+    LUA_RIDX_GLOBALS    = C.LUA_RIDX_GLOBALS
+
+    LUA_GCISRUNNING = C.LUA_GCISRUNNING
+    LUA_GCGEN       = C.LUA_GCGEN
+    LUA_GCINC       = C.LUA_GCINC
+
+    LUA_HOOKTAILCALL = C.LUA_HOOKTAILCALL
+)
+
+const (
+    LUA_OPADD  = ArithOp(C.LUA_OPADD)
+    LUA_OPSUB  = ArithOp(C.LUA_OPSUB)
+    LUA_OPMUL  = ArithOp(C.LUA_OPMUL)
+    LUA_OPMOD  = ArithOp(C.LUA_OPMOD)
+    LUA_OPPOW  = ArithOp(C.LUA_OPPOW)
+    LUA_OPDIV  = ArithOp(C.LUA_OPDIV)
+    LUA_OPIDIV = ArithOp(C.LUA_OPIDIV)
+    LUA_OPBAND = ArithOp(C.LUA_OPBAND)
+    LUA_OPBOR  = ArithOp(C.LUA_OPBOR)
+    LUA_OPBXOR = ArithOp(C.LUA_OPBXOR)
+    LUA_OPSHL  = ArithOp(C.LUA_OPSHL)
+    LUA_OPSHR  = ArithOp(C.LUA_OPSHR)
+    LUA_OPUNM  = ArithOp(C.LUA_OPUNM)
+    LUA_OPBNOT = ArithOp(C.LUA_OPBNOT)
+)
+
+const (
+    LUA_OPEQ = CompareOp(C.LUA_OPEQ)
+    LUA_OPLT = CompareOp(C.LUA_OPLT)
+    LUA_OPLE = CompareOp(C.LUA_OPLE)
+)
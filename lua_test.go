@@ -0,0 +1,433 @@
+package lua
+
+import (
+    "math"
+    "strings"
+    "testing"
+    "unsafe"
+)
+
+// Runs f on a fresh state and checks that it leaves the stack as it found it
+func withStack(t *testing.T, f func(L *State)) {
+    t.Helper()
+    L := newTestState(t)
+    f(L)
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
+
+func TestCompare(t *testing.T) {
+    tests := []struct {
+        a, b string
+        op   CompareOp
+        want bool
+    }{
+        {"1", "2", LUA_OPLT, true},
+        {"2", "1", LUA_OPLT, false},
+        {"2", "2", LUA_OPLE, true},
+        {"2", "2.0", LUA_OPEQ, true},
+        {`"a"`, `"b"`, LUA_OPLT, true},
+        {`"a"`, "1", LUA_OPEQ, false},
+        {"setmetatable({}, {__lt = function() return true end})", "{}", LUA_OPLT, true},
+        {"setmetatable({}, {__eq = function() return true end})", "{}", LUA_OPEQ, true},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            if err := L.DoString("return " + tt.a + ", " + tt.b); err != nil {
+                t.Fatal(err)
+            }
+            if got := L.Compare(-2, -1, tt.op); got != tt.want {
+                t.Errorf("Compare(%s, %s, %d) = %v", tt.a, tt.b, tt.op, got)
+            }
+            L.Pop(2)
+        })
+    }
+    withStack(t, func(L *State) {
+        L.PushInteger(1)
+        if L.Compare(-1, 5, LUA_OPEQ) {
+            t.Error("Compare with an invalid index is true")
+        }
+        L.Pop(1)
+    })
+}
+
+func TestEqualLessThan(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `
+local mt = {__lt = function() error("no order") end, __eq = function() error("no equality") end}
+a, b = setmetatable({}, mt), setmetatable({}, mt)`)
+    L.GetGlobal("a")
+    L.GetGlobal("b")
+    L.PushInteger(1)
+    L.PushNumber(2)
+    if !L.LessThan(3, 4) || L.LessThan(4, 3) || L.Equal(3, 4) || !L.Equal(1, 1) || L.Equal(1, 10) {
+        t.Error("comparison of numbers")
+    }
+    for _, f := range []func(){
+        func() { L.LessThan(1, 2) },
+        func() { L.Equal(1, 2) },
+        func() { L.LessThan(1, 3) },
+    } {
+        func() {
+            defer func() {
+                err, ok := recover().(*LuaError)
+                if !ok || !strings.Contains(err.Error(), "no order") && !strings.Contains(err.Error(), "no equality") &&
+                    !strings.Contains(err.Error(), "attempt to compare") {
+                    t.Errorf("panic %v", err)
+                }
+            }()
+            f()
+        }()
+        if L.GetTop() != 4 {
+            t.Errorf("%d values on the stack", L.GetTop())
+        }
+    }
+    L.SetTop(0)
+
+    // lua errors in Go functions called by lua
+    L.Register("lt", func(L *State) int {
+        L.PushBoolean(L.LessThan(1, 2))
+        return 1
+    })
+    mustRun(t, L, `
+for i = 1, 100 do
+    local ok, err = pcall(lt, a, b)
+    assert(not ok and err:find("no order"), err)
+end
+assert(lt(1, 2) and not lt(2, 1))`)
+    mustFail(t, L, `lt({}, 1)`, "attempt to compare")
+}
+
+func TestArith(t *testing.T) {
+    tests := []struct {
+        operands []float64
+        op       ArithOp
+        want     float64
+    }{
+        {[]float64{7, 2}, LUA_OPADD, 9},
+        {[]float64{7, 2}, LUA_OPSUB, 5},
+        {[]float64{7, 2}, LUA_OPMUL, 14},
+        {[]float64{7, 2}, LUA_OPDIV, 3.5},
+        {[]float64{7, 2}, LUA_OPIDIV, 3},
+        {[]float64{-7, 2}, LUA_OPMOD, 1},
+        {[]float64{2, 10}, LUA_OPPOW, 1024},
+        {[]float64{6, 3}, LUA_OPBAND, 2},
+        {[]float64{6, 3}, LUA_OPBOR, 7},
+        {[]float64{6, 3}, LUA_OPBXOR, 5},
+        {[]float64{1, 4}, LUA_OPSHL, 16},
+        {[]float64{16, 4}, LUA_OPSHR, 1},
+        {[]float64{3}, LUA_OPUNM, -3},
+        {[]float64{0}, LUA_OPBNOT, -1},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            for _, x := range tt.operands {
+                L.PushNumber(x)
+            }
+            L.Arith(tt.op)
+            if got := L.ToNumber(-1); got != tt.want {
+                t.Errorf("Arith(%v, %d) = %v, want %v", tt.operands, tt.op, got, tt.want)
+            }
+            L.Pop(1)
+        })
+    }
+}
+
+func TestLen(t *testing.T) {
+    tests := []struct {
+        value       string
+        len, rawlen int
+    }{
+        {`"hello"`, 5, 5},
+        {"{1, 2, 3}", 3, 3},
+        {"setmetatable({1}, {__len = function() return 42 end})", 42, 1},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            if err := L.DoString("return " + tt.value); err != nil {
+                t.Fatal(err)
+            }
+            L.Len(-1)
+            if got := L.ToInteger(-1); got != tt.len {
+                t.Errorf("Len(%s) = %d, want %d", tt.value, got, tt.len)
+            }
+            if got := L.RawLen(-2); got != uint(tt.rawlen) {
+                t.Errorf("RawLen(%s) = %d, want %d", tt.value, got, tt.rawlen)
+            }
+            L.Pop(2)
+        })
+    }
+}
+
+func TestRawGetPSetP(t *testing.T) {
+    withStack(t, func(L *State) {
+        var a, b int
+        L.NewTable()
+        L.PushString("a")
+        L.RawSetP(-2, unsafe.Pointer(&a))
+        if tp := L.RawGetP(-1, unsafe.Pointer(&a)); tp != LUA_TSTRING || L.ToString(-1) != "a" {
+            t.Errorf("RawGetP(&a) = %v %q", tp, L.ToString(-1))
+        }
+        if tp := L.RawGetP(-2, unsafe.Pointer(&b)); tp != LUA_TNIL {
+            t.Errorf("RawGetP(&b) = %v", tp)
+        }
+        L.Pop(3)
+    })
+}
+
+func TestGetISetI(t *testing.T) {
+    withStack(t, func(L *State) {
+        // through the metamethods, unlike RawGeti and RawSeti
+        err := L.DoString(`
+log = {}
+return setmetatable({}, {
+    __index = function(_, i) return i * 10 end,
+    __newindex = function(t, i, v) log[#log + 1] = i rawset(t, i, v) end,
+})`)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if tp := L.GetI(-1, 3); tp != LUA_TNUMBER || L.ToInteger(-1) != 30 {
+            t.Errorf("GetI(3) = %v %v", tp, L.ToInteger(-1))
+        }
+        L.Pop(1)
+        L.PushString("x")
+        L.SetI(-2, 5)
+        L.RawGeti(-1, 5)
+        if L.ToString(-1) != "x" {
+            t.Errorf("t[5] = %q", L.ToString(-1))
+        }
+        L.Pop(2)
+        if err := L.DoString(`assert(log[1] == 5)`); err != nil {
+            t.Error(err)
+        }
+    })
+}
+
+func TestStringToNumber(t *testing.T) {
+    tests := []struct {
+        s       string
+        ok      bool
+        integer bool
+        want    float64
+    }{
+        {"10", true, true, 10},
+        {"0x10", true, true, 16},
+        {" 1.5 ", true, false, 1.5},
+        {"1e2", true, false, 100},
+        {"abc", false, false, 0},
+        {"", false, false, 0},
+        {"1 2", false, false, 0},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            ok := L.StringToNumber(tt.s)
+            if ok != tt.ok {
+                t.Fatalf("StringToNumber(%q) = %v", tt.s, ok)
+            }
+            if !ok {
+                return
+            }
+            if L.IsInteger(-1) != tt.integer || L.ToNumber(-1) != tt.want {
+                t.Errorf("StringToNumber(%q) pushed %v", tt.s, L.ToNumber(-1))
+            }
+            L.Pop(1)
+        })
+    }
+}
+
+func TestToIntegerXNumberX(t *testing.T) {
+    tests := []struct {
+        value string
+        i     int64
+        isint bool
+        n     float64
+        isnum bool
+    }{
+        {"42", 42, true, 42, true},
+        {"2.0", 2, true, 2, true},
+        {"2.5", 0, false, 2.5, true},
+        {`"7"`, 7, true, 7, true},
+        {`"x"`, 0, false, 0, false},
+        {"nil", 0, false, 0, false},
+        {"{}", 0, false, 0, false},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            if err := L.DoString("return " + tt.value); err != nil {
+                t.Fatal(err)
+            }
+            if i, ok := L.ToIntegerX(-1); i != tt.i || ok != tt.isint {
+                t.Errorf("ToIntegerX(%s) = %d, %v", tt.value, i, ok)
+            }
+            if n, ok := L.ToNumberX(-1); n != tt.n || ok != tt.isnum {
+                t.Errorf("ToNumberX(%s) = %v, %v", tt.value, n, ok)
+            }
+            L.Pop(1)
+        })
+    }
+}
+
+// Returns the integers on the stack
+func stackInts(L *State) []int {
+    var s []int
+    for i := 1; i <= L.GetTop(); i++ {
+        s = append(s, L.ToInteger(i))
+    }
+    return s
+}
+
+func TestRotateCopyAbsIndex(t *testing.T) {
+    tests := []struct {
+        name string
+        f    func(L *State)
+        want []int
+    }{
+        {"rotate 1", func(L *State) { L.Rotate(1, 1) }, []int{4, 1, 2, 3}},
+        {"rotate -1", func(L *State) { L.Rotate(1, -1) }, []int{2, 3, 4, 1}},
+        {"rotate 2 from 2", func(L *State) { L.Rotate(2, 2) }, []int{1, 3, 4, 2}},
+        {"copy", func(L *State) { L.Copy(1, -1) }, []int{1, 2, 3, 1}},
+        {"copy abs", func(L *State) { L.Copy(L.AbsIndex(-2), 1) }, []int{3, 2, 3, 4}},
+    }
+    for _, tt := range tests {
+        withStack(t, func(L *State) {
+            for i := 1; i <= 4; i++ {
+                L.PushInteger(int64(i))
+            }
+            tt.f(L)
+            got := stackInts(L)
+            for i := range tt.want {
+                if i >= len(got) || got[i] != tt.want[i] {
+                    t.Errorf("%s: stack %v, want %v", tt.name, got, tt.want)
+                    break
+                }
+            }
+            L.SetTop(0)
+        })
+    }
+    withStack(t, func(L *State) {
+        L.PushNil()
+        L.PushNil()
+        for _, c := range [][2]int{{-1, 2}, {-2, 1}, {1, 1}, {LUA_REGISTRYINDEX, LUA_REGISTRYINDEX}} {
+            if got := L.AbsIndex(c[0]); got != c[1] {
+                t.Errorf("AbsIndex(%d) = %d, want %d", c[0], got, c[1])
+            }
+        }
+        L.Pop(2)
+    })
+}
+
+func TestIUserValue(t *testing.T) {
+    withStack(t, func(L *State) {
+        L.NewUserdataUV(8, 2)
+        L.PushString("first")
+        if !L.SetIUserValue(-2, 1) {
+            t.Error("SetIUserValue(1) failed")
+        }
+        L.PushInteger(2)
+        if !L.SetIUserValue(-2, 2) {
+            t.Error("SetIUserValue(2) failed")
+        }
+        L.PushInteger(3)
+        if L.SetIUserValue(-2, 3) {
+            t.Error("SetIUserValue(3) succeeded with 2 user values")
+        }
+        if tp := L.GetIUserValue(-1, 1); tp != LUA_TSTRING || L.ToString(-1) != "first" {
+            t.Errorf("GetIUserValue(1) = %v %q", tp, L.ToString(-1))
+        }
+        if tp := L.GetIUserValue(-2, 2); tp != LUA_TNUMBER || L.ToInteger(-1) != 2 {
+            t.Errorf("GetIUserValue(2) = %v", tp)
+        }
+        if tp := L.GetIUserValue(-3, 3); tp != LUA_TNONE {
+            t.Errorf("GetIUserValue(3) = %v, want LUA_TNONE", tp)
+        }
+        L.Pop(4)
+    })
+}
+
+func TestToCloseCloseSlot(t *testing.T) {
+    withStack(t, func(L *State) {
+        err := L.DoString(`
+closed = 0
+return setmetatable({}, {__close = function() closed = closed + 1 end})`)
+        if err != nil {
+            t.Fatal(err)
+        }
+        L.ToClose(-1)
+        L.CloseSlot(-1)
+        if !L.IsNil(-1) {
+            t.Error("slot not cleared by CloseSlot")
+        }
+        L.Pop(1)
+        L.GetGlobal("closed")
+        if n := L.ToInteger(-1); n != 1 {
+            t.Errorf("__close called %d times", n)
+        }
+        L.Pop(1)
+    })
+}
+
+func TestWarning(t *testing.T) {
+    withStack(t, func(L *State) {
+        var b strings.Builder
+        var messages []string
+        L.SetWarnF(func(L *State, msg string, tocont bool) {
+            b.WriteString(msg)
+            if !tocont {
+                messages = append(messages, b.String())
+                b.Reset()
+            }
+        })
+        L.Warning("one ", true)
+        L.Warning("piece", false)
+        if err := L.DoString(`warn("from ", "lua")`); err != nil {
+            t.Fatal(err)
+        }
+        if len(messages) != 2 || messages[0] != "one piece" || messages[1] != "from lua" {
+            t.Errorf("warnings %q", messages)
+        }
+        L.SetWarnF(nil)
+        L.Warning("ignored", false)
+        if len(messages) != 2 {
+            t.Errorf("warning after SetWarnF(nil): %q", messages)
+        }
+    })
+}
+
+func TestUpvalueId(t *testing.T) {
+    withStack(t, func(L *State) {
+        err := L.DoString(`
+local a, b = 1, 2
+return function() return a, b end, function() return a end, function() return b end`)
+        if err != nil {
+            t.Fatal(err)
+        }
+        f, g, h := 1, 2, 3
+        if L.UpvalueId(f, 1) != L.UpvalueId(g, 1) || L.UpvalueId(f, 2) != L.UpvalueId(h, 1) {
+            t.Error("shared upvalues have different ids")
+        }
+        if L.UpvalueId(f, 1) == L.UpvalueId(f, 2) {
+            t.Error("different upvalues have the same id")
+        }
+        L.UpvalueJoin(h, 1, g, 1)
+        if L.UpvalueId(h, 1) != L.UpvalueId(f, 1) {
+            t.Error("UpvalueJoin did not share the upvalue")
+        }
+        L.Pop(3)
+    })
+}
+
+func TestStringToNumberLimits(t *testing.T) {
+    withStack(t, func(L *State) {
+        if !L.StringToNumber("9223372036854775807") || L.ToInteger(-1) != math.MaxInt64 {
+            t.Error("max integer not converted")
+        }
+        L.Pop(1)
+        // too large for an integer, converted to a float
+        if !L.StringToNumber("9223372036854775808") || L.IsInteger(-1) {
+            t.Error("overflow not converted to a float")
+        }
+        L.Pop(1)
+    })
+}
@@ -0,0 +1,43 @@
+package lua
+
+/*
+#include "clua.h"
+*/
+import "C"
+import (
+    "errors"
+
+    "github.com/DGHeroin/lua.go/bytecode"
+)
+
+// Replaces the n lua functions on top of the stack with a main chunk calling them in order, the
+// way luac compiles several files into one chunk
+func (L *State) Combine(n int) error {
+    for i := -n; i < 0; i++ {
+        if !L.IsFunction(i) || L.IsCFunction(i) {
+            return errors.New("lua: Combine expects lua functions")
+        }
+    }
+    if C.clua_luac_combine(L.s, C.int(n)) != 0 {
+        err := errors.New(L.ToString(-1))
+        L.Pop(1)
+        return err
+    }
+    return nil
+}
+
+// Returns the bytecode listing of the lua function on top of the stack and of its nested
+// functions, in the format of luac -l (luac -l -l when full is true). The function is dumped and
+// listed by the bytecode package, see bytecode.Chunk.Listing.
+func (L *State) Listing(full bool) (string, error) {
+    if !L.IsFunction(-1) || L.IsCFunction(-1) {
+        return "", errors.New("lua: Listing expects a lua function")
+    }
+    L.Dump()
+    c, err := bytecode.Parse(L.ToBytes(-1))
+    L.Pop(1)
+    if err != nil {
+        return "", err
+    }
+    return c.Listing(full), nil
+}
@@ -0,0 +1,61 @@
+package lua
+
+import (
+    "regexp"
+    "strings"
+    "testing"
+)
+
+func TestCombineListing(t *testing.T) {
+    L := newTestState(t)
+    for _, src := range []string{`x = 1`, `local s = "a\n" x = x + #s`} {
+        if r := L.LoadBuffer([]byte(src), "=chunk", "t"); r != 0 {
+            t.Fatal(L.ToString(-1))
+        }
+    }
+    if err := L.Combine(2); err != nil {
+        t.Fatal(err)
+    }
+    if L.GetTop() != 1 {
+        t.Fatalf("%d values on the stack", L.GetTop())
+    }
+
+    listing, err := L.Listing(false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := regexp.MustCompile(`0x[0-9a-f]+`)
+    listing = addr.ReplaceAllString(listing, "ADDR")
+    for _, want := range []string{
+        "\nmain <(luac):0,0> (6 instructions at ADDR)\n",
+        "\t4\t[1]\tCLOSURE  \t0 1\t; ADDR\n",
+        "\nmain <chunk:0,0> (",
+        "\tSETTABUP \t0 0 1k\t; _ENV \"x\" 1\n",
+    } {
+        if !strings.Contains(listing, want) {
+            t.Errorf("listing without %q:\n%s", want, listing)
+        }
+    }
+    if strings.Contains(listing, "constants (") {
+        t.Error("constants listed without full")
+    }
+    full, _ := L.Listing(true)
+    if !strings.Contains(full, "\t0\tS\t\"a\\n\"\n") || !strings.Contains(full, "locals (1) for ") {
+        t.Errorf("full listing:\n%s", full)
+    }
+
+    if err := L.Call(0, 0); err != nil {
+        t.Fatal(err)
+    }
+    L.GetGlobal("x")
+    if L.ToInteger(-1) != 3 {
+        t.Errorf("x = %d", L.ToInteger(-1))
+    }
+    L.Pop(1)
+
+    L.PushGoFunction(func(L *State) int { return 0 })
+    if _, err := L.Listing(false); err == nil {
+        t.Error("Go function listed")
+    }
+    L.Pop(1)
+}
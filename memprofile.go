@@ -0,0 +1,166 @@
+package lua
+
+/*
+#include "clua.h"
+*/
+import "C"
+import (
+    "errors"
+    "math"
+    "sync"
+    "time"
+    "unsafe"
+
+    "github.com/google/pprof/profile"
+)
+
+// Options for StartMemProfile
+type MemProfileOptions struct {
+    // Average number of bytes allocated between two samples, 512 KiB if zero. With 1 every
+    // allocation is recorded.
+    Rate int
+    // Labels added to every sample besides language=lua
+    Labels map[string]string
+}
+
+type memProfiler struct {
+    mu    sync.Mutex
+    opts  MemProfileOptions
+    start time.Time
+    c     unsafe.Pointer
+    sites []*memSite
+    index map[string]int
+}
+
+// Allocations sampled at a call site, scaled to estimate all the allocations
+type memSite struct {
+    frames       []profileFrame
+    allocObjects float64
+    allocSpace   float64
+    inuseObjects float64
+    inuseSpace   float64
+}
+
+// Starts recording the allocations of the State per lua function and line.
+//
+// Allocations are sampled every opts.Rate bytes on average. Sampled blocks are followed until
+// they are freed by the garbage collector, so that MemProfile reports the live heap by call
+// site besides the total allocations. Allocations made by coroutines resumed from go are
+// attributed to the caller of the resume.
+//
+// The allocation function is wrapped while profiling: StartMemProfile and StopMemProfile must
+// not be called while lua code runs on another goroutine, nor SetAllocf in between.
+func (L *State) StartMemProfile(opts MemProfileOptions) error {
+    main := L.mainState()
+    if main.memProfiler != nil {
+        return errors.New("lua: memory profiler already running")
+    }
+    if opts.Rate <= 0 {
+        opts.Rate = 512 * 1024
+    }
+    p := &memProfiler{opts: opts, start: time.Now(), index: make(map[string]int)}
+    main.memProfiler = p
+    p.c = C.clua_memprof_start(main.s, C.size_t(main.Index), C.size_t(opts.Rate))
+    if p.c == nil {
+        main.memProfiler = nil
+        return errors.New("lua: cannot allocate the memory profiler")
+    }
+    return nil
+}
+
+// Stops the memory profiler and returns the final profile, or nil if it was not running
+func (L *State) StopMemProfile() *profile.Profile {
+    main := L.mainState()
+    p := main.memProfiler
+    if p == nil {
+        return nil
+    }
+    prof := L.MemProfile()
+    C.clua_memprof_stop(main.s, p.c)
+    main.memProfiler = nil
+    return prof
+}
+
+// Reports whether the allocation function of the memory profiler is installed
+func (L *State) memProfiling() bool {
+    return C.clua_memprof_active(L.mainState().s) != 0
+}
+
+// Returns the allocations recorded since StartMemProfile, in the format of a go heap profile
+// (alloc_objects, alloc_space, inuse_objects and inuse_space), or nil if the memory profiler
+// is not running. The inuse values describe the heap at the time of the call.
+func (L *State) MemProfile() *profile.Profile {
+    p := L.mainState().memProfiler
+    if p == nil {
+        return nil
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    b := newProfileBuilder()
+    for _, s := range p.sites {
+        b.add(s.frames, int64(s.allocObjects+0.5), int64(s.allocSpace+0.5), int64(s.inuseObjects+0.5), int64(s.inuseSpace+0.5))
+    }
+    now := time.Now()
+    prof := &profile.Profile{
+        SampleType: []*profile.ValueType{
+            {Type: "alloc_objects", Unit: "count"},
+            {Type: "alloc_space", Unit: "bytes"},
+            {Type: "inuse_objects", Unit: "count"},
+            {Type: "inuse_space", Unit: "bytes"},
+        },
+        DefaultSampleType: "inuse_space",
+        PeriodType:        &profile.ValueType{Type: "space", Unit: "bytes"},
+        Period:            int64(p.opts.Rate),
+        TimeNanos:         now.UnixNano(),
+        DurationNanos:     int64(now.Sub(p.start)),
+    }
+    return b.build(prof, p.opts.Labels)
+}
+
+// Inverse of the probability that a block of size bytes is sampled
+func (p *memProfiler) scale(size uint) float64 {
+    if p.opts.Rate <= 1 {
+        return 1
+    }
+    return 1 / (1 - math.Exp(-float64(size)/float64(p.opts.Rate)))
+}
+
+// Records an allocation of size bytes made by the coroutine L, returns its call site
+func (p *memProfiler) record(L *State, size uint) int {
+    frames := L.profileStack()
+    key := stackKey(frames)
+    scale := p.scale(size)
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    site, ok := p.index[key]
+    if !ok {
+        site = len(p.sites)
+        p.sites = append(p.sites, &memSite{frames: frames})
+        p.index[key] = site
+    }
+    s := p.sites[site]
+    s.allocObjects += scale
+    s.allocSpace += scale * float64(size)
+    s.inuseObjects += scale
+    s.inuseSpace += scale * float64(size)
+    return site
+}
+
+func (p *memProfiler) free(site int, size uint) {
+    scale := p.scale(size)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    s := p.sites[site]
+    s.inuseObjects -= scale
+    s.inuseSpace -= scale * float64(size)
+}
+
+func (p *memProfiler) resize(site int, osize, nsize uint) {
+    oscale, nscale := p.scale(osize), p.scale(nsize)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    s := p.sites[site]
+    s.inuseObjects += nscale - oscale
+    s.inuseSpace += nscale*float64(nsize) - oscale*float64(osize)
+}
@@ -0,0 +1,163 @@
+package lua
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/google/pprof/profile"
+)
+
+const memScript = `
+function build(n)
+    local t = {}
+    for i = 1, n do
+        t[i] = {i}
+    end
+    return t
+end
+
+function concat(n)
+    local s = ""
+    for i = 1, n do s = s .. "x" end
+    return s
+end
+`
+
+// Sums the sample value at index by innermost function and line
+func memBySite(p *profile.Profile, index int) map[string]int64 {
+    m := map[string]int64{}
+    for _, s := range p.Sample {
+        // made outside lua functions, like by the compiler
+        if len(s.Location) == 0 {
+            continue
+        }
+        line := s.Location[0].Line[0]
+        m[fmt.Sprintf("%s:%d", line.Function.Name, line.Line)] += s.Value[index]
+    }
+    return m
+}
+
+func TestMemProfile(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, memScript)
+    if L.MemProfile() != nil {
+        t.Error("MemProfile without profiler")
+    }
+    if err := L.StartMemProfile(MemProfileOptions{Rate: 1, Labels: map[string]string{"test": "1"}}); err != nil {
+        t.Fatal(err)
+    }
+    if L.StartMemProfile(MemProfileOptions{}) == nil {
+        t.Error("second memory profiler started")
+    }
+    mustRun(t, L, `big = build(1000) s = concat(100)`)
+
+    p := L.MemProfile()
+    if err := p.CheckValid(); err != nil {
+        t.Fatal(err)
+    }
+    if p.Period != 1 || p.DefaultSampleType != "inuse_space" || len(p.SampleType) != 4 {
+        t.Errorf("period %d, sample types %v", p.Period, p.SampleType)
+    }
+    for _, s := range p.Sample {
+        if s.Label["language"][0] != "lua" || s.Label["test"][0] != "1" {
+            t.Errorf("labels %v", s.Label)
+        }
+    }
+    // every allocation is recorded with a rate of 1: the 1000 tables of line 5, and their
+    // parts, and the growth of the array part of t
+    alloc := memBySite(p, 0)
+    if alloc["build:5"] < 1000 || alloc["build:5"] > 3000 {
+        t.Errorf("allocations by site %v", alloc)
+    }
+    // the first result is the constant "x"
+    if alloc["concat:12"] < 99 {
+        t.Errorf("allocations by site %v", alloc)
+    }
+    inuse := memBySite(p, 3)
+    if inuse["build:5"] < 1000*16 {
+        t.Errorf("in use by site %v", inuse)
+    }
+
+    // freed by the collector
+    mustRun(t, L, `big, s = nil, nil collectgarbage() collectgarbage()`)
+    after := memBySite(L.MemProfile(), 3)
+    if after["build:5"] > inuse["build:5"]/100 || after["concat:12"] > 1000 {
+        t.Errorf("in use after the collection %v, before %v", after, inuse)
+    }
+    if allocAfter := memBySite(L.MemProfile(), 0); allocAfter["build:5"] != alloc["build:5"] {
+        t.Errorf("allocations changed by the collection: %d, %d", allocAfter["build:5"], alloc["build:5"])
+    }
+
+    final := L.StopMemProfile()
+    if final == nil || L.StopMemProfile() != nil || L.MemProfile() != nil {
+        t.Fatal("StopMemProfile")
+    }
+}
+
+func TestMemProfileCoroutines(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, memScript)
+    if err := L.StartMemProfile(MemProfileOptions{Rate: 1}); err != nil {
+        t.Fatal(err)
+    }
+    mustRun(t, L, `
+local co = coroutine.wrap(function() coroutine.yield(build(100)) end)
+kept = co()
+kept2 = select(2, coroutine.resume(coroutine.create(build), 200))`)
+    alloc := memBySite(L.StopMemProfile(), 0)
+    if alloc["build:5"] < 300 {
+        t.Errorf("allocations by site %v", alloc)
+    }
+}
+
+func TestMemProfileStop(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, memScript)
+    if err := L.StartMemProfile(MemProfileOptions{Rate: 1}); err != nil {
+        t.Fatal(err)
+    }
+    // sampled blocks freed and resized after the stop, by the original allocator
+    mustRun(t, L, `big = build(1000) s = concat(100)`)
+    L.StopMemProfile()
+    if L.memProfiling() {
+        t.Fatal("allocator of the profiler still installed")
+    }
+    mustRun(t, L, `
+for i = 1, 1000 do big[i][2] = i end
+big, s = nil, nil
+collectgarbage()
+assert(#build(1000) == 1000 and #concat(100) == 100)`)
+
+    // and again
+    if err := L.StartMemProfile(MemProfileOptions{Rate: 64}); err != nil {
+        t.Fatal(err)
+    }
+    if !L.memProfiling() {
+        t.Fatal("allocator of the profiler not installed")
+    }
+    mustRun(t, L, `big = build(1000)`)
+    p := L.StopMemProfile()
+    if err := p.CheckValid(); err != nil {
+        t.Fatal(err)
+    }
+    if p.Period != 64 || len(p.Sample) == 0 {
+        t.Errorf("period %d, %d samples", p.Period, len(p.Sample))
+    }
+}
+
+func TestMemProfileClose(t *testing.T) {
+    for i := 0; i < 10; i++ {
+        L := NewState()
+        L.OpenLibs()
+        if err := L.StartMemProfile(MemProfileOptions{Rate: 1}); err != nil {
+            t.Fatal(err)
+        }
+        if err := L.DoString(memScript + `big = build(1000) s = concat(100)`); err != nil {
+            t.Fatal(err)
+        }
+        L.Close()
+        if L.memProfiler != nil {
+            t.Fatal("profiler kept after Close")
+        }
+    }
+}
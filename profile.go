@@ -0,0 +1,277 @@
+package lua
+
+/*
+#include <lua.h>
+#include <stdlib.h>
+*/
+import "C"
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unsafe"
+
+    "github.com/google/pprof/profile"
+)
+
+// Options for StartProfile
+type ProfileOptions struct {
+    // Number of VM instructions between two samples, 1000 if zero
+    Period int
+    // Labels added to every sample besides language=lua, so that the samples can be told apart
+    // once merged with other profiles of the same type
+    Labels map[string]string
+}
+
+// A function on the lua stack, as recorded by the profilers
+type profileFrame struct {
+    name        string
+    source      string
+    shortSource string
+    what        string
+    line        int
+    lineDefined int
+}
+
+// Identifies the function of the frame
+func (f *profileFrame) funcKey() string {
+    if f.what == "C" {
+        return "C:" + f.name
+    }
+    return f.source + ":" + strconv.Itoa(f.lineDefined)
+}
+
+func (f *profileFrame) funcName() string {
+    switch {
+    case f.what == "main":
+        return "main chunk"
+    case f.name != "":
+        return f.name
+    case f.what == "C":
+        return "?"
+    }
+    // not "function <src:line>" as lua does, pprof drops what is in angle brackets
+    return fmt.Sprintf("function@%s:%d", f.shortSource, f.lineDefined)
+}
+
+func (f *profileFrame) fileName() string {
+    if f.what == "C" {
+        return "[C]"
+    }
+    if strings.HasPrefix(f.source, "@") || strings.HasPrefix(f.source, "=") {
+        return f.source[1:]
+    }
+    return f.shortSource
+}
+
+// Walks the stack of the running coroutine, innermost function first
+func (L *State) profileStack() []profileFrame {
+    ar := (*C.lua_Debug)(C.malloc(C.sizeof_lua_Debug))
+    defer C.free(unsafe.Pointer(ar))
+    nSl := C.CString("nSl")
+    defer C.free(unsafe.Pointer(nSl))
+
+    frames := []profileFrame{}
+    for level := 0; C.lua_getstack(L.s, C.int(level), ar) > 0; level++ {
+        C.lua_getinfo(L.s, nSl, ar)
+        f := profileFrame{
+            source:      C.GoString(ar.source),
+            shortSource: C.GoString(&ar.short_src[0]),
+            what:        C.GoString(ar.what),
+            line:        int(ar.currentline),
+            lineDefined: int(ar.linedefined),
+        }
+        if ar.name != nil {
+            f.name = C.GoString(ar.name)
+        }
+        if f.line < 0 {
+            f.line = 0
+        }
+        frames = append(frames, f)
+    }
+    return frames
+}
+
+// Accumulates the values of the samples sharing a stack
+type profileBuilder struct {
+    samples map[string]*profileSample
+    order   []string
+}
+
+type profileSample struct {
+    frames []profileFrame
+    values []int64
+}
+
+func newProfileBuilder() *profileBuilder {
+    return &profileBuilder{samples: make(map[string]*profileSample)}
+}
+
+// Identifies a stack by its functions and current lines
+func stackKey(frames []profileFrame) string {
+    var sb strings.Builder
+    for i := range frames {
+        sb.WriteString(frames[i].funcKey())
+        sb.WriteByte(':')
+        sb.WriteString(strconv.Itoa(frames[i].line))
+        sb.WriteByte('|')
+    }
+    return sb.String()
+}
+
+func (b *profileBuilder) add(frames []profileFrame, values ...int64) {
+    key := stackKey(frames)
+    s, ok := b.samples[key]
+    if !ok {
+        s = &profileSample{frames: frames, values: make([]int64, len(values))}
+        b.samples[key] = s
+        b.order = append(b.order, key)
+    }
+    for i, v := range values {
+        s.values[i] += v
+    }
+}
+
+// Builds the profile, functions and locations are shared between the samples
+func (b *profileBuilder) build(p *profile.Profile, labels map[string]string) *profile.Profile {
+    funcs := make(map[string]*profile.Function)
+    locs := make(map[string]*profile.Location)
+    label := map[string][]string{"language": {"lua"}}
+    for k, v := range labels {
+        label[k] = []string{v}
+    }
+
+    for _, key := range b.order {
+        s := b.samples[key]
+        sample := &profile.Sample{Value: s.values, Label: label}
+        for i := range s.frames {
+            f := &s.frames[i]
+            fkey := f.funcKey()
+            fn, ok := funcs[fkey]
+            if !ok {
+                fn = &profile.Function{
+                    ID:         uint64(len(p.Function) + 1),
+                    Name:       f.funcName(),
+                    SystemName: f.funcName(),
+                    Filename:   f.fileName(),
+                    StartLine:  int64(f.lineDefined),
+                }
+                funcs[fkey] = fn
+                p.Function = append(p.Function, fn)
+            }
+            lkey := fkey + ":" + strconv.Itoa(f.line)
+            loc, ok := locs[lkey]
+            if !ok {
+                loc = &profile.Location{
+                    ID:   uint64(len(p.Location) + 1),
+                    Line: []profile.Line{{Function: fn, Line: int64(f.line)}},
+                }
+                locs[lkey] = loc
+                p.Location = append(p.Location, loc)
+            }
+            sample.Location = append(sample.Location, loc)
+        }
+        p.Sample = append(p.Sample, sample)
+    }
+    return p
+}
+
+type cpuProfiler struct {
+    mu      sync.Mutex
+    opts    ProfileOptions
+    start   time.Time
+    builder *profileBuilder
+
+    prevHook  HookFunction
+    prevMask  int
+    prevCount int
+}
+
+// Starts sampling the lua call stack every opts.Period VM instructions, using a count hook.
+//
+// Each sample stands for the opts.Period instructions executed since the previous one: the
+// time spent waiting between calls into lua or in Go functions is not counted. A hook set with
+// SetHook keeps receiving its events while profiling and is restored by StopProfile; the hook
+// of SetExecutionLimit is removed.
+//
+// Only the main thread and the coroutines created after StartProfile are sampled, as coroutines
+// get their hook from the thread creating them: the ones created before are not profiled.
+func (L *State) StartProfile(opts ProfileOptions) error {
+    main := L.mainState()
+    if main.profiler != nil {
+        return errors.New("lua: profiler already running")
+    }
+    if opts.Period <= 0 {
+        opts.Period = 1000
+    }
+    p := &cpuProfiler{
+        opts:      opts,
+        start:     time.Now(),
+        builder:   newProfileBuilder(),
+        prevHook:  main.hookf,
+        prevMask:  main.GetHookMask(),
+        prevCount: main.GetHookCount(),
+    }
+    main.profiler = p
+
+    mask := LUA_MASKCOUNT
+    if p.prevHook != nil {
+        mask |= p.prevMask
+    }
+    main.SetHook(mask, opts.Period, func(L *State, ar *Debug) {
+        if ar.Event == LUA_HOOKCOUNT {
+            p.sample(L)
+            if p.prevMask&LUA_MASKCOUNT == 0 {
+                return
+            }
+        }
+        if p.prevHook != nil {
+            p.prevHook(L, ar)
+        }
+    })
+    return nil
+}
+
+func (p *cpuProfiler) sample(L *State) {
+    frames := L.profileStack()
+    p.mu.Lock()
+    p.builder.add(frames, 1, int64(p.opts.Period))
+    p.mu.Unlock()
+}
+
+// Stops the profiler started by StartProfile and returns the collected samples, or nil if
+// it was not running.
+//
+// The profile has the sample types samples/count and instructions/count, with a period of
+// opts.Period instructions: it measures the work of the lua VM, not time.
+func (L *State) StopProfile() *profile.Profile {
+    main := L.mainState()
+    p := main.profiler
+    if p == nil {
+        return nil
+    }
+    main.profiler = nil
+    if p.prevHook != nil {
+        main.SetHook(p.prevMask, p.prevCount, p.prevHook)
+    } else {
+        main.SetHook(0, 0, nil)
+    }
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    now := time.Now()
+    prof := &profile.Profile{
+        SampleType: []*profile.ValueType{
+            {Type: "samples", Unit: "count"},
+            {Type: "instructions", Unit: "count"},
+        },
+        PeriodType:    &profile.ValueType{Type: "instructions", Unit: "count"},
+        Period:        int64(p.opts.Period),
+        TimeNanos:     p.start.UnixNano(),
+        DurationNanos: int64(now.Sub(p.start)),
+    }
+    return p.builder.build(prof, p.opts.Labels)
+}
@@ -0,0 +1,66 @@
+package lua
+
+import (
+    "testing"
+    "time"
+)
+
+func TestProfile(t *testing.T) {
+    L := newTestState(t)
+    L.Register("sleep", func(L *State) int {
+        time.Sleep(20 * time.Millisecond)
+        return 0
+    })
+    err := L.DoString(`
+function heavy() local x = 0 for i = 1, 200000 do x = x + i end return x end
+function light() local x = 0 for i = 1, 20000 do x = x + i end return x end
+function idle() sleep() end`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := L.StartProfile(ProfileOptions{Period: 100, Labels: map[string]string{"test": "1"}}); err != nil {
+        t.Fatal(err)
+    }
+    if L.StartProfile(ProfileOptions{}) == nil {
+        t.Error("second profiler started")
+    }
+    err = L.DoString(`
+heavy() light()
+for i = 1, 5 do idle() end
+-- sampled as it is created after StartProfile
+coroutine.wrap(heavy)()`)
+    // idle between calls into lua
+    time.Sleep(20 * time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := L.StopProfile()
+    if p == nil || L.StopProfile() != nil {
+        t.Fatal("StopProfile")
+    }
+    if err := p.CheckValid(); err != nil {
+        t.Fatal(err)
+    }
+    if p.SampleType[1].Type != "instructions" || p.PeriodType.Type != "instructions" || p.Period != 100 {
+        t.Errorf("sample types %v, period %v %d", p.SampleType, p.PeriodType, p.Period)
+    }
+
+    // instructions by innermost function
+    self := map[string]int64{}
+    for _, s := range p.Sample {
+        if s.Value[1] != s.Value[0]*100 {
+            t.Errorf("sample %v not weighted by the period", s.Value)
+        }
+        if s.Label["language"][0] != "lua" || s.Label["test"][0] != "1" {
+            t.Errorf("labels %v", s.Label)
+        }
+        self[s.Location[0].Line[0].Function.Name] += s.Value[1]
+    }
+    if self["heavy"] < 5*self["light"] || self["light"] == 0 {
+        t.Errorf("instructions by function %v", self)
+    }
+    // the time spent sleeping is not charged to lua code
+    if self["idle"]+self["sleep"] > self["light"] {
+        t.Errorf("instructions by function %v", self)
+    }
+}
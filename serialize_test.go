@@ -0,0 +1,185 @@
+package lua
+
+import (
+    "strings"
+    "testing"
+)
+
+func newTestState(t *testing.T) *State {
+    t.Helper()
+    L := NewState()
+    L.OpenLibs()
+    L.OpenLibsExt()
+    t.Cleanup(L.Close)
+    return L
+}
+
+// Lua helpers building serialize payloads by hand
+const serializePayloads = `
+function varint(n)
+    local s = ""
+    while n >= 0x80 do
+        s = s .. string.char(n % 0x80 + 0x80)
+        n = n // 0x80
+    end
+    return s .. string.char(n)
+end
+function fn(f, nups)
+    local code = string.dump(f, true)
+    return string.char(7) .. varint(#code) .. code .. varint(nups)
+end
+`
+
+func TestSerializeFunctions(t *testing.T) {
+    L := newTestState(t)
+    err := L.DoString(`
+local n = 0
+local function inc() n = n + 1 return n end
+local function get() return n end
+local s = serialize.pack(inc, get)
+local inc2, get2 = serialize.unpack(s)
+inc2() inc2()
+assert(get2() == 2, "upvalue not shared")
+assert(get() == 0)
+`)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSerializeRejectsBadBytecode(t *testing.T) {
+    L := newTestState(t)
+    if err := L.DoString(serializePayloads); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name    string
+        payload string
+        err     string
+    }{
+        {"truncated", `local s = fn(function(a) return a + 1 end, 0) return s:sub(1, 40)`, "serialize.unpack"},
+        // the stack size follows the tag, the length, the 31 bytes of header, the number of
+        // upvalues, the stripped source, the lines, the number of parameters and the vararg flag
+        {"stack size", `
+local s = fn(function(a, b) return a + b end, 0)
+assert(s:byte(40) == 3)
+return s:sub(1, 39) .. "\x01" .. s:sub(41)`, "invalid bytecode"},
+        {"upvalue index", `
+local x = 1
+local f = fn(function() return x end, 1) .. string.char(3) .. varint(2)
+return f .. fn(function() return 1 end, 1) .. string.char(11) .. varint(1) .. varint(1)`, "bad upvalue reference"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            top := L.GetTop()
+            defer L.SetTop(top)
+            if err := L.DoString("payload = (function() " + tt.payload + " end)()"); err != nil {
+                t.Fatal(err)
+            }
+            err := L.DoString(`serialize.unpack(payload)`)
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Fatalf("got error %v, want %q", err, tt.err)
+            }
+        })
+    }
+}
+
+func TestSerializeValues(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `
+local values = {nil, false, true, 0, -1, math.maxinteger, math.mininteger, 0.5, -1e300, "", "a\0b", _G}
+local out = table.pack(serialize.unpack(serialize.pack(table.unpack(values, 1, 12))))
+assert(out.n == 12, out.n)
+for i = 1, 12 do
+    assert(out[i] == values[i] and math.type(out[i]) == math.type(values[i]), i)
+end
+assert(select("#", serialize.unpack(serialize.pack())) == 0)
+`)
+}
+
+func TestSerializeReferences(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `
+local shared = {1, 2}
+local t = {a = shared, b = shared, list = {shared}, [shared] = "key"}
+t.self = t
+shared.parent = t
+local c = serialize.unpack(serialize.pack(t))
+assert(c ~= t and c.self == c and c.a.parent == c)
+-- one copy of shared, used as a value and as a key
+assert(c.a ~= shared and c.a == c.b and c.list[1] == c.a and c[c.a] == "key")
+assert(#c.a == 2 and c.a[2] == 2)
+
+-- references span the packed values
+local x, y, z = serialize.unpack(serialize.pack(shared, {shared}, shared))
+assert(y[1] == x and z == x)
+`)
+}
+
+func TestSerializeMetatables(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `
+local mt = {__index = function(_, k) return k .. "!" end}
+mt.__newindex = mt
+local t = setmetatable({x = 1}, mt)
+local u = setmetatable({}, mt)
+local c, d = serialize.unpack(serialize.pack(t, u))
+local cmt = getmetatable(c)
+assert(cmt ~= mt and cmt == getmetatable(d) and cmt.__newindex == cmt)
+assert(c.x == 1 and c.y == "y!" and rawget(c, "y") == nil)
+-- a metatable referring to the table
+local self = {}
+setmetatable(self, self)
+local s = serialize.unpack(serialize.pack(self))
+assert(getmetatable(s) == s)
+`)
+    mustFail(t, L, `serialize.pack(setmetatable({}, {__index = print}))`, "cannot serialize a C function")
+}
+
+func TestSerializeUserdata(t *testing.T) {
+    L := newTestState(t)
+    registerVec2(t, L, func(*testVec2) {}, func(*testVec2) {})
+    mustFail(t, L, `serialize.pack(Vec2(1, 2))`, "cannot serialize userdata of type Vec2 (no __serialize metamethod)")
+    mustRun(t, L, `
+local mt = getmetatable(Vec2(0, 0))
+mt.__serialize = function(v) return {v.x, v.y} end
+mt.__deserialize = function(t) return Vec2(t[1], t[2]) end
+local v = Vec2(1, 2)
+local w, list = serialize.unpack(serialize.pack(v, {v, v}))
+assert(w ~= v and w.x == 1 and w.y == 2)
+assert(list[1] == w and list[2] == w)
+data = serialize.pack(v)
+`)
+    L.PushNil()
+    L.SetField(LUA_REGISTRYINDEX, "Vec2")
+    mustFail(t, L, `serialize.unpack(data)`, "unknown userdata type 'Vec2'")
+
+    // a type with __serialize only
+    L.NewUserdata(8)
+    L.NewMetaTable("NoDeserialize")
+    L.PushGoFunction(func(L *State) int {
+        L.PushInteger(1)
+        return 1
+    })
+    L.SetField(-2, "__serialize")
+    L.SetMetaTable(-2)
+    L.SetGlobal("u")
+    mustRun(t, L, `data = serialize.pack(u)`)
+    mustFail(t, L, `serialize.unpack(data)`, "userdata type has no __deserialize metamethod")
+    mustFail(t, L, `serialize.pack(io.stdout)`, "cannot serialize userdata of type FILE*")
+}
+
+func TestSerializeUnsupported(t *testing.T) {
+    L := newTestState(t)
+    L.Register("gofunc", func(L *State) int { return 0 })
+    mustFail(t, L, `serialize.pack(coroutine.create(print))`, "cannot serialize a thread")
+    mustFail(t, L, `serialize.pack(print)`, "cannot serialize a C function")
+    mustFail(t, L, `serialize.pack(gofunc)`, "serialize.pack: cannot serialize")
+    mustFail(t, L, `serialize.pack({1, {2, {f = string.rep}}})`, "cannot serialize a C function")
+    mustFail(t, L, `local t = {} for i = 1, 200 do t = {t} end serialize.pack(t)`, "nesting too deep")
+    mustFail(t, L, `serialize.unpack("\255")`, "unknown tag")
+    mustFail(t, L, `serialize.unpack(serialize.pack("abc"):sub(1, 3))`, "truncated data")
+    if L.GetTop() != 0 {
+        t.Errorf("%d values left on the stack", L.GetTop())
+    }
+}
@@ -0,0 +1,157 @@
+package lua
+
+/*
+#include "clua.h"
+#include <lua.h>
+#include <lauxlib.h>
+*/
+import "C"
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "sort"
+)
+
+// serialize.unpack and Restore check the bytecode of functions with bytecode.Verify
+func init() {
+    C.clua_setserializeverifier()
+}
+
+// Header written in front of every snapshot
+var snapshotMagic = []byte("GLUASNAP\x01")
+
+// Converts go objects of one type to bytes and back so that values pushed
+// with PushGoStruct can be persisted by Snapshot and serialize.pack
+type SnapshotCodec interface {
+    Encode(v interface{}) ([]byte, error)
+    Decode(data []byte) (interface{}, error)
+}
+
+// Codec registered for a type, with the name identifying the type in snapshots
+type snapshotCodec struct {
+    SnapshotCodec
+    name string
+}
+
+// Registers the codec used to persist go objects whose dynamic type is t. The snapshots refer
+// to the type by name, which must be unique among the codecs of the state and should stay the
+// same across versions of the program, like "myapp.Options".
+//
+// The same codec must be registered with the same name on the State passed to Restore.
+func (L *State) RegisterSnapshotCodec(name string, t reflect.Type, codec SnapshotCodec) error {
+    L = L.mainState()
+    if other, ok := L.snapshotNames[name]; ok && L.snapshotCodecs[t] != other {
+        return fmt.Errorf("lua: snapshot codec name %s already used by another type", name)
+    }
+    if L.snapshotCodecs == nil {
+        L.snapshotCodecs = make(map[reflect.Type]*snapshotCodec)
+        L.snapshotNames = make(map[string]*snapshotCodec)
+    }
+    if old, ok := L.snapshotCodecs[t]; ok {
+        delete(L.snapshotNames, old.name)
+    }
+    c := &snapshotCodec{codec, name}
+    L.snapshotCodecs[t] = c
+    L.snapshotNames[name] = c
+    return nil
+}
+
+// Writes the globals named in roots, and everything reachable from them, to w.
+//
+// Tables (with their metatables), Lua functions (bytecode and upvalues, shared
+// upvalues stay shared), strings, numbers and booleans are persisted. Go
+// objects pushed with PushGoStruct are persisted with the codec registered for
+// their type. C functions, Go functions stored in globals and the modules in
+// package.loaded are written by name and must exist in the restoring State.
+// Anything else, like open files or coroutines, is an error.
+//
+// Without roots every global that is not one of those named values is saved.
+func (L *State) Snapshot(w io.Writer, roots ...string) error {
+    top := L.GetTop()
+    defer L.SetTop(top)
+
+    C.lua_pushcclosure(L.s, (*[0]byte)(C.luaserialize_packx), 0)
+    C.clua_pushpermanents(L.s, 0)
+    L.CreateTable(0, len(roots))
+    if len(roots) == 0 {
+        roots = L.snapshotGlobals(-2)
+    }
+    for _, name := range roots {
+        L.GetGlobal(name)
+        L.SetField(-2, name)
+    }
+    if err := L.Call(2, 1); err != nil {
+        return err
+    }
+
+    if _, err := w.Write(snapshotMagic); err != nil {
+        return err
+    }
+    _, err := w.Write(L.ToBytes(-1))
+    return err
+}
+
+// Returns the names of the globals which are not in the permanents table at index perms
+func (L *State) snapshotGlobals(perms int) []string {
+    perms = int(C.lua_absindex(L.s, C.int(perms)))
+    names := []string{}
+    C.lua_rawgeti(L.s, LUA_REGISTRYINDEX, C.LUA_RIDX_GLOBALS)
+    L.PushNil()
+    for L.Next(-2) != 0 {
+        if L.Type(-2) == LUA_TSTRING {
+            L.PushValue(-1)
+            L.RawGet(perms)
+            if L.IsNil(-1) {
+                names = append(names, L.ToString(-3))
+            }
+            L.Pop(1)
+        }
+        L.Pop(1)
+    }
+    L.Pop(1)
+    sort.Strings(names)
+    return names
+}
+
+// Loads a snapshot written by Snapshot into the globals of L.
+//
+// L should be a fresh State with the same libraries opened, Go functions
+// registered and snapshot codecs set up as the State the snapshot was taken
+// from.
+func (L *State) Restore(r io.Reader) error {
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return err
+    }
+    if !bytes.HasPrefix(data, snapshotMagic) {
+        return errors.New("lua: not a snapshot")
+    }
+    data = data[len(snapshotMagic):]
+
+    top := L.GetTop()
+    defer L.SetTop(top)
+
+    C.lua_pushcclosure(L.s, (*[0]byte)(C.luaserialize_unpackx), 0)
+    C.clua_pushpermanents(L.s, 1)
+    L.PushBytes(data)
+    if err := L.Call(2, 1); err != nil {
+        return err
+    }
+    if !L.IsTable(-1) {
+        return errors.New("lua: malformed snapshot")
+    }
+
+    L.PushNil()
+    for L.Next(-2) != 0 {
+        if L.Type(-2) == LUA_TSTRING {
+            L.SetGlobal(L.ToString(-2))
+        } else {
+            L.Pop(1)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,96 @@
+package lua
+
+import (
+    "bytes"
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+type jsonCodec struct {
+    t reflect.Type
+}
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (c jsonCodec) Decode(data []byte) (interface{}, error) {
+    v := reflect.New(c.t.Elem())
+    err := json.Unmarshal(data, v.Interface())
+    return v.Interface(), err
+}
+
+func TestSnapshotRestore(t *testing.T) {
+    // two types with the same reflect.Type.String()
+    type Options struct{ A int }
+    a := reflect.TypeOf(&Options{})
+    b := func() reflect.Type {
+        type Options struct{ B string }
+        return reflect.TypeOf(&Options{})
+    }()
+    if a.String() != b.String() {
+        t.Fatalf("%s and %s should have the same name", a, b)
+    }
+    register := func(L *State) {
+        if err := L.RegisterSnapshotCodec("test.A", a, jsonCodec{a}); err != nil {
+            t.Fatal(err)
+        }
+        if err := L.RegisterSnapshotCodec("test.B", b, jsonCodec{b}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    L := newTestState(t)
+    register(L)
+    if err := L.RegisterSnapshotCodec("test.A", b, jsonCodec{b}); err == nil {
+        t.Fatal("name of another type registered")
+    }
+    L.PushGoStruct(&Options{7})
+    L.SetGlobal("a")
+    L.PushGoStruct(reflect.New(b.Elem()).Interface())
+    L.SetGlobal("b")
+    err := L.DoString(`
+t = {1, "x", nested = {true}}
+t.self = t
+local n = 10
+function inc() n = n + 1 return n end
+function get() return n end
+`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    if err := L.Snapshot(&buf); err != nil {
+        t.Fatal(err)
+    }
+
+    R := newTestState(t)
+    register(R)
+    if err := R.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+        t.Fatal(err)
+    }
+    err = R.DoString(`
+assert(t[1] == 1 and t[2] == "x" and t.nested[1] == true and t.self == t)
+assert(inc() == 11 and get() == 11)
+`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    R.GetGlobal("a")
+    if o, ok := R.ToGoStruct(-1).(*Options); !ok || o.A != 7 {
+        t.Errorf("a restored as %#v", R.ToGoStruct(-1))
+    }
+    R.GetGlobal("b")
+    if reflect.TypeOf(R.ToGoStruct(-1)) != b {
+        t.Errorf("b restored as %T", R.ToGoStruct(-1))
+    }
+    R.Pop(2)
+
+    if err := newTestState(t).Restore(bytes.NewReader(buf.Bytes())); err == nil {
+        t.Error("restored go values without codec")
+    }
+    if err := R.Restore(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+        t.Error("restored a malformed snapshot")
+    }
+}
@@ -0,0 +1,359 @@
+package lua
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "reflect"
+    "strings"
+)
+
+// Go value exposed to lua, described by GenerateStubs
+type Binding struct {
+    // Global name of the value in lua, like "spawn" or "game.spawn"; "" to only describe the
+    // class of a struct
+    Name string
+    // A LuaGoFunction, another Go function, a struct, a pointer to a struct or the reflect.Type
+    // of a struct
+    Value interface{}
+    // Documentation, one annotation line per line. Lines can be LuaLS annotations like
+    // "@deprecated" or "@see other".
+    Doc string
+    // Parameters and results of functions. The arguments of a LuaGoFunction cannot be reflected
+    // and are described as "..." with type any when empty. For other functions, they name the
+    // parameters and results and may override their types.
+    Params  []StubParam
+    Returns []StubParam
+}
+
+// Parameter, result or field in the stubs
+type StubParam struct {
+    Name string
+    // LuaLS type like "integer", "string?" or "Player[]"; "" for the type reflected from Go
+    Type string
+    Doc  string
+}
+
+// Class of a Go struct, see WriteStubs
+type StubClass struct {
+    Name   string
+    Doc    string
+    Fields []StubParam
+    // Methods called like obj:Method(...), named without the class
+    Methods []StubFunc
+}
+
+// Global function, see WriteStubs
+type StubFunc struct {
+    Name    string
+    Doc     string
+    Params  []StubParam
+    Returns []StubParam
+}
+
+// Global variable holding an instance of a class, see WriteStubs
+type StubGlobal struct {
+    Name string
+    Doc  string
+    Type string
+}
+
+// Stub definitions written by WriteStubs
+type Stubs struct {
+    Classes   []StubClass
+    Functions []StubFunc
+    Globals   []StubGlobal
+}
+
+var typeOfLuaGoFunction = reflect.TypeOf(LuaGoFunction(nil))
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// Writes an EmmyLua/LuaLS definition file describing the bindings, with ---@class and ---@field
+// annotations for the structs, ---@param and ---@return for the functions. Structs used by the
+// functions and fields are described too. Fields are limited to the ones PushGoStruct gives
+// access to, including the ones promoted from embedded structs, and named as spelled in Go or by
+// their lua or json tag.
+func GenerateStubs(w io.Writer, bindings ...Binding) error {
+    return generateStubs(w, NamingAsIs, bindings)
+}
+
+// Like GenerateStubs with the field and method names of the naming policy of L
+func (L *State) GenerateStubs(w io.Writer, bindings ...Binding) error {
+    return generateStubs(w, L.mainState().naming, bindings)
+}
+
+func generateStubs(w io.Writer, naming NamingPolicy, bindings []Binding) error {
+    g := stubGenerator{seen: map[reflect.Type]int{}, naming: naming}
+    for _, b := range bindings {
+        if err := g.binding(b); err != nil {
+            return err
+        }
+    }
+    return WriteStubs(w, &g.stubs)
+}
+
+type stubGenerator struct {
+    stubs Stubs
+    // index of the class of each struct type in stubs.Classes
+    seen   map[reflect.Type]int
+    naming NamingPolicy
+}
+
+func (g *stubGenerator) binding(b Binding) error {
+    t, ok := b.Value.(reflect.Type)
+    if !ok {
+        t = reflect.TypeOf(b.Value)
+    }
+    if t == nil {
+        return fmt.Errorf("lua: no value to describe for binding %q", b.Name)
+    }
+    if t.Kind() == reflect.Func {
+        if b.Name == "" {
+            return fmt.Errorf("lua: function binding without name")
+        }
+        g.stubs.Functions = append(g.stubs.Functions, g.function(b, t))
+        return nil
+    }
+    if t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if t.Kind() != reflect.Struct || t.Name() == "" {
+        return fmt.Errorf("lua: cannot describe binding %q of type %v", b.Name, t)
+    }
+    if b.Name == "" {
+        g.class(t, b.Doc)
+    } else {
+        g.class(t, "")
+        g.stubs.Globals = append(g.stubs.Globals, StubGlobal{b.Name, b.Doc, t.Name()})
+    }
+    return nil
+}
+
+func (g *stubGenerator) function(b Binding, t reflect.Type) StubFunc {
+    f := StubFunc{Name: b.Name, Doc: b.Doc}
+    if t == typeOfLuaGoFunction || t.NumIn() == 1 && t.In(0) == reflect.TypeOf((*State)(nil)) {
+        f.Params, f.Returns = b.Params, b.Returns
+        if len(f.Params) == 0 {
+            f.Params = []StubParam{{Name: "...", Type: "any"}}
+        }
+        if len(f.Returns) == 0 {
+            f.Returns = []StubParam{{Name: "...", Type: "any"}}
+        }
+        return f
+    }
+    param := func(list []StubParam, i int, t reflect.Type, name string) StubParam {
+        p := StubParam{Name: name}
+        if i < len(list) {
+            p = list[i]
+        }
+        if p.Type == "" {
+            p.Type = g.luaType(t)
+        }
+        return p
+    }
+    for i := 0; i < t.NumIn(); i++ {
+        in := t.In(i)
+        if t.IsVariadic() && i == t.NumIn()-1 {
+            p := param(b.Params, i, in.Elem(), "...")
+            p.Name = "..."
+            f.Params = append(f.Params, p)
+            break
+        }
+        f.Params = append(f.Params, param(b.Params, i, in, fmt.Sprintf("p%d", i+1)))
+    }
+    for i := 0; i < t.NumOut(); i++ {
+        f.Returns = append(f.Returns, param(b.Returns, i, t.Out(i), ""))
+    }
+    return f
+}
+
+// Adds the class of the struct type t, once. A class added before, when a function or field used
+// it, gets the documentation.
+func (g *stubGenerator) class(t reflect.Type, doc string) {
+    if n, ok := g.seen[t]; ok {
+        if doc != "" {
+            g.stubs.Classes[n].Doc = doc
+        }
+        return
+    }
+    n := len(g.stubs.Classes)
+    g.seen[t] = n
+    g.stubs.Classes = append(g.stubs.Classes, StubClass{Name: t.Name(), Doc: doc})
+    var fields []StubParam
+    // with the fields promoted from embedded structs
+    for _, f := range structFields(t, g.naming) {
+        sf := t.FieldByIndex(f.index)
+        if sf.Anonymous {
+            continue
+        }
+        if typ := g.fieldType(sf.Type); typ != "" {
+            fields = append(fields, StubParam{Name: f.name, Type: typ})
+        }
+    }
+    g.stubs.Classes[n].Fields = fields
+
+    var methods []StubFunc
+    pt := reflect.PointerTo(t)
+    for i := 0; i < pt.NumMethod(); i++ {
+        m := pt.Method(i)
+        // without the receiver, nor the error raised
+        in := make([]reflect.Type, m.Type.NumIn()-1)
+        for j := range in {
+            in[j] = m.Type.In(j + 1)
+        }
+        out := make([]reflect.Type, m.Type.NumOut())
+        for j := range out {
+            out[j] = m.Type.Out(j)
+        }
+        if len(out) > 0 && out[len(out)-1] == typeOfError {
+            out = out[:len(out)-1]
+        }
+        ft := reflect.FuncOf(in, out, m.Type.IsVariadic())
+        methods = append(methods, g.function(Binding{Name: g.naming.Apply(m.Name)}, ft))
+    }
+    g.stubs.Classes[n].Methods = methods
+}
+
+// Type of a struct field accessible from lua, "" for the ones PushGoStruct does not handle
+func (g *stubGenerator) fieldType(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Chan, reflect.UnsafePointer, reflect.Uintptr, reflect.Complex64, reflect.Complex128:
+        return ""
+    case reflect.Ptr:
+        if typ := g.fieldType(t.Elem()); typ != "" {
+            return typ + "?"
+        }
+        return ""
+    }
+    return g.luaType(t)
+}
+
+func basicType(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return "integer"
+    case reflect.Float32, reflect.Float64:
+        return "number"
+    case reflect.String:
+        return "string"
+    }
+    return ""
+}
+
+// LuaLS type of a Go type, adding the classes of the structs it refers to
+func (g *stubGenerator) luaType(t reflect.Type) string {
+    if s := basicType(t); s != "" {
+        return s
+    }
+    switch t.Kind() {
+    case reflect.Ptr:
+        return g.luaType(t.Elem())
+    case reflect.Struct:
+        if t == typeOfTime {
+            return "integer"
+        }
+        if t.Name() == "" {
+            return "table"
+        }
+        g.class(t, "")
+        return t.Name()
+    case reflect.Slice, reflect.Array:
+        if t == typeOfBytes {
+            return "string"
+        }
+        return g.luaType(t.Elem()) + "[]"
+    case reflect.Map:
+        return fmt.Sprintf("table<%s, %s>", g.luaType(t.Key()), g.luaType(t.Elem()))
+    case reflect.Func:
+        return "function"
+    case reflect.Interface:
+        if t == typeOfError {
+            return "string?"
+        }
+    }
+    return "any"
+}
+
+// Writes the stubs as a LuaLS definition file (starting with ---@meta). Tables are declared for
+// the dotted names of functions and globals, methods are declared as function Class:name().
+func WriteStubs(w io.Writer, stubs *Stubs) error {
+    bw := bufio.NewWriter(w)
+    bw.WriteString("---@meta\n")
+    for _, c := range stubs.Classes {
+        bw.WriteString("\n")
+        writeDoc(bw, c.Doc)
+        fmt.Fprintf(bw, "---@class %s\n", c.Name)
+        for _, f := range c.Fields {
+            fmt.Fprintf(bw, "---@field %s %s", f.Name, f.Type)
+            if f.Doc != "" {
+                fmt.Fprintf(bw, " %s", f.Doc)
+            }
+            bw.WriteString("\n")
+        }
+        fmt.Fprintf(bw, "local %s = {}\n", c.Name)
+        for _, m := range c.Methods {
+            bw.WriteString("\n")
+            writeFunc(bw, c.Name+":"+m.Name, &m)
+        }
+    }
+    tables := map[string]bool{}
+    declare := func(name string) {
+        parts := strings.Split(name, ".")
+        for i := 1; i < len(parts); i++ {
+            t := strings.Join(parts[:i], ".")
+            if !tables[t] {
+                tables[t] = true
+                fmt.Fprintf(bw, "\n%s = {}\n", t)
+            }
+        }
+    }
+    for _, g := range stubs.Globals {
+        declare(g.Name)
+        bw.WriteString("\n")
+        writeDoc(bw, g.Doc)
+        fmt.Fprintf(bw, "---@type %s\n%s = nil\n", g.Type, g.Name)
+    }
+    for _, f := range stubs.Functions {
+        declare(f.Name)
+        bw.WriteString("\n")
+        writeFunc(bw, f.Name, &f)
+    }
+    return bw.Flush()
+}
+
+// Writes the annotations and the declaration of the function f named name
+func writeFunc(w *bufio.Writer, name string, f *StubFunc) {
+    writeDoc(w, f.Doc)
+    names := make([]string, len(f.Params))
+    for i, p := range f.Params {
+        names[i] = p.Name
+        fmt.Fprintf(w, "---@param %s %s", p.Name, p.Type)
+        if p.Doc != "" {
+            fmt.Fprintf(w, " %s", p.Doc)
+        }
+        w.WriteString("\n")
+    }
+    for _, r := range f.Returns {
+        fmt.Fprintf(w, "---@return %s", r.Type)
+        if r.Name != "" {
+            fmt.Fprintf(w, " %s", r.Name)
+        }
+        if r.Doc != "" {
+            fmt.Fprintf(w, " # %s", r.Doc)
+        }
+        w.WriteString("\n")
+    }
+    fmt.Fprintf(w, "function %s(%s) end\n", name, strings.Join(names, ", "))
+}
+
+func writeDoc(w *bufio.Writer, doc string) {
+    if doc == "" {
+        return
+    }
+    for _, line := range strings.Split(strings.TrimRight(doc, "\n"), "\n") {
+        fmt.Fprintf(w, "---%s\n", line)
+    }
+}
@@ -0,0 +1,87 @@
+package lua
+
+import (
+    "bytes"
+    "flag"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+type stubPosition struct {
+    X, Y float64
+}
+
+type stubEntity struct {
+    ID int64 `lua:"id,readonly"`
+}
+
+type stubPlayer struct {
+    stubEntity
+    Name      string
+    HTTPProxy string `json:"proxy,omitempty"`
+    Secret    string `lua:"-"`
+    Position  *stubPosition
+    Inventory []string
+    Stats     map[string]int
+    Avatar    []byte
+    Joined    time.Time
+    Notify    func(string) error
+    Events    chan int
+    hidden    int
+}
+
+func (p *stubPlayer) Move(dx, dy float64) (*stubPosition, error) { return p.Position, nil }
+func (p *stubPlayer) Say(format string, args ...interface{})     {}
+
+func TestGenerateStubs(t *testing.T) {
+    bindings := []Binding{
+        {Name: "game.spawn", Value: func(name string, at stubPosition) (*stubPlayer, error) { return nil, nil },
+            Doc: "Spawns a player\n@see game.players", Params: []StubParam{{Name: "name", Doc: "display name"}, {Name: "at"}},
+            Returns: []StubParam{{Name: "player"}, {Name: "err"}}},
+        {Name: "game.players", Value: func() []*stubPlayer { return nil }},
+        {Name: "log", Value: LuaGoFunction(func(L *State) int { return 0 }), Doc: "Logs its arguments"},
+        {Name: "sum", Value: func(L *State) int { return 1 },
+            Params: []StubParam{{Name: "...", Type: "number"}}, Returns: []StubParam{{Type: "number"}}},
+        {Name: "config", Value: &stubEntity{}, Doc: "Server entity"},
+        {Value: reflect.TypeOf(stubPosition{}), Doc: "Position in the world"},
+    }
+    for _, tt := range []struct {
+        golden string
+        naming NamingPolicy
+    }{
+        {"stubs.lua", NamingAsIs},
+        {"stubs_snake.lua", NamingSnakeCase},
+    } {
+        L := newTestState(t)
+        L.SetNamingPolicy(tt.naming)
+        var b bytes.Buffer
+        if err := L.GenerateStubs(&b, bindings...); err != nil {
+            t.Fatal(err)
+        }
+        path := filepath.Join("testdata", tt.golden)
+        if *updateGolden {
+            if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+                t.Fatal(err)
+            }
+            continue
+        }
+        want, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(b.Bytes(), want) {
+            t.Errorf("%s differs, run go test -run GenerateStubs -update and check the diff:\n%s", path, b.String())
+        }
+    }
+
+    for _, b := range []Binding{{Name: "x"}, {Value: func() {}}, {Name: "n", Value: 42}, {Name: "m", Value: struct{ A int }{}}} {
+        if err := GenerateStubs(&bytes.Buffer{}, b); err == nil {
+            t.Errorf("binding %+v described", b)
+        }
+    }
+}
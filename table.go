@@ -0,0 +1,222 @@
+package lua
+
+import (
+    "fmt"
+    "math"
+    "reflect"
+)
+
+// Lua table held by Go. Get and Set of Value honour the metamethods of the table, the other
+// methods access it raw. Values are converted like by Value.Call: nil, booleans, int64 or
+// float64 numbers, strings, Go objects and *Value for tables, functions and other user data.
+type Table struct {
+    *Value
+}
+
+// Returns a Table holding the table at index, nil for other values
+func (L *State) ToTable(index int) *Table {
+    if L.Type(index) != LUA_TTABLE {
+        return nil
+    }
+    return &Table{L.newValue(index)}
+}
+
+// Returns a new table copied from the map, slice or array x (or a pointer to one). Nested maps,
+// slices and arrays are copied too, other values are converted like the fields of PushGoStruct.
+// The table is created with the size of x.
+func (L *State) NewTableFrom(x interface{}) (*Table, error) {
+    top := L.GetTop()
+    if err := L.pushTable(reflect.ValueOf(x)); err != nil {
+        L.SetTop(top)
+        return nil, err
+    }
+    t := &Table{L.newValue(-1)}
+    L.Pop(1)
+    return t, nil
+}
+
+// Pushes a new table copied from the map, slice or array v
+func (L *State) pushTable(v reflect.Value) error {
+    for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+        v = v.Elem()
+    }
+    switch v.Kind() {
+    case reflect.Map:
+        L.CreateTable(0, v.Len())
+        it := v.MapRange()
+        for it.Next() {
+            k := it.Key()
+            for k.Kind() == reflect.Interface {
+                k = k.Elem()
+            }
+            if !k.IsValid() || (k.Kind() == reflect.Float32 || k.Kind() == reflect.Float64) && math.IsNaN(k.Float()) {
+                return fmt.Errorf("lua: invalid table key %v", k)
+            }
+            if !L.pushGoValue(k) {
+                return fmt.Errorf("lua: unsupported type of table key: %s", k.Type())
+            }
+            if err := L.pushTableValue(it.Value()); err != nil {
+                return err
+            }
+            L.RawSet(-3)
+        }
+        return nil
+
+    case reflect.Slice, reflect.Array:
+        if v.Type() != typeOfBytes {
+            L.CreateTable(v.Len(), 0)
+            for i := 0; i < v.Len(); i++ {
+                if err := L.pushTableValue(v.Index(i)); err != nil {
+                    return err
+                }
+                L.RawSeti(-2, i+1)
+            }
+            return nil
+        }
+    }
+    return fmt.Errorf("lua: cannot make a table from a %s", v.Type())
+}
+
+func (L *State) pushTableValue(v reflect.Value) error {
+    e := v
+    for e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface {
+        e = e.Elem()
+    }
+    if e.Kind() == reflect.Map || (e.Kind() == reflect.Slice || e.Kind() == reflect.Array) && e.Type() != typeOfBytes {
+        return L.pushTable(e)
+    }
+    if !L.pushGoValue(v) {
+        return fmt.Errorf("lua: unsupported type of table value: %s", e.Type())
+    }
+    return nil
+}
+
+// Returns the length of the sequence of the table, without __len
+func (t *Table) Len() int {
+    if t.check() != nil {
+        return 0
+    }
+    t.Push(t.L)
+    n := int(t.L.RawLen(-1))
+    t.L.Pop(1)
+    return n
+}
+
+// Returns t[key] without __index
+func (t *Table) RawGet(key interface{}) (interface{}, error) {
+    if err := t.check(); err != nil {
+        return nil, err
+    }
+    L := t.L
+    top := L.GetTop()
+    defer L.SetTop(top)
+    t.Push(L)
+    if err := L.pushValues([]interface{}{key}); err != nil {
+        return nil, err
+    }
+    L.RawGet(-2)
+    return L.toValues(-1)[0], nil
+}
+
+// Sets t[key] = value without __newindex. Returns an error for nil and NaN keys.
+func (t *Table) RawSet(key, value interface{}) error {
+    if err := t.check(); err != nil {
+        return err
+    }
+    L := t.L
+    top := L.GetTop()
+    defer L.SetTop(top)
+    t.Push(L)
+    if err := L.pushValues([]interface{}{key, value}); err != nil {
+        return err
+    }
+    // lua_rawset raises these errors
+    if L.IsNil(-2) || L.IsNumber(-2) && !L.IsInteger(-2) && math.IsNaN(L.ToNumber(-2)) {
+        return fmt.Errorf("lua: invalid table key %v", key)
+    }
+    L.RawSet(-3)
+    return nil
+}
+
+// Calls f with the keys and values of the table, in the order of next and without __pairs,
+// until f returns false. f may assign existing fields or clear them, but not add new ones.
+func (t *Table) ForEach(f func(key, value interface{}) bool) error {
+    if err := t.check(); err != nil {
+        return err
+    }
+    L := t.L
+    top := L.GetTop()
+    defer L.SetTop(top)
+    // the key, in a protected call for the errors of next
+    L.PushNil()
+    for {
+        L.pushHelper("return next(...)")
+        t.Push(L)
+        L.PushValue(top + 1)
+        if err := L.Call(2, 2); err != nil {
+            return err
+        }
+        if L.IsNil(top + 2) {
+            return nil
+        }
+        kv := L.toValues(top + 2)
+        L.Copy(top+2, top+1)
+        L.SetTop(top + 1)
+        if !f(kv[0], kv[1]) {
+            return nil
+        }
+    }
+}
+
+// Returns the keys of the table, in the order of ForEach
+func (t *Table) Keys() []interface{} {
+    var keys []interface{}
+    t.ForEach(func(key, _ interface{}) bool {
+        keys = append(keys, key)
+        return true
+    })
+    return keys
+}
+
+// Reports whether the keys of the table are the integers from 1 to its length, true for
+// empty tables
+func (t *Table) IsArray() bool {
+    n := int64(t.Len())
+    count := int64(0)
+    array := true
+    t.ForEach(func(key, _ interface{}) bool {
+        i, ok := key.(int64)
+        array = ok && i >= 1 && i <= n
+        count++
+        return array
+    })
+    return array && count == n
+}
+
+// Returns a copy of the table, nested tables are held by *Value
+func (t *Table) ToMap() map[interface{}]interface{} {
+    m := map[interface{}]interface{}{}
+    t.ForEach(func(key, value interface{}) bool {
+        m[key] = value
+        return true
+    })
+    return m
+}
+
+// Returns a copy of the sequence of the table, from 1 to Len
+func (t *Table) ToSlice() []interface{} {
+    if t.check() != nil {
+        return nil
+    }
+    L := t.L
+    n := t.Len()
+    s := make([]interface{}, n)
+    t.Push(L)
+    for i := range s {
+        L.RawGeti(-1, i+1)
+        s[i] = L.toValues(-1)[0]
+        L.Pop(1)
+    }
+    L.Pop(1)
+    return s
+}
@@ -0,0 +1,158 @@
+package lua
+
+import (
+    "fmt"
+    "math"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// A table with the raw fields 1, 2 and raw, proxying the others to store
+const proxyTable = `
+store = {a = "A"}
+t = setmetatable({10, 20, raw = true}, {
+    __index = function(_, k) return store[k] end,
+    __newindex = store,
+    __len = function() return 42 end,
+    __pairs = function() return next, store, nil end,
+})
+`
+
+func TestTableMetamethods(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, proxyTable)
+    L.GetGlobal("t")
+    tbl := L.ToTable(-1)
+    L.Pop(1)
+    top := L.GetTop()
+    checkTop := func(what string) {
+        t.Helper()
+        if L.GetTop() != top {
+            t.Errorf("%s: top %d, want %d", what, L.GetTop(), top)
+        }
+    }
+
+    if v, err := tbl.Get("a"); v != "A" || err != nil {
+        t.Errorf("Get = %v, %v", v, err)
+    }
+    checkTop("Get")
+    if v, err := tbl.RawGet("a"); v != nil || err != nil {
+        t.Errorf("RawGet = %v, %v", v, err)
+    }
+    checkTop("RawGet")
+    if v, _ := tbl.Get("raw"); v != true {
+        t.Errorf("Get of a raw field = %v", v)
+    }
+
+    if err := tbl.Set("b", int64(2)); err != nil {
+        t.Fatal(err)
+    }
+    checkTop("Set")
+    if v, _ := tbl.RawGet("b"); v != nil {
+        t.Errorf("Set stored %v in the table", v)
+    }
+    if err := tbl.RawSet("c", "C"); err != nil {
+        t.Fatal(err)
+    }
+    checkTop("RawSet")
+    mustRun(t, L, `assert(store.b == 2 and rawget(t, "b") == nil and rawget(t, "c") == "C" and store.c == nil)`)
+
+    if n := tbl.Len(); n != 2 {
+        t.Errorf("Len = %d", n)
+    }
+    checkTop("Len")
+    mustRun(t, L, `assert(#t == 42)`)
+
+    keys := func(each func(func(k, v interface{}) bool) error) []string {
+        var keys []string
+        if err := each(func(k, _ interface{}) bool {
+            keys = append(keys, fmt.Sprint(k))
+            return true
+        }); err != nil {
+            t.Fatal(err)
+        }
+        sort.Strings(keys)
+        return keys
+    }
+    if got := keys(tbl.Iterate); !reflect.DeepEqual(got, []string{"a", "b"}) {
+        t.Errorf("Iterate keys %v", got)
+    }
+    checkTop("Iterate")
+    if got := keys(tbl.ForEach); !reflect.DeepEqual(got, []string{"1", "2", "c", "raw"}) {
+        t.Errorf("ForEach keys %v", got)
+    }
+    checkTop("ForEach")
+    if tbl.IsArray() || len(tbl.Keys()) != 4 || len(tbl.ToMap()) != 4 {
+        t.Error("IsArray, Keys or ToMap honour __pairs")
+    }
+    if s := tbl.ToSlice(); !reflect.DeepEqual(s, []interface{}{int64(10), int64(20)}) {
+        t.Errorf("ToSlice %v", s)
+    }
+    checkTop("ToSlice")
+
+    // errors of the metamethods
+    mustRun(t, L, `getmetatable(t).__index = function() error("no index") end`)
+    if _, err := tbl.Get("x"); err == nil || !strings.Contains(err.Error(), "no index") {
+        t.Errorf("Get error %v", err)
+    }
+    checkTop("Get error")
+    if err := tbl.RawSet(nil, 1); err == nil {
+        t.Error("RawSet of a nil key")
+    }
+    if err := tbl.RawSet(math.NaN(), 1); err == nil {
+        t.Error("RawSet of a NaN key")
+    }
+    checkTop("RawSet error")
+}
+
+func TestNewTableFrom(t *testing.T) {
+    L := newTestState(t)
+    top := L.GetTop()
+    tbl, err := L.NewTableFrom(map[string]interface{}{
+        "list":   []int{1, 2, 3},
+        "nested": map[string][]string{"x": {"a", "b"}},
+        "ptr":    &[]float64{0.5},
+        "bytes":  []byte("raw"),
+        "num":    7,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if L.GetTop() != top {
+        t.Errorf("top %d, want %d", L.GetTop(), top)
+    }
+    tbl.Push(L)
+    L.SetGlobal("t")
+    mustRun(t, L, `
+assert(type(t.list) == "table" and #t.list == 3 and t.list[3] == 3)
+assert(type(t.nested.x) == "table" and t.nested.x[2] == "b")
+assert(type(t.ptr) == "table" and t.ptr[1] == 0.5)
+assert(t.bytes == "raw" and t.num == 7)
+`)
+    if tbl.IsArray() {
+        t.Error("IsArray of a map")
+    }
+
+    arr, err := L.NewTableFrom([2][]int{{1}, {2, 3}})
+    if err != nil || arr.Len() != 2 || !arr.IsArray() {
+        t.Errorf("NewTableFrom of an array: %v", err)
+    }
+
+    for _, x := range []interface{}{
+        map[float64]int{math.NaN(): 1},
+        map[interface{}]int{nil: 1},
+        map[string]interface{}{"nested": map[interface{}]int{math.NaN(): 1}},
+        map[string]chan int{"c": nil},
+        42,
+        []byte("bytes"),
+    } {
+        if _, err := L.NewTableFrom(x); err == nil {
+            t.Errorf("NewTableFrom of %#v", x)
+        }
+        if L.GetTop() != top {
+            t.Errorf("%#v: top %d, want %d", x, L.GetTop(), top)
+        }
+    }
+}
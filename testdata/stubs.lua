@@ -0,0 +1,58 @@
+---@meta
+
+---Position in the world
+---@class stubPosition
+---@field X number
+---@field Y number
+local stubPosition = {}
+
+---@class stubPlayer
+---@field id integer
+---@field Name string
+---@field proxy string
+---@field Position stubPosition?
+---@field Inventory string[]
+---@field Stats table<string, integer>
+---@field Avatar string
+---@field Joined integer
+---@field Notify function
+local stubPlayer = {}
+
+---@param p1 number
+---@param p2 number
+---@return stubPosition
+function stubPlayer:Move(p1, p2) end
+
+---@param p1 string
+---@param ... any
+function stubPlayer:Say(p1, ...) end
+
+---@class stubEntity
+---@field id integer
+local stubEntity = {}
+
+---Server entity
+---@type stubEntity
+config = nil
+
+game = {}
+
+---Spawns a player
+---@see game.players
+---@param name string display name
+---@param at stubPosition
+---@return stubPlayer player
+---@return string? err
+function game.spawn(name, at) end
+
+---@return stubPlayer[]
+function game.players() end
+
+---Logs its arguments
+---@param ... any
+---@return any ...
+function log(...) end
+
+---@param ... number
+---@return number
+function sum(...) end
@@ -0,0 +1,58 @@
+---@meta
+
+---Position in the world
+---@class stubPosition
+---@field x number
+---@field y number
+local stubPosition = {}
+
+---@class stubPlayer
+---@field id integer
+---@field name string
+---@field proxy string
+---@field position stubPosition?
+---@field inventory string[]
+---@field stats table<string, integer>
+---@field avatar string
+---@field joined integer
+---@field notify function
+local stubPlayer = {}
+
+---@param p1 number
+---@param p2 number
+---@return stubPosition
+function stubPlayer:move(p1, p2) end
+
+---@param p1 string
+---@param ... any
+function stubPlayer:say(p1, ...) end
+
+---@class stubEntity
+---@field id integer
+local stubEntity = {}
+
+---Server entity
+---@type stubEntity
+config = nil
+
+game = {}
+
+---Spawns a player
+---@see game.players
+---@param name string display name
+---@param at stubPosition
+---@return stubPlayer player
+---@return string? err
+function game.spawn(name, at) end
+
+---@return stubPlayer[]
+function game.players() end
+
+---Logs its arguments
+---@param ... any
+---@return any ...
+function log(...) end
+
+---@param ... number
+---@return number
+function sum(...) end
@@ -0,0 +1,267 @@
+package lua
+
+import (
+    "fmt"
+    "reflect"
+    "runtime"
+    "sync"
+)
+
+// Lua table, function, userdata or thread held by Go, see ToValue. It stays in the registry of
+// its state until Close is called or it is garbage collected by Go. Like the state, it must not
+// be used by several goroutines at the same time.
+type Value struct {
+    // main state of the registry
+    L   *State
+    ref int
+    typ LuaValType
+}
+
+var typeOfValue = reflect.TypeOf((*Value)(nil))
+
+// References to release, queued by the finalizers of Value running in other goroutines
+type releasedRefs struct {
+    sync.Mutex
+    refs []int
+    // set by State.Close: the registry is gone with the references
+    closed bool
+}
+
+// Returns a Value holding the table, function, userdata or thread at index, nil for other
+// values
+func (L *State) ToValue(index int) *Value {
+    switch L.Type(index) {
+    case LUA_TTABLE, LUA_TFUNCTION, LUA_TUSERDATA, LUA_TTHREAD:
+        return L.newValue(index)
+    }
+    return nil
+}
+
+func (L *State) newValue(index int) *Value {
+    L.mainState().releaseRefs()
+    typ := L.Type(index)
+    L.PushValue(index)
+    v := &Value{L.mainState(), L.Ref(LUA_REGISTRYINDEX), typ}
+    runtime.SetFinalizer(v, (*Value).finalize)
+    return v
+}
+
+func (v *Value) finalize() {
+    v.L.released.Lock()
+    if !v.L.released.closed {
+        v.L.released.refs = append(v.L.released.refs, v.ref)
+    }
+    v.L.released.Unlock()
+}
+
+// Frees the references of the values queued by their finalizer, from the goroutine using the
+// state
+func (L *State) releaseRefs() {
+    L.released.Lock()
+    refs := L.released.refs
+    L.released.refs = nil
+    closed := L.released.closed
+    L.released.Unlock()
+    if closed {
+        return
+    }
+    for _, ref := range refs {
+        L.Unref(LUA_REGISTRYINDEX, ref)
+    }
+}
+
+// Returns the type of the value, LUA_TNIL once closed
+func (v *Value) Type() LuaValType {
+    return v.typ
+}
+
+// Pushes the value onto the stack of L, which must be its state or a thread of it. Panics
+// otherwise or once the value is closed.
+func (v *Value) Push(L *State) {
+    if v.ref == LUA_NOREF {
+        panic("lua: Push of a closed Value")
+    }
+    if L.mainState() != v.L {
+        panic("lua: Push of a Value into another state")
+    }
+    L.RawGeti(LUA_REGISTRYINDEX, v.ref)
+}
+
+// Releases the value from the registry; it cannot be used anymore. Does nothing if it is
+// already closed, and only marks it closed once its state is closed.
+func (v *Value) Close() {
+    if v.ref == LUA_NOREF {
+        return
+    }
+    runtime.SetFinalizer(v, nil)
+    if !v.L.isClosed() {
+        v.L.Unref(LUA_REGISTRYINDEX, v.ref)
+    }
+    v.ref, v.typ = LUA_NOREF, LUA_TNIL
+}
+
+// Reports whether Close was called on the main state of L
+func (L *State) isClosed() bool {
+    L = L.mainState()
+    L.released.Lock()
+    defer L.released.Unlock()
+    return L.released.closed
+}
+
+func (v *Value) check() error {
+    if v.ref == LUA_NOREF {
+        return fmt.Errorf("lua: use of a closed Value")
+    }
+    if v.L.isClosed() {
+        return fmt.Errorf("lua: use of a Value of a closed state")
+    }
+    v.L.releaseRefs()
+    return nil
+}
+
+// Pushes the lua helper function with the code, compiled once per state
+func (L *State) pushHelper(code string) {
+    L = L.mainState()
+    if ref, ok := L.helpers[code]; ok {
+        L.RawGeti(LUA_REGISTRYINDEX, ref)
+        return
+    }
+    if L.helpers == nil {
+        L.helpers = map[string]int{}
+    }
+    if L.LoadString(code) != 0 {
+        panic("lua: cannot compile helper: " + L.ToString(-1))
+    }
+    L.PushValue(-1)
+    L.helpers[code] = L.Ref(LUA_REGISTRYINDEX)
+}
+
+// Pushes Go values converted like the fields of PushGoStruct, *Value included
+func (L *State) pushValues(values []interface{}) error {
+    for i, x := range values {
+        if !L.pushGoValue(reflect.ValueOf(x)) {
+            return fmt.Errorf("lua: unsupported type of value #%d: %T", i+1, x)
+        }
+    }
+    return nil
+}
+
+// Returns the values from index to the top of the stack converted for interface{} values: nil,
+// booleans, int64 or float64 numbers, strings, Go objects and *Value for the others, except
+// light user data which are nil
+func (L *State) toValues(index int) []interface{} {
+    index = L.AbsIndex(index)
+    values := make([]interface{}, 0, L.GetTop()-index+1)
+    for i := index; i <= L.GetTop(); i++ {
+        // nil for light user data
+        var x interface{}
+        if v, ok := L.toGoValue(i, typeOfInterface); ok {
+            x = v.Interface()
+        }
+        values = append(values, x)
+    }
+    return values
+}
+
+// Calls the value with args, converted like the fields of PushGoStruct, in a protected call
+// with the message handler of Call and returns its results converted like by toValues
+func (v *Value) Call(args ...interface{}) ([]interface{}, error) {
+    if err := v.check(); err != nil {
+        return nil, err
+    }
+    L := v.L
+    top := L.GetTop()
+    v.Push(L)
+    if err := L.pushValues(args); err != nil {
+        L.SetTop(top)
+        return nil, err
+    }
+    if err := L.Call(len(args), LUA_MULTRET); err != nil {
+        L.SetTop(top)
+        return nil, err
+    }
+    results := L.toValues(top + 1)
+    L.SetTop(top)
+    return results, nil
+}
+
+// Calls the helper function with v and args, returning nresults results
+func (v *Value) callHelper(code string, nresults int, args ...interface{}) ([]interface{}, error) {
+    if err := v.check(); err != nil {
+        return nil, err
+    }
+    L := v.L
+    top := L.GetTop()
+    L.pushHelper(code)
+    v.Push(L)
+    if err := L.pushValues(args); err != nil {
+        L.SetTop(top)
+        return nil, err
+    }
+    if err := L.Call(len(args)+1, nresults); err != nil {
+        L.SetTop(top)
+        return nil, err
+    }
+    results := L.toValues(top + 1)
+    L.SetTop(top)
+    return results, nil
+}
+
+// Returns v[key], with the metamethods
+func (v *Value) Get(key interface{}) (interface{}, error) {
+    r, err := v.callHelper("local t, k = ... return t[k]", 1, key)
+    if err != nil {
+        return nil, err
+    }
+    return r[0], nil
+}
+
+// Sets v[key] = value, with the metamethods
+func (v *Value) Set(key, value interface{}) error {
+    _, err := v.callHelper("local t, k, v = ... t[k] = v", 0, key, value)
+    return err
+}
+
+// Calls f with the keys and values of v, in the order of pairs (honouring __pairs), until f
+// returns false
+func (v *Value) Iterate(f func(key, value interface{}) bool) error {
+    if err := v.check(); err != nil {
+        return err
+    }
+    L := v.L
+    top := L.GetTop()
+    defer L.SetTop(top)
+    L.pushHelper("return pairs(...)")
+    v.Push(L)
+    // the iterator function, state and control variable
+    if err := L.Call(1, 3); err != nil {
+        return err
+    }
+    for {
+        L.PushValue(top + 1)
+        L.PushValue(top + 2)
+        L.PushValue(top + 3)
+        if err := L.Call(2, 2); err != nil {
+            return err
+        }
+        if L.IsNil(top + 4) {
+            return nil
+        }
+        kv := L.toValues(top + 4)
+        L.Copy(top+4, top+3)
+        L.SetTop(top + 3)
+        if !f(kv[0], kv[1]) {
+            return nil
+        }
+    }
+}
+
+// Returns the value converted by tostring, or the error raised by its __tostring metamethod
+func (v *Value) String() string {
+    r, err := v.callHelper("return tostring(...)", 1)
+    if err != nil {
+        return err.Error()
+    }
+    s, _ := r[0].(string)
+    return s
+}
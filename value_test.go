@@ -0,0 +1,112 @@
+package lua
+
+import (
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Runs the Go collector until n references are queued by the finalizers of Value
+func waitReleased(t *testing.T, L *State, n int) {
+    t.Helper()
+    for i := 0; i < 100; i++ {
+        runtime.GC()
+        L.released.Lock()
+        queued := len(L.released.refs)
+        L.released.Unlock()
+        if queued >= n {
+            return
+        }
+        time.Sleep(time.Millisecond)
+    }
+    t.Fatalf("references of the values not released")
+}
+
+func TestValueClose(t *testing.T) {
+    L := newTestState(t)
+    mustRun(t, L, `t = {1, 2}`)
+    L.GetGlobal("t")
+    v := L.ToValue(-1)
+    L.Pop(1)
+    if v.Type() != LUA_TTABLE {
+        t.Errorf("type %v", v.Type())
+    }
+    ref := v.ref
+    v.Close()
+    v.Close()
+    if v.Type() != LUA_TNIL {
+        t.Errorf("type %v once closed", v.Type())
+    }
+    if _, err := v.Call(); err == nil || !strings.Contains(err.Error(), "closed Value") {
+        t.Errorf("Call of a closed value: %v", err)
+    }
+    // the reference is free again
+    L.GetGlobal("t")
+    if w := L.ToValue(-1); w.ref != ref {
+        t.Errorf("reference %d, want %d", w.ref, ref)
+    }
+    L.Pop(1)
+    L.PushInteger(1)
+    if L.ToValue(-1) != nil {
+        t.Error("Value of a number")
+    }
+    L.Pop(1)
+}
+
+func TestValueFinalizer(t *testing.T) {
+    L := newTestState(t)
+    refs := map[int]bool{}
+    func() {
+        for i := 0; i < 10; i++ {
+            L.NewTable()
+            refs[L.ToValue(-1).ref] = true
+            L.Pop(1)
+        }
+    }()
+    waitReleased(t, L, len(refs))
+
+    // released by the next use of the state, and reused
+    for i := 0; i < 10; i++ {
+        L.NewTable()
+        v := L.ToValue(-1)
+        L.Pop(1)
+        if !refs[v.ref] {
+            t.Errorf("reference %d not reused", v.ref)
+        }
+        delete(refs, v.ref)
+        defer v.Close()
+    }
+}
+
+func TestValueCloseAfterState(t *testing.T) {
+    L := NewState()
+    L.OpenLibs()
+    L.NewTable()
+    v := L.ToValue(-1)
+    func() {
+        L.NewTable()
+        L.ToValue(-1)
+    }()
+    L.Close()
+
+    // queued by the finalizer, or not at all once closed
+    for i := 0; i < 3; i++ {
+        runtime.GC()
+        time.Sleep(time.Millisecond)
+    }
+    L.released.Lock()
+    if len(L.released.refs) != 0 {
+        t.Errorf("%d references queued after Close", len(L.released.refs))
+    }
+    L.released.Unlock()
+
+    if _, err := v.Call(); err == nil || !strings.Contains(err.Error(), "closed state") {
+        t.Errorf("Call of a value of a closed state: %v", err)
+    }
+    v.Close()
+    v.Close()
+    if v.Type() != LUA_TNIL {
+        t.Errorf("type %v once closed", v.Type())
+    }
+}